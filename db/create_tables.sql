@@ -43,6 +43,7 @@ create table customer_fact (
 	date_key date,
 	time_key time with time zone,
 	nanosecond smallint, -- optional field but could be good for granularity
+	customer_id bigint,
 	n smallint
 );
 
@@ -52,9 +53,17 @@ create function notify_customer_fact_tr_fn() returns trigger as $tr$
 declare 
 	_resp json;
 	chan_res text;
+	_state varchar(255);
+	_city varchar(255);
   begin
+	-- location is attributed from the customer record
+	select c.state, c.city into _state, _city from "public"."customer" c where c.customer_id = new.customer_id;
+
 	select jsonb_build_array(jsonb_build_object( 
 		'time_stamp', new.date_key + new.time_key, 
+		'customer_id', new.customer_id,
+		'state', _state,
+		'city', _city,
 		'n', new.n )) into _resp;
 	  
     --notify "customer", _resp::text;
@@ -72,6 +81,7 @@ create table order_fact (
 	date_key date,
 	time_key time with time zone,
 	nanosecond smallint, -- optional field but could be good for granularity
+	customer_id bigint,
 	product varchar(255),
 	n smallint,
 	revenue decimal(50, 5)
@@ -82,12 +92,21 @@ create function notify_order_fact_tr_fn() returns trigger as $tr$
 declare 
 	_resp json;
 	chan_res text;
+	_state varchar(255);
+	_city varchar(255);
   begin
+	-- location is attributed from the customer record
+	select c.state, c.city into _state, _city from "public"."customer" c where c.customer_id = new.customer_id;
+
 	select jsonb_build_array(jsonb_build_object( 
 		'time_stamp', new.date_key + new.time_key, 
 		'order_count', 1,
+		'customer_id', new.customer_id,
+		'product', new.product,
 		'n', new.n,
-		'revenue', new.revenue )) into _resp;
+		'revenue', new.revenue,
+		'state', _state,
+		'city', _city )) into _resp;
 	  
     select pg_notify('order', _resp::text) into chan_res;
     return new;
@@ -126,7 +145,7 @@ create function notify_customer_tr_fn() returns trigger as $tr$
 	--_date_key := (date_part('year', new.created_at) * 10000) + (date_part('month', new.created_at) * 100) + date_part('day', new.created_at);
 	--_time_key := (date_part('hour', new.created_at) * 10000) + (date_part('minute', new.created_at) * 100) + date_part('second', new.created_at);
 
-	insert into "mart"."customer_fact" (date_key, time_key, nanosecond, n) values (new.created_at::date, new.created_at::time, null, 1);
+	insert into "mart"."customer_fact" (date_key, time_key, nanosecond, customer_id, n) values (new.created_at::date, new.created_at::time, null, new.customer_id, 1);
 	  
     return new;
   end;
@@ -161,7 +180,7 @@ create function notify_order_tr_fn() returns trigger as $tr$
 
 	new.sales_price := new.quantity * new.unit_price;
 
-	insert into "mart"."order_fact" (date_key, time_key, nanosecond, product, n, revenue) values (new.created_at::date, cast(new.created_at as time with time zone), null, new.product, new.quantity, new.sales_price::decimal(50, 5));
+	insert into "mart"."order_fact" (date_key, time_key, nanosecond, customer_id, product, n, revenue) values (new.created_at::date, cast(new.created_at as time with time zone), null, new.customer_id, new.product, new.quantity, new.sales_price::decimal(50, 5));
 	
     return new;
   end;
@@ -170,3 +189,90 @@ $tr$ language plpgsql;
 
 create trigger notify_order_tr after insert on "order"
   for each row execute function notify_order_tr_fn();
+
+
+/*
+ *  revenue targets managed through the stream server goals endpoints
+ */
+
+drop table if exists revenue_goal cascade;
+create table revenue_goal (
+  goal_id serial primary key,
+  name varchar(255),
+  period varchar(10) not null check (period in ('day', 'month')),
+  period_start date not null,
+  target numeric(50, 5) not null check (target > 0),
+  created_at timestamptz default now(),
+  updated_at timestamptz default now(),
+  unique (period, period_start)
+);
+
+
+/*
+ *  durable subscriptions of the stream server, each has a committed position
+ *  per topic & the events after it are kept until every subscription acks them
+ */
+
+drop table if exists durable_subscription cascade;
+create table durable_subscription (
+  name varchar(64) primary key,
+  created_at timestamptz default now()
+);
+
+drop table if exists durable_position cascade;
+create table durable_position (
+  name varchar(64) not null,
+  topic varchar(255) not null,
+  position bigint not null default 0,
+  updated_at timestamptz default now(),
+  primary key (name, topic),
+  constraint durable_position_name_fk foreign key (name) references durable_subscription (name) on delete cascade
+);
+
+drop table if exists durable_event cascade;
+create table durable_event (
+  topic varchar(255) not null,
+  position bigint not null,
+  -- text keeps the payload exactly as it was sent
+  value text not null,
+  created_at timestamptz default now(),
+  primary key (topic, position)
+);
+
+
+/*
+ *  webhooks registered through the stream server & their delivery log
+ */
+
+drop table if exists webhook cascade;
+create table webhook (
+  webhook_id serial primary key,
+  url text not null,
+  topics jsonb not null,
+  -- attributes the events have to match, i.e. {"state": "CA"}
+  filter jsonb,
+  secret varchar(255) not null,
+  enabled boolean not null default true,
+  -- events failed in a row, the webhook is disabled past the configured limit
+  failures int not null default 0,
+  disabled_at timestamptz,
+  created_at timestamptz default now(),
+  updated_at timestamptz default now()
+);
+
+drop table if exists webhook_delivery cascade;
+create table webhook_delivery (
+  webhook_delivery_id bigserial primary key,
+  webhook_id int not null,
+  event_id varchar(32) not null,
+  topic varchar(255),
+  attempt int not null,
+  status_code int,
+  error text,
+  success boolean not null,
+  duration_ms float8,
+  created_at timestamptz default now(),
+  constraint webhook_delivery_webhook_id_fk foreign key (webhook_id) references webhook (webhook_id) on delete cascade
+);
+
+create index webhook_delivery_webhook_id_idx on webhook_delivery (webhook_id, webhook_delivery_id);
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// topic alert state changes are published on
+const alertsTopic = "alerts"
+
+// AlertsConfig holds the threshold rules & where notifications are sent
+type AlertsConfig struct {
+	// how often rules are checked, rules are time based so a topic that goes
+	// quiet is still evaluated
+	EvaluateInterval time.Duration   `yaml:"evaluateInterval"`
+	Webhooks         []WebhookConfig `yaml:"webhooks"`
+	Rules            []AlertRule     `yaml:"rules"`
+}
+
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// delivery attempts before giving up, defaults to 3
+	Attempts int           `yaml:"attempts"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// AlertRule fires when the aggregate of a topic field over the trailing window
+// compares true against the threshold
+type AlertRule struct {
+	Name  string `yaml:"name"`
+	Topic string `yaml:"topic"`
+	Field string `yaml:"field"`
+	// trailing window the aggregate is computed over
+	Window time.Duration `yaml:"window"`
+	// sum, count, avg, min or max
+	Aggregate string `yaml:"aggregate"`
+	// <, <=, >, >=, == or !=
+	Comparator string  `yaml:"comparator"`
+	Threshold  float64 `yaml:"threshold"`
+	// minimum time between firing notifications of the rule
+	Cooldown time.Duration `yaml:"cooldown"`
+}
+
+// Validate checks the rule can be evaluated
+func (ar *AlertRule) Validate() error {
+	if ar.Name == "" {
+		return fmt.Errorf("alert rule missing name")
+	}
+	if ar.Topic == "" || ar.Field == "" {
+		return fmt.Errorf("alert rule %s requires topic and field", ar.Name)
+	}
+	if ar.Window <= 0 {
+		return fmt.Errorf("alert rule %s requires a positive window", ar.Name)
+	}
+	switch ar.Aggregate {
+	case "sum", "count", "avg", "min", "max":
+	default:
+		return fmt.Errorf("alert rule %s has unknown aggregate %q", ar.Name, ar.Aggregate)
+	}
+	if _, err := compare(ar.Comparator, 0, 0); err != nil {
+		return fmt.Errorf("alert rule %s: %w", ar.Name, err)
+	}
+	return nil
+}
+
+func compare(comparator string, v, threshold float64) (bool, error) {
+	switch comparator {
+	case "<":
+		return v < threshold, nil
+	case "<=":
+		return v <= threshold, nil
+	case ">":
+		return v > threshold, nil
+	case ">=":
+		return v >= threshold, nil
+	case "==":
+		return v == threshold, nil
+	case "!=":
+		return v != threshold, nil
+	}
+	return false, fmt.Errorf("unknown comparator %q", comparator)
+}
+
+// Alert is sent when a rule starts firing or resolves
+type Alert struct {
+	Rule       string    `json:"rule"`
+	State      string    `json:"state"`
+	Topic      string    `json:"topic"`
+	Field      string    `json:"field"`
+	Aggregate  string    `json:"aggregate"`
+	Window     string    `json:"window"`
+	Comparator string    `json:"comparator"`
+	Threshold  float64   `json:"threshold"`
+	Value      float64   `json:"value"`
+	TimeStamp  time.Time `json:"time_stamp"`
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+type alertSample struct {
+	ts    time.Time
+	value float64
+}
+
+type alertRuleState struct {
+	AlertRule
+	// field values inside the window, sorted by time
+	samples   []alertSample
+	firing    bool
+	lastFired time.Time
+	// last alert sent, kept for the snapshot of active alerts
+	last *Alert
+}
+
+// AlertEngine evaluates the alert rules against the live streams
+type AlertEngine struct {
+	mu       sync.Mutex
+	rules    []*alertRuleState
+	webhooks []WebhookConfig
+	client   *http.Client
+	// publish sends an alert on the alerts topic
+	publish func(topic string, value []byte)
+	// rules are not evaluated until a full window has been observed, else a
+	// rule like "no signups for 10 minutes" fires as soon as the server starts
+	started time.Time
+}
+
+func NewAlertEngine(conf *AlertsConfig, publish func(string, []byte), started time.Time) (*AlertEngine, error) {
+	ae := &AlertEngine{
+		webhooks: conf.Webhooks,
+		client:   &http.Client{},
+		publish:  publish,
+		started:  started,
+	}
+	for i := range conf.Rules {
+		if err := conf.Rules[i].Validate(); err != nil {
+			return nil, err
+		}
+		ae.rules = append(ae.rules, &alertRuleState{AlertRule: conf.Rules[i]})
+	}
+	for i := range ae.webhooks {
+		if ae.webhooks[i].Attempts <= 0 {
+			ae.webhooks[i].Attempts = 3
+		}
+		if ae.webhooks[i].Timeout <= 0 {
+			ae.webhooks[i].Timeout = 10 * time.Second
+		}
+	}
+	return ae, nil
+}
+
+// HandleMessage records the rule fields of each event
+func (ae *AlertEngine) HandleMessage(msg *sarama.ConsumerMessage) {
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("alerts could not parse message: " + err.Error())
+		return
+	}
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	for _, rule := range ae.rules {
+		if rule.Topic != msg.Topic {
+			continue
+		}
+		for i := range events {
+			v, ok := events[i].Values[rule.Field]
+			if !ok {
+				continue
+			}
+			rule.add(alertSample{ts: events[i].TimeStamp, value: v})
+		}
+	}
+}
+
+func (rs *alertRuleState) add(s alertSample) {
+	n := len(rs.samples)
+	i := sort.Search(n, func(i int) bool { return rs.samples[i].ts.After(s.ts) })
+	rs.samples = append(rs.samples, alertSample{})
+	copy(rs.samples[i+1:], rs.samples[i:])
+	rs.samples[i] = s
+}
+
+// aggregate drops samples older than the window & aggregates the rest, ok is
+// false for avg, min & max with no samples
+func (rs *alertRuleState) aggregate(now time.Time) (v float64, ok bool) {
+	cutoff := now.Add(-rs.Window)
+	i := sort.Search(len(rs.samples), func(i int) bool { return rs.samples[i].ts.After(cutoff) })
+	rs.samples = append(rs.samples[:0], rs.samples[i:]...)
+
+	switch rs.Aggregate {
+	case "count":
+		return float64(len(rs.samples)), true
+	case "sum":
+		for _, s := range rs.samples {
+			v += s.value
+		}
+		return v, true
+	}
+
+	if len(rs.samples) == 0 {
+		return 0, false
+	}
+	switch rs.Aggregate {
+	case "avg":
+		for _, s := range rs.samples {
+			v += s.value
+		}
+		v /= float64(len(rs.samples))
+	case "min":
+		v = math.Inf(1)
+		for _, s := range rs.samples {
+			v = math.Min(v, s.value)
+		}
+	case "max":
+		v = math.Inf(-1)
+		for _, s := range rs.samples {
+			v = math.Max(v, s.value)
+		}
+	}
+	return v, true
+}
+
+// Evaluate checks every rule at now & returns the alerts which changed state,
+// the alerts are published & sent to the webhooks
+func (ae *AlertEngine) Evaluate(now time.Time) []Alert {
+	ae.mu.Lock()
+	var changed []Alert
+	for _, rule := range ae.rules {
+		v, ok := rule.aggregate(now)
+		if !ok || now.Sub(ae.started) < rule.Window {
+			continue
+		}
+		// comparator was validated when the engine was created
+		cond, _ := compare(rule.Comparator, v, rule.Threshold)
+
+		var state string
+		switch {
+		case cond && !rule.firing:
+			if !rule.lastFired.IsZero() && now.Sub(rule.lastFired) < rule.Cooldown {
+				continue
+			}
+			rule.firing = true
+			rule.lastFired = now
+			state = alertFiring
+		case !cond && rule.firing:
+			rule.firing = false
+			state = alertResolved
+		default:
+			continue
+		}
+
+		a := Alert{
+			Rule:       rule.Name,
+			State:      state,
+			Topic:      rule.Topic,
+			Field:      rule.Field,
+			Aggregate:  rule.Aggregate,
+			Window:     rule.Window.String(),
+			Comparator: rule.Comparator,
+			Threshold:  rule.Threshold,
+			Value:      v,
+			TimeStamp:  now,
+		}
+		rule.last = &a
+		changed = append(changed, a)
+	}
+	ae.mu.Unlock()
+
+	for _, a := range changed {
+		ae.notify(a)
+	}
+	return changed
+}
+
+// Active returns the alerts that are currently firing
+func (ae *AlertEngine) Active() []Alert {
+	ae.mu.Lock()
+	defer ae.mu.Unlock()
+	active := []Alert{}
+	for _, rule := range ae.rules {
+		if rule.firing && rule.last != nil {
+			active = append(active, *rule.last)
+		}
+	}
+	return active
+}
+
+func (ae *AlertEngine) notify(a Alert) {
+	logger.Printf("alert %s %s with value %v", a.Rule, a.State, a.Value)
+	// the stream sends arrays of records like the other topics
+	if b, err := json.Marshal([]Alert{a}); err != nil {
+		logger.Print("error encoding alert: " + err.Error())
+	} else if ae.publish != nil {
+		ae.publish(alertsTopic, b)
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil {
+		logger.Print("error encoding alert: " + err.Error())
+		return
+	}
+	for _, wh := range ae.webhooks {
+		go ae.postWebhook(wh, b)
+	}
+}
+
+// postWebhook sends the alert, retrying with a growing delay on failure
+func (ae *AlertEngine) postWebhook(wh WebhookConfig, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= wh.Attempts; attempt++ {
+		if err = ae.post(wh, body); err == nil {
+			return nil
+		}
+		logger.Printf("alert webhook %s attempt %d failed: %s", wh.URL, attempt, err.Error())
+		if attempt < wh.Attempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return err
+}
+
+func (ae *AlertEngine) post(wh WebhookConfig, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), wh.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ae.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Run evaluates the rules every interval until ctx is cancelled
+func (ae *AlertEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			ae.Evaluate(now)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func orderMessage(ts time.Time, revenue float64) *sarama.ConsumerMessage {
+	b, _ := json.Marshal([]map[string]interface{}{{
+		"time_stamp":  ts.Format(time.RFC3339Nano),
+		"order_count": 1,
+		"n":           1,
+		"revenue":     revenue,
+	}})
+	return &sarama.ConsumerMessage{Topic: "order_count", Value: b}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	good := AlertRule{Name: "a", Topic: "order_count", Field: "revenue", Window: time.Minute, Aggregate: "sum", Comparator: "<"}
+	if err := good.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	bad := good
+	bad.Aggregate = "median"
+	if err := bad.Validate(); err == nil {
+		t.Error("expected error for unknown aggregate")
+	}
+	bad = good
+	bad.Comparator = "=<"
+	if err := bad.Validate(); err == nil {
+		t.Error("expected error for unknown comparator")
+	}
+	bad = good
+	bad.Window = 0
+	if err := bad.Validate(); err == nil {
+		t.Error("expected error for missing window")
+	}
+}
+
+func TestAlertEngine(t *testing.T) {
+	hooks := make(chan Alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		var a Alert
+		if err := json.Unmarshal(b, &a); err != nil {
+			t.Error(err)
+		}
+		hooks <- a
+	}))
+	defer srv.Close()
+
+	var published [][]byte
+	publish := func(topic string, b []byte) {
+		if topic != alertsTopic {
+			t.Errorf("published to wrong topic %s", topic)
+		}
+		published = append(published, b)
+	}
+
+	start := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	conf := AlertsConfig{
+		Webhooks: []WebhookConfig{{URL: srv.URL}},
+		Rules: []AlertRule{{
+			Name:       "low_revenue",
+			Topic:      "order_count",
+			Field:      "revenue",
+			Window:     15 * time.Minute,
+			Aggregate:  "sum",
+			Comparator: "<",
+			Threshold:  100,
+			Cooldown:   time.Hour,
+		}},
+	}
+	ae, err := NewAlertEngine(&conf, publish, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ae.HandleMessage(orderMessage(start.Add(time.Minute), 50))
+	// a full window has not passed yet
+	if changed := ae.Evaluate(start.Add(10 * time.Minute)); len(changed) != 0 {
+		t.Errorf("expected no alerts before a full window, got %v", changed)
+	}
+
+	changed := ae.Evaluate(start.Add(15 * time.Minute))
+	if len(changed) != 1 || changed[0].State != alertFiring || changed[0].Value != 50 {
+		t.Fatalf("expected firing alert, got %v", changed)
+	}
+	if len(ae.Active()) != 1 {
+		t.Error("expected 1 active alert")
+	}
+	select {
+	case a := <-hooks:
+		if a.Rule != "low_revenue" || a.State != alertFiring {
+			t.Errorf("incorrect webhook alert %v", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	// still firing, nothing changes
+	if changed = ae.Evaluate(start.Add(16 * time.Minute)); len(changed) != 0 {
+		t.Errorf("expected no change, got %v", changed)
+	}
+
+	ae.HandleMessage(orderMessage(start.Add(17*time.Minute), 200))
+	changed = ae.Evaluate(start.Add(18 * time.Minute))
+	if len(changed) != 1 || changed[0].State != alertResolved {
+		t.Fatalf("expected resolved alert, got %v", changed)
+	}
+	if len(ae.Active()) != 0 {
+		t.Error("expected no active alerts")
+	}
+	<-hooks
+
+	// the revenue leaves the window but the rule is in cooldown
+	if changed = ae.Evaluate(start.Add(40 * time.Minute)); len(changed) != 0 {
+		t.Errorf("expected cooldown to hold the alert, got %v", changed)
+	}
+	if changed = ae.Evaluate(start.Add(76 * time.Minute)); len(changed) != 1 || changed[0].Value != 0 {
+		t.Errorf("expected alert to fire after cooldown, got %v", changed)
+	}
+	<-hooks
+
+	if len(published) != 3 {
+		t.Fatalf("expected 3 published alerts, got %d", len(published))
+	}
+	var alerts []Alert
+	if err = json.Unmarshal(published[0], &alerts); err != nil || len(alerts) != 1 {
+		t.Errorf("published alert should be an array of 1, got %s", published[0])
+	}
+}
+
+func TestAlertAggregates(t *testing.T) {
+	now := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	rs := &alertRuleState{AlertRule: AlertRule{Window: 10 * time.Minute}}
+	for i, v := range []float64{4, 1, 7} {
+		rs.add(alertSample{ts: now.Add(-time.Duration(i) * time.Minute), value: v})
+	}
+	// outside of the window
+	rs.add(alertSample{ts: now.Add(-20 * time.Minute), value: 100})
+
+	cases := map[string]float64{"sum": 12, "count": 3, "avg": 4, "min": 1, "max": 7}
+	for agg, e := range cases {
+		rs.Aggregate = agg
+		if v, ok := rs.aggregate(now); !ok || v != e {
+			t.Errorf("%s: expected %v got %v", agg, e, v)
+		}
+	}
+
+	rs.samples = nil
+	rs.Aggregate = "avg"
+	if _, ok := rs.aggregate(now); ok {
+		t.Error("expected avg of no samples to be undefined")
+	}
+	rs.Aggregate = "sum"
+	if v, ok := rs.aggregate(now); !ok || v != 0 {
+		t.Error("expected sum of no samples to be 0")
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// topic anomaly events are published on
+const anomaliesTopic = "anomalies"
+
+// how many anomalies are kept for the snapshot sent to new subscribers
+const recentAnomalies = 100
+
+// AnomalyConfig controls the anomaly detector which scores each closed live
+// bucket against its expected value
+type AnomalyConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+	// size of the buckets that are scored
+	GroupMinute int `yaml:"groupMinute"`
+	// EWMA smoothing factor, higher follows recent buckets more closely
+	Alpha float64 `yaml:"alpha"`
+	// absolute z-score at which a bucket is anomalous
+	Threshold float64 `yaml:"threshold"`
+	// buckets seen before the EWMA baseline is used
+	Warmup int `yaml:"warmup"`
+	// buckets a weekday & hour needs before its seasonal baseline is used
+	MinSeasonalSamples int `yaml:"minSeasonalSamples"`
+	// floor for the standard deviation so a flat series does not make every
+	// change infinitely anomalous
+	MinStdDev float64 `yaml:"minStdDev"`
+	// fields scored for each topic, defaults to every field of the topic
+	Fields map[string][]string `yaml:"fields"`
+}
+
+// AnomalyEvent is a scored bucket, Lower & Upper are the expected range so the
+// UI can shade it
+type AnomalyEvent struct {
+	Topic     string    `json:"topic"`
+	Field     string    `json:"field"`
+	TimeStamp time.Time `json:"time_stamp"`
+	Value     float64   `json:"value"`
+	Expected  float64   `json:"expected"`
+	Lower     float64   `json:"lower"`
+	Upper     float64   `json:"upper"`
+	Score     float64   `json:"score"`
+	// seasonal or ewma
+	Baseline string `json:"baseline"`
+}
+
+// Ewma tracks an exponentially weighted mean & variance
+type Ewma struct {
+	Alpha    float64
+	Mean     float64
+	Variance float64
+	N        int
+}
+
+func (e *Ewma) Update(x float64) {
+	if e.N == 0 {
+		e.Mean = x
+		e.N++
+		return
+	}
+	d := x - e.Mean
+	e.Mean += e.Alpha * d
+	e.Variance = (1 - e.Alpha) * (e.Variance + e.Alpha*d*d)
+	e.N++
+}
+
+// RunningStats is a mean & variance updated one value at a time
+type RunningStats struct {
+	N    int
+	Mean float64
+	m2   float64
+}
+
+func (rs *RunningStats) Update(x float64) {
+	rs.N++
+	d := x - rs.Mean
+	rs.Mean += d / float64(rs.N)
+	rs.m2 += d * (x - rs.Mean)
+}
+
+func (rs *RunningStats) StdDev() float64 {
+	if rs.N < 2 {
+		return 0
+	}
+	return math.Sqrt(rs.m2 / float64(rs.N-1))
+}
+
+// seasonKey is the weekday & hour of a bucket, weekday numbers match
+// date_dimension.weekday_number with Sunday as 0
+type seasonKey struct {
+	weekday int
+	hour    int
+}
+
+type anomalySeries struct {
+	ewma     Ewma
+	seasonal map[seasonKey]*RunningStats
+}
+
+// AnomalyDetector scores live buckets using the seasonal baseline for the
+// weekday & hour when there is enough history, falling back to the EWMA
+type AnomalyDetector struct {
+	mu      sync.Mutex
+	conf    AnomalyConfig
+	fields  map[string][]string
+	series  map[string]*anomalySeries
+	recent  []AnomalyEvent
+	publish func(topic string, value []byte)
+}
+
+func NewAnomalyDetector(conf *AnomalyConfig, specs map[string]*TopicSpec, publish func(string, []byte)) *AnomalyDetector {
+	ad := &AnomalyDetector{
+		conf:    *conf,
+		fields:  make(map[string][]string),
+		series:  make(map[string]*anomalySeries),
+		publish: publish,
+	}
+	for name, spec := range specs {
+		fields, ok := conf.Fields[name]
+		if !ok {
+			fields = spec.FieldNames()
+		}
+		ad.fields[name] = fields
+		for _, f := range fields {
+			ad.series[name+"."+f] = &anomalySeries{
+				ewma:     Ewma{Alpha: conf.Alpha},
+				seasonal: make(map[seasonKey]*RunningStats),
+			}
+		}
+	}
+	return ad
+}
+
+// SeedSeasonal sets the seasonal baseline of a weekday & hour from history
+func (ad *AnomalyDetector) SeedSeasonal(topic, field string, weekday, hour, n int, mean, stdDev float64) {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	s, ok := ad.series[topic+"."+field]
+	if !ok {
+		return
+	}
+	var m2 float64
+	if n > 1 {
+		m2 = stdDev * stdDev * float64(n-1)
+	}
+	s.seasonal[seasonKey{weekday, hour}] = &RunningStats{N: n, Mean: mean, m2: m2}
+}
+
+// score returns the expected value & z-score of x, ok is false while there is
+// not enough history for either baseline
+func (ad *AnomalyDetector) score(s *anomalySeries, key seasonKey, x float64) (ev AnomalyEvent, ok bool) {
+	var std float64
+	if st, exists := s.seasonal[key]; exists && st.N >= ad.conf.MinSeasonalSamples {
+		ev.Expected, std, ev.Baseline = st.Mean, st.StdDev(), "seasonal"
+	} else if s.ewma.N >= ad.conf.Warmup {
+		ev.Expected, std, ev.Baseline = s.ewma.Mean, math.Sqrt(s.ewma.Variance), "ewma"
+	} else {
+		return ev, false
+	}
+	std = math.Max(std, ad.conf.MinStdDev)
+	ev.Value = x
+	ev.Score = (x - ev.Expected) / std
+	ev.Lower = ev.Expected - ad.conf.Threshold*std
+	ev.Upper = ev.Expected + ad.conf.Threshold*std
+	return ev, true
+}
+
+// HandleBucket scores a closed bucket & then learns from it, satisfies
+// BucketListener
+func (ad *AnomalyDetector) HandleBucket(topic string, b Bucket) {
+	key := seasonKey{weekday: int(b.TimeStamp.Weekday()), hour: b.TimeStamp.Hour()}
+
+	var found []AnomalyEvent
+	ad.mu.Lock()
+	for _, field := range ad.fields[topic] {
+		s := ad.series[topic+"."+field]
+		x := b.Values[field]
+		if ev, ok := ad.score(s, key, x); ok && math.Abs(ev.Score) >= ad.conf.Threshold {
+			ev.Topic, ev.Field, ev.TimeStamp = topic, field, b.TimeStamp
+			found = append(found, ev)
+		}
+		s.ewma.Update(x)
+		st, ok := s.seasonal[key]
+		if !ok {
+			st = &RunningStats{}
+			s.seasonal[key] = st
+		}
+		st.Update(x)
+	}
+	ad.recent = append(ad.recent, found...)
+	if len(ad.recent) > recentAnomalies {
+		ad.recent = ad.recent[len(ad.recent)-recentAnomalies:]
+	}
+	ad.mu.Unlock()
+
+	if len(found) == 0 || ad.publish == nil {
+		return
+	}
+	out, err := json.Marshal(found)
+	if err != nil {
+		logger.Print("error encoding anomalies: " + err.Error())
+		return
+	}
+	ad.publish(anomaliesTopic, out)
+}
+
+// Recent returns the latest anomalies, oldest first
+func (ad *AnomalyDetector) Recent() []AnomalyEvent {
+	ad.mu.Lock()
+	defer ad.mu.Unlock()
+	res := make([]AnomalyEvent, len(ad.recent))
+	copy(res, ad.recent)
+	return res
+}
+
+// seasonalSQL builds the per weekday & hour bucket statistics of a topic using
+// the date & time dimensions, groupMinute is an integer so safe to format
+func seasonalSQL(spec *TopicSpec, groupMinute int) string {
+	inner := make([]string, len(spec.Fields))
+	outer := make([]string, 0, 2*len(spec.Fields))
+	for i, f := range spec.Fields {
+		inner[i] = fmt.Sprintf("%s %s", f.SQL, f.Name)
+		outer = append(outer, fmt.Sprintf("avg(%s) %s_mean", f.Name, f.Name), fmt.Sprintf("coalesce(stddev_samp(%s), 0) %s_std", f.Name, f.Name))
+	}
+	// only buckets with facts are counted so quiet periods read a little high
+	return fmt.Sprintf(`
+select weekday_number, hour_24, count(*) samples, %s
+from (
+	select dd.weekday_number, td.hour_24, f.date_key, floor(td.the_minute / %d) slot, %s
+	from %s f
+	join mart.date_dimension dd
+		on f.date_key = dd.date_key
+	join mart.time_dimension td
+		on f.time_key = td.time_key
+	group by dd.weekday_number, td.hour_24, f.date_key, floor(td.the_minute / %d)
+) t
+group by weekday_number, hour_24`, strings.Join(outer, ", "), groupMinute, strings.Join(inner, ", "), spec.Table, groupMinute)
+}
+
+// seedAnomalyBaselines loads the seasonal baselines from the fact tables
+func (api *API) seedAnomalyBaselines(ad *AnomalyDetector) {
+	for _, spec := range topicSpecs {
+		rows, err := api.dm.Raw(seasonalSQL(spec, ad.conf.GroupMinute)).Rows()
+		if err != nil {
+			logger.Print("error loading seasonal baseline for topic " + spec.Name + ": " + err.Error())
+			continue
+		}
+		var weekday, hour, n int
+		vals := make([]float64, 2*len(spec.Fields))
+		dest := []interface{}{&weekday, &hour, &n}
+		for i := range vals {
+			dest = append(dest, &vals[i])
+		}
+		for rows.Next() {
+			if err = rows.Scan(dest...); err != nil {
+				logger.Print("error reading seasonal baseline for topic " + spec.Name + ": " + err.Error())
+				break
+			}
+			for i, f := range spec.Fields {
+				ad.SeedSeasonal(spec.Name, f.Name, weekday, hour, n, vals[2*i], vals[2*i+1])
+			}
+		}
+		rows.Close()
+	}
+}
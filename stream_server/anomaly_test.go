@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEwma(t *testing.T) {
+	e := Ewma{Alpha: 0.5}
+	for _, x := range []float64{10, 10, 10} {
+		e.Update(x)
+	}
+	if e.Mean != 10 || e.Variance != 0 {
+		t.Errorf("incorrect steady state %v", e)
+	}
+	e.Update(20)
+	if e.Mean != 15 {
+		t.Errorf("expected mean 15 got %v", e.Mean)
+	}
+	if e.Variance != 25 {
+		t.Errorf("expected variance 25 got %v", e.Variance)
+	}
+}
+
+func TestRunningStats(t *testing.T) {
+	var rs RunningStats
+	for _, x := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		rs.Update(x)
+	}
+	if rs.Mean != 5 {
+		t.Errorf("expected mean 5 got %v", rs.Mean)
+	}
+	if math.Abs(rs.StdDev()-2.138) > 0.001 {
+		t.Errorf("expected std dev 2.138 got %v", rs.StdDev())
+	}
+}
+
+func TestAnomalyDetector(t *testing.T) {
+	var published [][]byte
+	conf := DefaultConfig().Anomaly
+	conf.Warmup = 5
+	ad := NewAnomalyDetector(&conf, topicSpecs, func(topic string, b []byte) {
+		if topic != anomaliesTopic {
+			t.Errorf("published to wrong topic %s", topic)
+		}
+		published = append(published, b)
+	})
+
+	// Monday 10:00, alternate between 9 & 11 orders
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		b := NewBucket(base.Add(time.Duration(i*5) * time.Minute))
+		b.Values["n"] = float64(9 + 2*(i%2))
+		ad.HandleBucket("customer_count", *b)
+	}
+	if len(published) != 0 {
+		t.Fatalf("unexpected anomalies %s", published)
+	}
+
+	// seasonal baseline for Monday 10:00 has 10 samples so it is used
+	b := NewBucket(base.Add(50 * time.Minute))
+	b.Values["n"] = 40
+	ad.HandleBucket("customer_count", *b)
+	if len(published) != 1 {
+		t.Fatalf("expected 1 anomaly, got %d", len(published))
+	}
+	var evs []AnomalyEvent
+	if err := json.Unmarshal(published[0], &evs); err != nil {
+		t.Fatal(err)
+	}
+	ev := evs[0]
+	if ev.Baseline != "seasonal" || ev.Expected != 10 || ev.Score < 3 || ev.Value != 40 {
+		t.Errorf("incorrect anomaly %+v", ev)
+	}
+	if ev.Lower >= ev.Expected || ev.Upper <= ev.Expected {
+		t.Errorf("incorrect expected range %+v", ev)
+	}
+
+	// a new hour has no seasonal history so the EWMA is used
+	b = NewBucket(base.Add(60 * time.Minute))
+	b.Values["n"] = 60
+	ad.HandleBucket("customer_count", *b)
+	if len(published) != 2 {
+		t.Fatalf("expected 2 anomalies, got %d", len(published))
+	}
+	json.Unmarshal(published[1], &evs)
+	if evs[0].Baseline != "ewma" || evs[0].Score < 3 {
+		t.Errorf("incorrect ewma anomaly %+v", evs[0])
+	}
+	if len(ad.Recent()) != 2 {
+		t.Error("expected 2 recent anomalies")
+	}
+}
+
+func TestAnomalySeedSeasonal(t *testing.T) {
+	conf := DefaultConfig().Anomaly
+	ad := NewAnomalyDetector(&conf, topicSpecs, nil)
+	ad.SeedSeasonal("order_count", "revenue", 1, 10, 20, 100, 10)
+
+	s := ad.series["order_count.revenue"]
+	ev, ok := ad.score(s, seasonKey{1, 10}, 150)
+	if !ok || ev.Baseline != "seasonal" || ev.Score != 5 || ev.Lower != 70 || ev.Upper != 130 {
+		t.Errorf("incorrect score from seeded baseline %+v", ev)
+	}
+	if _, ok = ad.score(s, seasonKey{2, 10}, 150); ok {
+		t.Error("expected no baseline for unseeded weekday")
+	}
+}
+
+func TestSeasonalSQL(t *testing.T) {
+	q := seasonalSQL(topicSpecs["order_count"], 5)
+	for _, e := range []string{"join mart.date_dimension dd", "join mart.time_dimension td", "floor(td.the_minute / 5)", "avg(revenue) revenue_mean", "stddev_samp(n)"} {
+		if !strings.Contains(q, e) {
+			t.Errorf("query missing %q:\n%s", e, q)
+		}
+	}
+}
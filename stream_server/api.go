@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"os"
@@ -16,9 +18,13 @@ import (
 
 // API represents main program configuration
 type API struct {
+	// configuration read at startup
+	Config *Config
 	// http server details, using http.Server to take advantage of built in
 	// cancellation
 	Server *http.Server
+	// certs is set when a TLS listener is configured
+	certs *CertReloader
 	// API version used for all endpoints, expects integer as string
 	Version string
 	// SubRouter contains the version prefix to be used by all routes
@@ -31,16 +37,45 @@ type API struct {
 	Kafka
 	// data ware
 	dm *gorm.DB
+	// recent buckets kept in memory, nil when disabled
+	cache *AggregateCache
+	// initial data for topics produced inside the server, keyed by topic
+	snapshots map[string]SnapshotFunc
+	// threshold alert rules, nil when none are configured
+	alerts *AlertEngine
+	// live buckets keyed by bucket size, see liveBuckets
+	bucketStreams map[int]*BucketStream
+	// scores live buckets, nil when disabled
+	anomalies *AnomalyDetector
+	// forecast models, nil when disabled
+	forecaster *Forecaster
+	// virtual topics computed from other topics, keyed by topic
+	derived map[string]*DerivedTopic
+	// recent order sketches, nil when disabled
+	sketches *SketchStore
+	// business KPIs, nil when disabled
+	kpis *KPITracker
+	// retention matrices, nil when they could not be loaded
+	cohorts *CohortTracker
+	// lifetime summary of each customer, nil when it could not be loaded
+	profiles *ProfileStore
+	// revenue targets, nil when they could not be loaded
+	goals *GoalTracker
+	// durable subscriptions, nil when they could not be loaded
+	durable *DurableStore
+	// registered webhooks, nil when they could not be loaded
+	webhooks *WebhookDispatcher
 	// RequestLogger
 	RequestLogger zerolog.Logger
 }
 
-// Init should read a configuration to initialize the program
-func (api *API) Init() error {
-	api.Version = "0"
+// Init uses the configuration to initialize the program
+func (api *API) Init(conf *Config) error {
+	api.Config = conf
+	api.Version = conf.Version
 	// CORS options
 	api.AllowedHeaders = []string{"X-Requested-With", "Content-Type", "Authorization"}
-	api.AllowedMethods = []string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}
+	api.AllowedMethods = []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"}
 	api.AllowedOrigins = []string{"*"}
 
 	reqLoggerFileName := "stream_server_requests.log"
@@ -56,6 +91,7 @@ func (api *API) Init() error {
 	api.SubRouter = r.PathPrefix(fmt.Sprintf("/v%s/", api.Version)).Subrouter()
 	api.AddRoutes()
 	r.Use(api.LoggingMiddleware)
+	api.SubRouter.Use(api.AuthMiddleware)
 
 	api.dm, err = gorm.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=%s",
 		"localhost", 5432, "postgres", "postgres", "webapp", "disable"))
@@ -64,24 +100,225 @@ func (api *API) Init() error {
 		os.Exit(1)
 	}
 
-	api.Server = &http.Server{
-		// TODO: get port from config file
-		Addr:    "127.0.0.1:3000",
-		Handler: handlers.CORS(handlers.AllowedHeaders(api.AllowedHeaders), handlers.AllowedMethods(api.AllowedMethods), handlers.AllowedOrigins(api.AllowedOrigins))(r),
-		// TODO: will need to play with these timeouts because likely would want to allow
-		// data streaming beyond 30 minutes
-		WriteTimeout: 30 * time.Minute,
-		ReadTimeout:  30 * time.Minute,
+	h := handlers.CORS(handlers.AllowedHeaders(api.AllowedHeaders), handlers.AllowedMethods(api.AllowedMethods), handlers.AllowedOrigins(api.AllowedOrigins))(r)
+	api.Server, api.certs, err = NewServer(&conf.Server, h)
+	if err != nil {
+		return err
 	}
 
 	return nil
 }
 
+// Serve starts all configured listeners & the TLS certificate watcher, the
+// watcher stops when ctx is cancelled
+func (api *API) Serve(ctx context.Context) error {
+	if api.certs != nil {
+		go api.certs.Watch(ctx, api.Config.Server.TLS.ReloadInterval)
+	}
+	_, err := ServeListeners(api.Server, api.Config.Server.Listeners)
+	return err
+}
+
+// SnapshotFunc returns the current state of a topic that is produced inside
+// the server, it is sent as the first event of a stream
+type SnapshotFunc func(r *http.Request) (interface{}, error)
+
+// InitProcessors sets up everything that is kept up to date from the Kafka
+// stream, must be called after the Kafka consumer is initialized
+func (api *API) InitProcessors() {
+	if *api.Config.Cache.Enabled {
+		api.cache = NewAggregateCache(api.Config.Cache.Window, api.Config.Cache.GroupMinutes, topicSpecs)
+		loaded := time.Now()
+		api.warmCache()
+		api.Kafka.AddHandler(skipBefore(loaded, api.cache.HandleMessage))
+		expvar.Publish("aggregate_cache", expvar.Func(func() interface{} {
+			return api.cache.Stats()
+		}))
+	}
+
+	api.snapshots = make(map[string]SnapshotFunc)
+
+	if len(api.Config.Alerts.Rules) > 0 {
+		var err error
+		api.alerts, err = NewAlertEngine(&api.Config.Alerts, api.Kafka.Publish, time.Now())
+		if err != nil {
+			logger.Print("error initializing alert rules: " + err.Error())
+		} else {
+			for _, rule := range api.Config.Alerts.Rules {
+				if !api.Kafka.HasTopic(rule.Topic) {
+					logger.Warn().Msgf("alert rule %s uses unknown topic %s", rule.Name, rule.Topic)
+				}
+			}
+			api.Kafka.RegisterTopic(alertsTopic)
+			api.snapshots[alertsTopic] = func(r *http.Request) (interface{}, error) {
+				return api.alerts.Active(), nil
+			}
+			api.Kafka.AddHandler(api.alerts.HandleMessage)
+			go api.alerts.Run(api.Kafka.ctx, api.Config.Alerts.EvaluateInterval)
+		}
+	}
+
+	if *api.Config.Anomaly.Enabled {
+		api.anomalies = NewAnomalyDetector(&api.Config.Anomaly, topicSpecs, api.Kafka.Publish)
+		api.seedAnomalyBaselines(api.anomalies)
+		api.Kafka.RegisterTopic(anomaliesTopic)
+		api.snapshots[anomaliesTopic] = func(r *http.Request) (interface{}, error) {
+			return api.anomalies.Recent(), nil
+		}
+		api.liveBuckets(api.Config.Anomaly.GroupMinute).AddListener(api.anomalies.HandleBucket)
+	}
+
+	if *api.Config.Forecast.Enabled {
+		api.forecaster = NewForecaster(&api.Config.Forecast, topicSpecs)
+		api.loadForecastHistory(api.forecaster)
+		api.liveBuckets(api.Config.Forecast.GroupMinute).AddListener(api.forecaster.HandleBucket)
+		expvar.Publish("forecast_backtest", expvar.Func(func() interface{} {
+			return api.forecaster.Backtests()
+		}))
+	}
+
+	if *api.Config.Sketches.Enabled {
+		api.sketches = NewSketchStore(&api.Config.Sketches, time.Time{})
+		loaded := time.Now()
+		api.warmSketches(api.sketches)
+		api.Kafka.AddHandler(skipBefore(loaded, api.sketches.HandleMessage))
+	}
+
+	if *api.Config.KPI.Enabled {
+		api.kpis = NewKPITracker(&api.Config.KPI, api.Kafka.Publish)
+		loaded := time.Now()
+		api.seedKPIs(api.kpis)
+		api.Kafka.RegisterTopic(kpisTopic)
+		api.snapshots[kpisTopic] = api.kpiSnapshot
+		api.Kafka.AddHandler(skipBefore(loaded, api.kpis.HandleMessage))
+	}
+
+	var err error
+	if *api.Config.Cohorts.Enabled {
+		loaded := time.Now()
+		if api.cohorts, err = api.loadCohorts(); err != nil {
+			logger.Print("error loading cohorts: " + err.Error())
+		} else {
+			api.Kafka.AddHandler(skipBefore(loaded, api.cohorts.HandleMessage))
+		}
+	}
+
+	if *api.Config.Profiles.Enabled {
+		profiles := NewProfileStore()
+		loaded := time.Now()
+		if err = api.loadProfiles(profiles); err != nil {
+			logger.Print("error loading customer profiles: " + err.Error())
+		} else {
+			api.profiles = profiles
+			api.Kafka.AddHandler(skipBefore(loaded, profiles.HandleMessage))
+		}
+	}
+
+	if *api.Config.Goals.Enabled {
+		api.goals = NewGoalTracker(api.Kafka.Publish)
+		loaded := time.Now()
+		if err = api.loadGoals(); err != nil {
+			logger.Print("error loading goals: " + err.Error())
+			api.goals = nil
+		} else {
+			api.Kafka.RegisterTopic(goalsTopic)
+			api.snapshots[goalsTopic] = api.goalsSnapshot
+			api.Kafka.AddHandler(skipBefore(loaded, api.goals.HandleMessage))
+		}
+	}
+
+	if *api.Config.Geo.Enabled {
+		api.Kafka.RegisterTopic(geoTopic)
+		api.snapshots[geoTopic] = api.geoSnapshot
+		api.Kafka.AddHandler((&GeoPublisher{publish: api.Kafka.Publish}).HandleMessage)
+	}
+
+	api.derived = make(map[string]*DerivedTopic)
+	for i := range api.Config.Derived {
+		d, err := NewDerivedTopic(&api.Config.Derived[i], topicSpecs, api.Kafka.Publish)
+		if err != nil {
+			logger.Print("error initializing derived topic: " + err.Error())
+			continue
+		}
+		if api.Kafka.HasTopic(d.Name) {
+			logger.Warn().Msgf("derived topic %s is already a topic", d.Name)
+			continue
+		}
+		api.derived[d.Name] = d
+		api.Kafka.RegisterTopic(d.Name)
+		api.snapshots[d.Name] = func(r *http.Request) (interface{}, error) {
+			return api.derivedHistory(r, d)
+		}
+		api.liveBuckets(d.GroupMinute).AddListener(d.HandleBucket)
+	}
+
+	for i := range api.Config.Leaderboards {
+		lb, err := NewLeaderboard(&api.Config.Leaderboards[i], api.Kafka.Publish)
+		if err != nil {
+			logger.Print("error initializing leaderboard: " + err.Error())
+			continue
+		}
+		if api.Kafka.HasTopic(lb.conf.Name) {
+			logger.Warn().Msgf("leaderboard %s is already a topic", lb.conf.Name)
+			continue
+		}
+		api.Kafka.RegisterTopic(lb.conf.Name)
+		loaded := time.Now()
+		api.seedLeaderboard(lb)
+		api.snapshots[lb.conf.Name] = func(r *http.Request) (interface{}, error) {
+			return lb.Current(), nil
+		}
+		api.Kafka.AddHandler(skipBefore(loaded, lb.HandleMessage))
+		go lb.Run(api.Kafka.ctx, 10*time.Second)
+	}
+
+	// after the topics registered above so they can be subscribed
+	api.durable = NewDurableStore(&api.Config.Durable)
+	if err = api.loadDurable(); err != nil {
+		logger.Print("error loading durable subscriptions: " + err.Error())
+		api.durable = nil
+	} else {
+		api.Kafka.AddTap(api.durableTap)
+		go api.pruneDurable(api.Kafka.ctx, time.Minute)
+	}
+
+	api.webhooks = NewWebhookDispatcher(api.Kafka.ctx, &api.Config.Webhooks, api.recordWebhookDelivery, api.setWebhookState)
+	if err = api.loadWebhooks(); err != nil {
+		logger.Print("error loading webhooks: " + err.Error())
+		api.webhooks = nil
+	} else {
+		api.Kafka.AddTap(api.webhooks.HandleMessage)
+		go api.pruneWebhookDeliveries(api.Kafka.ctx, time.Hour)
+	}
+}
+
+// warmCache loads the cache window from the fact tables
+func (api *API) warmCache() {
+	// only whole minutes are complete
+	start := time.Now().Add(-api.Config.Cache.Window).Truncate(time.Minute).Add(time.Minute)
+	for _, spec := range topicSpecs {
+		buckets, err := api.queryBuckets(spec, 1, start)
+		if err != nil {
+			logger.Print("error warming cache for topic " + spec.Name + ": " + err.Error())
+			continue
+		}
+		var older int
+		err = api.dm.Raw(fmt.Sprintf("select count(*) from (select 1 from %s where date_key + time_key < ? limit 1) t", spec.Table), start).Row().Scan(&older)
+		if err != nil {
+			logger.Print("error checking for older data of topic " + spec.Name + ": " + err.Error())
+			// assume there is so all history still comes from the database
+			older = 1
+		}
+		logger.Printf("warmed cache for topic %s with %d buckets", spec.Name, len(buckets))
+		api.cache.Warm(spec.Name, buckets, BucketKey(start), older > 0)
+	}
+}
+
 func (api *API) LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Do stuff here
 		r = r.WithContext(NewRequestContext(r.Context(), &RequestContext{ID: xid.New().String()}))
-		api.reqLogTrace(r, "request: %s", r.RequestURI)
+		api.reqLogTrace(r, "request: %s", loggedURI(r))
 		// Call the next handler, which can be another middleware in the chain, or the final handler.
 		next.ServeHTTP(w, r)
 	})
@@ -123,3 +360,23 @@ func (api *API) reqLogTrace(r *http.Request, format string, v ...interface{}) {
 		api.RequestLogger.Trace().Str("request_id", rc.ID).Msgf(format, v...)
 	}
 }
+
+// writeJSON encodes v as the response body, as MessagePack or CBOR when the
+// request asks for them
+func (api *API) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	format, err := ParseFormat(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := Encode(format, v)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error encoding response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	w.Header().Add("Vary", "Accept")
+	w.Write(b)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig protects the API with bearer tokens, the API is open when no
+// tokens are configured
+type AuthConfig struct {
+	Tokens []string `yaml:"tokens"`
+}
+
+// authorized checks a token against the configured tokens
+func (api *API) authorized(token string) bool {
+	if len(api.Config.Auth.Tokens) == 0 {
+		return true
+	}
+	ok := false
+	for _, t := range api.Config.Auth.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// bearerToken strips the Bearer scheme from an Authorization value
+func bearerToken(auth string) string {
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// requestToken reads the token from the Authorization header or the
+// `access_token` query parameter, the latter is for EventSource & WebSocket
+// clients which can not set headers
+func requestToken(r *http.Request) string {
+	if t := bearerToken(r.Header.Get("Authorization")); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// loggedURI is the request URI without the access_token so tokens are not
+// written to the request log
+func loggedURI(r *http.Request) string {
+	q := r.URL.Query()
+	if _, ok := q["access_token"]; !ok {
+		return r.RequestURI
+	}
+	q.Del("access_token")
+	u := *r.URL
+	u.RawQuery = q.Encode()
+	return u.RequestURI()
+}
+
+// route is the full path of a route of the API i.e. /v0/health
+func (api *API) route(path string) string {
+	return "/v" + api.Version + path
+}
+
+// graphqlUpgrade checks for a GraphQL WebSocket upgrade, the socket only
+// accepts graphql-transport-ws which authorizes with its connection_init
+func (api *API) graphqlUpgrade(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.URL.Path != api.route("/graphql") ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if strings.TrimSpace(p) == graphqlWSProtocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AuthMiddleware rejects requests without a valid token, the health check is
+// left open & GraphQL WebSockets may authorize in their first message instead
+func (api *API) AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.authorized(requestToken(r)) || r.URL.Path == api.route("/health") || api.graphqlUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		api.reqLogError(r, "unauthorized request")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stream_server"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	api := &API{Config: DefaultConfig(), Version: "0"}
+	h := api.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(method, path string, header map[string]string) int {
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// open without tokens
+	if code := serve("GET", "/v0/history/geo", nil); code != http.StatusOK {
+		t.Errorf("expected open API, got %d", code)
+	}
+
+	api.Config.Auth.Tokens = []string{"secret"}
+	socket := map[string]string{"Upgrade": "websocket", "Sec-WebSocket-Protocol": graphqlWSProtocol}
+	for _, c := range []struct {
+		method, path string
+		header       map[string]string
+		code         int
+	}{
+		{"GET", "/v0/history/geo", nil, http.StatusUnauthorized},
+		{"GET", "/v0/history/geo", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{"GET", "/v0/history/geo", map[string]string{"Authorization": "bearer secret"}, http.StatusOK},
+		{"GET", "/v0/stream/subscribe/order_count?access_token=secret", nil, http.StatusOK},
+		{"GET", "/v0/health", nil, http.StatusOK},
+		// only the health route itself is open
+		{"GET", "/v0/durable/health", nil, http.StatusUnauthorized},
+		{"DELETE", "/v0/durable/health", nil, http.StatusUnauthorized},
+		{"GET", "/v0/forecast/health", nil, http.StatusUnauthorized},
+		{"GET", "/v0/durable/graphql", socket, http.StatusUnauthorized},
+		// only GraphQL sockets authorize in their first message
+		{"GET", "/v0/graphql", socket, http.StatusOK},
+		{"GET", "/v0/graphql", map[string]string{"Upgrade": "websocket"}, http.StatusUnauthorized},
+		{"POST", "/v0/graphql", socket, http.StatusUnauthorized},
+		{"POST", "/v0/webhooks", socket, http.StatusUnauthorized},
+		{"GET", "/v0/stream/subscribe/order_count", socket, http.StatusUnauthorized},
+	} {
+		if code := serve(c.method, c.path, c.header); code != c.code {
+			t.Errorf("expected %d for %s %s %v, got %d", c.code, c.method, c.path, c.header, code)
+		}
+	}
+}
+
+func TestLoggedURI(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?access_token=secret&view=kpis", nil)
+	if u := loggedURI(r); u != "/v0/stream/subscribe/order_count?view=kpis" {
+		t.Errorf("expected the token to be removed, got %s", u)
+	}
+	r = httptest.NewRequest("GET", "/v0/history/geo?groupMinute=5", nil)
+	if u := loggedURI(r); u != "/v0/history/geo?groupMinute=5" {
+		t.Errorf("expected the URI unchanged, got %s", u)
+	}
+}
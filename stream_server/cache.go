@@ -0,0 +1,203 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// approximate bytes used by a bucket with a single value, each extra value
+// adds bucketValueBytes
+const (
+	bucketBaseBytes  = 96
+	bucketValueBytes = 40
+)
+
+// AggregateCache keeps a rolling window of recent buckets for each topic &
+// bucket size so new subscribers do not have to query the fact tables
+type AggregateCache struct {
+	mu     sync.RWMutex
+	window time.Duration
+	series map[cacheKey]*cachedSeries
+	hits   uint64
+	misses uint64
+}
+
+type cacheKey struct {
+	topic       string
+	groupMinute int
+}
+
+type cachedSeries struct {
+	spec        *TopicSpec
+	groupMinute int
+	// sorted by time stamp
+	buckets []Bucket
+	// buckets are complete from this key onwards
+	since time.Time
+	// set when the table holds data from before `since`, in that case requests
+	// for all history have to go to the database
+	older bool
+}
+
+// CacheStats are exported so the hit rate & memory use can be watched
+type CacheStats struct {
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Series      int     `json:"series"`
+	Buckets     int     `json:"buckets"`
+	ApproxBytes int     `json:"approx_bytes"`
+}
+
+func NewAggregateCache(window time.Duration, groupMinutes []int, specs map[string]*TopicSpec) *AggregateCache {
+	c := &AggregateCache{
+		window: window,
+		series: make(map[cacheKey]*cachedSeries),
+	}
+	for _, spec := range specs {
+		for _, g := range groupMinutes {
+			c.series[cacheKey{spec.Name, g}] = &cachedSeries{spec: spec, groupMinute: g}
+		}
+	}
+	return c
+}
+
+// Warm replaces the cached buckets of a topic, buckets are one minute
+// buckets starting at since & are rolled up into each cached bucket size
+func (c *AggregateCache) Warm(topic string, buckets []Bucket, since time.Time, older bool) {
+	SortBuckets(buckets)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, s := range c.series {
+		if k.topic != topic {
+			continue
+		}
+		s.buckets = Rollup(buckets, k.groupMinute)
+		s.since = BucketTime(since, k.groupMinute)
+		s.older = older
+		// a partial first bucket can not be used
+		if !s.since.Equal(since) {
+			s.since = s.since.Add(time.Duration(k.groupMinute) * time.Minute)
+		}
+	}
+}
+
+// Add sums an event into every cached bucket size of the topic
+func (c *AggregateCache) Add(topic string, e *Event) {
+	key := BucketKey(e.TimeStamp)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, s := range c.series {
+		if k.topic != topic {
+			continue
+		}
+		s.add(BucketTime(key, k.groupMinute), e)
+		s.evict(c.window)
+	}
+}
+
+func (s *cachedSeries) add(ts time.Time, e *Event) {
+	n := len(s.buckets)
+	// events nearly always land in the newest bucket
+	if n > 0 && s.buckets[n-1].TimeStamp.Equal(ts) {
+		s.buckets[n-1].Add(e, s.spec.FieldNames())
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return !s.buckets[i].TimeStamp.Before(ts) })
+	if i < n && s.buckets[i].TimeStamp.Equal(ts) {
+		s.buckets[i].Add(e, s.spec.FieldNames())
+		return
+	}
+	b := NewBucket(ts)
+	b.Add(e, s.spec.FieldNames())
+	s.buckets = append(s.buckets, Bucket{})
+	copy(s.buckets[i+1:], s.buckets[i:])
+	s.buckets[i] = *b
+}
+
+// evict drops buckets that have fallen out of the window of the newest bucket
+func (s *cachedSeries) evict(window time.Duration) {
+	n := len(s.buckets)
+	if n == 0 {
+		return
+	}
+	cutoff := s.buckets[n-1].TimeStamp.Add(-window)
+	i := sort.Search(n, func(i int) bool { return !s.buckets[i].TimeStamp.Before(cutoff) })
+	if i == 0 {
+		return
+	}
+	s.buckets = append(s.buckets[:0], s.buckets[i:]...)
+	if s.since.Before(cutoff) {
+		s.since = cutoff
+	}
+	s.older = true
+}
+
+// Get returns the cached buckets of a topic at or after from, a zero from
+// asks for all history, ok is false if the cache can not answer the request
+func (c *AggregateCache) Get(topic string, groupMinute int, from time.Time) (res []Bucket, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	s, exists := c.series[cacheKey{topic, groupMinute}]
+	switch {
+	case !exists:
+		ok = false
+	case from.IsZero():
+		ok = !s.older
+	default:
+		// the bucket holding from is returned whole
+		from = BucketTime(BucketKey(from), groupMinute)
+		ok = !from.Before(s.since)
+	}
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+
+	start := 0
+	if !from.IsZero() {
+		start = sort.Search(len(s.buckets), func(i int) bool { return !s.buckets[i].TimeStamp.Before(from) })
+	}
+	res = make([]Bucket, 0, len(s.buckets)-start)
+	for i := start; i < len(s.buckets); i++ {
+		res = append(res, s.buckets[i].Copy())
+	}
+	return res, true
+}
+
+// HandleMessage updates the cache from a consumed Kafka message
+func (c *AggregateCache) HandleMessage(msg *sarama.ConsumerMessage) {
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("cache could not parse message: " + err.Error())
+		return
+	}
+	for i := range events {
+		c.Add(msg.Topic, &events[i])
+	}
+}
+
+// Stats returns the hit rate & approximate memory use
+func (c *AggregateCache) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	st := CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Series: len(c.series),
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits) / float64(total)
+	}
+	for _, s := range c.series {
+		st.Buckets += len(s.buckets)
+		st.ApproxBytes += len(s.buckets) * (bucketBaseBytes + bucketValueBytes*(len(s.spec.Fields)-1))
+	}
+	return st
+}
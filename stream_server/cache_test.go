@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func testEvent(ts time.Time, n float64) *Event {
+	return &Event{TimeStamp: ts, Values: map[string]float64{"n": n}}
+}
+
+func TestAggregateCache(t *testing.T) {
+	// keys are local wall clock so build the times in local time
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	key := BucketKey(base)
+
+	c := NewAggregateCache(time.Hour, []int{1, 5}, topicSpecs)
+
+	// warm with 3 one minute buckets and no older data
+	var warm []Bucket
+	for i := 0; i < 3; i++ {
+		b := NewBucket(key.Add(time.Duration(i) * time.Minute))
+		b.Values["n"] = 1
+		warm = append(warm, *b)
+	}
+	c.Warm("customer_count", warm, key, false)
+
+	c.Add("customer_count", testEvent(base.Add(2*time.Minute+10*time.Second), 2))
+	c.Add("customer_count", testEvent(base.Add(6*time.Minute), 1))
+
+	res, ok := c.Get("customer_count", 1, time.Time{})
+	if !ok {
+		t.Fatal("expected cache hit for all history")
+	}
+	if len(res) != 4 {
+		t.Fatalf("expected 4 buckets, got %d", len(res))
+	}
+	if res[2].Values["n"] != 3 {
+		t.Errorf("expected live event summed into warm bucket, got %v", res[2].Values["n"])
+	}
+
+	res, ok = c.Get("customer_count", 5, base.Add(5*time.Minute))
+	if !ok {
+		t.Fatal("expected cache hit inside window")
+	}
+	if len(res) != 1 || res[0].Values["n"] != 1 {
+		t.Errorf("incorrect 5 minute buckets %v", res)
+	}
+
+	// returned buckets must not share memory with the cache
+	res[0].Values["n"] = 100
+	res, _ = c.Get("customer_count", 5, base.Add(5*time.Minute))
+	if res[0].Values["n"] != 1 {
+		t.Error("cached bucket was modified through result")
+	}
+
+	// bucket sizes that are not cached always miss
+	if _, ok = c.Get("customer_count", 3, time.Time{}); ok {
+		t.Error("expected miss for uncached bucket size")
+	}
+
+	// moving past the window evicts old buckets, so all history is a miss
+	c.Add("customer_count", testEvent(base.Add(90*time.Minute), 1))
+	if _, ok = c.Get("customer_count", 1, time.Time{}); ok {
+		t.Error("expected miss for all history after eviction")
+	}
+	if _, ok = c.Get("customer_count", 1, base); ok {
+		t.Error("expected miss for history before window")
+	}
+	res, ok = c.Get("customer_count", 1, base.Add(60*time.Minute))
+	if !ok || len(res) != 1 {
+		t.Errorf("expected hit inside window, got %v %v", ok, res)
+	}
+
+	st := c.Stats()
+	if st.Hits != 4 || st.Misses != 3 {
+		t.Errorf("incorrect hits %d & misses %d", st.Hits, st.Misses)
+	}
+	if st.ApproxBytes == 0 || st.Buckets == 0 {
+		t.Error("expected memory use to be reported")
+	}
+}
+
+func TestAggregateCacheOlderData(t *testing.T) {
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	c := NewAggregateCache(time.Hour, []int{1}, topicSpecs)
+	c.Warm("order_count", nil, BucketKey(base), true)
+
+	if _, ok := c.Get("order_count", 1, time.Time{}); ok {
+		t.Error("expected miss when table has data older than the window")
+	}
+	if _, ok := c.Get("order_count", 1, base.Add(time.Minute)); !ok {
+		t.Error("expected hit inside window")
+	}
+}
+
+func TestAggregateCacheHandleMessage(t *testing.T) {
+	c := NewAggregateCache(time.Hour, []int{1}, topicSpecs)
+	c.HandleMessage(&sarama.ConsumerMessage{
+		Topic: "order_count",
+		Value: []byte(`[{"time_stamp": "2020-06-01T10:15:30+00:00", "order_count": 1, "n": 2, "revenue": 10.5}]`),
+	})
+	res, ok := c.Get("order_count", 1, time.Time{})
+	if !ok || len(res) != 1 {
+		t.Fatalf("expected 1 bucket, got %v %v", ok, res)
+	}
+	if res[0].Values["revenue"] != 10.5 || res[0].Values["n"] != 2 || res[0].Values["order_count"] != 1 {
+		t.Errorf("incorrect values %v", res[0].Values)
+	}
+}
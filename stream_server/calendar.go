@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// calendarColumn is a date_dimension column returned with each calendar bucket
+type calendarColumn struct {
+	Name string
+	Text bool
+}
+
+// CalendarUnit groups facts by columns of mart.date_dimension
+type CalendarUnit struct {
+	// grouped columns in sort order
+	Columns []calendarColumn
+	// SQL building the display label from the columns
+	Label string
+}
+
+var calendarUnits = map[string]*CalendarUnit{
+	"week": {
+		Columns: []calendarColumn{{Name: "the_year"}, {Name: "week_of_year"}},
+		Label:   "'W' || lpad(dd.week_of_year::text, 2, '0') || ' ' || dd.the_year",
+	},
+	"month": {
+		Columns: []calendarColumn{{Name: "the_year"}, {Name: "month_number"}, {Name: "month_name", Text: true}},
+		Label:   "trim(dd.month_name) || ' ' || dd.the_year",
+	},
+	"quarter": {
+		Columns: []calendarColumn{{Name: "the_year"}, {Name: "quarter_number"}, {Name: "quarter_name", Text: true}},
+		Label:   "trim(dd.quarter_name) || ' ' || dd.the_year",
+	},
+	"year": {
+		Columns: []calendarColumn{{Name: "the_year"}},
+		Label:   "dd.the_year::text",
+	},
+	// across the whole range i.e. all Mondays together
+	"weekday": {
+		Columns: []calendarColumn{{Name: "weekday_number"}, {Name: "weekday_name", Text: true}},
+		Label:   "trim(dd.weekday_name)",
+	},
+	// weekdays against weekends across the whole range
+	"daytype": {
+		Label: "case when dd.weekend then 'Weekend' else 'Weekday' end",
+	},
+}
+
+// CalendarUnitNames lists the supported `by` values
+func CalendarUnitNames() []string {
+	names := make([]string, 0, len(calendarUnits))
+	for name := range calendarUnits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CalendarParams are the query parameters of a calendar rollup
+type CalendarParams struct {
+	By   string
+	Unit *CalendarUnit
+	// also split each unit into weekdays & weekends
+	SplitWeekend bool
+	// optional date range, To is exclusive
+	From time.Time
+	To   time.Time
+}
+
+// ParseCalendarParams reads `by`, `splitWeekend`, `from` & `to` from the
+// request, the dates are YYYY-MM-DD
+func ParseCalendarParams(r *http.Request) (*CalendarParams, error) {
+	q := r.URL.Query()
+	p := CalendarParams{By: q.Get("by")}
+	var ok bool
+	if p.Unit, ok = calendarUnits[p.By]; !ok {
+		return nil, fmt.Errorf("by must be one of %s, got %q", strings.Join(CalendarUnitNames(), ", "), p.By)
+	}
+	switch q.Get("splitWeekend") {
+	case "", "false":
+	case "true":
+		p.SplitWeekend = p.By != "daytype"
+	default:
+		return nil, fmt.Errorf("splitWeekend must be true or false, got %s", q.Get("splitWeekend"))
+	}
+	var err error
+	if p.From, p.To, err = parseDateRange(r); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// parseDateRange reads the optional `from` & `to` dates as YYYY-MM-DD, to is
+// exclusive
+func parseDateRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse("2006-01-02", s); err != nil {
+			return from, to, fmt.Errorf("error parsing from %s as YYYY-MM-DD: %w", s, err)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse("2006-01-02", s); err != nil {
+			return from, to, fmt.Errorf("error parsing to %s as YYYY-MM-DD: %w", s, err)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// dateRangeWhere limits dd.the_date to the range, empty when there is no range
+func dateRangeWhere(from, to time.Time) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if !from.IsZero() {
+		where = append(where, "dd.the_date >= ?")
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where = append(where, "dd.the_date < ?")
+		args = append(args, to)
+	}
+	return strings.Join(where, " and "), args
+}
+
+// CalendarBucket is the facts of one calendar unit with the dimension labels
+type CalendarBucket struct {
+	Label string
+	// grouped date_dimension columns
+	Dimensions map[string]interface{}
+	// weekday or weekend when split
+	DayType string
+	// first & last date with facts
+	Start time.Time
+	End   time.Time
+	// number of dates with facts
+	Days   int
+	Values map[string]float64
+}
+
+// MarshalJSON flattens the bucket the same as Bucket
+func (cb CalendarBucket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(cb.flat())
+}
+
+func (cb CalendarBucket) flat() map[string]interface{} {
+	m := make(map[string]interface{}, len(cb.Values)+len(cb.Dimensions)+5)
+	for k, v := range cb.Values {
+		m[k] = v
+	}
+	for k, v := range cb.Dimensions {
+		m[k] = v
+	}
+	m["label"] = cb.Label
+	if cb.DayType != "" {
+		m["day_type"] = cb.DayType
+	}
+	m["start"] = cb.Start.Format("2006-01-02")
+	m["end"] = cb.End.Format("2006-01-02")
+	m["days"] = cb.Days
+	return m
+}
+
+// calendarSQL builds the rollup query of a topic joined to the date dimension,
+// only columns from calendarUnits are formatted into it
+func calendarSQL(spec *TopicSpec, p *CalendarParams) string {
+	cols := []string{p.Unit.Label + " label"}
+	var group []string
+	for _, c := range p.Unit.Columns {
+		cols = append(cols, "dd."+c.Name)
+		group = append(group, "dd."+c.Name)
+	}
+	if p.SplitWeekend || p.By == "daytype" {
+		cols = append(cols, "case when dd.weekend then 'weekend' else 'weekday' end day_type")
+		group = append(group, "dd.weekend")
+	} else {
+		cols = append(cols, "'' day_type")
+	}
+	cols = append(cols, "min(dd.the_date) start_date", "max(dd.the_date) end_date", "count(distinct dd.date_key) days")
+	for _, f := range spec.Fields {
+		cols = append(cols, fmt.Sprintf("%s %s", f.SQL, f.Name))
+	}
+
+	q := fmt.Sprintf(`
+select %s
+from %s t0
+join mart.date_dimension dd
+	on t0.date_key = dd.date_key`, strings.Join(cols, ", "), spec.Table)
+	if where, _ := dateRangeWhere(p.From, p.To); where != "" {
+		q += "\nwhere " + where
+	}
+	return q + fmt.Sprintf("\ngroup by %s\norder by %s", strings.Join(group, ", "), strings.Join(group, ", "))
+}
+
+// queryCalendar runs the calendar rollup of a topic
+func (api *API) queryCalendar(spec *TopicSpec, p *CalendarParams) ([]CalendarBucket, error) {
+	_, args := dateRangeWhere(p.From, p.To)
+	rows, err := api.dm.Raw(calendarSQL(spec, p), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []CalendarBucket{}
+	nums := make([]int64, len(p.Unit.Columns))
+	texts := make([]string, len(p.Unit.Columns))
+	vals := make([]float64, len(spec.Fields))
+	for rows.Next() {
+		var cb CalendarBucket
+		dest := []interface{}{&cb.Label}
+		for i, c := range p.Unit.Columns {
+			if c.Text {
+				dest = append(dest, &texts[i])
+			} else {
+				dest = append(dest, &nums[i])
+			}
+		}
+		dest = append(dest, &cb.DayType, &cb.Start, &cb.End, &cb.Days)
+		for i := range vals {
+			dest = append(dest, &vals[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		cb.Dimensions = make(map[string]interface{}, len(p.Unit.Columns))
+		for i, c := range p.Unit.Columns {
+			if c.Text {
+				cb.Dimensions[c.Name] = strings.TrimSpace(texts[i])
+			} else {
+				cb.Dimensions[c.Name] = nums[i]
+			}
+		}
+		cb.Values = make(map[string]float64, len(spec.Fields))
+		for i, f := range spec.Fields {
+			cb.Values[f.Name] = vals[i]
+		}
+		res = append(res, cb)
+	}
+	return res, rows.Err()
+}
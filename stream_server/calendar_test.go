@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCalendarParams(t *testing.T) {
+	p, err := ParseCalendarParams(httptest.NewRequest("GET", "/?by=quarter&splitWeekend=true&from=2020-01-01&to=2021-01-01", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Unit != calendarUnits["quarter"] || !p.SplitWeekend || p.From.Year() != 2020 || p.To.Year() != 2021 {
+		t.Errorf("incorrect params %+v", p)
+	}
+
+	for _, q := range []string{"", "by=fortnight", "by=week&splitWeekend=yes", "by=week&from=2020-13-01", "by=week&from=2020-02-01&to=2020-01-01"} {
+		if _, err = ParseCalendarParams(httptest.NewRequest("GET", "/?"+q, nil)); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+}
+
+func TestCalendarSQL(t *testing.T) {
+	p := &CalendarParams{By: "month", Unit: calendarUnits["month"], SplitWeekend: true, From: time.Now()}
+	q := calendarSQL(topicSpecs["order_count"], p)
+	for _, s := range []string{"join mart.date_dimension dd", "dd.month_name", "sum(revenue) revenue", "group by dd.the_year, dd.month_number, dd.month_name, dd.weekend", "where dd.the_date >= ?"} {
+		if !strings.Contains(q, s) {
+			t.Errorf("expected query to contain %s:\n%s", s, q)
+		}
+	}
+	if strings.Contains(q, "the_date < ?") {
+		t.Error("query should not have an end date")
+	}
+
+	q = calendarSQL(topicSpecs["customer_count"], &CalendarParams{By: "daytype", Unit: calendarUnits["daytype"]})
+	if !strings.Contains(q, "group by dd.weekend") || strings.Contains(q, "where") {
+		t.Errorf("incorrect weekday against weekend query:\n%s", q)
+	}
+}
+
+func TestCalendarBucketJSON(t *testing.T) {
+	cb := CalendarBucket{
+		Label:      "Q4 2020",
+		Dimensions: map[string]interface{}{"the_year": int64(2020), "quarter_name": "Q4"},
+		DayType:    "weekend",
+		Start:      time.Date(2020, 10, 3, 0, 0, 0, 0, time.UTC),
+		End:        time.Date(2020, 12, 27, 0, 0, 0, 0, time.UTC),
+		Days:       26,
+		Values:     map[string]float64{"revenue": 10},
+	}
+	b, err := json.Marshal(cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	json.Unmarshal(b, &m)
+	if m["label"] != "Q4 2020" || m["quarter_name"] != "Q4" || m["start"] != "2020-10-03" || m["revenue"] != 10.0 || m["day_type"] != "weekend" {
+		t.Errorf("incorrect JSON %s", b)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves the TLS certificate from the configured files & swaps
+// it out when either file changes, so certs can be rotated without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	// modification times of the files the current cert was loaded from
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the cert & key, fails if they can not be read
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS listener requires certFile and keyFile")
+	}
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the cert & key if either file changed since the last load,
+// returns true if the certificate was replaced
+func (cr *CertReloader) Reload() (bool, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && certInfo.ModTime().Equal(cr.certMod) && keyInfo.ModTime().Equal(cr.keyMod)
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	// keep serving the old cert if the new pair is not valid, this can happen
+	// when the files are read between the cert & key being written
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	cr.mu.Unlock()
+	return true, nil
+}
+
+// Watch checks the files for changes every interval until ctx is cancelled
+func (cr *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := cr.Reload()
+			if err != nil {
+				logger.Print("error reloading TLS certificate: " + err.Error())
+				continue
+			}
+			if reloaded {
+				logger.Print("reloaded TLS certificate from " + cr.certFile)
+			}
+		}
+	}
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// default & largest number of periods after the signup period in a matrix
+const (
+	defaultCohortPeriods = 12
+	maxCohortPeriods     = 104
+)
+
+// CohortConfig controls the retention cohorts kept in memory
+type CohortConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+}
+
+// CohortPeriod is a week or month of the date dimension
+type CohortPeriod struct {
+	Label string
+	Start time.Time
+}
+
+// CohortCalendar numbers the weeks or months of mart.date_dimension so period
+// W+1 is the next period in the dimension
+type CohortCalendar struct {
+	periods []CohortPeriod
+	// period index of each date, keyed YYYY-MM-DD
+	byDate map[string]int
+}
+
+// DimensionDate is a row of mart.date_dimension used to build the calendars
+type DimensionDate struct {
+	Date        time.Time
+	Year        int
+	WeekOfYear  int
+	MonthNumber int
+	MonthName   string
+}
+
+// NewCohortCalendars builds the week & month calendars from dimension rows
+// sorted by date
+func NewCohortCalendars(dates []DimensionDate) map[string]*CohortCalendar {
+	cals := map[string]*CohortCalendar{
+		"week":  {byDate: make(map[string]int)},
+		"month": {byDate: make(map[string]int)},
+	}
+	last := map[string]string{}
+	for _, d := range dates {
+		labels := map[string]string{
+			"week":  fmt.Sprintf("W%02d %d", d.WeekOfYear, d.Year),
+			"month": fmt.Sprintf("%s %d", d.MonthName, d.Year),
+		}
+		for unit, label := range labels {
+			cal := cals[unit]
+			if label != last[unit] {
+				cal.periods = append(cal.periods, CohortPeriod{Label: label, Start: d.Date})
+				last[unit] = label
+			}
+			cal.byDate[d.Date.Format("2006-01-02")] = len(cal.periods) - 1
+		}
+	}
+	return cals
+}
+
+// Index is the period of an event time on the local wall clock the same as
+// BucketKey
+func (cc *CohortCalendar) Index(t time.Time) (int, bool) {
+	i, ok := cc.byDate[BucketKey(t).Format("2006-01-02")]
+	return i, ok
+}
+
+// CohortRow is the retention of the customers that signed up in one period
+type CohortRow struct {
+	Cohort string    `json:"cohort"`
+	Start  time.Time `json:"start"`
+	Size   int       `json:"size"`
+	// customers of the cohort that ordered in the signup period & each period
+	// after it
+	Retained []int     `json:"retained"`
+	Rates    []float64 `json:"rates"`
+}
+
+// CohortMatrix is the retention matrix of a unit
+type CohortMatrix struct {
+	Unit    string      `json:"unit"`
+	Periods int         `json:"periods"`
+	Cohorts []CohortRow `json:"cohorts"`
+}
+
+// CSV writes the retained counts with a row per cohort
+func (cm *CohortMatrix) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	header := []string{"cohort", "start", "size"}
+	for i := 0; i <= cm.Periods; i++ {
+		header = append(header, strconv.Itoa(i))
+	}
+	w.Write(header)
+	for _, row := range cm.Cohorts {
+		rec := []string{row.Cohort, row.Start.Format("2006-01-02"), strconv.Itoa(row.Size)}
+		for _, n := range row.Retained {
+			rec = append(rec, strconv.Itoa(n))
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+type cohortUnit struct {
+	cal *CohortCalendar
+	// signup period of each customer
+	cohort map[string]int
+	size   map[int]int
+	// customers of a cohort that ordered, by periods since signup
+	active map[int]map[int]map[string]bool
+	// built on request & dropped when a customer or order is added
+	matrix *CohortMatrix
+}
+
+// CohortTracker keeps the signup period of every customer & the periods they
+// ordered in so the retention matrices are updated as orders arrive
+type CohortTracker struct {
+	mu    sync.Mutex
+	units map[string]*cohortUnit
+}
+
+func NewCohortTracker(cals map[string]*CohortCalendar) *CohortTracker {
+	ct := &CohortTracker{units: make(map[string]*cohortUnit)}
+	for unit, cal := range cals {
+		ct.units[unit] = &cohortUnit{
+			cal:    cal,
+			cohort: make(map[string]int),
+			size:   make(map[int]int),
+			active: make(map[int]map[int]map[string]bool),
+		}
+	}
+	return ct
+}
+
+// AddCustomer records the signup of a customer
+func (ct *CohortTracker) AddCustomer(customerID string, created time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for _, u := range ct.units {
+		i, ok := u.cal.Index(created)
+		if !ok {
+			continue
+		}
+		if _, exists := u.cohort[customerID]; exists {
+			continue
+		}
+		u.cohort[customerID] = i
+		u.size[i]++
+		u.matrix = nil
+	}
+}
+
+// AddOrder records an order, orders of unknown customers or from before the
+// signup are skipped
+func (ct *CohortTracker) AddOrder(customerID string, created time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for _, u := range ct.units {
+		c, ok := u.cohort[customerID]
+		if !ok {
+			continue
+		}
+		i, ok := u.cal.Index(created)
+		if !ok || i < c {
+			continue
+		}
+		offsets, ok := u.active[c]
+		if !ok {
+			offsets = make(map[int]map[string]bool)
+			u.active[c] = offsets
+		}
+		customers, ok := offsets[i-c]
+		if !ok {
+			customers = make(map[string]bool)
+			offsets[i-c] = customers
+		}
+		if !customers[customerID] {
+			customers[customerID] = true
+			u.matrix = nil
+		}
+	}
+}
+
+// HandleMessage adds signups & orders from the customer & order events
+func (ct *CohortTracker) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" && msg.Topic != "customer_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("cohorts could not parse message: " + err.Error())
+		return
+	}
+	for i := range events {
+		customerID, _ := orderSketchValues(&events[i])
+		if customerID == "" {
+			continue
+		}
+		if msg.Topic == "customer_count" {
+			ct.AddCustomer(customerID, events[i].TimeStamp)
+		} else {
+			ct.AddOrder(customerID, events[i].TimeStamp)
+		}
+	}
+}
+
+// Matrix returns the retention matrix of a unit with the given number of
+// periods after signup, the full matrix is cached until the next change
+func (ct *CohortTracker) Matrix(unit string, periods int) (*CohortMatrix, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	u, ok := ct.units[unit]
+	if !ok {
+		return nil, fmt.Errorf("unit must be week or month, got %s", unit)
+	}
+	if u.matrix == nil {
+		u.matrix = u.build()
+	}
+
+	res := &CohortMatrix{Unit: unit, Periods: periods, Cohorts: make([]CohortRow, len(u.matrix.Cohorts))}
+	for i, row := range u.matrix.Cohorts {
+		n := periods + 1
+		if n > len(row.Retained) {
+			n = len(row.Retained)
+		}
+		row.Retained = row.Retained[:n]
+		row.Rates = row.Rates[:n]
+		res.Cohorts[i] = row
+	}
+	return res, nil
+}
+
+// build makes the full matrix up to the last period of the dimension
+func (u *cohortUnit) build() *CohortMatrix {
+	cohorts := make([]int, 0, len(u.size))
+	for c := range u.size {
+		cohorts = append(cohorts, c)
+	}
+	sort.Ints(cohorts)
+
+	m := &CohortMatrix{Cohorts: make([]CohortRow, len(cohorts))}
+	for i, c := range cohorts {
+		row := CohortRow{
+			Cohort: u.cal.periods[c].Label,
+			Start:  u.cal.periods[c].Start,
+			Size:   u.size[c],
+		}
+		// periods that have started
+		for off := 0; c+off < len(u.cal.periods) && !u.cal.periods[c+off].Start.After(BucketKey(time.Now())); off++ {
+			n := len(u.active[c][off])
+			row.Retained = append(row.Retained, n)
+			row.Rates = append(row.Rates, float64(n)/float64(row.Size))
+		}
+		m.Cohorts[i] = row
+	}
+	return m
+}
+
+// CohortParams are the query parameters of the cohort endpoint
+type CohortParams struct {
+	Unit    string
+	Periods int
+	// json or csv
+	Format string
+}
+
+// ParseCohortParams reads `unit`, `periods` & `format` from the request, CSV
+// is also picked by an Accept of text/csv & the binary formats by writeJSON
+func ParseCohortParams(r *http.Request) (*CohortParams, error) {
+	q := r.URL.Query()
+	p := CohortParams{Unit: q.Get("unit"), Periods: defaultCohortPeriods, Format: q.Get("format")}
+	if p.Unit == "" {
+		p.Unit = "week"
+	}
+	if s := q.Get("periods"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > maxCohortPeriods {
+			return nil, fmt.Errorf("periods must be an integer between 0 and %d", maxCohortPeriods)
+		}
+		p.Periods = n
+	}
+	switch p.Format {
+	case "":
+		p.Format = "json"
+		if r.Header.Get("Accept") == "text/csv" {
+			p.Format = "csv"
+		}
+	case "json", "csv", formatMsgpack, formatCBOR:
+	default:
+		return nil, fmt.Errorf("format must be json, csv, msgpack or cbor, got %s", p.Format)
+	}
+	return &p, nil
+}
+
+// loadCohorts builds the calendars from the date dimension & loads every
+// customer & order
+func (api *API) loadCohorts() (*CohortTracker, error) {
+	rows, err := api.dm.Raw(`select the_date, the_year, week_of_year, month_number, trim(month_name) from mart.date_dimension order by the_date`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	var dates []DimensionDate
+	for rows.Next() {
+		var d DimensionDate
+		if err = rows.Scan(&d.Date, &d.Year, &d.WeekOfYear, &d.MonthNumber, &d.MonthName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		dates = append(dates, d)
+	}
+	rows.Close()
+	ct := NewCohortTracker(NewCohortCalendars(dates))
+
+	for _, q := range []struct {
+		sql string
+		add func(string, time.Time)
+	}{
+		{`select customer_id, created_at from public.customer where deleted_at is null`, ct.AddCustomer},
+		{`select customer_id, created_at from public."order" where deleted_at is null`, ct.AddOrder},
+	} {
+		rows, err = api.dm.Raw(q.sql).Rows()
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var t time.Time
+			if err = rows.Scan(&id, &t); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			q.add(strconv.FormatInt(id, 10), t)
+		}
+		rows.Close()
+	}
+	return ct, nil
+}
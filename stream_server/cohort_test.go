@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// two weeks of January 2020 & the first of February
+func testCohortCalendars() map[string]*CohortCalendar {
+	var dates []DimensionDate
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 42; i++ {
+		d := start.AddDate(0, 0, i)
+		dates = append(dates, DimensionDate{
+			Date:        d,
+			Year:        d.Year(),
+			WeekOfYear:  (d.YearDay() - 1) / 7,
+			MonthNumber: int(d.Month()),
+			MonthName:   d.Month().String(),
+		})
+	}
+	return NewCohortCalendars(dates)
+}
+
+func cohortTime(day int) time.Time {
+	return time.Date(2020, 1, day, 12, 0, 0, 0, time.Local)
+}
+
+func TestCohortTracker(t *testing.T) {
+	ct := NewCohortTracker(testCohortCalendars())
+	ct.AddCustomer("1", cohortTime(1))
+	ct.AddCustomer("2", cohortTime(2))
+	ct.AddCustomer("3", cohortTime(9))
+	// ordered in week 0 twice, week 2 & before signing up
+	ct.AddOrder("1", cohortTime(2))
+	ct.AddOrder("1", cohortTime(3))
+	ct.AddOrder("1", cohortTime(16))
+	ct.AddOrder("3", cohortTime(2))
+	// unknown customer
+	ct.AddOrder("4", cohortTime(2))
+
+	m, err := ct.Matrix("week", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Cohorts) != 2 {
+		t.Fatalf("expected 2 cohorts, got %d", len(m.Cohorts))
+	}
+	w0 := m.Cohorts[0]
+	if w0.Cohort != "W00 2020" || w0.Size != 2 {
+		t.Errorf("unexpected first cohort %+v", w0)
+	}
+	if len(w0.Retained) != 3 || w0.Retained[0] != 1 || w0.Retained[1] != 0 || w0.Retained[2] != 1 {
+		t.Errorf("unexpected retention %v", w0.Retained)
+	}
+	if w0.Rates[0] != 0.5 {
+		t.Errorf("expected rate 0.5, got %v", w0.Rates[0])
+	}
+	if m.Cohorts[1].Retained[0] != 0 {
+		t.Errorf("order before signup was counted: %v", m.Cohorts[1].Retained)
+	}
+
+	// the cached matrix is dropped on new orders
+	ct.AddOrder("3", cohortTime(10))
+	m, _ = ct.Matrix("week", 2)
+	if m.Cohorts[1].Retained[0] != 1 {
+		t.Errorf("expected new order in the matrix, got %v", m.Cohorts[1].Retained)
+	}
+
+	m, _ = ct.Matrix("month", 1)
+	if len(m.Cohorts) != 1 || m.Cohorts[0].Cohort != "January 2020" || m.Cohorts[0].Retained[0] != 2 {
+		t.Errorf("unexpected month matrix %+v", m.Cohorts)
+	}
+	if _, err = ct.Matrix("day", 1); err == nil {
+		t.Error("expected error for unknown unit")
+	}
+}
+
+func TestCohortTrackerHandleMessage(t *testing.T) {
+	ct := NewCohortTracker(testCohortCalendars())
+	b, _ := json.Marshal([]map[string]interface{}{{
+		"time_stamp":  cohortTime(1).Format(time.RFC3339Nano),
+		"customer_id": 7,
+		"n":           1,
+	}})
+	ct.HandleMessage(&sarama.ConsumerMessage{Topic: "customer_count", Value: b})
+	ct.HandleMessage(customerOrderMessage(cohortTime(8), 7, 10))
+
+	m, _ := ct.Matrix("week", 1)
+	if len(m.Cohorts) != 1 || m.Cohorts[0].Size != 1 || m.Cohorts[0].Retained[1] != 1 {
+		t.Errorf("unexpected matrix %+v", m.Cohorts)
+	}
+}
+
+func TestCohortMatrixCSV(t *testing.T) {
+	m := &CohortMatrix{Unit: "week", Periods: 1, Cohorts: []CohortRow{
+		{Cohort: "W00 2020", Start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Size: 4, Retained: []int{2, 1}},
+	}}
+	b, err := m.CSV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "cohort,start,size,0,1\nW00 2020,2020-01-01,4,2,1\n"
+	if string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+}
+
+func TestParseCohortParams(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v0/history/cohorts", nil)
+	p, err := ParseCohortParams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Unit != "week" || p.Periods != defaultCohortPeriods || p.Format != "json" {
+		t.Errorf("unexpected defaults %+v", p)
+	}
+
+	r = httptest.NewRequest("GET", "/v0/history/cohorts?unit=month&periods=3", nil)
+	r.Header.Set("Accept", "text/csv")
+	if p, _ = ParseCohortParams(r); p.Format != "csv" || p.Periods != 3 {
+		t.Errorf("unexpected params %+v", p)
+	}
+
+	for _, q := range []string{"periods=-1", "periods=x", "format=xml"} {
+		r = httptest.NewRequest("GET", "/v0/history/cohorts?"+q, nil)
+		if _, err = ParseCohortParams(r); err == nil || !strings.Contains(err.Error(), "must be") {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// comparePeriods are the supported `compare` offsets in days
+var comparePeriods = map[string]int{
+	"1d":  1,
+	"7d":  7,
+	"28d": 28,
+}
+
+// ComparePeriod parses `compare` from the request, 0 when not asked for
+func ComparePeriod(r *http.Request) (int, error) {
+	c := r.URL.Query().Get("compare")
+	if c == "" {
+		return 0, nil
+	}
+	days, ok := comparePeriods[c]
+	if !ok {
+		return 0, fmt.Errorf("compare must be 1d, 7d or 28d, got %s", c)
+	}
+	return days, nil
+}
+
+// CompareSeries keeps the buckets of a topic long enough to compare each one
+// with the bucket the same wall clock time a number of days before, shifting
+// by days keeps the comparison on the same time of day over DST changes as
+// bucket keys are wall clock times
+type CompareSeries struct {
+	spec        *TopicSpec
+	groupMinute int
+	days        int
+	buckets     map[time.Time]*Bucket
+}
+
+func NewCompareSeries(spec *TopicSpec, groupMinute, days int) *CompareSeries {
+	return &CompareSeries{
+		spec:        spec,
+		groupMinute: groupMinute,
+		days:        days,
+		buckets:     make(map[time.Time]*Bucket),
+	}
+}
+
+// Load adds history buckets to the series
+func (cs *CompareSeries) Load(buckets []Bucket) {
+	for i := range buckets {
+		b := buckets[i].Copy()
+		cs.buckets[b.TimeStamp] = &b
+	}
+}
+
+// Compare returns the bucket at ts with `{field}_compare` from the baseline,
+// `{field}_delta` & `{field}_pct`, the percentage is left out when the
+// baseline is zero
+func (cs *CompareSeries) Compare(ts time.Time) Bucket {
+	res := NewBucket(ts)
+	cur := cs.buckets[ts]
+	base := cs.buckets[ts.AddDate(0, 0, -cs.days)]
+	for _, f := range cs.spec.FieldNames() {
+		var v, bv float64
+		if cur != nil {
+			v = cur.Values[f]
+		}
+		if base != nil {
+			bv = base.Values[f]
+		}
+		res.Values[f] = v
+		res.Values[f+"_compare"] = bv
+		res.Values[f+"_delta"] = v - bv
+		if bv != 0 {
+			res.Values[f+"_pct"] = 100 * (v - bv) / bv
+		}
+	}
+	return *res
+}
+
+// History compares every bucket from `from` to `until` which has facts in
+// either period, a zero from starts at the first bucket
+func (cs *CompareSeries) History(from, until time.Time) []Bucket {
+	seen := make(map[time.Time]bool)
+	var times []time.Time
+	for ts := range cs.buckets {
+		for _, t := range []time.Time{ts, ts.AddDate(0, 0, cs.days)} {
+			if seen[t] || t.Before(from) || t.After(until) {
+				continue
+			}
+			seen[t] = true
+			times = append(times, t)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	res := make([]Bucket, len(times))
+	for i, ts := range times {
+		res[i] = cs.Compare(ts)
+	}
+	return res
+}
+
+// HandleMessage sums the events of a message into the series & returns the
+// compared buckets that changed
+func (cs *CompareSeries) HandleMessage(msg *sarama.ConsumerMessage) []Bucket {
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("compare could not parse message: " + err.Error())
+		return nil
+	}
+	var changed []time.Time
+	for i := range events {
+		ts := BucketTime(BucketKey(events[i].TimeStamp), cs.groupMinute)
+		b, ok := cs.buckets[ts]
+		if !ok {
+			b = NewBucket(ts)
+			cs.buckets[ts] = b
+		}
+		b.Add(&events[i], cs.spec.FieldNames())
+		if len(changed) == 0 || !changed[len(changed)-1].Equal(ts) {
+			changed = append(changed, ts)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	cs.evict(changed[len(changed)-1])
+
+	res := make([]Bucket, len(changed))
+	for i, ts := range changed {
+		res[i] = cs.Compare(ts)
+	}
+	return res
+}
+
+// evict drops buckets which can no longer be a baseline of the newest bucket
+func (cs *CompareSeries) evict(newest time.Time) {
+	cutoff := newest.AddDate(0, 0, -cs.days).Add(-time.Duration(cs.groupMinute) * time.Minute)
+	for ts := range cs.buckets {
+		if ts.Before(cutoff) {
+			delete(cs.buckets, ts)
+		}
+	}
+}
+
+// compareView streams the buckets of a topic next to a shifted baseline, live
+// events send the running total of their bucket with its baseline
+type compareView struct {
+	spec   *TopicSpec
+	days   int
+	params HistoryParams
+	series *CompareSeries
+}
+
+func (v *compareView) History(api *API, r *http.Request) (interface{}, error) {
+	p := v.params
+	var from time.Time
+	if !p.From.IsZero() {
+		from = BucketTime(BucketKey(p.From), p.GroupMinute)
+		p.From = p.From.AddDate(0, 0, -v.days)
+	}
+	history, err := api.bucketHistory(r, v.spec, &p)
+	if err != nil {
+		return nil, err
+	}
+	v.series.Load(history)
+	until := BucketTime(BucketKey(time.Now()), p.GroupMinute)
+	res := v.series.History(from, until)
+	v.series.evict(until)
+	return res, nil
+}
+
+func (v *compareView) HandleMessage(msg *sarama.ConsumerMessage) interface{} {
+	return bucketsOrNil(v.series.HandleMessage(msg))
+}
+
+func (v *compareView) Tick(now time.Time) interface{} {
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestComparePeriod(t *testing.T) {
+	if days, err := ComparePeriod(httptest.NewRequest("GET", "/?compare=7d", nil)); err != nil || days != 7 {
+		t.Errorf("expected 7 days, got %d %v", days, err)
+	}
+	if days, err := ComparePeriod(httptest.NewRequest("GET", "/", nil)); err != nil || days != 0 {
+		t.Errorf("expected no comparison, got %d %v", days, err)
+	}
+	if _, err := ComparePeriod(httptest.NewRequest("GET", "/?compare=2d", nil)); err == nil {
+		t.Error("expected error for unsupported period")
+	}
+}
+
+func TestCompareSeries(t *testing.T) {
+	cs := NewCompareSeries(topicSpecs["order_count"], 5, 1)
+	today := time.Date(2020, 6, 2, 10, 0, 0, 0, time.UTC)
+	yesterday := today.AddDate(0, 0, -1)
+	bucket := func(ts time.Time, revenue float64) Bucket {
+		b := NewBucket(ts)
+		b.Values["revenue"] = revenue
+		return *b
+	}
+	cs.Load([]Bucket{
+		bucket(yesterday, 100),
+		bucket(yesterday.Add(5*time.Minute), 50),
+		bucket(yesterday.Add(10*time.Minute), 0),
+		bucket(today, 150),
+	})
+
+	res := cs.History(today, today.Add(10*time.Minute))
+	if len(res) != 3 {
+		t.Fatalf("expected 3 buckets, got %v", res)
+	}
+	first := res[0].Values
+	if first["revenue"] != 150 || first["revenue_compare"] != 100 || first["revenue_delta"] != 50 || first["revenue_pct"] != 50 {
+		t.Errorf("incorrect first bucket %v", first)
+	}
+	// a bucket with only a baseline
+	if second := res[1].Values; second["revenue"] != 0 || second["revenue_delta"] != -50 || second["revenue_pct"] != -100 {
+		t.Errorf("incorrect second bucket %v", second)
+	}
+	if _, ok := res[2].Values["revenue_pct"]; ok {
+		t.Error("percentage should be left out for a zero baseline")
+	}
+
+	// live events update the running total of their bucket
+	ts := time.Date(2020, 6, 2, 10, 6, 0, 0, time.Local)
+	res = cs.HandleMessage(orderMessage(ts, 20))
+	if len(res) != 1 {
+		t.Fatalf("expected 1 changed bucket, got %v", res)
+	}
+	if !res[0].TimeStamp.Equal(today.Add(5*time.Minute)) || res[0].Values["revenue"] != 20 || res[0].Values["revenue_compare"] != 50 {
+		t.Errorf("incorrect live bucket %v", res[0])
+	}
+	res = cs.HandleMessage(orderMessage(ts, 40))
+	if res[0].Values["revenue"] != 60 || res[0].Values["revenue_pct"] != 20 {
+		t.Errorf("incorrect running total %v", res[0])
+	}
+
+	// baselines older than the bucket before the newest are dropped
+	cs.HandleMessage(orderMessage(ts.Add(5*time.Minute), 1))
+	if _, ok := cs.buckets[yesterday]; ok {
+		t.Error("expected old baseline to be evicted")
+	}
+}
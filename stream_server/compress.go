@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// supported content encodings in order of preference
+var supportedEncodings = []string{"gzip", "deflate"}
+
+// CompressRequested checks if the client opted in to a compressed stream with
+// the `compress` query parameter, EventSource cannot set request headers so
+// this needs to be part of the URL
+func CompressRequested(r *http.Request) bool {
+	c, ok := r.URL.Query()["compress"]
+	if !ok {
+		return false
+	}
+	// `?compress` without a value is treated as opting in
+	if c[0] == "" {
+		return true
+	}
+	b, err := strconv.ParseBool(c[0])
+	if err != nil {
+		return false
+	}
+	return b
+}
+
+// NegotiateEncoding picks the preferred supported encoding from the request
+// Accept-Encoding header, returns empty string if none are acceptable
+func NegotiateEncoding(r *http.Request) string {
+	accepted := make(map[string]float64)
+	for _, h := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(h, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name := part
+			q := 1.0
+			if i := strings.Index(part, ";"); i >= 0 {
+				name = strings.TrimSpace(part[:i])
+				param := strings.TrimSpace(part[i+1:])
+				if strings.HasPrefix(param, "q=") {
+					v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					if err != nil {
+						continue
+					}
+					q = v
+				}
+			}
+			accepted[strings.ToLower(name)] = q
+		}
+	}
+
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, enc := range supportedEncodings {
+		q, ok := accepted[enc]
+		if !ok {
+			// wildcard covers encodings not explicitly listed
+			if q, ok = accepted["*"]; !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// compressor is satisfied by both gzip.Writer & flate.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressWriter wraps a http.ResponseWriter so that everything written is
+// compressed, Flush pushes pending compressed data through to the client so
+// each event is delivered as soon as it is written
+type CompressWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+	c       compressor
+}
+
+// NewCompressWriter sets the encoding headers & returns the wrapped writer,
+// must be called before anything is written to the response
+func NewCompressWriter(w http.ResponseWriter, encoding string) (*CompressWriter, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response writer does not support flushing")
+	}
+
+	cw := &CompressWriter{ResponseWriter: w, flusher: f}
+	switch encoding {
+	case "gzip":
+		cw.c = gzip.NewWriter(w)
+	case "deflate":
+		fw, err := flate.NewWriter(w, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		cw.c = fw
+	default:
+		return nil, errors.New("unsupported encoding " + encoding)
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	// length is unknown once compressed
+	w.Header().Del("Content-Length")
+	return cw, nil
+}
+
+func (cw *CompressWriter) Write(b []byte) (int, error) {
+	return cw.c.Write(b)
+}
+
+// Flush writes any buffered compressed data then flushes the underlying
+// connection, without the first step the event would sit in the compressor
+func (cw *CompressWriter) Flush() {
+	if err := cw.c.Flush(); err != nil {
+		logger.Print("error flushing compressed stream: " + err.Error())
+		return
+	}
+	cw.flusher.Flush()
+}
+
+// Close writes the compression footer, does not close the underlying writer
+func (cw *CompressWriter) Close() error {
+	return cw.c.Close()
+}
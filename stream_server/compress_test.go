@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":                          "",
+		"gzip":                      "gzip",
+		"deflate":                   "deflate",
+		"gzip, deflate, br":         "gzip",
+		"gzip;q=0.5, deflate;q=0.8": "deflate",
+		"gzip;q=0":                  "",
+		"*":                         "gzip",
+		"br":                        "",
+		"identity":                  "",
+	}
+
+	for header, e := range cases {
+		r := httptest.NewRequest("GET", "/v0/stream/subscribe/customer_count", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		if o := NegotiateEncoding(r); o != e {
+			t.Errorf("Accept-Encoding %q: expected %q got %q", header, e, o)
+		}
+	}
+}
+
+func TestCompressRequested(t *testing.T) {
+	cases := map[string]bool{
+		"":                 false,
+		"?compress":        true,
+		"?compress=true":   true,
+		"?compress=1":      true,
+		"?compress=false":  false,
+		"?compress=banana": false,
+	}
+	for qp, e := range cases {
+		r := httptest.NewRequest("GET", "/v0/stream/subscribe/customer_count"+qp, nil)
+		if o := CompressRequested(r); o != e {
+			t.Errorf("query %q: expected %v got %v", qp, e, o)
+		}
+	}
+}
+
+// each flushed event should be readable by the client before the stream ends
+func TestCompressWriterFlush(t *testing.T) {
+	for _, enc := range supportedEncodings {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+
+		go func() {
+			w := &pipeResponseWriter{header: http.Header{}, w: pw}
+			cw, err := NewCompressWriter(w, enc)
+			if err != nil {
+				done <- err
+				return
+			}
+			for i := 0; i < 3; i++ {
+				fmt.Fprintf(cw, "data: %d\n\n", i)
+				cw.Flush()
+			}
+			done <- nil
+			// keep stream open until the reader is done
+		}()
+
+		var rd io.Reader
+		var err error
+		switch enc {
+		case "gzip":
+			rd, err = gzip.NewReader(pr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case "deflate":
+			rd = flate.NewReader(pr)
+		}
+		br := bufio.NewReader(rd)
+		for i := 0; i < 3; i++ {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("%s: error reading event %d: %v", enc, i, err)
+			}
+			if e := fmt.Sprintf("data: %d\n", i); line != e {
+				t.Errorf("%s: expected %q got %q", enc, e, line)
+			}
+			// blank line separating events
+			if _, err = br.ReadString('\n'); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = <-done; err != nil {
+			t.Error(err)
+		}
+		pw.Close()
+	}
+}
+
+func TestCompressWriterHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	cw, err := NewCompressWriter(w, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(cw, "data: []\n\n")
+	cw.Flush()
+	cw.Close()
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Error("missing Content-Encoding header")
+	}
+	if !w.Flushed {
+		t.Error("underlying writer was not flushed")
+	}
+	if _, err = NewCompressWriter(w, "br"); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
+
+// pipeResponseWriter lets the test read the body while it is still being written
+type pipeResponseWriter struct {
+	header http.Header
+	w      io.Writer
+}
+
+func (p *pipeResponseWriter) Header() http.Header         { return p.header }
+func (p *pipeResponseWriter) Write(b []byte) (int, error) { return p.w.Write(b) }
+func (p *pipeResponseWriter) WriteHeader(int)             {}
+func (p *pipeResponseWriter) Flush()                      {}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Config is the stream server configuration read from config.yaml
+type Config struct {
+	// API version used for all endpoints, expects integer as string
+	Version  string         `yaml:"version"`
+	Server   ServerConfig   `yaml:"server"`
+	Cache    CacheConfig    `yaml:"cache"`
+	Alerts   AlertsConfig   `yaml:"alerts"`
+	Anomaly  AnomalyConfig  `yaml:"anomaly"`
+	Forecast ForecastConfig `yaml:"forecast"`
+	// virtual topics computed from other topics
+	Derived []DerivedConfig `yaml:"derived"`
+	// product rankings published as topics
+	Leaderboards []LeaderboardConfig `yaml:"leaderboards"`
+	Sketches     SketchConfig        `yaml:"sketches"`
+	KPI          KPIConfig           `yaml:"kpi"`
+	Geo          GeoConfig           `yaml:"geo"`
+	Cohorts      CohortConfig        `yaml:"cohorts"`
+	Profiles     ProfileConfig       `yaml:"profiles"`
+	Goals        GoalConfig          `yaml:"goals"`
+	// limits of the semantic layer queries
+	Query QueryConfig `yaml:"query"`
+	Auth  AuthConfig  `yaml:"auth"`
+	// log kept for durable subscriptions
+	Durable DurableConfig `yaml:"durable"`
+	// delivery of the webhooks registered through the API
+	Webhooks WebhookRegistryConfig `yaml:"webhooks"`
+}
+
+type ServerConfig struct {
+	// each listener is served by the same http.Server
+	Listeners []ListenerConfig `yaml:"listeners"`
+	TLS       TLSConfig        `yaml:"tls"`
+	// HTTP/2 is only negotiated on TLS listeners, defaults to enabled
+	HTTP2        *bool         `yaml:"http2"`
+	ReadTimeout  time.Duration `yaml:"readTimeout"`
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+}
+
+type ListenerConfig struct {
+	Addr string `yaml:"addr"`
+	TLS  bool   `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// how often the cert & key files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// CacheConfig controls the in memory aggregate cache
+type CacheConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+	// how far back buckets are kept
+	Window time.Duration `yaml:"window"`
+	// bucket sizes which are cached, other sizes are read from the database
+	GroupMinutes []int `yaml:"groupMinutes"`
+}
+
+// LoadConfig reads the YAML config file at path & fills in defaults
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(b)
+}
+
+// ParseConfig parses YAML config & fills in defaults
+func ParseConfig(b []byte) (*Config, error) {
+	var c Config
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	return &c, nil
+}
+
+// DefaultConfig is used when no config file is available
+func DefaultConfig() *Config {
+	var c Config
+	c.setDefaults()
+	return &c
+}
+
+func (c *Config) setDefaults() {
+	if c.Version == "" {
+		c.Version = "0"
+	}
+	if len(c.Server.Listeners) == 0 {
+		c.Server.Listeners = []ListenerConfig{{Addr: "127.0.0.1:3000"}}
+	}
+	if c.Server.HTTP2 == nil {
+		t := true
+		c.Server.HTTP2 = &t
+	}
+	if c.Server.TLS.ReloadInterval == 0 {
+		c.Server.TLS.ReloadInterval = 30 * time.Second
+	}
+	if c.Cache.Enabled == nil {
+		t := true
+		c.Cache.Enabled = &t
+	}
+	if c.Cache.Window == 0 {
+		c.Cache.Window = 24 * time.Hour
+	}
+	if len(c.Cache.GroupMinutes) == 0 {
+		// same options the UI offers
+		c.Cache.GroupMinutes = []int{1, 2, 3, 4, 5, 10, 15, 30}
+	}
+	if c.Alerts.EvaluateInterval == 0 {
+		c.Alerts.EvaluateInterval = 30 * time.Second
+	}
+	if c.Anomaly.Enabled == nil {
+		t := true
+		c.Anomaly.Enabled = &t
+	}
+	if c.Anomaly.GroupMinute == 0 {
+		c.Anomaly.GroupMinute = 5
+	}
+	if c.Anomaly.Alpha == 0 {
+		c.Anomaly.Alpha = 0.1
+	}
+	if c.Anomaly.Threshold == 0 {
+		c.Anomaly.Threshold = 3
+	}
+	if c.Anomaly.Warmup == 0 {
+		c.Anomaly.Warmup = 12
+	}
+	if c.Anomaly.MinSeasonalSamples == 0 {
+		c.Anomaly.MinSeasonalSamples = 4
+	}
+	if c.Anomaly.MinStdDev == 0 {
+		c.Anomaly.MinStdDev = 1
+	}
+	if c.Forecast.Enabled == nil {
+		t := true
+		c.Forecast.Enabled = &t
+	}
+	if c.Forecast.GroupMinute == 0 {
+		c.Forecast.GroupMinute = 15
+	}
+	if len(c.Forecast.Topics) == 0 {
+		c.Forecast.Topics = []string{"order_count"}
+	}
+	if c.Forecast.History == 0 {
+		c.Forecast.History = 28 * 24 * time.Hour
+	}
+	for i := range c.Derived {
+		if c.Derived[i].GroupMinute == 0 {
+			c.Derived[i].GroupMinute = 1
+		}
+	}
+	for i := range c.Leaderboards {
+		if c.Leaderboards[i].By == "" {
+			c.Leaderboards[i].By = "revenue"
+		}
+		if c.Leaderboards[i].Size == 0 {
+			c.Leaderboards[i].Size = 10
+		}
+		if c.Leaderboards[i].Window == 0 {
+			c.Leaderboards[i].Window = time.Hour
+		}
+	}
+	if c.Sketches.Enabled == nil {
+		t := true
+		c.Sketches.Enabled = &t
+	}
+	if c.Sketches.Window == 0 {
+		c.Sketches.Window = 24 * time.Hour
+	}
+	if c.Sketches.MaxHistory == 0 {
+		c.Sketches.MaxHistory = 7 * 24 * time.Hour
+	}
+	if c.Sketches.Precision == 0 {
+		c.Sketches.Precision = 12
+	}
+	if c.Sketches.Compression == 0 {
+		c.Sketches.Compression = 100
+	}
+	if c.KPI.Enabled == nil {
+		t := true
+		c.KPI.Enabled = &t
+	}
+	if c.KPI.GroupMinute == 0 {
+		c.KPI.GroupMinute = 15
+	}
+	if c.KPI.Window == 0 {
+		c.KPI.Window = 24 * time.Hour
+	}
+	if c.Geo.Enabled == nil {
+		t := true
+		c.Geo.Enabled = &t
+	}
+	if c.Cohorts.Enabled == nil {
+		t := true
+		c.Cohorts.Enabled = &t
+	}
+	if c.Profiles.Enabled == nil {
+		t := true
+		c.Profiles.Enabled = &t
+	}
+	if c.Goals.Enabled == nil {
+		t := true
+		c.Goals.Enabled = &t
+	}
+	if c.Query.MaxRows == 0 {
+		c.Query.MaxRows = 10000
+	}
+	if c.Query.MaxCost == 0 {
+		c.Query.MaxCost = 1000000
+	}
+	if c.Query.Timeout == 0 {
+		c.Query.Timeout = 10 * time.Second
+	}
+	if c.Query.MaxFields == 0 {
+		c.Query.MaxFields = 10
+	}
+	if c.Query.MaxValues == 0 {
+		c.Query.MaxValues = 100
+	}
+	if c.Durable.MaxEvents == 0 {
+		c.Durable.MaxEvents = 100000
+	}
+	if c.Durable.Retention == 0 {
+		c.Durable.Retention = 72 * time.Hour
+	}
+	if c.Durable.MaxBatch == 0 {
+		c.Durable.MaxBatch = 1000
+	}
+	if c.Webhooks.Timeout == 0 {
+		c.Webhooks.Timeout = 10 * time.Second
+	}
+	if c.Webhooks.MaxAttempts == 0 {
+		c.Webhooks.MaxAttempts = 5
+	}
+	if c.Webhooks.Backoff == 0 {
+		c.Webhooks.Backoff = time.Second
+	}
+	if c.Webhooks.MaxBackoff == 0 {
+		c.Webhooks.MaxBackoff = 5 * time.Minute
+	}
+	if c.Webhooks.DisableAfter == 0 {
+		c.Webhooks.DisableAfter = 10
+	}
+	if c.Webhooks.QueueSize == 0 {
+		c.Webhooks.QueueSize = 100
+	}
+	if c.Webhooks.LogRetention == 0 {
+		c.Webhooks.LogRetention = 7 * 24 * time.Hour
+	}
+	// streams can stay open a long time so these are kept generous
+	if c.Server.ReadTimeout == 0 {
+		c.Server.ReadTimeout = 30 * time.Minute
+	}
+	if c.Server.WriteTimeout == 0 {
+		c.Server.WriteTimeout = 30 * time.Minute
+	}
+}
+
+// UsesTLS checks if any listener is configured for TLS
+func (s *ServerConfig) UsesTLS() bool {
+	for _, l := range s.Listeners {
+		if l.TLS {
+			return true
+		}
+	}
+	return false
+}
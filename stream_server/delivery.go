@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// most messages held for a client between frames, older ones are dropped
+const maxPendingMessages = 1000
+
+// largest batchMs
+const maxBatchMs = 60000
+
+// DeliveryOptions change how a client's messages are sent, zero options send
+// every message in its own frame
+type DeliveryOptions struct {
+	// shortest time between frames, from maxRate
+	MinInterval time.Duration
+	// how long the first message of a frame waits for more
+	Batch time.Duration
+	// only the newest message of a frame is sent
+	Latest bool
+}
+
+// ParseDeliveryOptions reads `maxRate` (frames per second or minute i.e.
+// 2/s), `batchMs` & `coalesce=latest`, nil when none are set
+func ParseDeliveryOptions(r *http.Request) (*DeliveryOptions, error) {
+	q := r.URL.Query()
+	rate, batch, coalesce := q.Get("maxRate"), q.Get("batchMs"), q.Get("coalesce")
+	if rate == "" && batch == "" && coalesce == "" {
+		return nil, nil
+	}
+	var o DeliveryOptions
+	if rate != "" {
+		parts := strings.SplitN(rate, "/", 2)
+		n, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || n <= 0 || len(parts) != 2 {
+			return nil, fmt.Errorf("maxRate must be a positive number of frames per s or m i.e. 2/s, got %s", rate)
+		}
+		switch parts[1] {
+		case "s":
+			o.MinInterval = time.Duration(float64(time.Second) / n)
+		case "m":
+			o.MinInterval = time.Duration(float64(time.Minute) / n)
+		default:
+			return nil, fmt.Errorf("maxRate must be per s or m, got %s", rate)
+		}
+	}
+	if batch != "" {
+		ms, err := strconv.Atoi(batch)
+		if err != nil || ms < 1 || ms > maxBatchMs {
+			return nil, fmt.Errorf("batchMs must be an integer between 1 and %d", maxBatchMs)
+		}
+		o.Batch = time.Duration(ms) * time.Millisecond
+	}
+	switch coalesce {
+	case "":
+	case "latest":
+		o.Latest = true
+	default:
+		return nil, fmt.Errorf("coalesce must be latest, got %s", coalesce)
+	}
+	return &o, nil
+}
+
+// DeliveryFrame is sent in place of single messages when delivery options are
+// set, Merged is the number of messages in the frame & Dropped the number
+// left out since the previous frame
+type DeliveryFrame struct {
+	Messages []json.RawMessage `json:"messages"`
+	Merged   int               `json:"merged"`
+	Dropped  int               `json:"dropped"`
+}
+
+// Delivery holds a client's messages until their frame is due
+type Delivery struct {
+	opts    DeliveryOptions
+	pending []json.RawMessage
+	dropped int
+	// arrival of the oldest pending message
+	first time.Time
+	// when the last frame was sent
+	sent time.Time
+}
+
+func NewDelivery(opts *DeliveryOptions) *Delivery {
+	return &Delivery{opts: *opts}
+}
+
+// Add queues a message
+func (d *Delivery) Add(msg []byte, now time.Time) {
+	if len(d.pending) == 0 {
+		d.first = now
+	}
+	if d.opts.Latest && len(d.pending) > 0 {
+		d.pending = d.pending[:0]
+		d.dropped++
+	} else if len(d.pending) == maxPendingMessages {
+		d.pending = d.pending[1:]
+		d.dropped++
+	}
+	// the consumer's buffer can be reused
+	d.pending = append(d.pending, append(json.RawMessage(nil), msg...))
+}
+
+// Due is when the pending messages should be sent, zero when there are none
+func (d *Delivery) Due() time.Time {
+	if len(d.pending) == 0 {
+		return time.Time{}
+	}
+	due := d.first.Add(d.opts.Batch)
+	if next := d.sent.Add(d.opts.MinInterval); next.After(due) {
+		due = next
+	}
+	return due
+}
+
+// Flush returns the frame once it is due, nil otherwise
+func (d *Delivery) Flush(now time.Time) *DeliveryFrame {
+	due := d.Due()
+	if due.IsZero() || now.Before(due) {
+		return nil
+	}
+	frame := &DeliveryFrame{Messages: d.pending, Merged: len(d.pending), Dropped: d.dropped}
+	d.pending, d.dropped, d.sent = nil, 0, now
+	return frame
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseDeliveryOptions(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v0/stream/subscribe/order_count", nil)
+	if o, err := ParseDeliveryOptions(r); err != nil || o != nil {
+		t.Errorf("expected no options, got %+v %v", o, err)
+	}
+
+	r = httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?maxRate=2/s&batchMs=500&coalesce=latest", nil)
+	o, err := ParseDeliveryOptions(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.MinInterval != 500*time.Millisecond || o.Batch != 500*time.Millisecond || !o.Latest {
+		t.Errorf("unexpected options %+v", o)
+	}
+
+	r = httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?maxRate=30/m", nil)
+	if o, err = ParseDeliveryOptions(r); err != nil || o.MinInterval != 2*time.Second {
+		t.Errorf("expected 2s interval, got %+v %v", o, err)
+	}
+
+	for _, q := range []string{"maxRate=2", "maxRate=0/s", "maxRate=2/h", "batchMs=0", "batchMs=x", "coalesce=first"} {
+		r = httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?"+q, nil)
+		if _, err = ParseDeliveryOptions(r); err == nil {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+}
+
+func TestDeliveryBatch(t *testing.T) {
+	d := NewDelivery(&DeliveryOptions{Batch: 500 * time.Millisecond})
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	if !d.Due().IsZero() || d.Flush(now) != nil {
+		t.Error("expected nothing due")
+	}
+
+	d.Add([]byte(`{"n":1}`), now)
+	d.Add([]byte(`{"n":2}`), now.Add(100*time.Millisecond))
+	if due := d.Due(); !due.Equal(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected due at 500ms, got %s", due)
+	}
+	if d.Flush(now.Add(400*time.Millisecond)) != nil {
+		t.Error("expected no frame before the batch is due")
+	}
+	f := d.Flush(now.Add(500 * time.Millisecond))
+	if f == nil || f.Merged != 2 || f.Dropped != 0 || string(f.Messages[1]) != `{"n":2}` {
+		t.Errorf("unexpected frame %+v", f)
+	}
+	if !d.Due().IsZero() {
+		t.Error("expected nothing pending after flush")
+	}
+}
+
+func TestDeliveryRateCoalesce(t *testing.T) {
+	d := NewDelivery(&DeliveryOptions{MinInterval: time.Second, Latest: true})
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	d.Add([]byte(`1`), now)
+	if f := d.Flush(now); f == nil || f.Merged != 1 {
+		t.Fatalf("expected the first message at once, got %+v", f)
+	}
+	d.Add([]byte(`2`), now.Add(100*time.Millisecond))
+	d.Add([]byte(`3`), now.Add(200*time.Millisecond))
+	d.Add([]byte(`4`), now.Add(300*time.Millisecond))
+	if due := d.Due(); !due.Equal(now.Add(time.Second)) {
+		t.Errorf("expected due a second after the last frame, got %s", due)
+	}
+	f := d.Flush(now.Add(time.Second))
+	if f == nil || f.Merged != 1 || f.Dropped != 2 || string(f.Messages[0]) != `4` {
+		t.Errorf("unexpected frame %+v", f)
+	}
+}
+
+func TestDeliveryPendingLimit(t *testing.T) {
+	d := NewDelivery(&DeliveryOptions{Batch: time.Second})
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxPendingMessages+5; i++ {
+		d.Add([]byte(`{}`), now)
+	}
+	f := d.Flush(now.Add(time.Second))
+	if f == nil || f.Merged != maxPendingMessages || f.Dropped != 5 {
+		t.Errorf("unexpected frame merged %d dropped %d", f.Merged, f.Dropped)
+	}
+}
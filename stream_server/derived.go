@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// field of a derived bucket holding the result of the expression
+const derivedValueField = "value"
+
+// DerivedConfig is a virtual topic computed from the bucketed fields of other
+// topics i.e. `order_count.revenue / order_count.n`
+type DerivedConfig struct {
+	Name       string `yaml:"name"`
+	Expression string `yaml:"expression"`
+	// size of the live buckets, defaults to 1 minute
+	GroupMinute int `yaml:"groupMinute"`
+}
+
+// Expr is a parsed derived metric expression, ok is false when the result is
+// undefined i.e. dividing by zero
+type Expr interface {
+	Eval(vals map[string]float64) (v float64, ok bool)
+}
+
+type numberExpr float64
+
+func (n numberExpr) Eval(map[string]float64) (float64, bool) {
+	return float64(n), true
+}
+
+// refExpr is a `topic.field` reference
+type refExpr string
+
+func (r refExpr) Eval(vals map[string]float64) (float64, bool) {
+	return vals[string(r)], true
+}
+
+type negExpr struct {
+	x Expr
+}
+
+func (n negExpr) Eval(vals map[string]float64) (float64, bool) {
+	v, ok := n.x.Eval(vals)
+	return -v, ok
+}
+
+type binaryExpr struct {
+	op   byte
+	l, r Expr
+}
+
+func (b binaryExpr) Eval(vals map[string]float64) (float64, bool) {
+	l, ok := b.l.Eval(vals)
+	if !ok {
+		return 0, false
+	}
+	r, ok := b.r.Eval(vals)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	case '/':
+		if r == 0 {
+			return 0, false
+		}
+		return l / r, true
+	}
+	return 0, false
+}
+
+// exprParser is a recursive descent parser for + - * / & parentheses over
+// numbers & `topic.field` references
+type exprParser struct {
+	src  string
+	pos  int
+	refs []string
+}
+
+// ParseExpr parses a derived metric expression & returns the references it
+// uses in the order they first appear
+func ParseExpr(src string) (Expr, []string, error) {
+	p := &exprParser{src: src}
+	e, err := p.sum()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, nil, fmt.Errorf("unexpected %q at position %d", p.src[p.pos], p.pos)
+	}
+	return e, p.refs, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func (p *exprParser) sum() (Expr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || (p.src[p.pos] != '+' && p.src[p.pos] != '-') {
+			return l, nil
+		}
+		op := p.src[p.pos]
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *exprParser) product() (Expr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) || (p.src[p.pos] != '*' && p.src[p.pos] != '/') {
+			return l, nil
+		}
+		op := p.src[p.pos]
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *exprParser) unary() (Expr, error) {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '-' {
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	}
+	return p.operand()
+}
+
+func (p *exprParser) operand() (Expr, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ) at position %d", p.pos)
+		}
+		p.pos++
+		return e, nil
+	case c >= '0' && c <= '9' || c == '.':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", p.src[start:p.pos])
+		}
+		return numberExpr(v), nil
+	case isIdentChar(c):
+		start := p.pos
+		for p.pos < len(p.src) && (isIdentChar(p.src[p.pos]) || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		ref := p.src[start:p.pos]
+		if parts := strings.Split(ref, "."); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("reference %s must be topic.field", ref)
+		}
+		found := false
+		for _, r := range p.refs {
+			found = found || r == ref
+		}
+		if !found {
+			p.refs = append(p.refs, ref)
+		}
+		return refExpr(ref), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// DerivedTopic computes a derived metric from the buckets of its source topics,
+// each bucket carries the referenced source fields as `topic.field` next to
+// the `value` so clients can roll buckets up without averaging ratios
+type DerivedTopic struct {
+	Name        string
+	Expression  string
+	GroupMinute int
+	expr        Expr
+	refs        []string
+	// source topics, sorted
+	topics  []string
+	mu      sync.Mutex
+	pending map[time.Time]map[string]Bucket
+	publish func(topic string, value []byte)
+}
+
+func NewDerivedTopic(conf *DerivedConfig, specs map[string]*TopicSpec, publish func(string, []byte)) (*DerivedTopic, error) {
+	if conf.Name == "" {
+		return nil, errors.New("derived topic is missing a name")
+	}
+	if _, ok := specs[conf.Name]; ok {
+		return nil, fmt.Errorf("derived topic %s has the same name as a topic", conf.Name)
+	}
+	expr, refs, err := ParseExpr(conf.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("derived topic %s: %w", conf.Name, err)
+	}
+	d := &DerivedTopic{
+		Name:        conf.Name,
+		Expression:  conf.Expression,
+		GroupMinute: conf.GroupMinute,
+		expr:        expr,
+		refs:        refs,
+		pending:     make(map[time.Time]map[string]Bucket),
+		publish:     publish,
+	}
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		parts := strings.SplitN(ref, ".", 2)
+		spec, ok := specs[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("derived topic %s uses unknown topic %s", conf.Name, parts[0])
+		}
+		known := false
+		for _, f := range spec.FieldNames() {
+			known = known || f == parts[1]
+		}
+		if !known {
+			return nil, fmt.Errorf("derived topic %s uses unknown field %s", conf.Name, ref)
+		}
+		if !seen[parts[0]] {
+			seen[parts[0]] = true
+			d.topics = append(d.topics, parts[0])
+		}
+	}
+	if len(d.topics) == 0 {
+		return nil, fmt.Errorf("derived topic %s does not reference any topic", conf.Name)
+	}
+	sort.Strings(d.topics)
+	return d, nil
+}
+
+// Topics lists the source topics of the derived topic
+func (d *DerivedTopic) Topics() []string {
+	return d.topics
+}
+
+// combine evaluates the expression over the aligned source buckets of one
+// interval, missing sources count as zero
+func (d *DerivedTopic) combine(ts time.Time, sources map[string]Bucket) Bucket {
+	b := NewBucket(ts)
+	for _, ref := range d.refs {
+		parts := strings.SplitN(ref, ".", 2)
+		b.Values[ref] = sources[parts[0]].Values[parts[1]]
+	}
+	// the value is left out when undefined, JSON has no NaN
+	if v, ok := d.expr.Eval(b.Values); ok {
+		b.Values[derivedValueField] = v
+	}
+	return *b
+}
+
+// History aligns the bucketed history of each source topic on time stamp &
+// computes the derived value of each interval, sources must be sorted by time
+func (d *DerivedTopic) History(sources map[string][]Bucket) []Bucket {
+	aligned := make(map[time.Time]map[string]Bucket)
+	var times []time.Time
+	for topic, buckets := range sources {
+		for _, b := range buckets {
+			m, ok := aligned[b.TimeStamp]
+			if !ok {
+				m = make(map[string]Bucket)
+				aligned[b.TimeStamp] = m
+				times = append(times, b.TimeStamp)
+			}
+			m[topic] = b
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	res := make([]Bucket, len(times))
+	for i, ts := range times {
+		res[i] = d.combine(ts, aligned[ts])
+	}
+	return res
+}
+
+// HandleBucket collects the closed buckets of the source topics & publishes
+// the derived bucket once every source has closed the interval, satisfies
+// BucketListener
+func (d *DerivedTopic) HandleBucket(topic string, b Bucket) {
+	i := sort.SearchStrings(d.topics, topic)
+	if i == len(d.topics) || d.topics[i] != topic {
+		return
+	}
+
+	d.mu.Lock()
+	m, ok := d.pending[b.TimeStamp]
+	if !ok {
+		m = make(map[string]Bucket)
+		d.pending[b.TimeStamp] = m
+	}
+	m[topic] = b
+	if len(m) < len(d.topics) {
+		d.mu.Unlock()
+		return
+	}
+	res := d.combine(b.TimeStamp, m)
+	// the live buckets close every interval of every topic in order so
+	// anything older can no longer complete
+	for ts := range d.pending {
+		if !ts.After(b.TimeStamp) {
+			delete(d.pending, ts)
+		}
+	}
+	d.mu.Unlock()
+
+	if d.publish == nil {
+		return
+	}
+	out, err := json.Marshal([]Bucket{res})
+	if err != nil {
+		logger.Print("error encoding derived topic " + d.Name + ": " + err.Error())
+		return
+	}
+	d.publish(d.Name, out)
+}
+
+// derivedHistory is the initial data of a derived topic stream, it takes the
+// same parameters as the history of a topic but is grouped by the derived
+// topic's groupMinute
+func (api *API) derivedHistory(r *http.Request, d *DerivedTopic) ([]Bucket, error) {
+	p, err := ParseHistoryParams(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		return nil, err
+	}
+	// the history lines up with the live buckets
+	p.GroupMinute = d.GroupMinute
+	sources := make(map[string][]Bucket)
+	for _, topic := range d.Topics() {
+		if sources[topic], err = api.bucketHistory(r, topicSpecs[topic], p); err != nil {
+			return nil, err
+		}
+	}
+	return d.History(sources), nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseExpr(t *testing.T) {
+	vals := map[string]float64{"a.x": 6, "b.y": 2}
+	cases := []struct {
+		src  string
+		want float64
+	}{
+		{"a.x / b.y", 3},
+		{"a.x + b.y * 2", 10},
+		{"(a.x + b.y) * 2", 16},
+		{"-a.x + 1", -5},
+		{"a.x - b.y - 1", 3},
+		{"100 * a.x / (b.y + 1)", 200},
+	}
+	for _, c := range cases {
+		e, _, err := ParseExpr(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		if v, ok := e.Eval(vals); !ok || v != c.want {
+			t.Errorf("%s: expected %v got %v", c.src, c.want, v)
+		}
+	}
+
+	_, refs, _ := ParseExpr("a.x / b.y + a.x")
+	if len(refs) != 2 || refs[0] != "a.x" || refs[1] != "b.y" {
+		t.Errorf("incorrect references %v", refs)
+	}
+
+	e, _, _ := ParseExpr("a.x / (b.y - 2)")
+	if _, ok := e.Eval(vals); ok {
+		t.Error("dividing by zero should be undefined")
+	}
+
+	for _, src := range []string{"", "a.x +", "(a.x", "a.x b.y", "a + 1", "a.x.y", "a.x % 2"} {
+		if _, _, err := ParseExpr(src); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestNewDerivedTopic(t *testing.T) {
+	bad := []DerivedConfig{
+		{Name: "", Expression: "order_count.n"},
+		{Name: "order_count", Expression: "order_count.n"},
+		{Name: "x", Expression: "orders.n"},
+		{Name: "x", Expression: "order_count.units"},
+		{Name: "x", Expression: "1 + 2"},
+	}
+	for _, c := range bad {
+		if _, err := NewDerivedTopic(&c, topicSpecs, nil); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+
+	d, err := NewDerivedTopic(&DerivedConfig{Name: "x", Expression: "order_count.n / customer_count.n", GroupMinute: 1}, topicSpecs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topics := d.Topics(); len(topics) != 2 || topics[0] != "customer_count" || topics[1] != "order_count" {
+		t.Errorf("incorrect source topics %v", topics)
+	}
+}
+
+func TestDerivedHistory(t *testing.T) {
+	d, err := NewDerivedTopic(&DerivedConfig{Name: "orders_per_customer", Expression: "order_count.order_count / customer_count.n", GroupMinute: 1}, topicSpecs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	bucket := func(m int, field string, v float64) Bucket {
+		b := NewBucket(base.Add(time.Duration(m) * time.Minute))
+		b.Values[field] = v
+		return *b
+	}
+
+	res := d.History(map[string][]Bucket{
+		"customer_count": {bucket(0, "n", 2), bucket(2, "n", 4)},
+		"order_count":    {bucket(0, "order_count", 6), bucket(1, "order_count", 3), bucket(2, "order_count", 2)},
+	})
+	if len(res) != 3 {
+		t.Fatalf("expected 3 aligned buckets, got %d", len(res))
+	}
+	if v, ok := res[0].Values["value"]; !ok || v != 3 {
+		t.Errorf("incorrect first bucket %v", res[0].Values)
+	}
+	// no customers in the second minute
+	if _, ok := res[1].Values["value"]; ok || res[1].Values["order_count.order_count"] != 3 {
+		t.Errorf("incorrect second bucket %v", res[1].Values)
+	}
+	if res[2].Values["value"] != 0.5 || res[2].Values["customer_count.n"] != 4 {
+		t.Errorf("incorrect third bucket %v", res[2].Values)
+	}
+}
+
+func TestDerivedLive(t *testing.T) {
+	var published [][]byte
+	publish := func(topic string, value []byte) {
+		if topic != "revenue_per_customer" {
+			t.Errorf("published to %s", topic)
+		}
+		published = append(published, value)
+	}
+	d, err := NewDerivedTopic(&DerivedConfig{Name: "revenue_per_customer", Expression: "order_count.revenue / customer_count.n", GroupMinute: 1}, topicSpecs, publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	orders := NewBucket(base)
+	orders.Values["revenue"] = 90
+	customers := NewBucket(base)
+	customers.Values["n"] = 3
+
+	d.HandleBucket("order_count", *orders)
+	d.HandleBucket("anomalies", *orders)
+	if len(published) != 0 {
+		t.Fatal("published before every source closed the bucket")
+	}
+	d.HandleBucket("customer_count", *customers)
+	if len(published) != 1 {
+		t.Fatalf("expected 1 published bucket, got %d", len(published))
+	}
+
+	var res []map[string]interface{}
+	if err = json.Unmarshal(published[0], &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0]["value"] != 30.0 || res[0]["order_count.revenue"] != 90.0 {
+		t.Errorf("incorrect derived bucket %s", published[0])
+	}
+	if len(d.pending) != 0 {
+		t.Errorf("expected pending buckets to be cleared, got %d", len(d.pending))
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// DurableConfig bounds the log kept for durable subscriptions
+type DurableConfig struct {
+	// events kept per topic, older ones are dropped even when not acked
+	MaxEvents int `yaml:"maxEvents"`
+	// events older than this are dropped even when not acked
+	Retention time.Duration `yaml:"retention"`
+	// most events of a topic returned by one fetch
+	MaxBatch int `yaml:"maxBatch"`
+}
+
+// durableName is the allowed subscription name
+var durableName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var (
+	errDurableNotFound = errors.New("durable subscription not found")
+	errDurableExists   = errors.New("durable subscription already exists")
+)
+
+// DurableEvent is a message of a topic at its position in the durable log,
+// positions count up from 1 per topic
+type DurableEvent struct {
+	Topic    string          `json:"topic"`
+	Position int64           `json:"position"`
+	Time     time.Time       `json:"time"`
+	Value    json.RawMessage `json:"value"`
+}
+
+// DurableSubscription is a named consumer with a committed position per
+// topic, events after the committed position are delivered until acked
+type DurableSubscription struct {
+	Name      string           `json:"name"`
+	Created   time.Time        `json:"created"`
+	Committed map[string]int64 `json:"committed"`
+}
+
+// Topics lists the subscribed topics in order
+func (ds *DurableSubscription) Topics() []string {
+	topics := make([]string, 0, len(ds.Committed))
+	for t := range ds.Committed {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// DurableTopicStatus is how far a subscription is behind on a topic
+type DurableTopicStatus struct {
+	Topic     string `json:"topic"`
+	Committed int64  `json:"committed"`
+	// position of the newest event
+	Head    int64 `json:"head"`
+	Pending int64 `json:"pending"`
+}
+
+// DurableStatus is a subscription with its topics
+type DurableStatus struct {
+	Name    string               `json:"name"`
+	Created time.Time            `json:"created"`
+	Topics  []DurableTopicStatus `json:"topics"`
+}
+
+// DurableBatch is the events after the committed positions, Skipped counts
+// the events of each topic dropped by the retention before they were acked
+type DurableBatch struct {
+	Events  []DurableEvent   `json:"events"`
+	Skipped map[string]int64 `json:"skipped,omitempty"`
+	// a topic has more events than were returned
+	More bool `json:"more"`
+}
+
+// durableTopic is the log of a topic with at least one subscription
+type durableTopic struct {
+	events []DurableEvent
+	head   int64
+}
+
+// DurableStore keeps the subscriptions & the log of their topics, the api
+// writes both through to Postgres
+type DurableStore struct {
+	mu     sync.Mutex
+	conf   *DurableConfig
+	subs   map[string]*DurableSubscription
+	topics map[string]*durableTopic
+}
+
+func NewDurableStore(conf *DurableConfig) *DurableStore {
+	return &DurableStore{
+		conf:   conf,
+		subs:   make(map[string]*DurableSubscription),
+		topics: make(map[string]*durableTopic),
+	}
+}
+
+// Add registers a subscription starting after the newest event of each topic
+func (s *DurableStore) Add(name string, topics []string, now time.Time) (*DurableSubscription, error) {
+	if !durableName.MatchString(name) {
+		return nil, fmt.Errorf("name must be 1 to 64 letters, digits, _, . or -")
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("topics must not be empty")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[name]; ok {
+		return nil, errDurableExists
+	}
+	sub := &DurableSubscription{Name: name, Created: now, Committed: make(map[string]int64, len(topics))}
+	for _, t := range topics {
+		dt, ok := s.topics[t]
+		if !ok {
+			dt = &durableTopic{}
+			s.topics[t] = dt
+		}
+		sub.Committed[t] = dt.head
+	}
+	s.subs[name] = sub
+	return sub, nil
+}
+
+// restore sets a stored subscription, the heads of its topics are at least
+// its committed positions
+func (s *DurableStore) restore(sub *DurableSubscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub.Name] = sub
+	for t, pos := range sub.Committed {
+		dt, ok := s.topics[t]
+		if !ok {
+			dt = &durableTopic{}
+			s.topics[t] = dt
+		}
+		if pos > dt.head {
+			dt.head = pos
+		}
+	}
+}
+
+// restoreEvent adds a stored event, events must be restored in order after
+// their subscriptions
+func (s *DurableStore) restoreEvent(ev DurableEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dt, ok := s.topics[ev.Topic]
+	if !ok {
+		return
+	}
+	dt.add(ev, s.conf.MaxEvents)
+	if ev.Position > dt.head {
+		dt.head = ev.Position
+	}
+}
+
+// Remove drops a subscription & returns the topics no other subscription has
+func (s *DurableStore) Remove(name string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[name]
+	if !ok {
+		return nil, errDurableNotFound
+	}
+	delete(s.subs, name)
+	var unused []string
+	for _, t := range sub.Topics() {
+		if !s.subscribed(t) {
+			delete(s.topics, t)
+			unused = append(unused, t)
+		}
+	}
+	return unused, nil
+}
+
+// subscribed checks if any subscription has the topic, must hold mu
+func (s *DurableStore) subscribed(topic string) bool {
+	for _, sub := range s.subs {
+		if _, ok := sub.Committed[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Append logs a message of a subscribed topic, false when no subscription has
+// the topic
+func (s *DurableStore) Append(topic string, value []byte, now time.Time) (DurableEvent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dt, ok := s.topics[topic]
+	if !ok {
+		return DurableEvent{}, false
+	}
+	dt.head++
+	ev := DurableEvent{Topic: topic, Position: dt.head, Time: now, Value: value}
+	dt.add(ev, s.conf.MaxEvents)
+	return ev, true
+}
+
+// add appends an event & drops the oldest past max
+func (dt *durableTopic) add(ev DurableEvent, max int) {
+	dt.events = append(dt.events, ev)
+	if len(dt.events) > max {
+		dt.events = dt.events[len(dt.events)-max:]
+	}
+}
+
+// discard drops an appended event that could not be stored, its position is
+// not reused so the message is logged again after it
+func (s *DurableStore) discard(ev DurableEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dt, ok := s.topics[ev.Topic]
+	if !ok {
+		return
+	}
+	for i := range dt.events {
+		if dt.events[i].Position == ev.Position {
+			dt.events = append(dt.events[:i:i], dt.events[i+1:]...)
+			return
+		}
+	}
+}
+
+// Fetch returns up to limit events of each topic after the committed
+// position, only of topic when it is set
+func (s *DurableStore) Fetch(name, topic string, limit int) (*DurableBatch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[name]
+	if !ok {
+		return nil, errDurableNotFound
+	}
+	if _, ok = sub.Committed[topic]; topic != "" && !ok {
+		return nil, fmt.Errorf("%s is not subscribed to %s", name, topic)
+	}
+	batch := &DurableBatch{Events: []DurableEvent{}}
+	for _, t := range sub.Topics() {
+		if topic != "" && t != topic {
+			continue
+		}
+		committed, dt := sub.Committed[t], s.topics[t]
+		i := sort.Search(len(dt.events), func(i int) bool { return dt.events[i].Position > committed })
+		if i == 0 && len(dt.events) > 0 && dt.events[0].Position > committed+1 {
+			if batch.Skipped == nil {
+				batch.Skipped = make(map[string]int64)
+			}
+			batch.Skipped[t] = dt.events[0].Position - committed - 1
+		}
+		events := dt.events[i:]
+		if len(events) > limit {
+			events, batch.More = events[:limit], true
+		}
+		batch.Events = append(batch.Events, events...)
+	}
+	return batch, nil
+}
+
+// Ack commits positions of topics, positions before the committed one are
+// ignored so acks can be repeated
+func (s *DurableStore) Ack(name string, positions map[string]int64) (map[string]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[name]
+	if !ok {
+		return nil, errDurableNotFound
+	}
+	for t, pos := range positions {
+		if _, ok = sub.Committed[t]; !ok {
+			return nil, fmt.Errorf("%s is not subscribed to %s", name, t)
+		}
+		if head := s.topics[t].head; pos > head {
+			return nil, fmt.Errorf("position %d of %s is after the newest event %d", pos, t, head)
+		}
+	}
+	changed := make(map[string]int64, len(positions))
+	for t, pos := range positions {
+		if pos > sub.Committed[t] {
+			sub.Committed[t] = pos
+			changed[t] = pos
+			s.trim(t)
+		}
+	}
+	return changed, nil
+}
+
+// trim drops the events every subscription has acked, saveDurablePositions
+// deletes the same from the table, must hold mu
+func (s *DurableStore) trim(topic string) {
+	dt := s.topics[topic]
+	acked := dt.head
+	for _, sub := range s.subs {
+		if pos, ok := sub.Committed[topic]; ok && pos < acked {
+			acked = pos
+		}
+	}
+	i := sort.Search(len(dt.events), func(i int) bool { return dt.events[i].Position > acked })
+	dt.events = dt.events[i:]
+}
+
+// Prune drops the events older than the retention & returns the first
+// position kept of each topic with events
+func (s *DurableStore) Prune(now time.Time) map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-s.conf.Retention)
+	first := make(map[string]int64, len(s.topics))
+	for t, dt := range s.topics {
+		i := sort.Search(len(dt.events), func(i int) bool { return !dt.events[i].Time.Before(cutoff) })
+		if i == len(dt.events) && i > 0 {
+			i--
+		}
+		dt.events = dt.events[i:]
+		if len(dt.events) > 0 {
+			first[t] = dt.events[0].Position
+		}
+	}
+	return first
+}
+
+// Status lists how far the subscription is behind on each topic
+func (s *DurableStore) Status(name string) (*DurableStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subs[name]
+	if !ok {
+		return nil, errDurableNotFound
+	}
+	return s.status(sub), nil
+}
+
+// List is the status of every subscription ordered by name
+func (s *DurableStore) List() []DurableStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]DurableStatus, 0, len(s.subs))
+	for _, sub := range s.subs {
+		out = append(out, *s.status(sub))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// status must hold mu
+func (s *DurableStore) status(sub *DurableSubscription) *DurableStatus {
+	st := &DurableStatus{Name: sub.Name, Created: sub.Created, Topics: []DurableTopicStatus{}}
+	for _, t := range sub.Topics() {
+		head := s.topics[t].head
+		st.Topics = append(st.Topics, DurableTopicStatus{Topic: t, Committed: sub.Committed[t], Head: head, Pending: head - sub.Committed[t]})
+	}
+	return st
+}
+
+// attempts to store a durable event before the message is given up on & the
+// wait before the first retry, doubled after each
+const (
+	durableStoreAttempts = 3
+	durableStoreBackoff  = 200 * time.Millisecond
+)
+
+// durableTap stores the messages of subscribed topics, it is a tap so
+// published topics are logged as well, a message that can not be stored
+// fails the tap so Kafka delivers it again
+func (api *API) durableTap(msg *sarama.ConsumerMessage) error {
+	ev, ok := api.durable.Append(msg.Topic, msg.Value, time.Now())
+	if !ok {
+		return nil
+	}
+	var err error
+	wait := durableStoreBackoff
+	for i := 0; i < durableStoreAttempts; i++ {
+		if i > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		if err = api.dm.Exec(`insert into public.durable_event (topic, position, value, created_at) values (?, ?, ?, ?)`,
+			ev.Topic, ev.Position, string(ev.Value), ev.Time).Error; err == nil {
+			return nil
+		}
+		logger.Print("error storing durable event: " + err.Error())
+	}
+	api.durable.discard(ev)
+	return fmt.Errorf("storing durable event %d of %s: %w", ev.Position, ev.Topic, err)
+}
+
+// saveDurable stores a subscription added to the store with its positions
+func (api *API) saveDurable(sub *DurableSubscription) error {
+	tx := api.dm.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+	if err := tx.Exec(`insert into public.durable_subscription (name, created_at) values (?, ?)`, sub.Name, sub.Created).Error; err != nil {
+		return err
+	}
+	for t, pos := range sub.Committed {
+		if err := tx.Exec(`insert into public.durable_position (name, topic, position) values (?, ?, ?)`, sub.Name, t, pos).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// saveDurablePositions stores the positions committed by an ack & deletes
+// the events every subscription of the topic has acked
+func (api *API) saveDurablePositions(name string, positions map[string]int64) error {
+	tx := api.dm.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+	for t, pos := range positions {
+		if err := tx.Exec(`update public.durable_position set position = ?, updated_at = now() where name = ? and topic = ?`,
+			pos, name, t).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`
+delete from public.durable_event
+where topic = ?
+	and position <= (select min(position) from public.durable_position where topic = ?)`, t, t).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Commit().Error
+}
+
+// dropDurable deletes a subscription removed from the store & the log of the
+// topics nobody else subscribes to
+func (api *API) dropDurable(name string, unused []string) error {
+	if err := api.dm.Exec(`delete from public.durable_subscription where name = ?`, name).Error; err != nil {
+		return err
+	}
+	for _, t := range unused {
+		if err := api.dm.Exec(`delete from public.durable_event where topic = ?`, t).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDurable restores the stored subscriptions & their logs
+func (api *API) loadDurable() error {
+	rows, err := api.dm.Raw(`
+select s.name, s.created_at, p.topic, p.position
+from public.durable_subscription s
+join public.durable_position p
+	on p.name = s.name
+order by s.name`).Rows()
+	if err != nil {
+		return err
+	}
+	subs := make(map[string]*DurableSubscription)
+	for rows.Next() {
+		var name, topic string
+		var created time.Time
+		var pos int64
+		if err = rows.Scan(&name, &created, &topic, &pos); err != nil {
+			rows.Close()
+			return err
+		}
+		sub, ok := subs[name]
+		if !ok {
+			sub = &DurableSubscription{Name: name, Created: created, Committed: make(map[string]int64)}
+			subs[name] = sub
+		}
+		sub.Committed[topic] = pos
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		api.durable.restore(sub)
+	}
+
+	rows, err = api.dm.Raw(`select topic, position, created_at, value from public.durable_event order by topic, position`).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev DurableEvent
+		var value string
+		if err = rows.Scan(&ev.Topic, &ev.Position, &ev.Time, &value); err != nil {
+			return err
+		}
+		ev.Value = json.RawMessage(value)
+		api.durable.restoreEvent(ev)
+	}
+	return rows.Err()
+}
+
+// pruneDurable drops the events past the retention from the store & the
+// table, until ctx is cancelled
+func (api *API) pruneDurable(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for t, first := range api.durable.Prune(now) {
+				if err := api.dm.Exec(`delete from public.durable_event where topic = ? and position < ?`, t, first).Error; err != nil {
+					logger.Print("error pruning durable events: " + err.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestDurableStore(t *testing.T) {
+	s := NewDurableStore(&DurableConfig{MaxEvents: 100, Retention: time.Hour})
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if _, ok := s.Append("order_count", []byte(`[]`), now); ok {
+		t.Error("expected topics without subscriptions not to be logged")
+	}
+	if _, err := s.Add("bad name", []string{"order_count"}, now); err == nil {
+		t.Error("expected error for an invalid name")
+	}
+	if _, err := s.Add("nightly", nil, now); err == nil {
+		t.Error("expected error without topics")
+	}
+	if _, err := s.Add("nightly", []string{"order_count", "customer_count"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add("nightly", []string{"order_count"}, now); err != errDurableExists {
+		t.Errorf("expected exists error, got %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		ev, ok := s.Append("order_count", []byte(fmt.Sprintf(`{"n":%d}`, i)), now)
+		if !ok || ev.Position != int64(i) {
+			t.Errorf("expected position %d, got %+v", i, ev)
+		}
+	}
+	s.Append("customer_count", []byte(`{"n":1}`), now)
+
+	// a subscription added later starts at the head
+	if _, err := s.Add("hourly", []string{"order_count"}, now); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := s.Fetch("hourly", "", 10); len(b.Events) != 0 {
+		t.Errorf("expected no events for the new subscription, got %d", len(b.Events))
+	}
+
+	b, err := s.Fetch("nightly", "order_count", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.Events) != 3 || !b.More || b.Events[0].Position != 1 || string(b.Events[2].Value) != `{"n":3}` {
+		t.Errorf("unexpected batch %+v", b)
+	}
+	// the same events until acked
+	if b, _ = s.Fetch("nightly", "", 10); len(b.Events) != 6 || b.More {
+		t.Errorf("expected all 6 events, got %+v", b)
+	}
+
+	if _, err = s.Ack("nightly", map[string]int64{"order_count": 9}); err == nil {
+		t.Error("expected error acking past the head")
+	}
+	if _, err = s.Ack("nightly", map[string]int64{"kpis": 1}); err == nil {
+		t.Error("expected error acking an unsubscribed topic")
+	}
+	changed, err := s.Ack("nightly", map[string]int64{"order_count": 3})
+	if err != nil || changed["order_count"] != 3 {
+		t.Errorf("unexpected ack %v %v", changed, err)
+	}
+	// repeated & older acks change nothing
+	if changed, _ = s.Ack("nightly", map[string]int64{"order_count": 2}); len(changed) != 0 {
+		t.Errorf("expected no change, got %v", changed)
+	}
+	b, _ = s.Fetch("nightly", "order_count", 10)
+	if len(b.Events) != 2 || b.Events[0].Position != 4 {
+		t.Errorf("expected events 4 & 5, got %+v", b.Events)
+	}
+
+	st, err := s.Status("nightly")
+	if err != nil || len(st.Topics) != 2 || st.Topics[1].Topic != "order_count" || st.Topics[1].Pending != 2 || st.Topics[1].Head != 5 {
+		t.Errorf("unexpected status %+v %v", st, err)
+	}
+	if l := s.List(); len(l) != 2 || l[0].Name != "hourly" {
+		t.Errorf("unexpected list %+v", l)
+	}
+
+	unused, err := s.Remove("nightly")
+	if err != nil || len(unused) != 1 || unused[0] != "customer_count" {
+		t.Errorf("expected customer_count to be unused, got %v %v", unused, err)
+	}
+	if _, err = s.Fetch("nightly", "", 10); err != errDurableNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestDurableStoreRetention(t *testing.T) {
+	s := NewDurableStore(&DurableConfig{MaxEvents: 3, Retention: time.Hour})
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.Add("nightly", []string{"order_count"}, now)
+
+	for i := 0; i < 5; i++ {
+		s.Append("order_count", []byte(`{}`), now.Add(time.Duration(i)*time.Minute))
+	}
+	b, _ := s.Fetch("nightly", "", 10)
+	if len(b.Events) != 3 || b.Skipped["order_count"] != 2 {
+		t.Errorf("expected 2 events skipped by maxEvents, got %+v", b)
+	}
+
+	// the newest event is kept so the head survives a restart
+	first := s.Prune(now.Add(2 * time.Hour))
+	if first["order_count"] != 5 {
+		t.Errorf("expected only the newest event to be kept, got %v", first)
+	}
+	b, _ = s.Fetch("nightly", "", 10)
+	if len(b.Events) != 1 || b.Skipped["order_count"] != 4 {
+		t.Errorf("unexpected batch %+v", b)
+	}
+
+	// once every subscription acked an event it is dropped
+	s.Ack("nightly", map[string]int64{"order_count": 5})
+	s.Append("order_count", []byte(`{}`), now.Add(2*time.Hour))
+	s.Ack("nightly", map[string]int64{"order_count": 6})
+	if first = s.Prune(now.Add(2 * time.Hour)); len(first) != 0 {
+		t.Errorf("expected acked events to be trimmed, got %v", first)
+	}
+	if ev, _ := s.Append("order_count", []byte(`{}`), now); ev.Position != 7 {
+		t.Errorf("expected the head to stay after trimming, got %d", ev.Position)
+	}
+	if st, _ := s.Status("nightly"); st.Topics[0].Pending != 1 {
+		t.Errorf("unexpected status %+v", st)
+	}
+
+	// a stored event is discarded, its position is not reused
+	ev, _ := s.Append("order_count", []byte(`{}`), now)
+	s.discard(ev)
+	if b, _ = s.Fetch("nightly", "", 10); len(b.Events) != 1 || b.Events[0].Position != 7 {
+		t.Errorf("expected only event 7, got %+v", b.Events)
+	}
+	if ev, _ = s.Append("order_count", []byte(`{}`), now); ev.Position != 9 {
+		t.Errorf("expected position 9, got %d", ev.Position)
+	}
+
+	// restored subscriptions keep their positions
+	r := NewDurableStore(&DurableConfig{MaxEvents: 3, Retention: time.Hour})
+	r.restore(&DurableSubscription{Name: "nightly", Committed: map[string]int64{"order_count": 6}})
+	if ev, _ := r.Append("order_count", []byte(`{}`), now); ev.Position != 7 {
+		t.Errorf("expected position 7 after restore, got %d", ev.Position)
+	}
+
+	// restored events are capped the same as appended ones
+	r = NewDurableStore(&DurableConfig{MaxEvents: 3, Retention: time.Hour})
+	r.restore(&DurableSubscription{Name: "nightly", Committed: map[string]int64{"order_count": 0}})
+	for i := int64(1); i <= 5; i++ {
+		r.restoreEvent(DurableEvent{Topic: "order_count", Position: i, Time: now, Value: []byte(`{}`)})
+	}
+	if b, _ := r.Fetch("nightly", "", 10); len(b.Events) != 3 || b.Events[0].Position != 3 || b.Skipped["order_count"] != 2 {
+		t.Errorf("expected events 3 to 5, got %+v", b)
+	}
+}
+
+func TestKafkaTap(t *testing.T) {
+	k := KafkaInit()
+	k.RegisterTopic("alerts")
+	s := NewDurableStore(&DurableConfig{MaxEvents: 10, Retention: time.Hour})
+	s.Add("nightly", []string{"alerts"}, time.Now())
+	k.AddTap(func(msg *sarama.ConsumerMessage) error {
+		s.Append(msg.Topic, msg.Value, time.Now())
+		return nil
+	})
+
+	// published without any connected client
+	k.Publish("alerts", []byte(`[1]`))
+	b, _ := s.Fetch("nightly", "", 10)
+	if len(b.Events) != 1 || string(b.Events[0].Value) != `[1]` {
+		t.Errorf("expected the published message to be logged, got %+v", b)
+	}
+}
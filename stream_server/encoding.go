@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// response & event formats, JSON is the default
+const (
+	formatJSON    = "json"
+	formatMsgpack = "msgpack"
+	formatCBOR    = "cbor"
+)
+
+// formatContentTypes are the media types of each format, msgpack is also
+// accepted as application/x-msgpack
+var formatContentTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatMsgpack: "application/msgpack",
+	formatCBOR:    "application/cbor",
+}
+
+// ParseFormat picks the format from `format` or else the first binary media
+// type listed in Accept
+func ParseFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatContentTypes[f]; !ok {
+			return "", fmt.Errorf("format must be json, msgpack or cbor, got %s", f)
+		}
+		return f, nil
+	}
+	for _, h := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(h, ",") {
+			media := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			switch strings.ToLower(media) {
+			case "application/msgpack", "application/x-msgpack":
+				return formatMsgpack, nil
+			case "application/cbor":
+				return formatCBOR, nil
+			}
+		}
+	}
+	return formatJSON, nil
+}
+
+// Encode marshals v in the format, binary formats are encoded straight from
+// v with the field names & omitempty of its json tags
+func Encode(format string, v interface{}) ([]byte, error) {
+	if format == formatJSON {
+		return json.Marshal(v)
+	}
+	w, err := newBinaryWriter(format)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeValue(w, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// TranscodeJSON converts a JSON document to the format, i.e. a Kafka message
+// value, whole numbers stay integers
+func TranscodeJSON(format string, b []byte) ([]byte, error) {
+	if format == formatJSON || len(b) == 0 {
+		return b, nil
+	}
+	w, err := newBinaryWriter(format)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeJSONValue(w, b); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// binaryWriter is the wire side of a binary format, containers are written as
+// a header with their length followed by the elements
+type binaryWriter interface {
+	Nil()
+	Bool(v bool)
+	Int(v int64)
+	Uint(v uint64)
+	Float(v float64)
+	Text(v string)
+	Array(n int)
+	Map(n int)
+	Bytes() []byte
+}
+
+func newBinaryWriter(format string) (binaryWriter, error) {
+	switch format {
+	case formatMsgpack:
+		return &msgpackWriter{}, nil
+	case formatCBOR:
+		return &cborWriter{}, nil
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// writeJSONValue writes a JSON document, only used for values that are JSON
+// already such as Kafka messages
+func writeJSONValue(w binaryWriter, b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+	return writeValue(w, reflect.ValueOf(v))
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	numberType     = reflect.TypeOf(json.Number(""))
+	gqlMapType     = reflect.TypeOf(gqlMap(nil))
+)
+
+// flatMarshaler is a type that flattens itself into a map for JSON, the
+// binary formats write the same map
+type flatMarshaler interface {
+	flat() map[string]interface{}
+}
+
+// writeValue walks a Go value the way encoding/json does, types that only
+// know their JSON form are transcoded from it
+func writeValue(w binaryWriter, v reflect.Value) error {
+	if !v.IsValid() {
+		w.Nil()
+		return nil
+	}
+	switch t := v.Type(); {
+	case t == timeType:
+		w.Text(v.Interface().(time.Time).Format(time.RFC3339Nano))
+		return nil
+	case t == rawMessageType:
+		if v.Len() == 0 {
+			w.Nil()
+			return nil
+		}
+		return writeJSONValue(w, v.Bytes())
+	case t == numberType:
+		n := json.Number(v.String())
+		if i, err := n.Int64(); err == nil {
+			w.Int(i)
+			return nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		w.Float(f)
+		return nil
+	case t == gqlMapType:
+		m := v.Interface().(gqlMap)
+		w.Map(len(m))
+		for _, e := range m {
+			w.Text(e.Key)
+			if err := writeValue(w, reflect.ValueOf(e.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			w.Nil()
+			return nil
+		}
+		if v.Kind() == reflect.Interface {
+			return writeValue(w, v.Elem())
+		}
+	}
+	var i interface{}
+	if v.CanInterface() {
+		i = v.Interface()
+	}
+	switch m := i.(type) {
+	case flatMarshaler:
+		return writeValue(w, reflect.ValueOf(m.flat()))
+	case json.Marshaler:
+		b, err := m.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		return writeJSONValue(w, b)
+	case encoding.TextMarshaler:
+		b, err := m.MarshalText()
+		if err != nil {
+			return err
+		}
+		w.Text(string(b))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		return writeValue(w, v.Elem())
+	case reflect.Bool:
+		w.Bool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		w.Int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		w.Uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		// whole numbers are integers the same as in transcoded JSON
+		if f := v.Float(); f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			w.Int(int64(f))
+		} else {
+			w.Float(f)
+		}
+	case reflect.String:
+		w.Text(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.Nil()
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			w.Text(base64.StdEncoding.EncodeToString(v.Bytes()))
+			return nil
+		}
+		w.Array(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := writeValue(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.Nil()
+			return nil
+		}
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			k, err := mapKey(it.Key())
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			values[k] = it.Value()
+		}
+		sort.Strings(keys)
+		w.Map(len(keys))
+		for _, k := range keys {
+			w.Text(k)
+			if err := writeValue(w, values[k]); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		var fields []reflect.Value
+		var names []string
+		for _, f := range structFields(v.Type()) {
+			fv, ok := fieldByIndex(v, f.index)
+			if !ok || f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			fields = append(fields, fv)
+			names = append(names, f.name)
+		}
+		w.Map(len(fields))
+		for i, fv := range fields {
+			w.Text(names[i])
+			if err := writeValue(w, fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// mapKey formats a map key the same as encoding/json
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		b, err := tm.MarshalText()
+		return string(b), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", k.Type())
+}
+
+// encodedField is a struct field as it is named in JSON
+type encodedField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var structFieldCache sync.Map
+
+// structFields lists the fields of a struct the way encoding/json names them,
+// embedded structs are flattened & shallower fields win
+func structFields(t reflect.Type) []encodedField {
+	if f, ok := structFieldCache.Load(t); ok {
+		return f.([]encodedField)
+	}
+	var fields []encodedField
+	seen := make(map[string]bool)
+	next := []encodedField{{}}
+	for len(next) > 0 {
+		level := next
+		next = nil
+		found := make(map[string]int)
+		var add []encodedField
+		for _, parent := range level {
+			pt := t
+			for _, i := range parent.index {
+				pt = pt.Field(i).Type
+				if pt.Kind() == reflect.Ptr {
+					pt = pt.Elem()
+				}
+			}
+			for i := 0; i < pt.NumField(); i++ {
+				sf := pt.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				index := append(append([]int{}, parent.index...), i)
+				name, opts := tag, ""
+				if c := strings.Index(tag, ","); c >= 0 {
+					name, opts = tag[:c], tag[c+1:]
+				}
+				ft := sf.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, encodedField{index: index})
+					continue
+				}
+				if sf.PkgPath != "" {
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				found[name]++
+				add = append(add, encodedField{name: name, index: index,
+					omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+			}
+		}
+		// names given twice at the same depth are dropped, as in encoding/json
+		for _, f := range add {
+			if !seen[f.name] && found[f.name] == 1 {
+				fields = append(fields, f)
+			}
+		}
+		for name := range found {
+			seen[name] = true
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return lessIndex(fields[i].index, fields[j].index)
+	})
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+func lessIndex(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex follows embedded pointers, a nil one hides its fields
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// msgpackWriter writes MessagePack
+type msgpackWriter struct {
+	bytes.Buffer
+}
+
+func (w *msgpackWriter) Nil() {
+	w.WriteByte(0xc0)
+}
+
+func (w *msgpackWriter) Bool(v bool) {
+	if v {
+		w.WriteByte(0xc3)
+	} else {
+		w.WriteByte(0xc2)
+	}
+}
+
+func (w *msgpackWriter) Int(i int64) {
+	switch {
+	case i >= 0:
+		w.Uint(uint64(i))
+	case i >= -32:
+		w.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		w.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		w.WriteByte(0xd1)
+		binary.Write(w, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		w.WriteByte(0xd2)
+		binary.Write(w, binary.BigEndian, int32(i))
+	default:
+		w.WriteByte(0xd3)
+		binary.Write(w, binary.BigEndian, i)
+	}
+}
+
+func (w *msgpackWriter) Uint(i uint64) {
+	switch {
+	case i < 128:
+		w.WriteByte(byte(i))
+	case i <= math.MaxUint8:
+		w.Write([]byte{0xcc, byte(i)})
+	case i <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		binary.Write(w, binary.BigEndian, uint16(i))
+	case i <= math.MaxUint32:
+		w.WriteByte(0xce)
+		binary.Write(w, binary.BigEndian, uint32(i))
+	default:
+		w.WriteByte(0xcf)
+		binary.Write(w, binary.BigEndian, i)
+	}
+}
+
+func (w *msgpackWriter) Float(f float64) {
+	w.WriteByte(0xcb)
+	binary.Write(w, binary.BigEndian, math.Float64bits(f))
+}
+
+func (w *msgpackWriter) Text(v string) {
+	w.header(len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+	w.WriteString(v)
+}
+
+func (w *msgpackWriter) Array(n int) {
+	w.header(n, 0x90, 16, 0, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) Map(n int) {
+	w.header(n, 0x80, 16, 0, 0xde, 0xdf)
+}
+
+// header writes the fix, 8, 16 or 32 bit length of a string, array or map,
+// arrays & maps have no 8 bit form
+func (w *msgpackWriter) header(n int, fix byte, fixMax int, b8, b16, b32 byte) {
+	switch {
+	case n < fixMax:
+		w.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		w.Write([]byte{b8, byte(n)})
+	case n <= math.MaxUint16:
+		w.WriteByte(b16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(b32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+)
+
+// cborWriter writes CBOR (RFC 8949) with definite lengths
+type cborWriter struct {
+	bytes.Buffer
+}
+
+func (w *cborWriter) Nil() {
+	w.WriteByte(0xf6)
+}
+
+func (w *cborWriter) Bool(v bool) {
+	if v {
+		w.WriteByte(0xf5)
+	} else {
+		w.WriteByte(0xf4)
+	}
+}
+
+func (w *cborWriter) Int(i int64) {
+	if i >= 0 {
+		w.header(cborUint, uint64(i))
+	} else {
+		w.header(cborNegInt, uint64(-1-i))
+	}
+}
+
+func (w *cborWriter) Uint(i uint64) {
+	w.header(cborUint, i)
+}
+
+func (w *cborWriter) Float(f float64) {
+	w.WriteByte(0xfb)
+	binary.Write(w, binary.BigEndian, math.Float64bits(f))
+}
+
+func (w *cborWriter) Text(v string) {
+	w.header(cborText, uint64(len(v)))
+	w.WriteString(v)
+}
+
+func (w *cborWriter) Array(n int) {
+	w.header(cborArray, uint64(n))
+}
+
+func (w *cborWriter) Map(n int) {
+	w.header(cborMap, uint64(n))
+}
+
+// header writes the major type with its argument in the shortest form
+func (w *cborWriter) header(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		w.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		w.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		w.WriteByte(major | 25)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		w.WriteByte(major | 26)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	default:
+		w.WriteByte(major | 27)
+		binary.Write(w, binary.BigEndian, n)
+	}
+}
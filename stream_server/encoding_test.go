@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
+)
+
+func TestParseFormat(t *testing.T) {
+	cases := []struct {
+		query, accept, format string
+	}{
+		{"", "", formatJSON},
+		{"", "text/event-stream", formatJSON},
+		{"", "application/msgpack", formatMsgpack},
+		{"", "text/html, application/x-msgpack;q=0.9", formatMsgpack},
+		{"", "application/cbor", formatCBOR},
+		{"format=cbor", "application/msgpack", formatCBOR},
+		{"format=json", "application/cbor", formatJSON},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/v0/history/geo?"+c.query, nil)
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+		f, err := ParseFormat(r)
+		if err != nil || f != c.format {
+			t.Errorf("expected %s for %q %q, got %s %v", c.format, c.query, c.accept, f, err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/v0/history/geo?format=xml", nil)
+	if _, err := ParseFormat(r); err == nil {
+		t.Error("expected error for format=xml")
+	}
+}
+
+func TestTranscodeJSON(t *testing.T) {
+	doc := []byte(`{"c": -1.5, "a": 1, "b": [true, null, "x"]}`)
+	cases := map[string][]byte{
+		formatJSON: doc,
+		formatMsgpack: {0x83, 0xa1, 'a', 0x01, 0xa1, 'b', 0x93, 0xc3, 0xc0, 0xa1, 'x',
+			0xa1, 'c', 0xcb, 0xbf, 0xf8, 0, 0, 0, 0, 0, 0},
+		formatCBOR: {0xa3, 0x61, 'a', 0x01, 0x61, 'b', 0x83, 0xf5, 0xf6, 0x61, 'x',
+			0x61, 'c', 0xfb, 0xbf, 0xf8, 0, 0, 0, 0, 0, 0},
+	}
+	for format, e := range cases {
+		b, err := TranscodeJSON(format, doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, e) {
+			t.Errorf("%s: expected % x, got % x", format, e, b)
+		}
+	}
+
+	if _, err := TranscodeJSON(formatMsgpack, []byte(`{"a":`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestTranscodeIntegers(t *testing.T) {
+	msgpack := map[string][]byte{
+		"127":   {0x7f},
+		"-32":   {0xe0},
+		"-33":   {0xd0, 0xdf},
+		"300":   {0xcd, 0x01, 0x2c},
+		"70000": {0xce, 0x00, 0x01, 0x11, 0x70},
+		"-300":  {0xd1, 0xfe, 0xd4},
+	}
+	for n, e := range msgpack {
+		if b, _ := TranscodeJSON(formatMsgpack, []byte(n)); !bytes.Equal(b, e) {
+			t.Errorf("msgpack %s: expected % x, got % x", n, e, b)
+		}
+	}
+
+	cbor := map[string][]byte{
+		"23":   {0x17},
+		"24":   {0x18, 0x18},
+		"500":  {0x19, 0x01, 0xf4},
+		"-1":   {0x20},
+		"-500": {0x39, 0x01, 0xf3},
+	}
+	for n, e := range cbor {
+		if b, _ := TranscodeJSON(formatCBOR, []byte(n)); !bytes.Equal(b, e) {
+			t.Errorf("cbor %s: expected % x, got % x", n, e, b)
+		}
+	}
+}
+
+type encodeInner struct {
+	B string `json:"b"`
+}
+
+type encodeTest struct {
+	encodeInner
+	A    int     `json:"a"`
+	C    float64 `json:"c,omitempty"`
+	Skip string  `json:"-"`
+	D    *bool   `json:"d"`
+}
+
+func TestEncodeStruct(t *testing.T) {
+	v := encodeTest{encodeInner: encodeInner{B: "x"}, A: 300, Skip: "no"}
+	b, err := Encode(formatMsgpack, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := []byte{0x83, 0xa1, 'b', 0xa1, 'x', 0xa1, 'a', 0xcd, 0x01, 0x2c, 0xa1, 'd', 0xc0}
+	if !bytes.Equal(b, e) {
+		t.Errorf("expected % x, got % x", e, b)
+	}
+	v.C = 1.5
+	if b, _ = Encode(formatCBOR, &v); !bytes.Contains(b, []byte{0x61, 'c', 0xfb, 0x3f, 0xf8}) {
+		t.Errorf("expected c as a float, got % x", b)
+	}
+}
+
+func TestEncodeMatchesJSON(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	values := []interface{}{
+		Bucket{TimeStamp: ts, Values: map[string]float64{"revenue": 12.5, "orders": 3}},
+		map[string]interface{}{"raw": json.RawMessage(`{"n": 1, "f": [1.5, null]}`), "at": ts, "ids": []int{1, -40}},
+		[]Bucket{},
+		nil,
+	}
+	for _, v := range values {
+		j, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{formatMsgpack, formatCBOR} {
+			want, _ := TranscodeJSON(format, j)
+			got, err := Encode(format, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s %s: expected % x, got % x", format, j, want, got)
+			}
+		}
+	}
+}
+
+func TestWriteJSONFormat(t *testing.T) {
+	api := &API{}
+	r := httptest.NewRequest("GET", "/v0/history/geo", nil)
+	r.Header.Set("Accept", "application/cbor")
+	w := httptest.NewRecorder()
+	api.writeJSON(w, r, map[string]int{"n": 2})
+	if ct := w.Header().Get("Content-Type"); ct != "application/cbor" {
+		t.Errorf("expected application/cbor, got %s", ct)
+	}
+	if b := w.Body.Bytes(); !bytes.Equal(b, []byte{0xa1, 0x61, 'n', 0x02}) {
+		t.Errorf("unexpected body % x", b)
+	}
+}
+
+func TestStreamSocketBinary(t *testing.T) {
+	api := &API{Config: DefaultConfig(), Kafka: KafkaInit()}
+	api.Kafka.RegisterTopic("alerts")
+	router := mux.NewRouter()
+	router.Use(api.LoggingMiddleware)
+	router.Use(api.AuthMiddleware)
+	router.HandleFunc("/stream/subscribe/{topic}", api.StreamMessages)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/stream/subscribe/alerts?format=msgpack"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	receive := func() []byte {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var b []byte
+		if err := websocket.Message.Receive(ws, &b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// the topic has no history
+	if b := receive(); len(b) != 0 {
+		t.Errorf("expected empty history, got % x", b)
+	}
+	api.Kafka.Publish("alerts", []byte(`[{"n": 1}]`))
+	if b := receive(); !bytes.Equal(b, []byte{0x91, 0x81, 0xa1, 'n', 0x01}) {
+		t.Errorf("unexpected frame % x", b)
+	}
+
+	// sockets are refused by the middleware the same as other requests
+	api.Config.Auth.Tokens = []string{"secret"}
+	if _, err = websocket.Dial(url, "", srv.URL); err == nil {
+		t.Error("expected an unauthorized socket to be refused")
+	}
+	if ws, err = websocket.Dial(url+"&access_token=secret", "", srv.URL); err != nil {
+		t.Error(err)
+	} else {
+		ws.Close()
+	}
+}
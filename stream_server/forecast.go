@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ForecastConfig controls the forecasting models fit on bucketed topics
+type ForecastConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+	// size of the buckets the models are fit on, a day of these is a season
+	GroupMinute int `yaml:"groupMinute"`
+	// topics that are forecast, defaults to order_count
+	Topics []string `yaml:"topics"`
+	// how much history the models are fit on
+	History time.Duration `yaml:"history"`
+	// buckets held out for the backtest, defaults to a season or a fifth of
+	// the history when there is less than two seasons
+	Holdout int `yaml:"holdout"`
+}
+
+// largest horizon the forecast endpoint allows, a week of one minute buckets
+const maxForecastHorizon = 7 * 24 * 60
+
+// FieldForecast is the forecast of one field of a topic
+type FieldForecast struct {
+	Field    string           `json:"field"`
+	Model    *HoltWinters     `json:"model"`
+	Backtest *BacktestMetrics `json:"backtest,omitempty"`
+	Forecast []ForecastBucket `json:"forecast"`
+	// projected total of the day the forecast starts in
+	Day *DayProjection `json:"day,omitempty"`
+}
+
+type ForecastBucket struct {
+	TimeStamp time.Time `json:"time_stamp"`
+	ForecastPoint
+}
+
+// DayProjection is where the day is expected to end up
+type DayProjection struct {
+	Date   string  `json:"date"`
+	Actual float64 `json:"actual"`
+	// actual plus the forecast for the rest of the day
+	Projected float64 `json:"projected"`
+	Lower     float64 `json:"lower"`
+	Upper     float64 `json:"upper"`
+}
+
+// TopicForecast is returned from the forecast endpoint
+type TopicForecast struct {
+	Topic       string          `json:"topic"`
+	GroupMinute int             `json:"group_minute"`
+	FittedAt    time.Time       `json:"fitted_at"`
+	Fields      []FieldForecast `json:"fields"`
+}
+
+type fieldModel struct {
+	hw       *HoltWinters
+	backtest *BacktestMetrics
+}
+
+// Forecaster keeps the closed buckets of each forecast topic & refits the
+// models every time a live bucket closes
+type Forecaster struct {
+	mu     sync.RWMutex
+	conf   ForecastConfig
+	period int
+	specs  map[string]*TopicSpec
+	// contiguous closed buckets per topic
+	series   map[string][]Bucket
+	models   map[string]map[string]*fieldModel
+	fittedAt map[string]time.Time
+}
+
+func NewForecaster(conf *ForecastConfig, specs map[string]*TopicSpec) *Forecaster {
+	f := &Forecaster{
+		conf:     *conf,
+		period:   BucketsPerDay(conf.GroupMinute),
+		specs:    make(map[string]*TopicSpec),
+		series:   make(map[string][]Bucket),
+		models:   make(map[string]map[string]*fieldModel),
+		fittedAt: make(map[string]time.Time),
+	}
+	for _, t := range conf.Topics {
+		if spec, ok := specs[t]; ok {
+			f.specs[t] = spec
+		} else {
+			logger.Warn().Msgf("forecast topic %s is unknown", t)
+		}
+	}
+	return f
+}
+
+// Load sets the history of a topic & fits its models
+func (f *Forecaster) Load(topic string, buckets []Bucket) {
+	if _, ok := f.specs[topic]; !ok {
+		return
+	}
+	SortBuckets(buckets)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.series[topic] = FillGaps(buckets, f.conf.GroupMinute)
+	f.trim(topic)
+	f.refit(topic, time.Now())
+}
+
+// HandleBucket adds a closed live bucket & refits, satisfies BucketListener
+func (f *Forecaster) HandleBucket(topic string, b Bucket) {
+	if _, ok := f.specs[topic]; !ok {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.series[topic]
+	if n := len(s); n > 0 {
+		last := s[n-1].TimeStamp
+		switch {
+		case b.TimeStamp.Equal(last):
+			// the bucket open at startup was partly loaded from the database
+			s[n-1].Merge(&b)
+		case b.TimeStamp.Before(last):
+			return
+		default:
+			s = FillGaps(append(s, b.Copy()), f.conf.GroupMinute)
+		}
+	} else {
+		s = append(s, b.Copy())
+	}
+	f.series[topic] = s
+	f.trim(topic)
+	f.refit(topic, time.Now())
+}
+
+// trim drops history older than the configured length, must be locked
+func (f *Forecaster) trim(topic string) {
+	s := f.series[topic]
+	if len(s) == 0 {
+		return
+	}
+	cutoff := s[len(s)-1].TimeStamp.Add(-f.conf.History)
+	i := 0
+	for i < len(s) && s[i].TimeStamp.Before(cutoff) {
+		i++
+	}
+	f.series[topic] = s[i:]
+}
+
+func (f *Forecaster) holdout(n int) int {
+	if f.conf.Holdout > 0 {
+		return f.conf.Holdout
+	}
+	if n >= 3*f.period {
+		return f.period
+	}
+	return n / 5
+}
+
+// refit fits a model for each field of the topic, must be locked
+func (f *Forecaster) refit(topic string, now time.Time) {
+	s := f.series[topic]
+	models := make(map[string]*fieldModel)
+	for _, field := range f.specs[topic].FieldNames() {
+		y := make([]float64, len(s))
+		for i := range s {
+			y[i] = s[i].Values[field]
+		}
+		hw, err := FitHoltWinters(y, f.period)
+		if err != nil {
+			continue
+		}
+		fm := &fieldModel{hw: hw}
+		if h := f.holdout(len(y)); h > 0 && len(y)-h >= 3 {
+			if fm.backtest, err = Backtest(y, f.period, h); err != nil {
+				logger.Print("error backtesting forecast: " + err.Error())
+			}
+		}
+		models[field] = fm
+	}
+	f.models[topic] = models
+	f.fittedAt[topic] = now
+}
+
+// Forecast predicts horizon buckets after the last closed bucket for the
+// fields, a horizon of 0 forecasts to the end of the day
+func (f *Forecaster) Forecast(topic string, fields []string, horizon int) (*TopicForecast, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	spec, ok := f.specs[topic]
+	if !ok {
+		return nil, errors.New("topic " + topic + " is not forecast")
+	}
+	models := f.models[topic]
+	s := f.series[topic]
+	if len(models) == 0 || len(s) == 0 {
+		return nil, errors.New("not enough history to forecast topic " + topic)
+	}
+	if len(fields) == 0 {
+		fields = spec.FieldNames()
+	}
+
+	// time stamps of the forecast buckets
+	start := NextBucketTime(s[len(s)-1].TimeStamp, f.conf.GroupMinute)
+	dayStart := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location())
+	dayEnd := dayStart.AddDate(0, 0, 1)
+	var times []time.Time
+	for ts := start; (horizon > 0 && len(times) < horizon) || (horizon <= 0 && ts.Before(dayEnd)); ts = NextBucketTime(ts, f.conf.GroupMinute) {
+		times = append(times, ts)
+	}
+
+	res := &TopicForecast{
+		Topic:       topic,
+		GroupMinute: f.conf.GroupMinute,
+		FittedAt:    f.fittedAt[topic],
+	}
+	for _, field := range fields {
+		fm, ok := models[field]
+		if !ok {
+			return nil, errors.New("no model for field " + field)
+		}
+		points := fm.hw.Forecast(len(times))
+		ff := FieldForecast{
+			Field:    field,
+			Model:    fm.hw,
+			Backtest: fm.backtest,
+			Forecast: make([]ForecastBucket, len(times)),
+		}
+		day := &DayProjection{Date: start.Format("2006-01-02")}
+		for i := range s {
+			if !s[i].TimeStamp.Before(dayStart) {
+				day.Actual += s[i].Values[field]
+			}
+		}
+		day.Projected = day.Actual
+		// treats the errors of each bucket as independent
+		var variance float64
+		for i, ts := range times {
+			ff.Forecast[i] = ForecastBucket{TimeStamp: ts, ForecastPoint: points[i]}
+			if ts.Before(dayEnd) {
+				day.Projected += points[i].Value
+				sd := (points[i].Upper - points[i].Lower) / (2 * confidenceZ)
+				variance += sd * sd
+			}
+		}
+		width := confidenceZ * math.Sqrt(variance)
+		day.Lower, day.Upper = day.Projected-width, day.Projected+width
+		ff.Day = day
+		res.Fields = append(res.Fields, ff)
+	}
+	return res, nil
+}
+
+// Backtests returns the backtest metrics of every model for export
+func (f *Forecaster) Backtests() map[string]map[string]*BacktestMetrics {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := make(map[string]map[string]*BacktestMetrics)
+	for topic, models := range f.models {
+		out[topic] = make(map[string]*BacktestMetrics)
+		for field, fm := range models {
+			out[topic][field] = fm.backtest
+		}
+	}
+	return out
+}
+
+// loadForecastHistory fits the forecast models on the fact table history
+func (api *API) loadForecastHistory(f *Forecaster) {
+	from := time.Now().Add(-f.conf.History)
+	for topic, spec := range f.specs {
+		buckets, err := api.queryBuckets(spec, f.conf.GroupMinute, from)
+		if err != nil {
+			logger.Print("error loading forecast history for topic " + topic + ": " + err.Error())
+			continue
+		}
+		f.Load(topic, buckets)
+	}
+}
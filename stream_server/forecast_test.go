@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForecaster(t *testing.T) {
+	conf := DefaultConfig().Forecast
+	conf.GroupMinute = 60
+	f := NewForecaster(&conf, topicSpecs)
+
+	// 3 days of hourly buckets, busy during the day
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var buckets []Bucket
+	for i := 0; i < 3*24; i++ {
+		ts := start.Add(time.Duration(i) * time.Hour)
+		// leave a gap to check it is filled
+		if i == 30 {
+			continue
+		}
+		b := NewBucket(ts)
+		if h := ts.Hour(); h >= 8 && h < 20 {
+			b.Values["order_count"] = 10
+			b.Values["revenue"] = 100
+		}
+		buckets = append(buckets, *b)
+	}
+	// the last day ends at noon
+	f.Load("order_count", buckets[:len(buckets)-12])
+
+	if n := len(f.series["order_count"]); n != 3*24-12 {
+		t.Fatalf("expected gap to be filled, got %d buckets", n)
+	}
+
+	res, err := f.Forecast("order_count", []string{"revenue"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Fields) != 1 || res.Fields[0].Field != "revenue" {
+		t.Fatalf("expected revenue forecast, got %+v", res.Fields)
+	}
+	ff := res.Fields[0]
+	// forecast to the end of the day from 12:00
+	if len(ff.Forecast) != 12 {
+		t.Fatalf("expected 12 buckets to end of day, got %d", len(ff.Forecast))
+	}
+	if !ff.Forecast[0].TimeStamp.Equal(start.Add(60 * time.Hour)) {
+		t.Errorf("forecast starts at %v", ff.Forecast[0].TimeStamp)
+	}
+	if ff.Day.Actual != 400 {
+		t.Errorf("expected 400 actual revenue today, got %v", ff.Day.Actual)
+	}
+	// 8 more busy hours of 100
+	if ff.Day.Projected < 1000 || ff.Day.Projected > 1400 {
+		t.Errorf("expected projection around 1200, got %v", ff.Day.Projected)
+	}
+	if ff.Day.Lower > ff.Day.Projected || ff.Day.Upper < ff.Day.Projected {
+		t.Errorf("projection outside of band %+v", ff.Day)
+	}
+	if ff.Backtest == nil {
+		t.Error("expected backtest metrics")
+	}
+
+	res, err = f.Forecast("order_count", nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Fields) != 3 || len(res.Fields[0].Forecast) != 3 {
+		t.Errorf("expected 3 fields with 3 buckets, got %+v", res.Fields)
+	}
+
+	if _, err = f.Forecast("customer_count", nil, 0); err == nil {
+		t.Error("expected error for topic that is not forecast")
+	}
+	if _, err = f.Forecast("order_count", []string{"banana"}, 0); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestForecasterHandleBucket(t *testing.T) {
+	conf := DefaultConfig().Forecast
+	conf.GroupMinute = 60
+	f := NewForecaster(&conf, topicSpecs)
+
+	start := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var buckets []Bucket
+	for i := 0; i < 5; i++ {
+		b := NewBucket(start.Add(time.Duration(i) * time.Hour))
+		b.Values["n"] = 1
+		buckets = append(buckets, *b)
+	}
+	f.Load("order_count", buckets)
+
+	// the partly loaded last bucket is completed by the live one
+	live := NewBucket(start.Add(4 * time.Hour))
+	live.Values["n"] = 2
+	f.HandleBucket("order_count", *live)
+	s := f.series["order_count"]
+	if len(s) != 5 || s[4].Values["n"] != 3 {
+		t.Errorf("expected live bucket merged, got %v", s[len(s)-1])
+	}
+
+	// later buckets are appended with gaps filled
+	live = NewBucket(start.Add(7 * time.Hour))
+	live.Values["n"] = 1
+	f.HandleBucket("order_count", *live)
+	if s = f.series["order_count"]; len(s) != 8 {
+		t.Errorf("expected 8 buckets, got %d", len(s))
+	}
+	fc, err := f.Forecast("order_count", []string{"n"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fc.Fields[0].Forecast[0].TimeStamp.Equal(start.Add(8 * time.Hour)) {
+		t.Error("forecast should start after the newest live bucket")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// topic the live geographic changes are published on
+const geoTopic = "geo"
+
+// region used for facts without a customer location
+const unknownRegion = "unknown"
+
+// GeoConfig controls the live geographic topic
+type GeoConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+}
+
+// GeoTotals are the facts of one region
+type GeoTotals struct {
+	Customers float64 `json:"customers"`
+	Orders    float64 `json:"orders"`
+	Units     float64 `json:"units"`
+	Revenue   float64 `json:"revenue"`
+}
+
+// GeoParams are the query parameters of the geographic history
+type GeoParams struct {
+	// state or city
+	Level string
+	// optional date range, To is exclusive
+	From time.Time
+	To   time.Time
+}
+
+// ParseGeoParams reads `level`, `from` & `to` from the request
+func ParseGeoParams(r *http.Request) (*GeoParams, error) {
+	p := GeoParams{Level: r.URL.Query().Get("level")}
+	switch p.Level {
+	case "":
+		p.Level = "state"
+	case "state", "city":
+	default:
+		return nil, fmt.Errorf("level must be state or city, got %s", p.Level)
+	}
+	var err error
+	if p.From, p.To, err = parseDateRange(r); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GeoBreakdown is keyed by region so it can be joined to map features, states
+// are keyed by the state & cities by `city, state`
+type GeoBreakdown struct {
+	Level   string                `json:"level"`
+	Regions map[string]*GeoTotals `json:"regions"`
+}
+
+// GeoUpdate is published for each message with the changes of each state &
+// city, the values are added to the regions of a breakdown
+type GeoUpdate struct {
+	TimeStamp time.Time             `json:"time_stamp"`
+	States    map[string]*GeoTotals `json:"states"`
+	Cities    map[string]*GeoTotals `json:"cities"`
+}
+
+// cityRegion is the key of a city, city names repeat across states
+func cityRegion(city, state string) string {
+	if city == "" {
+		city = unknownRegion
+	}
+	if state == "" {
+		state = unknownRegion
+	}
+	return city + ", " + state
+}
+
+func regionTotals(m map[string]*GeoTotals, region string) *GeoTotals {
+	t, ok := m[region]
+	if !ok {
+		t = &GeoTotals{}
+		m[region] = t
+	}
+	return t
+}
+
+// GeoChanges turns the events of an order or customer message into the
+// changes of each state & city, nil for other topics
+func GeoChanges(msg *sarama.ConsumerMessage) (*GeoUpdate, error) {
+	if msg.Topic != "order_count" && msg.Topic != "customer_count" {
+		return nil, nil
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	u := &GeoUpdate{
+		TimeStamp: msg.Timestamp,
+		States:    make(map[string]*GeoTotals),
+		Cities:    make(map[string]*GeoTotals),
+	}
+	for i := range events {
+		e := &events[i]
+		state := e.Attrs["state"]
+		if state == "" {
+			state = unknownRegion
+		}
+		for _, t := range []*GeoTotals{regionTotals(u.States, state), regionTotals(u.Cities, cityRegion(e.Attrs["city"], e.Attrs["state"]))} {
+			if msg.Topic == "customer_count" {
+				t.Customers += e.Values["n"]
+				continue
+			}
+			t.Orders += e.Values["order_count"]
+			t.Units += e.Values["n"]
+			t.Revenue += e.Values["revenue"]
+		}
+	}
+	return u, nil
+}
+
+// GeoPublisher publishes the geographic changes of every order & customer
+// message on the geo topic
+type GeoPublisher struct {
+	publish func(topic string, value []byte)
+}
+
+func (gp *GeoPublisher) HandleMessage(msg *sarama.ConsumerMessage) {
+	u, err := GeoChanges(msg)
+	if err != nil {
+		logger.Print("geo could not parse message: " + err.Error())
+		return
+	}
+	if u == nil || len(u.States) == 0 {
+		return
+	}
+	out, err := json.Marshal(u)
+	if err != nil {
+		logger.Print("error encoding geo update: " + err.Error())
+		return
+	}
+	gp.publish(geoTopic, out)
+}
+
+// geoRegionSQL is the region of a customer row aliased c
+func geoRegionSQL(level string) string {
+	if level == "city" {
+		return "coalesce(c.city, 'unknown') || ', ' || coalesce(c.state, 'unknown')"
+	}
+	return "coalesce(c.state, 'unknown')"
+}
+
+// geoOrdersSQL sums the orders of each region from the customer of the order
+func geoOrdersSQL(p *GeoParams) string {
+	q := fmt.Sprintf(`
+select %s region, count(*) orders, sum(f.n) units, sum(f.revenue) revenue
+from mart.order_fact f
+join mart.date_dimension dd
+	on f.date_key = dd.date_key
+left join public.customer c
+	on f.customer_id = c.customer_id`, geoRegionSQL(p.Level))
+	if where, _ := dateRangeWhere(p.From, p.To); where != "" {
+		q += "\nwhere " + where
+	}
+	return q + "\ngroup by 1"
+}
+
+// geoCustomersSQL counts the customers created in each region
+func geoCustomersSQL(p *GeoParams) string {
+	q := fmt.Sprintf(`
+select %s region, count(*) customers
+from public.customer c
+join mart.date_dimension dd
+	on c.created_at::date = dd.date_key
+where c.deleted_at is null`, geoRegionSQL(p.Level))
+	if where, _ := dateRangeWhere(p.From, p.To); where != "" {
+		q += " and " + where
+	}
+	return q + "\ngroup by 1"
+}
+
+// queryGeo builds the breakdown of the date range from the store & fact tables
+func (api *API) queryGeo(p *GeoParams) (*GeoBreakdown, error) {
+	res := &GeoBreakdown{Level: p.Level, Regions: make(map[string]*GeoTotals)}
+	_, args := dateRangeWhere(p.From, p.To)
+
+	rows, err := api.dm.Raw(geoOrdersSQL(p), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var region string
+		var orders, units, revenue float64
+		if err = rows.Scan(&region, &orders, &units, &revenue); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t := regionTotals(res.Regions, region)
+		t.Orders, t.Units, t.Revenue = orders, units, revenue
+	}
+	rows.Close()
+
+	rows, err = api.dm.Raw(geoCustomersSQL(p), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var region string
+		var customers float64
+		if err = rows.Scan(&region, &customers); err != nil {
+			return nil, err
+		}
+		regionTotals(res.Regions, region).Customers = customers
+	}
+	return res, rows.Err()
+}
+
+// geoSnapshot is the first event of the geo stream, it takes the same
+// parameters as the history
+func (api *API) geoSnapshot(r *http.Request) (interface{}, error) {
+	p, err := ParseGeoParams(r)
+	if err != nil {
+		return nil, err
+	}
+	return api.queryGeo(p)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseGeoParams(t *testing.T) {
+	p, err := ParseGeoParams(httptest.NewRequest("GET", "/", nil))
+	if err != nil || p.Level != "state" {
+		t.Errorf("expected state level by default, got %+v %v", p, err)
+	}
+	if _, err = ParseGeoParams(httptest.NewRequest("GET", "/?level=country", nil)); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
+
+func TestGeoSQL(t *testing.T) {
+	q := geoOrdersSQL(&GeoParams{Level: "city", From: time.Now()})
+	for _, s := range []string{"left join public.customer c", "f.customer_id = c.customer_id", "coalesce(c.city, 'unknown')", "where dd.the_date >= ?"} {
+		if !strings.Contains(q, s) {
+			t.Errorf("expected orders query to contain %s:\n%s", s, q)
+		}
+	}
+	q = geoCustomersSQL(&GeoParams{Level: "state", To: time.Now()})
+	if !strings.Contains(q, "where c.deleted_at is null and dd.the_date < ?") {
+		t.Errorf("incorrect customers query:\n%s", q)
+	}
+}
+
+func TestGeoChanges(t *testing.T) {
+	ts := time.Now().Format(time.RFC3339Nano)
+	b, _ := json.Marshal([]map[string]interface{}{
+		{"time_stamp": ts, "order_count": 1, "n": 2, "revenue": 20, "state": "AZ", "city": "Phoenix"},
+		{"time_stamp": ts, "order_count": 1, "n": 1, "revenue": 5, "state": "AZ", "city": "Tucson"},
+		{"time_stamp": ts, "order_count": 1, "n": 1, "revenue": 1, "state": nil},
+	})
+	u, err := GeoChanges(&sarama.ConsumerMessage{Topic: "order_count", Value: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if az := u.States["AZ"]; az == nil || *az != (GeoTotals{Orders: 2, Units: 3, Revenue: 25}) {
+		t.Errorf("incorrect AZ totals %+v", az)
+	}
+	if u.Cities["Tucson, AZ"] == nil || u.States["unknown"] == nil || u.Cities["unknown, unknown"] == nil {
+		t.Errorf("incorrect regions %+v %+v", u.States, u.Cities)
+	}
+
+	b, _ = json.Marshal([]map[string]interface{}{{"time_stamp": ts, "n": 1, "state": "NV", "city": "Reno"}})
+	u, _ = GeoChanges(&sarama.ConsumerMessage{Topic: "customer_count", Value: b})
+	if nv := u.States["NV"]; nv == nil || nv.Customers != 1 || nv.Orders != 0 {
+		t.Errorf("incorrect customer change %+v", nv)
+	}
+
+	if u, _ = GeoChanges(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte("[]")}); u != nil {
+		t.Error("expected no changes for other topics")
+	}
+}
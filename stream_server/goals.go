@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// goalsTopic publishes the progress of the goals changed by each order
+const goalsTopic = "goals"
+
+// GoalConfig controls the revenue goal tracking
+type GoalConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+}
+
+// Goal is a revenue target for a day or month, stored in public.revenue_goal
+type Goal struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name,omitempty"`
+	Period string `json:"period"`
+	// YYYY-MM-DD, the first of the month for monthly goals
+	Start  string  `json:"start"`
+	Target float64 `json:"target"`
+}
+
+// Validate checks the period & target, a monthly goal has to start on the
+// first of the month
+func (g *Goal) Validate() error {
+	if g.Period != "day" && g.Period != "month" {
+		return fmt.Errorf("period must be day or month, got %s", g.Period)
+	}
+	start, err := time.Parse("2006-01-02", g.Start)
+	if err != nil {
+		return errors.New("start must be a date as YYYY-MM-DD")
+	}
+	if g.Period == "month" && start.Day() != 1 {
+		return errors.New("monthly goals must start on the first of the month")
+	}
+	if g.Target <= 0 {
+		return errors.New("target must be positive")
+	}
+	return nil
+}
+
+// Bounds are the start & end of the period in the same wall clock as
+// BucketKey, the goal must be valid
+func (g *Goal) Bounds() (time.Time, time.Time) {
+	start, _ := time.Parse("2006-01-02", g.Start)
+	if g.Period == "month" {
+		return start, start.AddDate(0, 1, 0)
+	}
+	return start, start.AddDate(0, 0, 1)
+}
+
+// GoalProgress is how far a goal is along, rates are revenue per hour
+type GoalProgress struct {
+	Goal
+	// upcoming, active or finished
+	Status string  `json:"status"`
+	Actual float64 `json:"actual"`
+	Pct    float64 `json:"pct"`
+	// share of the period that has passed
+	Elapsed float64 `json:"elapsed"`
+	RunRate float64 `json:"run_rate"`
+	// rate needed for the rest of the period to hit the target
+	RequiredRunRate float64 `json:"required_run_rate"`
+	// period total at the current run rate
+	Projected float64 `json:"projected"`
+	// when the target is hit at the current run rate, left out once it is hit or
+	// when that is after the period
+	ProjectedFinish *time.Time `json:"projected_finish,omitempty"`
+}
+
+// Progress computes the progress at now, which is a BucketKey
+func (g *Goal) Progress(actual float64, now time.Time) GoalProgress {
+	start, end := g.Bounds()
+	p := GoalProgress{Goal: *g, Actual: actual, Pct: 100 * actual / g.Target}
+	switch {
+	case now.Before(start):
+		p.Status = "upcoming"
+	case !now.Before(end):
+		p.Status = "finished"
+		p.Elapsed = 1
+	default:
+		p.Status = "active"
+		p.Elapsed = float64(now.Sub(start)) / float64(end.Sub(start))
+	}
+
+	remaining := g.Target - actual
+	switch p.Status {
+	case "upcoming":
+		p.RequiredRunRate = g.Target / end.Sub(start).Hours()
+	case "active":
+		if hours := now.Sub(start).Hours(); hours > 0 {
+			p.RunRate = actual / hours
+		}
+		if remaining > 0 {
+			p.RequiredRunRate = remaining / end.Sub(now).Hours()
+		}
+		p.Projected = actual + p.RunRate*end.Sub(now).Hours()
+	case "finished":
+		p.RunRate = actual / end.Sub(start).Hours()
+		p.Projected = actual
+	}
+
+	if p.Status == "active" && remaining > 0 && p.RunRate > 0 {
+		finish := now.Add(time.Duration(remaining / p.RunRate * float64(time.Hour)))
+		if finish.Before(end) {
+			p.ProjectedFinish = &finish
+		}
+	}
+	return p
+}
+
+type goalState struct {
+	goal   Goal
+	actual float64
+}
+
+// GoalTracker keeps the revenue of every goal's period, the revenue is read
+// from mart.order_fact when a goal is loaded & summed from the order events
+type GoalTracker struct {
+	mu      sync.Mutex
+	goals   map[int64]*goalState
+	publish func(topic string, value []byte)
+}
+
+func NewGoalTracker(publish func(topic string, value []byte)) *GoalTracker {
+	return &GoalTracker{goals: make(map[int64]*goalState), publish: publish}
+}
+
+// Set adds or replaces a goal with the revenue of its period so far
+func (gt *GoalTracker) Set(g Goal, actual float64) {
+	gt.mu.Lock()
+	gt.goals[g.ID] = &goalState{goal: g, actual: actual}
+	gt.mu.Unlock()
+	gt.send([]GoalProgress{g.Progress(actual, BucketKey(time.Now()))})
+}
+
+// Remove drops a deleted goal
+func (gt *GoalTracker) Remove(id int64) {
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	delete(gt.goals, id)
+}
+
+// Progress lists the progress of every goal, only active goals unless all is
+// set, ordered by start
+func (gt *GoalTracker) Progress(all bool, now time.Time) []GoalProgress {
+	gt.mu.Lock()
+	defer gt.mu.Unlock()
+	out := []GoalProgress{}
+	for _, gs := range gt.goals {
+		p := gs.goal.Progress(gs.actual, now)
+		if all || p.Status == "active" {
+			out = append(out, p)
+		}
+	}
+	sortGoalProgress(out)
+	return out
+}
+
+// HandleMessage adds the revenue of orders to the goals of their period &
+// publishes the progress of those goals
+func (gt *GoalTracker) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("goals could not parse message: " + err.Error())
+		return
+	}
+
+	now := BucketKey(time.Now())
+	changed := make(map[int64]bool)
+	gt.mu.Lock()
+	for i := range events {
+		key := BucketKey(events[i].TimeStamp)
+		for id, gs := range gt.goals {
+			if start, end := gs.goal.Bounds(); !key.Before(start) && key.Before(end) {
+				gs.actual += events[i].Values["revenue"]
+				changed[id] = true
+			}
+		}
+	}
+	out := make([]GoalProgress, 0, len(changed))
+	for id := range changed {
+		gs := gt.goals[id]
+		out = append(out, gs.goal.Progress(gs.actual, now))
+	}
+	gt.mu.Unlock()
+
+	sortGoalProgress(out)
+	gt.send(out)
+}
+
+func (gt *GoalTracker) send(progress []GoalProgress) {
+	if len(progress) == 0 {
+		return
+	}
+	b, err := json.Marshal(progress)
+	if err != nil {
+		logger.Print("error encoding goals: " + err.Error())
+		return
+	}
+	gt.publish(goalsTopic, b)
+}
+
+func sortGoalProgress(p []GoalProgress) {
+	sort.Slice(p, func(i, j int) bool {
+		if p[i].Start != p[j].Start {
+			return p[i].Start < p[j].Start
+		}
+		return p[i].ID < p[j].ID
+	})
+}
+
+// errGoalNotFound is returned when no goal has the id
+var errGoalNotFound = errors.New("goal not found")
+
+const goalColumns = `goal_id, coalesce(name, ''), period, to_char(period_start, 'YYYY-MM-DD'), target::float8`
+
+// listGoals reads every goal
+func (api *API) listGoals() ([]Goal, error) {
+	rows, err := api.dm.Raw(`select ` + goalColumns + ` from public.revenue_goal order by period_start, goal_id`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	goals := []Goal{}
+	for rows.Next() {
+		var g Goal
+		if err = rows.Scan(&g.ID, &g.Name, &g.Period, &g.Start, &g.Target); err != nil {
+			return nil, err
+		}
+		goals = append(goals, g)
+	}
+	return goals, nil
+}
+
+// getGoal reads the goal with the id
+func (api *API) getGoal(id int64) (*Goal, error) {
+	var g Goal
+	err := api.dm.Raw(`select `+goalColumns+` from public.revenue_goal where goal_id = ?`, id).Row().
+		Scan(&g.ID, &g.Name, &g.Period, &g.Start, &g.Target)
+	if err == sql.ErrNoRows {
+		return nil, errGoalNotFound
+	}
+	return &g, err
+}
+
+// saveGoal inserts a goal without an id or updates the goal with its id & sets
+// it on the tracker
+func (api *API) saveGoal(g *Goal) error {
+	var row *sql.Row
+	if g.ID == 0 {
+		row = api.dm.Raw(`insert into public.revenue_goal (name, period, period_start, target) values (?, ?, ?, ?) returning goal_id`,
+			g.Name, g.Period, g.Start, g.Target).Row()
+	} else {
+		row = api.dm.Raw(`update public.revenue_goal set name = ?, period = ?, period_start = ?, target = ?, updated_at = now() where goal_id = ? returning goal_id`,
+			g.Name, g.Period, g.Start, g.Target, g.ID).Row()
+	}
+	if err := row.Scan(&g.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return errGoalNotFound
+		}
+		return err
+	}
+	return api.trackGoal(*g)
+}
+
+// deleteGoal removes the goal with the id
+func (api *API) deleteGoal(id int64) error {
+	res := api.dm.Exec(`delete from public.revenue_goal where goal_id = ?`, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errGoalNotFound
+	}
+	api.goals.Remove(id)
+	return nil
+}
+
+// trackGoal reads the revenue of the goal's period & sets it on the tracker
+func (api *API) trackGoal(g Goal) error {
+	start, end := g.Bounds()
+	var actual float64
+	err := api.dm.Raw(`select coalesce(sum(revenue), 0)::float8 from mart.order_fact where date_key >= ? and date_key < ?`,
+		start.Format("2006-01-02"), end.Format("2006-01-02")).Row().Scan(&actual)
+	if err != nil {
+		return err
+	}
+	api.goals.Set(g, actual)
+	return nil
+}
+
+// loadGoals sets every stored goal on the tracker
+func (api *API) loadGoals() error {
+	goals, err := api.listGoals()
+	if err != nil {
+		return err
+	}
+	for _, g := range goals {
+		if err = api.trackGoal(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// goalsSnapshot is the first event of the goals topic, `all=true` includes
+// goals that are not active
+func (api *API) goalsSnapshot(r *http.Request) (interface{}, error) {
+	return api.goals.Progress(r.URL.Query().Get("all") == "true", BucketKey(time.Now())), nil
+}
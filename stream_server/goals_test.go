@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGoalValidate(t *testing.T) {
+	valid := []Goal{
+		{Period: "day", Start: "2020-03-04", Target: 100},
+		{Period: "month", Start: "2020-03-01", Target: 1},
+	}
+	for _, g := range valid {
+		if err := g.Validate(); err != nil {
+			t.Errorf("expected %+v to be valid: %v", g, err)
+		}
+	}
+	invalid := []Goal{
+		{Period: "week", Start: "2020-03-04", Target: 100},
+		{Period: "day", Start: "04/03/2020", Target: 100},
+		{Period: "month", Start: "2020-03-04", Target: 100},
+		{Period: "day", Start: "2020-03-04", Target: 0},
+	}
+	for _, g := range invalid {
+		if err := g.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", g)
+		}
+	}
+}
+
+func TestGoalProgress(t *testing.T) {
+	g := Goal{ID: 1, Period: "day", Start: "2020-03-04", Target: 240}
+	start, end := g.Bounds()
+	if !end.Equal(start.Add(24 * time.Hour)) {
+		t.Errorf("unexpected bounds %v %v", start, end)
+	}
+
+	// a quarter of the day with 40 of revenue
+	p := g.Progress(40, start.Add(6*time.Hour))
+	if p.Status != "active" || p.Elapsed != 0.25 || math.Abs(p.Pct-100.0/6) > 1e-9 {
+		t.Errorf("unexpected progress %+v", p)
+	}
+	if math.Abs(p.RunRate-40.0/6) > 1e-9 || math.Abs(p.RequiredRunRate-200.0/18) > 1e-9 || math.Abs(p.Projected-160) > 1e-9 {
+		t.Errorf("unexpected rates %+v", p)
+	}
+	// below the required rate the target is not hit within the day
+	if p.ProjectedFinish != nil {
+		t.Errorf("expected no finish, got %v", p.ProjectedFinish)
+	}
+
+	p = g.Progress(120, start.Add(6*time.Hour))
+	if p.ProjectedFinish == nil || !p.ProjectedFinish.Equal(start.Add(12*time.Hour)) {
+		t.Errorf("expected finish at noon, got %v", p.ProjectedFinish)
+	}
+
+	if p = g.Progress(0, start.Add(-time.Hour)); p.Status != "upcoming" || p.RequiredRunRate != 10 {
+		t.Errorf("unexpected upcoming progress %+v", p)
+	}
+	if p = g.Progress(300, end); p.Status != "finished" || p.Pct != 125 || p.Projected != 300 {
+		t.Errorf("unexpected finished progress %+v", p)
+	}
+
+	m := Goal{Period: "month", Start: "2020-02-01", Target: 1}
+	if start, end = m.Bounds(); end.Format("2006-01-02") != "2020-03-01" {
+		t.Errorf("unexpected month end %v", end)
+	}
+}
+
+func TestGoalTracker(t *testing.T) {
+	var published [][]GoalProgress
+	gt := NewGoalTracker(func(topic string, value []byte) {
+		if topic != goalsTopic {
+			t.Errorf("unexpected topic %s", topic)
+		}
+		var p []GoalProgress
+		if err := json.Unmarshal(value, &p); err != nil {
+			t.Fatal(err)
+		}
+		published = append(published, p)
+	})
+
+	now := time.Now()
+	today := BucketKey(now).Format("2006-01-02")
+	gt.Set(Goal{ID: 1, Period: "day", Start: today, Target: 100}, 10)
+	gt.Set(Goal{ID: 2, Period: "day", Start: "2000-01-01", Target: 100}, 50)
+	if len(published) != 2 {
+		t.Fatalf("expected a publish per goal, got %d", len(published))
+	}
+
+	gt.HandleMessage(orderMessage(now, 15))
+	if len(published) != 3 || len(published[2]) != 1 || published[2][0].ID != 1 || published[2][0].Actual != 25 {
+		t.Errorf("unexpected published progress %+v", published)
+	}
+
+	if p := gt.Progress(false, BucketKey(now)); len(p) != 1 || p[0].ID != 1 {
+		t.Errorf("expected only the active goal, got %+v", p)
+	}
+	if p := gt.Progress(true, BucketKey(now)); len(p) != 2 || p[0].ID != 2 {
+		t.Errorf("expected every goal ordered by start, got %+v", p)
+	}
+
+	gt.Remove(1)
+	gt.HandleMessage(orderMessage(now, 15))
+	if len(published) != 3 {
+		t.Error("expected no publish without a matching goal")
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// this is a subset of GraphQL big enough for the stream server schema:
+// queries & subscriptions with aliases, arguments, variables, fragments and
+// the @include & @skip directives, there is no introspection as the schema is
+// served as SDL instead
+
+// gqlDocument is a parsed request
+type gqlDocument struct {
+	Operations []*gqlOperation
+	Fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	// query or subscription
+	Type       string
+	Name       string
+	Variables  []gqlVariableDef
+	Selections []gqlSelection
+}
+
+type gqlVariableDef struct {
+	Name     string
+	Type     string
+	Default  interface{}
+	Required bool
+}
+
+type gqlFragment struct {
+	TypeCondition string
+	Selections    []gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread (Spread) or an inline fragment
+// (Inline)
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Directives map[string]map[string]interface{}
+	Selections []gqlSelection
+	Spread     string
+	Inline     bool
+	// type condition of inline fragments
+	On string
+}
+
+// ResponseKey is the alias or the name of a field
+func (s *gqlSelection) ResponseKey() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// gqlVariable is a reference to a variable in a value
+type gqlVariable string
+
+// gqlEnum is an enum value, resolvers see it as a string
+type gqlEnum string
+
+type gqlToken struct {
+	kind  byte // n name, i int, f float, s string, p punctuator, e end
+	value string
+	pos   int
+}
+
+// gqlLex splits a request into tokens, commas & comments are ignored
+func gqlLex(src string) ([]gqlToken, error) {
+	var toks []gqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			toks = append(toks, gqlToken{kind: 'p', value: "...", pos: i})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+			toks = append(toks, gqlToken{kind: 'p', value: string(c), pos: i})
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(src) && (src[i] == '_' || (src[i] >= 'a' && src[i] <= 'z') || (src[i] >= 'A' && src[i] <= 'Z') || (src[i] >= '0' && src[i] <= '9')) {
+				i++
+			}
+			toks = append(toks, gqlToken{kind: 'n', value: src[start:i], pos: start})
+		case c == '-' || (c >= '0' && c <= '9'):
+			start := i
+			kind := byte('i')
+			i++
+			for i < len(src) && ((src[i] >= '0' && src[i] <= '9') || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				((src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E'))) {
+				if src[i] == '.' || src[i] == 'e' || src[i] == 'E' {
+					kind = 'f'
+				}
+				i++
+			}
+			toks = append(toks, gqlToken{kind: kind, value: src[start:i], pos: start})
+		case c == '"':
+			s, n, err := gqlLexString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%v at %d", err, i)
+			}
+			toks = append(toks, gqlToken{kind: 's', value: s, pos: i})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("unexpected character %q at %d", r, i)
+		}
+	}
+	return append(toks, gqlToken{kind: 'e', pos: len(src)}), nil
+}
+
+// gqlLexString reads a string or block string, returns the value & the
+// number of bytes read
+func gqlLexString(src string) (string, int, error) {
+	if strings.HasPrefix(src, `"""`) {
+		end := strings.Index(src[3:], `"""`)
+		if end < 0 {
+			return "", 0, fmt.Errorf("unterminated block string")
+		}
+		return strings.TrimSpace(strings.ReplaceAll(src[3:3+end], `\"""`, `"""`)), end + 6, nil
+	}
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '\\':
+			i++
+			if i >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch src[i] {
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, fmt.Errorf("bad unicode escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case '"', '\\', '/':
+				b.WriteByte(src[i])
+			default:
+				return "", 0, fmt.Errorf("bad escape \\%c", src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// gqlMaxDepth caps how deeply selections, types & values may nest
+const gqlMaxDepth = 32
+
+type gqlParser struct {
+	toks  []gqlToken
+	i     int
+	depth int
+}
+
+// enter goes one level deeper, i.e. into a selection set, list or object
+func (p *gqlParser) enter() error {
+	if p.depth++; p.depth > gqlMaxDepth {
+		return fmt.Errorf("document nests deeper than %d levels", gqlMaxDepth)
+	}
+	return nil
+}
+
+func (p *gqlParser) leave() {
+	p.depth--
+}
+
+// ParseGraphQL parses a request document
+func ParseGraphQL(src string) (*gqlDocument, error) {
+	toks, err := gqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{toks: toks}
+	doc := &gqlDocument{Fragments: make(map[string]*gqlFragment)}
+	for p.peek().kind != 'e' {
+		switch t := p.peek(); {
+		case t.kind == 'p' && t.value == "{":
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, &gqlOperation{Type: "query", Selections: sels})
+		case t.kind == 'n' && t.value == "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.keyword("on"); err != nil {
+				return nil, err
+			}
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.Fragments[name]; dup {
+				return nil, fmt.Errorf("fragment %s is defined twice", name)
+			}
+			doc.Fragments[name] = &gqlFragment{TypeCondition: on, Selections: sels}
+		case t.kind == 'n' && (t.value == "query" || t.value == "subscription" || t.value == "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.Operations = append(doc.Operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("document has no operations")
+	}
+	return doc, nil
+}
+
+// Operation picks the operation to run, the name is needed when there are
+// several
+func (doc *gqlDocument) Operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("operationName is needed when there are several operations")
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %s", name)
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.toks[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.toks[p.i]
+	if t.kind != 'e' {
+		p.i++
+	}
+	return t
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 'e' {
+		return fmt.Errorf("unexpected end of document")
+	}
+	return fmt.Errorf("unexpected %q at %d", t.value, t.pos)
+}
+
+// punct consumes a punctuator if it is next
+func (p *gqlParser) punct(v string) bool {
+	if t := p.peek(); t.kind == 'p' && t.value == v {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(v string) error {
+	if !p.punct(v) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	if t := p.peek(); t.kind == 'n' {
+		p.i++
+		return t.value, nil
+	}
+	return "", p.unexpected()
+}
+
+func (p *gqlParser) keyword(v string) error {
+	if t := p.peek(); t.kind == 'n' && t.value == v {
+		p.i++
+		return nil
+	}
+	return p.unexpected()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{Type: p.next().value}
+	if p.peek().kind == 'n' {
+		op.Name = p.next().value
+	}
+	if p.punct("(") {
+		for !p.punct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var v gqlVariableDef
+			var err error
+			if v.Name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if v.Type, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			v.Required = strings.HasSuffix(v.Type, "!")
+			if p.punct("=") {
+				if v.Default, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			op.Variables = append(op.Variables, v)
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.Selections, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef reads a type such as [String!]! back into text
+func (p *gqlParser) typeRef() (string, error) {
+	var t string
+	if p.punct("[") {
+		if err := p.enter(); err != nil {
+			return "", err
+		}
+		defer p.leave()
+		inner, err := p.typeRef()
+		if err != nil {
+			return "", err
+		}
+		if err = p.expect("]"); err != nil {
+			return "", err
+		}
+		t = "[" + inner + "]"
+	} else {
+		name, err := p.name()
+		if err != nil {
+			return "", err
+		}
+		t = name
+	}
+	if p.punct("!") {
+		t += "!"
+	}
+	return t, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var sels []gqlSelection
+	for !p.punct("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, sel)
+	}
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return sels, nil
+}
+
+func (p *gqlParser) selection() (gqlSelection, error) {
+	var sel gqlSelection
+	var err error
+	if p.punct("...") {
+		if t := p.peek(); t.kind == 'n' && t.value != "on" {
+			sel.Spread = p.next().value
+			sel.Directives, err = p.directives()
+			return sel, err
+		}
+		sel.Inline = true
+		if t := p.peek(); t.kind == 'n' && t.value == "on" {
+			p.next()
+			if sel.On, err = p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if sel.Directives, err = p.directives(); err != nil {
+			return sel, err
+		}
+		sel.Selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.Name, err = p.name(); err != nil {
+		return sel, err
+	}
+	if p.punct(":") {
+		sel.Alias = sel.Name
+		if sel.Name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	if sel.Args, err = p.arguments(); err != nil {
+		return sel, err
+	}
+	if sel.Directives, err = p.directives(); err != nil {
+		return sel, err
+	}
+	if t := p.peek(); t.kind == 'p' && t.value == "{" {
+		sel.Selections, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if !p.punct("(") {
+		return args, nil
+	}
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if _, dup := args[name]; dup {
+			return nil, fmt.Errorf("argument %s is given twice", name)
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() (map[string]map[string]interface{}, error) {
+	var dirs map[string]map[string]interface{}
+	for p.punct("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		if dirs == nil {
+			dirs = make(map[string]map[string]interface{})
+		}
+		dirs[name] = args
+	}
+	return dirs, nil
+}
+
+// value reads a literal, constant values can not hold variables
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.peek()
+	switch t.kind {
+	case 'i':
+		p.next()
+		n, err := strconv.ParseInt(t.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad integer %s", t.value)
+		}
+		return float64(n), nil
+	case 'f':
+		p.next()
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad float %s", t.value)
+		}
+		return f, nil
+	case 's':
+		p.next()
+		return t.value, nil
+	case 'n':
+		p.next()
+		switch t.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.value), nil
+	case 'p':
+		switch t.value {
+		case "$":
+			if constant {
+				return nil, fmt.Errorf("variables are not allowed at %d", t.pos)
+			}
+			p.next()
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			p.next()
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			list := []interface{}{}
+			for !p.punct("]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, nil
+		case "{":
+			p.next()
+			if err := p.enter(); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			obj := make(map[string]interface{})
+			for !p.punct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			return obj, nil
+		}
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// gqlObject is a GraphQL object type, Resolve returns scalars, other objects
+// or lists of them
+type gqlObject interface {
+	TypeName() string
+	Resolve(field string, args map[string]interface{}) (interface{}, error)
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+type gqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// gqlMap keeps the fields in the order they were selected
+type gqlMap []gqlEntry
+
+type gqlEntry struct {
+	Key   string
+	Value interface{}
+}
+
+func (m gqlMap) MarshalJSON() ([]byte, error) {
+	b := []byte{'{'}
+	for i, e := range m {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		k, _ := json.Marshal(e.Key)
+		v, err := json.Marshal(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		b = append(append(append(b, k...), ':'), v...)
+	}
+	return append(b, '}'), nil
+}
+
+// gqlExecutor runs the selections of an operation, field errors are collected
+// & the field is null
+type gqlExecutor struct {
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	errors []gqlError
+}
+
+// newGqlExecutor checks the variables of the operation against its
+// definitions & fills in defaults
+func newGqlExecutor(doc *gqlDocument, op *gqlOperation, raw map[string]interface{}) (*gqlExecutor, error) {
+	vars := make(map[string]interface{})
+	for _, def := range op.Variables {
+		v, ok := raw[def.Name]
+		switch {
+		case ok && v != nil:
+			vars[def.Name] = v
+		case def.Default != nil:
+			vars[def.Name] = def.Default
+		case def.Required:
+			return nil, fmt.Errorf("variable $%s of type %s is required", def.Name, def.Type)
+		default:
+			vars[def.Name] = nil
+		}
+	}
+	return &gqlExecutor{doc: doc, vars: vars}, nil
+}
+
+// value replaces variables & enums in an argument
+func (e *gqlExecutor) value(v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case gqlVariable:
+		res, ok := e.vars[string(val)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", val)
+		}
+		return res, nil
+	case gqlEnum:
+		return string(val), nil
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i := range val {
+			var err error
+			if out[i], err = e.value(val[i]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k := range val {
+			var err error
+			if out[k], err = e.value(val[k]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+func (e *gqlExecutor) args(raw map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		var err error
+		if out[k], err = e.value(v); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// included evaluates @include & @skip
+func (e *gqlExecutor) included(dirs map[string]map[string]interface{}) (bool, error) {
+	for name, want := range map[string]bool{"include": true, "skip": false} {
+		d, ok := dirs[name]
+		if !ok {
+			continue
+		}
+		v, err := e.value(d["if"])
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a boolean if", name)
+		}
+		if b != want {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// gqlField is a response key with the selections merged from every place it
+// was selected
+type gqlField struct {
+	key        string
+	sel        gqlSelection
+	selections []gqlSelection
+}
+
+// collect expands fragments & merges fields with the same response key
+func (e *gqlExecutor) collect(typeName string, sels []gqlSelection, fields []*gqlField, visited map[string]bool) ([]*gqlField, error) {
+	for _, sel := range sels {
+		ok, err := e.included(sel.Directives)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case sel.Spread != "":
+			if visited[sel.Spread] {
+				continue
+			}
+			frag, ok := e.doc.Fragments[sel.Spread]
+			if !ok {
+				return nil, fmt.Errorf("unknown fragment %s", sel.Spread)
+			}
+			visited[sel.Spread] = true
+			if frag.TypeCondition != typeName {
+				continue
+			}
+			if fields, err = e.collect(typeName, frag.Selections, fields, visited); err != nil {
+				return nil, err
+			}
+		case sel.Inline:
+			if sel.On != "" && sel.On != typeName {
+				continue
+			}
+			if fields, err = e.collect(typeName, sel.Selections, fields, visited); err != nil {
+				return nil, err
+			}
+		default:
+			key := sel.ResponseKey()
+			var f *gqlField
+			for _, existing := range fields {
+				if existing.key == key {
+					f = existing
+				}
+			}
+			if f == nil {
+				f = &gqlField{key: key, sel: sel}
+				fields = append(fields, f)
+			} else if f.sel.Name != sel.Name {
+				return nil, fmt.Errorf("%s selects both %s & %s", key, f.sel.Name, sel.Name)
+			}
+			f.selections = append(f.selections, sel.Selections...)
+		}
+	}
+	return fields, nil
+}
+
+// object resolves the selections of an object
+func (e *gqlExecutor) object(obj gqlObject, sels []gqlSelection, path []interface{}) interface{} {
+	fields, err := e.collect(obj.TypeName(), sels, nil, make(map[string]bool))
+	if err != nil {
+		e.fail(err, path)
+		return nil
+	}
+	res := make(gqlMap, 0, len(fields))
+	for _, f := range fields {
+		fieldPath := append(append([]interface{}{}, path...), f.key)
+		if f.sel.Name == "__typename" {
+			res = append(res, gqlEntry{f.key, obj.TypeName()})
+			continue
+		}
+		args, err := e.args(f.sel.Args)
+		if err != nil {
+			e.fail(err, fieldPath)
+			res = append(res, gqlEntry{f.key, nil})
+			continue
+		}
+		v, err := obj.Resolve(f.sel.Name, args)
+		if err != nil {
+			e.fail(err, fieldPath)
+			res = append(res, gqlEntry{f.key, nil})
+			continue
+		}
+		res = append(res, gqlEntry{f.key, e.complete(v, f.sel.Name, f.selections, fieldPath)})
+	}
+	return res
+}
+
+// complete turns a resolved value into its response
+func (e *gqlExecutor) complete(v interface{}, name string, sels []gqlSelection, path []interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case gqlObject:
+		if len(sels) == 0 {
+			e.fail(fmt.Errorf("field %s of type %s must have a selection of subfields", name, val.TypeName()), path)
+			return nil
+		}
+		return e.object(val, sels, path)
+	case []gqlObject:
+		out := make([]interface{}, len(val))
+		for i := range val {
+			out[i] = e.complete(val[i], name, sels, append(append([]interface{}{}, path...), i))
+		}
+		return out
+	}
+	if len(sels) > 0 {
+		e.fail(fmt.Errorf("field %s has no subfields", name), path)
+		return nil
+	}
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+func (e *gqlExecutor) fail(err error, path []interface{}) {
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: path})
+}
+
+// Execute runs the operation on the root object
+func (e *gqlExecutor) Execute(root gqlObject, op *gqlOperation) *gqlResponse {
+	data := e.object(root, op.Selections, nil)
+	res := &gqlResponse{Data: data, Errors: e.errors}
+	e.errors = nil
+	return res
+}
+
+// gqlString reads a string argument
+func gqlString(args map[string]interface{}, name string, required bool) (string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		if required {
+			return "", fmt.Errorf("argument %s is required", name)
+		}
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %s must be a string", name)
+	}
+	return s, nil
+}
+
+// gqlInt reads an integer argument
+func gqlInt(args map[string]interface{}, name string, def int) (int, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return def, nil
+	}
+	f, ok := v.(float64)
+	if !ok || f != float64(int(f)) {
+		return 0, fmt.Errorf("argument %s must be an integer", name)
+	}
+	return int(f), nil
+}
+
+// gqlBool reads a boolean argument
+func gqlBool(args map[string]interface{}, name string, def bool) (bool, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return def, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("argument %s must be a boolean", name)
+	}
+	return b, nil
+}
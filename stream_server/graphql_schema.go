@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// graphqlSchema documents the types served at /graphql, it is returned by
+// /graphql/schema for code generation
+const graphqlSchema = `scalar Time
+scalar JSON
+
+type Query {
+  "topics that can be subscribed to"
+  topics: [String!]!
+  "bucketed history of a fact table topic, the same as the first event of its stream"
+  history(topic: String!, groupMinute: Int = 1, from: Time): [Bucket!]!
+  "history rolled up by the date dimension, from & to are YYYY-MM-DD"
+  calendar(topic: String!, by: String!, splitWeekend: Boolean = false, from: String, to: String): [CalendarBucket!]!
+  "rows of the date dimension, from & to are YYYY-MM-DD"
+  dates(from: String, to: String): [Date!]!
+}
+
+type Subscription {
+  "events of a fact table topic as they arrive"
+  events(topic: String!): [Event!]!
+  "messages of any topic with the payload sent over SSE"
+  messages(topic: String!): Message!
+}
+
+type FieldValue {
+  name: String!
+  value: Float!
+}
+
+type Attribute {
+  name: String!
+  value: String!
+}
+
+type Bucket {
+  timeStamp: Time!
+  fields: [FieldValue!]!
+  value(field: String!): Float
+}
+
+type CalendarBucket {
+  label: String!
+  dayType: String
+  start: String!
+  end: String!
+  days: Int!
+  "grouped date_dimension columns"
+  dimensions: JSON!
+  fields: [FieldValue!]!
+  value(field: String!): Float
+}
+
+type Date {
+  date: String!
+  year: Int!
+  quarter: Int!
+  quarterName: String!
+  month: Int!
+  monthName: String!
+  week: Int!
+  weekday: Int!
+  weekdayName: String!
+  dayOfMonth: Int!
+  dayOfYear: Int!
+  weekend: Boolean!
+}
+
+type Event {
+  timeStamp: Time!
+  fields: [FieldValue!]!
+  value(field: String!): Float
+  attributes: [Attribute!]!
+  attribute(name: String!): String
+}
+
+type Message {
+  topic: String!
+  timeStamp: Time!
+  payload: JSON
+}
+`
+
+// maxDimensionDates caps the dates query at about ten years
+const maxDimensionDates = 3660
+
+// gqlRequest copies the request with the GraphQL arguments as the query
+// string so the REST parameter parsing is shared
+func gqlRequest(r *http.Request, params map[string]string) *http.Request {
+	q := url.Values{}
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	c := r.Clone(r.Context())
+	c.URL.RawQuery = q.Encode()
+	return c
+}
+
+func unknownField(typeName, field string) error {
+	return fmt.Errorf("unknown field %s on type %s", field, typeName)
+}
+
+// gqlQuery is the Query root
+type gqlQuery struct {
+	api *API
+	r   *http.Request
+}
+
+func (q *gqlQuery) TypeName() string { return "Query" }
+
+func (q *gqlQuery) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "topics":
+		return q.api.Kafka.Topics(), nil
+	case "history":
+		spec, err := gqlTopicSpec(args)
+		if err != nil {
+			return nil, err
+		}
+		groupMinute, err := gqlInt(args, "groupMinute", 1)
+		if err != nil {
+			return nil, err
+		}
+		from, err := gqlString(args, "from", false)
+		if err != nil {
+			return nil, err
+		}
+		r := gqlRequest(q.r, map[string]string{"groupMinute": strconv.Itoa(groupMinute), "from": from})
+		buckets, err := q.api.getHistory(r, spec)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]gqlObject, len(buckets))
+		for i := range buckets {
+			out[i] = gqlBucket(buckets[i])
+		}
+		return out, nil
+	case "calendar":
+		spec, err := gqlTopicSpec(args)
+		if err != nil {
+			return nil, err
+		}
+		params := map[string]string{}
+		for _, name := range []string{"by", "from", "to"} {
+			if params[name], err = gqlString(args, name, name == "by"); err != nil {
+				return nil, err
+			}
+		}
+		split, err := gqlBool(args, "splitWeekend", false)
+		if err != nil {
+			return nil, err
+		}
+		params["splitWeekend"] = strconv.FormatBool(split)
+		p, err := ParseCalendarParams(gqlRequest(q.r, params))
+		if err != nil {
+			return nil, err
+		}
+		buckets, err := q.api.queryCalendar(spec, p)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]gqlObject, len(buckets))
+		for i := range buckets {
+			out[i] = &gqlCalendarBucket{buckets[i]}
+		}
+		return out, nil
+	case "dates":
+		params := map[string]string{}
+		for _, name := range []string{"from", "to"} {
+			var err error
+			if params[name], err = gqlString(args, name, false); err != nil {
+				return nil, err
+			}
+		}
+		from, to, err := parseDateRange(gqlRequest(q.r, params))
+		if err != nil {
+			return nil, err
+		}
+		return q.api.queryDates(from, to)
+	}
+	return nil, unknownField(q.TypeName(), field)
+}
+
+func gqlTopicSpec(args map[string]interface{}) (*TopicSpec, error) {
+	topic, err := gqlString(args, "topic", true)
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := topicSpecs[topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %s has no history", topic)
+	}
+	return spec, nil
+}
+
+// gqlFields lists the values of a bucket or event sorted by name
+func gqlFields(values map[string]float64) []gqlObject {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make([]gqlObject, len(names))
+	for i, name := range names {
+		out[i] = &gqlPair{typeName: "FieldValue", name: name, value: values[name]}
+	}
+	return out
+}
+
+// gqlValue resolves value(field:), null when the field is not set
+func gqlValue(values map[string]float64, args map[string]interface{}) (interface{}, error) {
+	name, err := gqlString(args, "field", true)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := values[name]; ok {
+		return v, nil
+	}
+	return nil, nil
+}
+
+// gqlPair is a FieldValue or Attribute
+type gqlPair struct {
+	typeName string
+	name     string
+	value    interface{}
+}
+
+func (p *gqlPair) TypeName() string { return p.typeName }
+
+func (p *gqlPair) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "name":
+		return p.name, nil
+	case "value":
+		return p.value, nil
+	}
+	return nil, unknownField(p.typeName, field)
+}
+
+type gqlBucket Bucket
+
+func (b gqlBucket) TypeName() string { return "Bucket" }
+
+func (b gqlBucket) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "timeStamp":
+		return b.TimeStamp, nil
+	case "fields":
+		return gqlFields(b.Values), nil
+	case "value":
+		return gqlValue(b.Values, args)
+	}
+	return nil, unknownField(b.TypeName(), field)
+}
+
+type gqlCalendarBucket struct {
+	CalendarBucket
+}
+
+func (b *gqlCalendarBucket) TypeName() string { return "CalendarBucket" }
+
+func (b *gqlCalendarBucket) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "label":
+		return b.Label, nil
+	case "dayType":
+		if b.DayType == "" {
+			return nil, nil
+		}
+		return b.DayType, nil
+	case "start":
+		return b.Start.Format("2006-01-02"), nil
+	case "end":
+		return b.End.Format("2006-01-02"), nil
+	case "days":
+		return b.Days, nil
+	case "dimensions":
+		return b.Dimensions, nil
+	case "fields":
+		return gqlFields(b.Values), nil
+	case "value":
+		return gqlValue(b.Values, args)
+	}
+	return nil, unknownField(b.TypeName(), field)
+}
+
+// gqlDate is a row of mart.date_dimension
+type gqlDate struct {
+	Date        time.Time
+	Year        int
+	Quarter     int
+	QuarterName string
+	Month       int
+	MonthName   string
+	Week        int
+	Weekday     int
+	WeekdayName string
+	DayOfMonth  int
+	DayOfYear   int
+	Weekend     bool
+}
+
+func (d *gqlDate) TypeName() string { return "Date" }
+
+func (d *gqlDate) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "date":
+		return d.Date.Format("2006-01-02"), nil
+	case "year":
+		return d.Year, nil
+	case "quarter":
+		return d.Quarter, nil
+	case "quarterName":
+		return d.QuarterName, nil
+	case "month":
+		return d.Month, nil
+	case "monthName":
+		return d.MonthName, nil
+	case "week":
+		return d.Week, nil
+	case "weekday":
+		return d.Weekday, nil
+	case "weekdayName":
+		return d.WeekdayName, nil
+	case "dayOfMonth":
+		return d.DayOfMonth, nil
+	case "dayOfYear":
+		return d.DayOfYear, nil
+	case "weekend":
+		return d.Weekend, nil
+	}
+	return nil, unknownField(d.TypeName(), field)
+}
+
+// queryDates reads the date dimension in the range
+func (api *API) queryDates(from, to time.Time) ([]gqlObject, error) {
+	where, args := dateRangeWhere(from, to)
+	if where != "" {
+		where = "where " + where
+	}
+	rows, err := api.dm.Raw(fmt.Sprintf(`
+select dd.the_date, dd.the_year, dd.quarter_number, trim(dd.quarter_name), dd.month_number, trim(dd.month_name),
+	dd.week_of_year, dd.weekday_number, trim(dd.weekday_name), dd.day_of_month, dd.day_of_year, dd.weekend
+from mart.date_dimension dd
+%s
+order by dd.the_date
+limit %d`, where, maxDimensionDates), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []gqlObject{}
+	for rows.Next() {
+		var d gqlDate
+		if err = rows.Scan(&d.Date, &d.Year, &d.Quarter, &d.QuarterName, &d.Month, &d.MonthName,
+			&d.Week, &d.Weekday, &d.WeekdayName, &d.DayOfMonth, &d.DayOfYear, &d.Weekend); err != nil {
+			return nil, err
+		}
+		out = append(out, &d)
+	}
+	return out, rows.Err()
+}
+
+type gqlEvent Event
+
+func (e *gqlEvent) TypeName() string { return "Event" }
+
+func (e *gqlEvent) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "timeStamp":
+		return e.TimeStamp, nil
+	case "fields":
+		return gqlFields(e.Values), nil
+	case "value":
+		return gqlValue(e.Values, args)
+	case "attributes":
+		names := make([]string, 0, len(e.Attrs))
+		for name := range e.Attrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		out := make([]gqlObject, len(names))
+		for i, name := range names {
+			out[i] = &gqlPair{typeName: "Attribute", name: name, value: e.Attrs[name]}
+		}
+		return out, nil
+	case "attribute":
+		name, err := gqlString(args, "name", true)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := e.Attrs[name]; ok {
+			return v, nil
+		}
+		return nil, nil
+	}
+	return nil, unknownField(e.TypeName(), field)
+}
+
+type gqlMessage struct {
+	msg *sarama.ConsumerMessage
+}
+
+func (m *gqlMessage) TypeName() string { return "Message" }
+
+func (m *gqlMessage) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "topic":
+		return m.msg.Topic, nil
+	case "timeStamp":
+		return m.msg.Timestamp, nil
+	case "payload":
+		// payloads that are not JSON are sent as a string
+		if json.Valid(m.msg.Value) {
+			return json.RawMessage(m.msg.Value), nil
+		}
+		return string(m.msg.Value), nil
+	}
+	return nil, unknownField(m.TypeName(), field)
+}
+
+// gqlSubscriptionField is the single root field of a subscription, Value
+// turns each message of the topic into the field's value
+type gqlSubscriptionField struct {
+	Key        string
+	Name       string
+	Topic      string
+	Selections []gqlSelection
+	Value      func(msg *sarama.ConsumerMessage) (interface{}, error)
+}
+
+// subscriptionField checks the root field of a subscription
+func (api *API) subscriptionField(ex *gqlExecutor, op *gqlOperation) (*gqlSubscriptionField, error) {
+	fields, err := ex.collect("Subscription", op.Selections, nil, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("a subscription must select exactly one field")
+	}
+	f := fields[0]
+	args, err := ex.args(f.sel.Args)
+	if err != nil {
+		return nil, err
+	}
+	topic, err := gqlString(args, "topic", true)
+	if err != nil {
+		return nil, err
+	}
+	sf := &gqlSubscriptionField{Key: f.key, Name: f.sel.Name, Topic: topic, Selections: f.selections}
+	switch f.sel.Name {
+	case "events":
+		if _, ok := topicSpecs[topic]; !ok {
+			return nil, fmt.Errorf("topic %s does not send events, use messages", topic)
+		}
+		sf.Value = func(msg *sarama.ConsumerMessage) (interface{}, error) {
+			events, err := ParseEvents(msg.Value)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]gqlObject, len(events))
+			for i := range events {
+				e := gqlEvent(events[i])
+				out[i] = &e
+			}
+			return out, nil
+		}
+	case "messages":
+		if !api.Kafka.HasTopic(topic) {
+			return nil, fmt.Errorf("unknown topic %s", topic)
+		}
+		sf.Value = func(msg *sarama.ConsumerMessage) (interface{}, error) {
+			return &gqlMessage{msg: msg}, nil
+		}
+	default:
+		return nil, unknownField("Subscription", f.sel.Name)
+	}
+	return sf, nil
+}
+
+// Result executes the selections on the value of one message
+func (sf *gqlSubscriptionField) Result(ex *gqlExecutor, msg *sarama.ConsumerMessage) *gqlResponse {
+	v, err := sf.Value(msg)
+	if err != nil {
+		return &gqlResponse{Data: gqlMap{{sf.Key, nil}}, Errors: []gqlError{{Message: err.Error(), Path: []interface{}{sf.Key}}}}
+	}
+	data := gqlMap{{sf.Key, ex.complete(v, sf.Name, sf.Selections, []interface{}{sf.Key})}}
+	res := &gqlResponse{Data: data, Errors: ex.errors}
+	ex.errors = nil
+	return res
+}
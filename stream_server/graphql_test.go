@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	doc, err := ParseGraphQL(`
+# history of a topic
+query History($topic: String!, $g: Int = 5) {
+  h: history(topic: $topic, groupMinute: $g) { ...B timeStamp @skip(if: true) }
+  topics
+}
+fragment B on Bucket { value(field: "revenue") }
+subscription { events(topic: "order_count") { attribute(name: "pro\"duct") } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Operations) != 2 || doc.Fragments["B"] == nil {
+		t.Fatalf("unexpected document %+v", doc)
+	}
+	op, err := doc.Operation("History")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Type != "query" || len(op.Variables) != 2 || !op.Variables[0].Required || op.Variables[1].Default != 5.0 {
+		t.Errorf("unexpected variables %+v", op.Variables)
+	}
+	h := op.Selections[0]
+	if h.Alias != "h" || h.Name != "history" || h.Args["topic"] != gqlVariable("topic") || len(h.Selections) != 2 {
+		t.Errorf("unexpected field %+v", h)
+	}
+	if _, err = doc.Operation(""); err == nil {
+		t.Error("expected error picking from several operations")
+	}
+	sub := doc.Operations[1].Selections[0].Selections[0]
+	if sub.Args["name"] != `pro"duct` {
+		t.Errorf("unexpected string %v", sub.Args["name"])
+	}
+
+	deep := []string{
+		"{ a(b: " + strings.Repeat("[", 100000) + strings.Repeat("]", 100000) + ") }",
+		strings.Repeat("{ a ", gqlMaxDepth+1) + strings.Repeat("}", gqlMaxDepth+1),
+		"query ($v: " + strings.Repeat("[", gqlMaxDepth+1) + "Int" + strings.Repeat("]", gqlMaxDepth+1) + ") { a }",
+	}
+	if _, err = ParseGraphQL(strings.Repeat("{ a ", gqlMaxDepth) + strings.Repeat("}", gqlMaxDepth)); err != nil {
+		t.Errorf("unexpected error at the depth limit: %v", err)
+	}
+	for _, src := range append(deep, "", "{", "{ a(b: ) }", "query { a } }", `{ a(b: "x) }`, "{ a(b: 1, b: 2) }", "{ }") {
+		if _, err = ParseGraphQL(src); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
+
+type testObject struct {
+	name string
+}
+
+func (o *testObject) TypeName() string { return "Test" }
+
+func (o *testObject) Resolve(field string, args map[string]interface{}) (interface{}, error) {
+	switch field {
+	case "name":
+		return o.name, nil
+	case "child":
+		return &testObject{name: o.name + "/child"}, nil
+	case "children":
+		n, err := gqlInt(args, "n", 2)
+		if err != nil {
+			return nil, err
+		}
+		var out []gqlObject
+		for i := 0; i < n; i++ {
+			out = append(out, &testObject{name: o.name + "/" + string(rune('a'+i))})
+		}
+		return out, nil
+	case "fail":
+		return nil, errors.New("boom")
+	case "at":
+		return time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	return nil, unknownField(o.TypeName(), field)
+}
+
+func runTestQuery(t *testing.T, query string, vars map[string]interface{}) string {
+	body := gqlRequestBody{Query: query, Variables: vars}
+	op, ex, err := body.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(ex.Execute(&testObject{name: "root"}, op))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestGraphQLExecute(t *testing.T) {
+	res := runTestQuery(t, `query($n: Int, $skip: Boolean!) {
+  name
+  kids: children(n: $n) { name __typename }
+  child { ... on Test { name } ...F @include(if: $skip) }
+  at
+}
+fragment F on Test { child { name } }`, map[string]interface{}{"n": 1.0, "skip": false})
+	expected := `{"data":{"name":"root","kids":[{"name":"root/a","__typename":"Test"}],"child":{"name":"root/child"},"at":"2020-01-01T00:00:00Z"}}`
+	if res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	// field errors are null with a path
+	res = runTestQuery(t, `{ name fail child { nope } }`, nil)
+	expected = `{"data":{"name":"root","fail":null,"child":{"nope":null}},"errors":[{"message":"boom","path":["fail"]},{"message":"unknown field nope on type Test","path":["child","nope"]}]}`
+	if res != expected {
+		t.Errorf("expected %s, got %s", expected, res)
+	}
+
+	res = runTestQuery(t, `{ child name { x } }`, nil)
+	if !strings.Contains(res, "must have a selection") || !strings.Contains(res, "has no subfields") {
+		t.Errorf("expected selection errors, got %s", res)
+	}
+
+	body := gqlRequestBody{Query: `query($n: Int!) { children(n: $n) { name } }`}
+	if _, _, err := body.prepare(); err == nil {
+		t.Error("expected error for a missing required variable")
+	}
+	body = gqlRequestBody{Query: `mutation { name }`}
+	if _, _, err := body.prepare(); err == nil {
+		t.Error("expected error for a mutation")
+	}
+}
+
+func TestGraphQLSocketSubscription(t *testing.T) {
+	api := &API{Config: DefaultConfig(), Kafka: KafkaInit()}
+	api.Config.Auth.Tokens = []string{"secret"}
+	srv := httptest.NewServer(api.graphqlSocket())
+	defer srv.Close()
+
+	conf, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http"), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Protocol = []string{graphqlWSProtocol}
+	ws, err := websocket.DialConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	receive := func() gqlWSMessage {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var m gqlWSMessage
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	websocket.JSON.Send(ws, gqlWSMessage{Type: "connection_init", Payload: json.RawMessage(`{"Authorization": "Bearer secret"}`)})
+	if m := receive(); m.Type != "connection_ack" {
+		t.Fatalf("expected ack, got %+v", m)
+	}
+
+	payload, _ := json.Marshal(gqlRequestBody{Query: `subscription { events(topic: "order_count") { value(field: "revenue") } }`})
+	websocket.JSON.Send(ws, gqlWSMessage{ID: "1", Type: "subscribe", Payload: payload})
+	// wait for the subscription to reach the fan-out
+	topic := "order_count"
+	for i := 0; i < 100; i++ {
+		api.Kafka.stLock.RLock()
+		n := len(api.Kafka.subs[topic].clients)
+		api.Kafka.stLock.RUnlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	api.Kafka.Publish(topic, orderMessage(time.Now(), 12.5).Value)
+	m := receive()
+	if m.ID != "1" || m.Type != "next" || string(m.Payload) != `{"data":{"events":[{"value":12.5}]}}` {
+		t.Errorf("unexpected message %+v %s", m, m.Payload)
+	}
+
+	// bad subscriptions get an error & the socket stays open
+	payload, _ = json.Marshal(gqlRequestBody{Query: `subscription { events(topic: "kpis") { value(field: "aov") } }`})
+	websocket.JSON.Send(ws, gqlWSMessage{ID: "2", Type: "subscribe", Payload: payload})
+	if m = receive(); m.ID != "2" || m.Type != "error" {
+		t.Errorf("expected error, got %+v", m)
+	}
+	websocket.JSON.Send(ws, gqlWSMessage{Type: "ping"})
+	if m = receive(); m.Type != "pong" {
+		t.Errorf("expected pong, got %+v", m)
+	}
+}
+
+func TestGraphQLSocketUnauthorized(t *testing.T) {
+	api := &API{Config: DefaultConfig(), Kafka: KafkaInit()}
+	api.Config.Auth.Tokens = []string{"secret"}
+	srv := httptest.NewServer(api.graphqlSocket())
+	defer srv.Close()
+
+	conf, _ := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http"), srv.URL)
+	conf.Protocol = []string{graphqlWSProtocol}
+	ws, err := websocket.DialConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	websocket.JSON.Send(ws, gqlWSMessage{Type: "connection_init", Payload: json.RawMessage(`{"token": "wrong"}`)})
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var m gqlWSMessage
+	if err = websocket.JSON.Receive(ws, &m); err == nil {
+		t.Errorf("expected the socket to be closed, got %+v", m)
+	}
+}
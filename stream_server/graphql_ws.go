@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// graphqlWSProtocol is the graphql-ws library's protocol, the older
+// subscriptions-transport-ws protocol is not supported
+const graphqlWSProtocol = "graphql-transport-ws"
+
+// how long a socket has to send connection_init
+const graphqlInitTimeout = 10 * time.Second
+
+// graphqlMaxBytes caps a request body or WebSocket message
+const graphqlMaxBytes = 1 << 20
+
+// gqlRequestBody is a GraphQL request over HTTP or in a subscribe message
+type gqlRequestBody struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// prepare parses the request & picks its operation
+func (body *gqlRequestBody) prepare() (*gqlOperation, *gqlExecutor, error) {
+	doc, err := ParseGraphQL(body.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	op, err := doc.Operation(body.OperationName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if op.Type == "mutation" {
+		return nil, nil, fmt.Errorf("mutations are not supported")
+	}
+	ex, err := newGqlExecutor(doc, op, body.Variables)
+	if err != nil {
+		return nil, nil, err
+	}
+	return op, ex, nil
+}
+
+type gqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// gqlSocket is one WebSocket connection running any number of operations
+type gqlSocket struct {
+	api *API
+	ws  *websocket.Conn
+	r   *http.Request
+	// writes come from every subscription
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+// graphqlSocket accepts WebSockets speaking graphql-transport-ws, the origin
+// is not checked the same as the CORS setup
+func (api *API) graphqlSocket() websocket.Server {
+	return websocket.Server{
+		Handshake: func(c *websocket.Config, r *http.Request) error {
+			if !SliceContainsString(c.Protocol, graphqlWSProtocol) {
+				return fmt.Errorf("the %s subprotocol is required", graphqlWSProtocol)
+			}
+			c.Protocol = []string{graphqlWSProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.MaxPayloadBytes = graphqlMaxBytes
+			s := &gqlSocket{api: api, ws: ws, r: ws.Request(), subs: make(map[string]context.CancelFunc)}
+			s.serve()
+		},
+	}
+}
+
+func (s *gqlSocket) send(m gqlWSMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return websocket.JSON.Send(s.ws, m)
+}
+
+func (s *gqlSocket) sendPayload(id, typ string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return s.send(gqlWSMessage{ID: id, Type: typ, Payload: b})
+}
+
+// serve runs until the client goes away or breaks the protocol, the socket is
+// closed without a protocol close code as x/net/websocket always closes
+// normally
+func (s *gqlSocket) serve() {
+	defer s.ws.Close()
+	if !s.init() {
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		for _, cancel := range s.subs {
+			cancel()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	}()
+
+	for {
+		var m gqlWSMessage
+		if err := websocket.JSON.Receive(s.ws, &m); err != nil {
+			s.api.reqLogTrace(s.r, "graphql socket closed: %s", err.Error())
+			return
+		}
+		switch m.Type {
+		case "ping":
+			s.send(gqlWSMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !s.subscribe(m) {
+				return
+			}
+		case "complete":
+			s.mu.Lock()
+			if cancel, ok := s.subs[m.ID]; ok {
+				cancel()
+				delete(s.subs, m.ID)
+			}
+			s.mu.Unlock()
+		default:
+			s.api.reqLogError(s.r, "unexpected graphql socket message %s", m.Type)
+			return
+		}
+	}
+}
+
+// init waits for connection_init & authorizes with the upgrade request or the
+// Authorization (or token) in its payload
+func (s *gqlSocket) init() bool {
+	s.ws.SetReadDeadline(time.Now().Add(graphqlInitTimeout))
+	var m gqlWSMessage
+	if err := websocket.JSON.Receive(s.ws, &m); err != nil || m.Type != "connection_init" {
+		s.api.reqLogError(s.r, "graphql socket did not send connection_init")
+		return false
+	}
+	s.ws.SetReadDeadline(time.Time{})
+
+	token := requestToken(s.r)
+	if !s.api.authorized(token) {
+		var payload map[string]string
+		json.Unmarshal(m.Payload, &payload)
+		for _, k := range []string{"Authorization", "authorization"} {
+			if t := bearerToken(payload[k]); t != "" {
+				token = t
+			}
+		}
+		if t := payload["token"]; t != "" {
+			token = t
+		}
+		if !s.api.authorized(token) {
+			s.api.reqLogError(s.r, "unauthorized graphql socket")
+			return false
+		}
+	}
+	return s.send(gqlWSMessage{Type: "connection_ack"}) == nil
+}
+
+// subscribe starts an operation, queries are answered at once & subscriptions
+// run until completed, false closes the socket
+func (s *gqlSocket) subscribe(m gqlWSMessage) bool {
+	if m.ID == "" {
+		return false
+	}
+	s.mu.Lock()
+	_, dup := s.subs[m.ID]
+	s.mu.Unlock()
+	if dup {
+		s.api.reqLogError(s.r, "graphql subscriber for %s already exists", m.ID)
+		return false
+	}
+
+	var body gqlRequestBody
+	if err := json.Unmarshal(m.Payload, &body); err != nil {
+		return s.sendPayload(m.ID, "error", []gqlError{{Message: "invalid payload: " + err.Error()}}) == nil
+	}
+	op, ex, err := body.prepare()
+	var sf *gqlSubscriptionField
+	if err == nil && op.Type == "subscription" {
+		sf, err = s.api.subscriptionField(ex, op)
+	}
+	if err != nil {
+		return s.sendPayload(m.ID, "error", []gqlError{{Message: err.Error()}}) == nil
+	}
+
+	if sf == nil {
+		res := ex.Execute(&gqlQuery{api: s.api, r: s.r}, op)
+		if s.sendPayload(m.ID, "next", res) != nil {
+			return false
+		}
+		return s.send(gqlWSMessage{ID: m.ID, Type: "complete"}) == nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.subs[m.ID] = cancel
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.stream(ctx, m.ID, ex, sf)
+	}()
+	return true
+}
+
+// stream sends the subscription's result for each message of its topic from
+// the same Kafka fan-out as the SSE streams
+func (s *gqlSocket) stream(ctx context.Context, id string, ex *gqlExecutor, sf *gqlSubscriptionField) {
+	clientID := id
+	if rc, ok := FromRequestContext(s.r.Context()); ok {
+		clientID = rc.ID + ":" + id
+	}
+	topic := sf.Topic
+	s.api.reqLogTrace(s.r, "subscribing graphql client to topic %s", topic)
+	s.api.Kafka.Subscribe(&clientID, &topic)
+	ch := *s.api.Kafka.GetMessage(&clientID, &topic)
+	defer func() {
+		if err := s.api.Kafka.Unsubscribe(&clientID, &topic); err != nil {
+			s.api.reqLogError(s.r, "%s", err.Error())
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, open := <-ch:
+			if !open {
+				s.send(gqlWSMessage{ID: id, Type: "complete"})
+				return
+			}
+			if err := s.sendPayload(id, "next", sf.Result(ex, msg)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// otherGroup holds the groups outside the top K
+const otherGroup = "other"
+
+// default & largest number of groups with their own series
+const (
+	defaultGroupTop = 10
+	maxGroupTop     = 100
+)
+
+// GroupByDim is a `groupBy` option, SQL is the group of an order_fact row t0
+// with Join adding the tables it needs & Key is the group of a live event
+type GroupByDim struct {
+	SQL  string
+	Join string
+	Key  func(e *Event) string
+}
+
+// groupByDims are the `groupBy` options of order_count
+var groupByDims = map[string]*GroupByDim{
+	"product": {
+		SQL: "coalesce(t0.product, 'unknown')",
+		Key: func(e *Event) string { return attrOrUnknown(e, "product") },
+	},
+	"state": {
+		SQL:  "coalesce(c.state, 'unknown')",
+		Join: "left join public.customer c on c.customer_id = t0.customer_id",
+		Key:  func(e *Event) string { return attrOrUnknown(e, "state") },
+	},
+	"weekday": {
+		SQL:  "trim(dd.weekday_name)",
+		Join: "join mart.date_dimension dd on dd.date_key = t0.date_key",
+		Key:  func(e *Event) string { return BucketKey(e.TimeStamp).Weekday().String() },
+	},
+}
+
+func attrOrUnknown(e *Event, name string) string {
+	if v := e.Attrs[name]; v != "" {
+		return v
+	}
+	return "unknown"
+}
+
+// GroupByParams are the query parameters of a grouped subscription
+type GroupByParams struct {
+	HistoryParams
+	By  string
+	Dim *GroupByDim
+	// number of groups with their own series
+	Top int
+	// field the groups are ranked by
+	RankBy string
+}
+
+// ParseGroupByParams reads `groupBy`, `top`, `rankBy` & the history params
+func ParseGroupByParams(r *http.Request, spec *TopicSpec) (*GroupByParams, error) {
+	q := r.URL.Query()
+	if spec.Name != "order_count" {
+		return nil, fmt.Errorf("groupBy is only supported on order_count")
+	}
+	hp, err := ParseHistoryParams(r)
+	if err != nil {
+		return nil, err
+	}
+	p := GroupByParams{HistoryParams: *hp, By: q.Get("groupBy"), Top: defaultGroupTop, RankBy: q.Get("rankBy")}
+	var ok bool
+	if p.Dim, ok = groupByDims[p.By]; !ok {
+		return nil, fmt.Errorf("groupBy must be product, state or weekday, got %s", p.By)
+	}
+	if s := q.Get("top"); s != "" {
+		if p.Top, err = strconv.Atoi(s); err != nil || p.Top < 1 || p.Top > maxGroupTop {
+			return nil, fmt.Errorf("top must be an integer between 1 and %d", maxGroupTop)
+		}
+	}
+	if p.RankBy == "" {
+		p.RankBy = "revenue"
+	}
+	if spec.Field(p.RankBy) == nil {
+		return nil, fmt.Errorf("unknown field %s for topic %s", p.RankBy, spec.Name)
+	}
+	return &p, nil
+}
+
+// GroupSeries is the series of one group
+type GroupSeries struct {
+	Group   string   `json:"group"`
+	Buckets []Bucket `json:"buckets"`
+}
+
+// GroupedSeries splits a topic into a series per group for the top groups &
+// sums the rest into other, groups seen live are added to the top while there
+// is room
+type GroupedSeries struct {
+	spec   *TopicSpec
+	params *GroupByParams
+	// groups with their own series
+	top map[string]bool
+	// recent buckets of each series for the running totals
+	buckets map[string]map[time.Time]*Bucket
+}
+
+func NewGroupedSeries(spec *TopicSpec, p *GroupByParams) *GroupedSeries {
+	return &GroupedSeries{
+		spec:    spec,
+		params:  p,
+		top:     make(map[string]bool),
+		buckets: make(map[string]map[time.Time]*Bucket),
+	}
+}
+
+// series maps a group to its series name
+func (gs *GroupedSeries) series(group string) string {
+	if gs.top[group] {
+		return group
+	}
+	if len(gs.top) < gs.params.Top && group != otherGroup {
+		gs.top[group] = true
+		return group
+	}
+	return otherGroup
+}
+
+// add sums a bucket into its series, returns the summed bucket
+func (gs *GroupedSeries) add(series string, b *Bucket) *Bucket {
+	m, ok := gs.buckets[series]
+	if !ok {
+		m = make(map[time.Time]*Bucket)
+		gs.buckets[series] = m
+	}
+	sum, ok := m[b.TimeStamp]
+	if !ok {
+		sum = NewBucket(b.TimeStamp)
+		m[b.TimeStamp] = sum
+	}
+	sum.Merge(b)
+	return sum
+}
+
+// Load picks the top groups by their total of the rank field & returns the
+// history of each series, the top groups first by rank & other last
+func (gs *GroupedSeries) Load(history map[string][]Bucket) []GroupSeries {
+	totals := make(map[string]float64, len(history))
+	groups := make([]string, 0, len(history))
+	for g, buckets := range history {
+		for i := range buckets {
+			totals[g] += buckets[i].Values[gs.params.RankBy]
+		}
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if totals[groups[i]] != totals[groups[j]] {
+			return totals[groups[i]] > totals[groups[j]]
+		}
+		return groups[i] < groups[j]
+	})
+
+	var ranked []string
+	for _, g := range groups {
+		if len(ranked) < gs.params.Top && g != otherGroup {
+			gs.top[g] = true
+			ranked = append(ranked, g)
+		}
+	}
+
+	merged := make(map[string]map[time.Time]*Bucket)
+	for g, buckets := range history {
+		s := gs.series(g)
+		if merged[s] == nil {
+			merged[s] = make(map[time.Time]*Bucket)
+		}
+		for i := range buckets {
+			b, ok := merged[s][buckets[i].TimeStamp]
+			if !ok {
+				b = NewBucket(buckets[i].TimeStamp)
+				merged[s][b.TimeStamp] = b
+			}
+			b.Merge(&buckets[i])
+			gs.add(s, &buckets[i])
+		}
+	}
+	if _, ok := merged[otherGroup]; ok {
+		ranked = append(ranked, otherGroup)
+	}
+
+	res := make([]GroupSeries, 0, len(ranked))
+	for _, s := range ranked {
+		series := GroupSeries{Group: s, Buckets: make([]Bucket, 0, len(merged[s]))}
+		for _, b := range merged[s] {
+			series.Buckets = append(series.Buckets, *b)
+		}
+		SortBuckets(series.Buckets)
+		res = append(res, series)
+	}
+	gs.evict(BucketTime(BucketKey(time.Now()), gs.params.GroupMinute))
+	return res
+}
+
+// HandleMessage sums the events into their series & returns the running
+// totals of the changed buckets, series without events are left out
+func (gs *GroupedSeries) HandleMessage(msg *sarama.ConsumerMessage) []GroupSeries {
+	if msg.Topic != gs.spec.Name {
+		return nil
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("groupBy could not parse message: " + err.Error())
+		return nil
+	}
+
+	changed := make(map[string]map[time.Time]*Bucket)
+	var order []string
+	var newest time.Time
+	for i := range events {
+		b := NewBucket(BucketTime(BucketKey(events[i].TimeStamp), gs.params.GroupMinute))
+		b.Add(&events[i], gs.spec.FieldNames())
+		s := gs.series(gs.params.Dim.Key(&events[i]))
+		if changed[s] == nil {
+			changed[s] = make(map[time.Time]*Bucket)
+			order = append(order, s)
+		}
+		changed[s][b.TimeStamp] = gs.add(s, b)
+		if b.TimeStamp.After(newest) {
+			newest = b.TimeStamp
+		}
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	res := make([]GroupSeries, len(order))
+	for i, s := range order {
+		res[i].Group = s
+		for _, b := range changed[s] {
+			res[i].Buckets = append(res[i].Buckets, b.Copy())
+		}
+		SortBuckets(res[i].Buckets)
+	}
+	gs.evict(newest)
+	return res
+}
+
+// evict drops buckets before the one preceding the newest, events later than
+// that start a new running total
+func (gs *GroupedSeries) evict(newest time.Time) {
+	cutoff := newest.Add(-time.Duration(gs.params.GroupMinute) * time.Minute)
+	for _, m := range gs.buckets {
+		for ts := range m {
+			if ts.Before(cutoff) {
+				delete(m, ts)
+			}
+		}
+	}
+}
+
+// groupBySQL builds the grouped history query, the group expression & joins
+// come from groupByDims so only the group minute is formatted from the request
+func groupBySQL(spec *TopicSpec, p *GroupByParams) string {
+	cols := ""
+	for _, f := range spec.Fields {
+		cols += fmt.Sprintf(", %s %s", f.SQL, f.Name)
+	}
+	where := ""
+	if !p.From.IsZero() {
+		where = "\n\twhere t0.date_key + t0.time_key >= ?"
+	}
+	return fmt.Sprintf(`
+select ts time_stamp, grp%s
+from (
+	select
+		t0.date_key + make_time(
+			extract(hour from t0.date_key + t0.time_key)::int,
+			cast(floor(extract(minute from t0.date_key + t0.time_key) / %d) * %d as int),
+			0
+		) ts
+		,%s grp
+		,t0.*
+	from %s t0
+	%s%s
+) t
+group by ts, grp
+order by time_stamp`, cols, p.GroupMinute, p.GroupMinute, p.Dim.SQL, spec.Table, p.Dim.Join, where)
+}
+
+// queryGroupBy reads the history of each group
+func (api *API) queryGroupBy(spec *TopicSpec, p *GroupByParams) (map[string][]Bucket, error) {
+	var args []interface{}
+	if !p.From.IsZero() {
+		args = append(args, p.From)
+	}
+	rows, err := api.dm.Raw(groupBySQL(spec, p), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string][]Bucket)
+	vals := make([]float64, len(spec.Fields))
+	dest := make([]interface{}, len(spec.Fields)+2)
+	for i := range vals {
+		dest[i+2] = &vals[i]
+	}
+	for rows.Next() {
+		var ts time.Time
+		var group string
+		dest[0], dest[1] = &ts, &group
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		b := NewBucket(ts)
+		for i, f := range spec.Fields {
+			b.Values[f.Name] = vals[i]
+		}
+		res[group] = append(res[group], *b)
+	}
+	return res, rows.Err()
+}
+
+// groupByView streams a series per group
+type groupByView struct {
+	spec   *TopicSpec
+	params *GroupByParams
+	series *GroupedSeries
+}
+
+func (v *groupByView) History(api *API, r *http.Request) (interface{}, error) {
+	history, err := api.queryGroupBy(v.spec, v.params)
+	if err != nil {
+		return nil, err
+	}
+	return v.series.Load(history), nil
+}
+
+func (v *groupByView) HandleMessage(msg *sarama.ConsumerMessage) interface{} {
+	if res := v.series.HandleMessage(msg); len(res) > 0 {
+		return res
+	}
+	return nil
+}
+
+func (v *groupByView) Tick(now time.Time) interface{} {
+	return nil
+}
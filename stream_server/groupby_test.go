@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseGroupByParams(t *testing.T) {
+	spec := topicSpecs["order_count"]
+	r := httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?groupBy=state", nil)
+	p, err := ParseGroupByParams(r, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.By != "state" || p.Top != defaultGroupTop || p.RankBy != "revenue" || p.GroupMinute != 1 {
+		t.Errorf("unexpected params %+v", p)
+	}
+
+	for _, q := range []string{"groupBy=city", "groupBy=product&top=0", "groupBy=product&rankBy=price"} {
+		r = httptest.NewRequest("GET", "/v0/stream/subscribe/order_count?"+q, nil)
+		if _, err = ParseGroupByParams(r, spec); err == nil {
+			t.Errorf("expected error for %s", q)
+		}
+	}
+	r = httptest.NewRequest("GET", "/v0/stream/subscribe/customer_count?groupBy=product", nil)
+	if _, err = ParseGroupByParams(r, topicSpecs["customer_count"]); err == nil {
+		t.Error("expected error for customer_count")
+	}
+}
+
+func TestGroupedSeries(t *testing.T) {
+	spec := topicSpecs["order_count"]
+	p := &GroupByParams{HistoryParams: HistoryParams{GroupMinute: 60}, By: "product", Dim: groupByDims["product"], Top: 2, RankBy: "revenue"}
+	gs := NewGroupedSeries(spec, p)
+
+	now := time.Now()
+	open := BucketTime(BucketKey(now), 60)
+	bucket := func(ts time.Time, revenue float64) Bucket {
+		return Bucket{TimeStamp: ts, Values: map[string]float64{"revenue": revenue, "n": 1, "order_count": 1}}
+	}
+	res := gs.Load(map[string][]Bucket{
+		"widget": {bucket(open.Add(-time.Hour), 10), bucket(open, 50)},
+		"gadget": {bucket(open, 30)},
+		"gizmo":  {bucket(open.Add(-time.Hour), 5)},
+		"doodad": {bucket(open, 1)},
+	})
+	if len(res) != 3 || res[0].Group != "widget" || res[1].Group != "gadget" || res[2].Group != otherGroup {
+		t.Fatalf("unexpected series %+v", res)
+	}
+	if len(res[2].Buckets) != 2 || res[2].Buckets[0].Values["revenue"] != 5 || res[2].Buckets[1].Values["revenue"] != 1 {
+		t.Errorf("unexpected other series %+v", res[2].Buckets)
+	}
+
+	// only the series of the events are sent with their running totals
+	out := gs.HandleMessage(productMessage(now, "gizmo", 1, 4))
+	if len(out) != 1 || out[0].Group != otherGroup || len(out[0].Buckets) != 1 || out[0].Buckets[0].Values["revenue"] != 5 {
+		t.Errorf("unexpected update %+v", out)
+	}
+	out = gs.HandleMessage(productMessage(now, "widget", 1, 5))
+	if len(out) != 1 || out[0].Group != "widget" || out[0].Buckets[0].Values["revenue"] != 55 {
+		t.Errorf("unexpected update %+v", out)
+	}
+}
+
+func TestGroupedSeriesLiveGroups(t *testing.T) {
+	spec := topicSpecs["order_count"]
+	p := &GroupByParams{HistoryParams: HistoryParams{GroupMinute: 1}, By: "state", Dim: groupByDims["state"], Top: 1, RankBy: "revenue"}
+	gs := NewGroupedSeries(spec, p)
+	gs.Load(nil)
+
+	now := time.Now()
+	stateMessage := func(state string) *sarama.ConsumerMessage {
+		b, _ := json.Marshal([]map[string]interface{}{{
+			"time_stamp": now.Format(time.RFC3339Nano),
+			"state":      state,
+			"revenue":    1,
+		}})
+		return &sarama.ConsumerMessage{Topic: "order_count", Value: b}
+	}
+	// the first group fills the top, later ones go to other
+	if out := gs.HandleMessage(stateMessage("NY")); len(out) != 1 || out[0].Group != "NY" {
+		t.Errorf("unexpected update %+v", out)
+	}
+	if out := gs.HandleMessage(stateMessage("")); len(out) != 1 || out[0].Group != otherGroup {
+		t.Errorf("unexpected update %+v", out)
+	}
+}
+
+func TestGroupBySQL(t *testing.T) {
+	p := &GroupByParams{HistoryParams: HistoryParams{GroupMinute: 15, From: time.Now()}, Dim: groupByDims["state"]}
+	q := groupBySQL(topicSpecs["order_count"], p)
+	for _, s := range []string{"coalesce(c.state, 'unknown') grp", "left join public.customer c", "group by ts, grp", "/ 15) * 15", ">= ?"} {
+		if !strings.Contains(q, s) {
+			t.Errorf("expected %q in %s", s, q)
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
 )
 
 // GetHealth just returns 200 if is accessible
@@ -23,13 +28,83 @@ func (api *API) StreamMessages(w http.ResponseWriter, r *http.Request) {
 	f, ok := w.(http.Flusher)
 	if !ok {
 		msg := "Streaming unsupported!"
-		api.reqLogError(r, msg)
+		api.reqLogError(r, "%s", msg)
 		http.Error(w, msg, http.StatusInternalServerError)
 		return
 	}
 
+	if !api.Kafka.HasTopic(topic) {
+		msg := "unknown topic " + topic
+		api.reqLogError(r, "%s", msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	// i.e. sliding windows computed from the fact table buckets
+	view, err := api.streamView(r, topic)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// optional batching & rate limiting for slow clients
+	opts, err := ParseDeliveryOptions(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// msgpack or cbor events, base64 in the event stream
+	format, err := ParseFormat(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	rc, ok := FromRequestContext(r.Context())
 
+	// the same events as WebSocket messages, binary formats in binary frames,
+	// the origin is not checked the same as the GraphQL socket
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			api.reqLogTrace(r, "subscribing socket client to topic %s", topic)
+			api.Kafka.Subscribe(&rc.ID, &topic)
+			ch := *api.Kafka.GetMessage(&rc.ID, &topic)
+			defer func() {
+				if err := api.Kafka.Unsubscribe(&rc.ID, &topic); err != nil {
+					api.reqLogError(r, "%s", err.Error())
+				}
+			}()
+
+			// clients send nothing, a failed read means the socket closed
+			done := make(chan struct{})
+			go func() {
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+				api.reqLogTrace(r, "client closed socket")
+				close(done)
+			}()
+
+			api.streamTopic(r, ch, done, topic, view, opts, func(b []byte) error {
+				if format == formatJSON {
+					return websocket.Message.Send(ws, string(b))
+				}
+				b, err := TranscodeJSON(format, b)
+				if err != nil {
+					api.reqLogError(r, "%s", err.Error())
+					return nil
+				}
+				return websocket.Message.Send(ws, b)
+			})
+		}}.ServeHTTP(w, r)
+		return
+	}
+
 	// Listen to the closing of the http connection via the CloseNotifier
 	notify := w.(http.CloseNotifier).CloseNotify()
 	go func() {
@@ -38,7 +113,7 @@ func (api *API) StreamMessages(w http.ResponseWriter, r *http.Request) {
 		// handle closing the connection
 		err := api.Kafka.Unsubscribe(&rc.ID, &topic)
 		if err != nil {
-			api.reqLogError(r, err.Error())
+			api.reqLogError(r, "%s", err.Error())
 			// client does not need to know this error
 			// http.Error(w, "error detaching data source", http.StatusInternalServerError)
 		}
@@ -46,142 +121,864 @@ func (api *API) StreamMessages(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// check if that Kafka consumer has been started for the topic
-	api.reqLogTrace(r, "subscribing client to topic "+topic)
+	api.reqLogTrace(r, "subscribing client to topic %s", topic)
 	api.Kafka.Subscribe(&rc.ID, &topic)
+	ch := *api.Kafka.GetMessage(&rc.ID, &topic)
+
+	w, f, closeStream := api.eventStream(w, r, f)
+	defer closeStream()
 
+	api.streamTopic(r, ch, r.Context().Done(), topic, view, opts, func(b []byte) error {
+		if format != formatJSON {
+			bin, err := TranscodeJSON(format, b)
+			if err != nil {
+				api.reqLogError(r, "%s", err.Error())
+				return nil
+			}
+			b = []byte(base64.StdEncoding.EncodeToString(bin))
+		}
+		// Write to the ResponseWriter, `w`.
+		fmt.Fprintf(w, "data: %s\n\n", string(b))
+
+		// Flush the response.  This is only possible if
+		// the repsonse supports streaming.
+		f.Flush()
+		return nil
+	})
+
+	// Done.
+	api.reqLogTrace(r, "Finished HTTP request at %s", r.URL.Path)
+}
+
+// streamTopic sends the history of a subscribed topic then its messages as
+// JSON until the channel or done closes or send fails
+func (api *API) streamTopic(r *http.Request, ch <-chan *sarama.ConsumerMessage, done <-chan struct{}, topic string, view StreamView, opts *DeliveryOptions, send func([]byte) error) {
 	var b []byte
 	var err error
-	switch topic {
-	case "customer_count":
-		b, err = api.getCustomerData(r)
-	case "order_count":
-		b, err = api.getOrderData(r)
+	if view != nil {
+		var res interface{}
+		if res, err = view.History(api, r); err == nil {
+			b, err = json.Marshal(res)
+		}
+	} else if spec, ok := topicSpecs[topic]; ok {
+		var res []Bucket
+		if res, err = api.getHistory(r, spec); err == nil {
+			b, err = json.Marshal(res)
+		}
+	} else if snapshot, ok := api.snapshots[topic]; ok {
+		var res interface{}
+		if res, err = snapshot(r); err == nil {
+			b, err = json.Marshal(res)
+		}
 	}
 	if err != nil {
-		api.reqLogError(r, err.Error())
-		r.Context().Done()
+		api.reqLogError(r, "%s", err.Error())
 	}
 
-	// Set the headers related to event streaming.
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Transfer-Encoding", "chunked")
-
 	// logger.Trace().Msg("initial data: " + string(b))
-	fmt.Fprintf(w, "data: %s\n\n", string(b))
-	f.Flush()
+	if err = send(b); err != nil {
+		return
+	}
+
+	// views are ticked as well so i.e. a window on a quiet topic still moves
+	var tick <-chan time.Time
+	if view != nil {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	// messages are held in delivery until their frame is due
+	var delivery *Delivery
+	flush := time.NewTimer(time.Hour)
+	flush.Stop()
+	defer flush.Stop()
+	if opts != nil {
+		delivery = NewDelivery(opts)
+	}
 
 	// Don't close the connection, instead loop endlessly.
 	for {
-
+		var out interface{}
+		var b []byte
+		select {
 		// Read from our messageChan.
-		msg, open := <-*api.Kafka.GetMessage(&rc.ID, &topic)
+		case msg, open := <-ch:
+			if !open {
+				// If our messageChan was closed, this means that the client has
+				// disconnected.
+				// this should not be closed during active request
+				api.reqLogTrace(r, "Kafka message channel closed")
+				return
+			}
+			if view == nil {
+				b = msg.Value
+			} else {
+				out = view.HandleMessage(msg)
+			}
+		case now := <-tick:
+			out = view.Tick(now)
+		case <-flush.C:
+		case <-done:
+			return
+		}
 
-		if !open {
-			// If our messageChan was closed, this means that the client has
-			// disconnected.
-			// this should not be closed during active request
-			api.reqLogTrace(r, "Kafka message channel closed")
-			break
+		if out != nil {
+			if b, err = json.Marshal(out); err != nil {
+				api.reqLogError(r, "%s", err.Error())
+				continue
+			}
+		}
+		if delivery == nil {
+			if b != nil {
+				if err = send(b); err != nil {
+					return
+				}
+			}
+			continue
 		}
 
-		// Write to the ResponseWriter, `w`.
-		fmt.Fprintf(w, "data: %s\n\n", string(msg.Value))
+		now := time.Now()
+		if b != nil {
+			delivery.Add(b, now)
+		}
+		if frame := delivery.Flush(now); frame != nil {
+			if b, err = json.Marshal(frame); err != nil {
+				api.reqLogError(r, "%s", err.Error())
+				continue
+			}
+			if err = send(b); err != nil {
+				return
+			}
+		}
+		if due := delivery.Due(); !due.IsZero() {
+			flush.Stop()
+			flush.Reset(due.Sub(now))
+		}
+	}
+}
 
-		// Flush the response.  This is only possible if
-		// the repsonse supports streaming.
-		f.Flush()
+// eventStream sets the event stream headers & wraps the writer with the
+// compressor when the client asked for it, the returned func closes it
+func (api *API) eventStream(w http.ResponseWriter, r *http.Request, f http.Flusher) (http.ResponseWriter, http.Flusher, func()) {
+	// Set the headers related to event streaming.
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// connection specific headers are not allowed in HTTP/2
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Transfer-Encoding", "chunked")
 	}
 
-	// Done.
-	api.reqLogTrace(r, "Finished HTTP request at %s", r.URL.Path)
+	// compression is opt-in, the compressor is flushed along with the
+	// connection after each event so delivery is not delayed
+	if CompressRequested(r) {
+		if enc := NegotiateEncoding(r); enc != "" {
+			cw, err := NewCompressWriter(w, enc)
+			if err != nil {
+				api.reqLogError(r, "error setting up compression: %s", err.Error())
+			} else {
+				api.reqLogTrace(r, "compressing stream with %s", enc)
+				return cw, cw, func() { cw.Close() }
+			}
+		}
+	}
+
+	return w, f, func() {}
 }
 
-func (api *API) getCustomerData(r *http.Request) ([]byte, error) {
-	var res []struct {
-		TimeStamp time.Time `json:"time_stamp" gorm:"column:time_stamp"`
-		N         int       `json:"n" gorm:"column:n"`
+// GetForecast returns the forecast of a topic, `field` can be repeated to pick
+// fields & `horizon` is the number of buckets, defaulting to the end of day
+func (api *API) GetForecast(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	if api.forecaster == nil {
+		http.Error(w, "forecasting is disabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+	horizon := 0
+	if h := q.Get("horizon"); h != "" {
+		var err error
+		if horizon, err = strconv.Atoi(h); err != nil || horizon < 1 || horizon > maxForecastHorizon {
+			msg := fmt.Sprintf("horizon must be an integer between 1 and %d", maxForecastHorizon)
+			api.reqLogError(r, "%s", msg)
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := api.forecaster.Forecast(topic, q["field"], horizon)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
-	gMin, ok := r.URL.Query()["groupMinute"]
+	api.writeJSON(w, r, res)
+}
+
+// GetCalendar returns the history of a topic rolled up by calendar units of
+// the date dimension i.e. `?by=month&splitWeekend=true`
+func (api *API) GetCalendar(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	spec, ok := topicSpecs[topic]
 	if !ok {
-		api.reqLogInfo(r, "groupMinute query parameter not found, defaulting to 1")
-		gMin = []string{"1"}
+		msg := "unknown topic " + topic
+		api.reqLogError(r, "%s", msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
 	}
-	groupMinute, err := strconv.Atoi(gMin[0])
+
+	p, err := ParseCalendarParams(r)
 	if err != nil {
-		api.reqLogError(r, "error converting groupMinute "+gMin[0]+" to integer: "+err.Error())
-		return nil, err
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	err = api.dm.Raw(fmt.Sprintf(`
-select ts time_stamp, sum(n) n
-from (
-	select
-		date_key + make_time(
-			extract(hour from date_key + time_key)::int,
-			cast(floor(extract(minute from date_key + time_key) / %d) * %d as int),
-			0
-		) ts
-		,n
-	from mart.customer_fact cf2
-) t
-group by ts
-order by time_stamp`, groupMinute, groupMinute)).Scan(&res).Error
+	res, err := api.queryCalendar(spec, p)
 	if err != nil {
-		api.reqLogError(r, err.Error())
-		return nil, err
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying calendar history", http.StatusInternalServerError)
+		return
 	}
+	api.writeJSON(w, r, res)
+}
 
-	b, err := json.Marshal(&res)
+// GetHeatmap returns a field of a topic summed by weekday & hour, subscribe
+// with `view=heatmap` for live updates
+func (api *API) GetHeatmap(w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	spec, ok := topicSpecs[topic]
+	if !ok {
+		msg := "unknown topic " + topic
+		api.reqLogError(r, "%s", msg)
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+
+	p, err := ParseHeatmapParams(r, spec)
 	if err != nil {
-		api.reqLogError(r, err.Error())
-		return nil, err
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	return b, nil
+
+	res, err := api.queryHeatmap(spec, p)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying heatmap", http.StatusInternalServerError)
+		return
+	}
+	api.writeJSON(w, r, res)
 }
 
-func (api *API) getOrderData(r *http.Request) ([]byte, error) {
-	var res []struct {
-		TimeStamp time.Time `json:"time_stamp" gorm:"column:time_stamp"`
-		N         int       `json:"n" gorm:"column:n"`
-		Revenue   float32   `json:"revenue" gorm:"column:revenue"`
+// GetGeo returns customers, orders & revenue by state or city of the customer
+func (api *API) GetGeo(w http.ResponseWriter, r *http.Request) {
+	p, err := ParseGeoParams(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	gMin, ok := r.URL.Query()["groupMinute"]
+
+	res, err := api.queryGeo(p)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying geographic breakdown", http.StatusInternalServerError)
+		return
+	}
+	api.writeJSON(w, r, res)
+}
+
+// GetCohorts returns the retention matrix of the customers that signed up in
+// each week or month as JSON or CSV
+func (api *API) GetCohorts(w http.ResponseWriter, r *http.Request) {
+	if api.cohorts == nil {
+		http.Error(w, "cohorts are not available", http.StatusServiceUnavailable)
+		return
+	}
+	p, err := ParseCohortParams(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := api.cohorts.Matrix(p.Unit, p.Periods)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if p.Format == "csv" {
+		b, err := res.CSV()
+		if err != nil {
+			api.reqLogError(r, "%s", err.Error())
+			http.Error(w, "error encoding response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=cohorts_%s.csv", p.Unit))
+		w.Write(b)
+		return
+	}
+	api.writeJSON(w, r, res)
+}
+
+// GetCustomerProfile returns the profile of a customer, clients accepting
+// text/event-stream get the profile again after every change
+func (api *API) GetCustomerProfile(w http.ResponseWriter, r *http.Request) {
+	if api.profiles == nil {
+		http.Error(w, "customer profiles are not available", http.StatusServiceUnavailable)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	top, err := ParseProfileProducts(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		profile, ok := api.profiles.Profile(id, top)
+		if !ok {
+			http.Error(w, "unknown customer "+id, http.StatusNotFound)
+			return
+		}
+		api.writeJSON(w, r, profile)
+		return
+	}
+
+	f, ok := w.(http.Flusher)
 	if !ok {
-		api.reqLogInfo(r, "groupMinute query parameter not found, defaulting to 1")
-		gMin = []string{"1"}
+		msg := "Streaming unsupported!"
+		api.reqLogError(r, "%s", msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	// watch before reading the profile so no change is missed
+	changed, stop := api.profiles.Watch(id)
+	defer stop()
+	profile, ok := api.profiles.Profile(id, top)
+	if !ok {
+		http.Error(w, "unknown customer "+id, http.StatusNotFound)
+		return
+	}
+
+	w, f, closeStream := api.eventStream(w, r, f)
+	defer closeStream()
+	for {
+		b, err := json.Marshal(profile)
+		if err != nil {
+			api.reqLogError(r, "%s", err.Error())
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", string(b))
+		f.Flush()
+
+		select {
+		case <-r.Context().Done():
+			api.reqLogTrace(r, "client closed request")
+			return
+		case <-changed:
+			profile, _ = api.profiles.Profile(id, top)
+		}
+	}
+}
+
+// goalsAvailable writes an error when goals could not be loaded
+func (api *API) goalsAvailable(w http.ResponseWriter) bool {
+	if api.goals == nil {
+		http.Error(w, "goals are not available", http.StatusServiceUnavailable)
+		return false
 	}
-	groupMinute, err := strconv.Atoi(gMin[0])
+	return true
+}
+
+// goalID reads the id from the path
+func goalID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		api.reqLogError(r, "error converting groupMinute "+gMin[0]+" to integer: "+err.Error())
-		return nil, err
+		http.Error(w, "id must be an integer", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeGoalError maps errors from the goal queries to a status
+func (api *API) writeGoalError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errGoalNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
+	api.reqLogError(r, "%s", err.Error())
+	http.Error(w, "error saving goal", http.StatusInternalServerError)
+}
 
-	err = api.dm.Raw(fmt.Sprintf(`
-select ts time_stamp, sum(n) n, sum(revenue) revenue
-from (
-	select
-		date_key + make_time(
-			extract(hour from date_key + time_key)::int,
-			cast(floor(extract(minute from date_key + time_key) / %d) * %d as int),
-			0
-		) ts
-		,n
-		,revenue
-	from mart.order_fact cf2
-) t
-group by ts
-order by time_stamp`, groupMinute, groupMinute)).Scan(&res).Error
+// ListGoals returns every goal, `progress=true` returns their progress instead
+func (api *API) ListGoals(w http.ResponseWriter, r *http.Request) {
+	if !api.goalsAvailable(w) {
+		return
+	}
+	if r.URL.Query().Get("progress") == "true" {
+		api.writeJSON(w, r, api.goals.Progress(true, BucketKey(time.Now())))
+		return
+	}
+	goals, err := api.listGoals()
 	if err != nil {
-		api.reqLogError(r, err.Error())
-		return nil, err
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying goals", http.StatusInternalServerError)
+		return
 	}
+	api.writeJSON(w, r, goals)
+}
 
-	b, err := json.Marshal(&res)
+// GetGoal returns a goal
+func (api *API) GetGoal(w http.ResponseWriter, r *http.Request) {
+	id, ok := goalID(w, r)
+	if !ok || !api.goalsAvailable(w) {
+		return
+	}
+	g, err := api.getGoal(id)
 	if err != nil {
-		api.reqLogError(r, err.Error())
-		return nil, err
+		api.writeGoalError(w, r, err)
+		return
+	}
+	api.writeJSON(w, r, g)
+}
+
+// CreateGoal stores the goal in the JSON body & returns it with its id
+func (api *API) CreateGoal(w http.ResponseWriter, r *http.Request) {
+	if api.goalsAvailable(w) {
+		api.saveGoalRequest(w, r, 0)
+	}
+}
+
+// UpdateGoal replaces a goal with the JSON body
+func (api *API) UpdateGoal(w http.ResponseWriter, r *http.Request) {
+	id, ok := goalID(w, r)
+	if ok && api.goalsAvailable(w) {
+		api.saveGoalRequest(w, r, id)
+	}
+}
+
+func (api *API) saveGoalRequest(w http.ResponseWriter, r *http.Request, id int64) {
+	var g Goal
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "invalid goal: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.ID = id
+	if err := g.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := api.saveGoal(&g); err != nil {
+		api.writeGoalError(w, r, err)
+		return
+	}
+	if id == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(g)
+		return
+	}
+	api.writeJSON(w, r, g)
+}
+
+// DeleteGoal removes a goal
+func (api *API) DeleteGoal(w http.ResponseWriter, r *http.Request) {
+	id, ok := goalID(w, r)
+	if !ok || !api.goalsAvailable(w) {
+		return
+	}
+	if err := api.deleteGoal(id); err != nil {
+		api.writeGoalError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PostQuery runs a semantic layer query from the JSON body
+func (api *API) PostQuery(w http.ResponseWriter, r *http.Request) {
+	var q SemanticQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, queryMaxBytes)).Decode(&q); err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	bq, err := semanticModel.Build(&q, &api.Config.Query)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	api.reqLogTrace(r, "running semantic query: %s", bq.SQL)
+	res, err := api.runQuery(bq)
+	switch {
+	case errors.Is(err, errQueryCost):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil && strings.Contains(err.Error(), "statement timeout"):
+		http.Error(w, "query timed out", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error running query", http.StatusInternalServerError)
+		return
+	}
+	api.writeJSON(w, r, res)
+}
+
+// PostGraphQL runs a GraphQL query, subscriptions need the WebSocket
+func (api *API) PostGraphQL(w http.ResponseWriter, r *http.Request) {
+	var body gqlRequestBody
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, graphqlMaxBytes)).Decode(&body); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ex, err := body.prepare()
+	if err == nil && op.Type == "subscription" {
+		err = errors.New("subscriptions are only served over WebSocket")
+	}
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(gqlResponse{Errors: []gqlError{{Message: err.Error()}}})
+		return
+	}
+	api.writeJSON(w, r, ex.Execute(&gqlQuery{api: api, r: r}, op))
+}
+
+// GraphQLSocket upgrades to a graphql-transport-ws WebSocket
+func (api *API) GraphQLSocket(w http.ResponseWriter, r *http.Request) {
+	api.graphqlSocket().ServeHTTP(w, r)
+}
+
+// GetGraphQLSchema returns the schema as SDL
+func (api *API) GetGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(graphqlSchema))
+}
+
+// durableAvailable writes an error when durable subscriptions could not be
+// loaded
+func (api *API) durableAvailable(w http.ResponseWriter) bool {
+	if api.durable == nil {
+		http.Error(w, "durable subscriptions are not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// writeDurableError maps errors from the durable store to a status, anything
+// else is invalid input
+func (api *API) writeDurableError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errDurableNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errDurableExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// ListDurable returns every durable subscription with its positions
+func (api *API) ListDurable(w http.ResponseWriter, r *http.Request) {
+	if api.durableAvailable(w) {
+		api.writeJSON(w, r, api.durable.List())
+	}
+}
+
+// GetDurable returns the positions of a durable subscription
+func (api *API) GetDurable(w http.ResponseWriter, r *http.Request) {
+	if !api.durableAvailable(w) {
+		return
+	}
+	st, err := api.durable.Status(mux.Vars(r)["name"])
+	if err != nil {
+		api.writeDurableError(w, r, err)
+		return
+	}
+	api.writeJSON(w, r, st)
+}
+
+// CreateDurable registers a durable subscription from `{"name", "topics"}`,
+// it gets the events after the newest event of each topic
+func (api *API) CreateDurable(w http.ResponseWriter, r *http.Request) {
+	if !api.durableAvailable(w) {
+		return
+	}
+	var body struct {
+		Name   string   `json:"name"`
+		Topics []string `json:"topics"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid subscription: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range body.Topics {
+		if !api.Kafka.HasTopic(t) {
+			http.Error(w, "unknown topic "+t, http.StatusBadRequest)
+			return
+		}
+	}
+	sub, err := api.durable.Add(body.Name, body.Topics, time.Now())
+	if err != nil {
+		api.writeDurableError(w, r, err)
+		return
+	}
+	if err = api.saveDurable(sub); err != nil {
+		api.durable.Remove(sub.Name)
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error saving durable subscription", http.StatusInternalServerError)
+		return
+	}
+	st, _ := api.durable.Status(sub.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(st)
+}
+
+// DeleteDurable removes a durable subscription & the events only it needed
+func (api *API) DeleteDurable(w http.ResponseWriter, r *http.Request) {
+	if !api.durableAvailable(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	unused, err := api.durable.Remove(name)
+	if err != nil {
+		api.writeDurableError(w, r, err)
+		return
+	}
+	if err = api.dropDurable(name, unused); err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error deleting durable subscription", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDurableEvents returns the events after the committed positions, the
+// same events are returned until they are acked, `topic` picks one topic &
+// `limit` caps the events of each topic
+func (api *API) GetDurableEvents(w http.ResponseWriter, r *http.Request) {
+	if !api.durableAvailable(w) {
+		return
+	}
+	q := r.URL.Query()
+	limit := api.Config.Durable.MaxBatch
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > api.Config.Durable.MaxBatch {
+			http.Error(w, fmt.Sprintf("limit must be an integer between 1 and %d", api.Config.Durable.MaxBatch), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	batch, err := api.durable.Fetch(mux.Vars(r)["name"], q.Get("topic"), limit)
+	if err != nil {
+		api.writeDurableError(w, r, err)
+		return
+	}
+	api.writeJSON(w, r, batch)
+}
+
+// AckDurable commits the positions of a `{"topic": position}` body, the
+// events up to them are not returned again
+func (api *API) AckDurable(w http.ResponseWriter, r *http.Request) {
+	if !api.durableAvailable(w) {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	var positions map[string]int64
+	if err := json.NewDecoder(r.Body).Decode(&positions); err != nil {
+		http.Error(w, "invalid positions: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	changed, err := api.durable.Ack(name, positions)
+	if err != nil {
+		api.writeDurableError(w, r, err)
+		return
+	}
+	if err = api.saveDurablePositions(name, changed); err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error saving positions", http.StatusInternalServerError)
+		return
+	}
+	st, _ := api.durable.Status(name)
+	api.writeJSON(w, r, st)
+}
+
+// webhooksAvailable writes an error when webhooks could not be loaded
+func (api *API) webhooksAvailable(w http.ResponseWriter) bool {
+	if api.webhooks == nil {
+		http.Error(w, "webhooks are not available", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// webhookID reads the id from the path
+func webhookID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "id must be an integer", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// writeWebhookError maps errors from the webhook queries to a status
+func (api *API) writeWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errWebhookNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	api.reqLogError(r, "%s", err.Error())
+	http.Error(w, "error saving webhook", http.StatusInternalServerError)
+}
+
+// ListWebhooks returns every webhook without its secret
+func (api *API) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if !api.webhooksAvailable(w) {
+		return
+	}
+	hooks, err := api.listWebhooks()
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying webhooks", http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	api.writeJSON(w, r, hooks)
+}
+
+// GetWebhook returns a webhook without its secret
+func (api *API) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok || !api.webhooksAvailable(w) {
+		return
+	}
+	wh, err := api.getWebhook(id)
+	if err != nil {
+		api.writeWebhookError(w, r, err)
+		return
+	}
+	wh.Secret = ""
+	api.writeJSON(w, r, wh)
+}
+
+// CreateWebhook registers a webhook from the JSON body, the secret is
+// generated when there is none & only returned here
+func (api *API) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	if api.webhooksAvailable(w) {
+		api.saveWebhookRequest(w, r, 0)
+	}
+}
+
+// UpdateWebhook replaces a webhook with the JSON body, the secret is kept
+// when there is none & enabling it again resets the failures
+func (api *API) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if ok && api.webhooksAvailable(w) {
+		api.saveWebhookRequest(w, r, id)
+	}
+}
+
+func (api *API) saveWebhookRequest(w http.ResponseWriter, r *http.Request, id int64) {
+	var body struct {
+		URL    string            `json:"url"`
+		Topics []string          `json:"topics"`
+		Filter map[string]string `json:"filter"`
+		Secret string            `json:"secret"`
+		// enabled unless set to false
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid webhook: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh := WebhookEndpoint{ID: id, URL: body.URL, Topics: body.Topics, Filter: body.Filter, Secret: body.Secret, Enabled: body.Enabled == nil || *body.Enabled}
+	err := wh.Validate()
+	if err == nil {
+		err = api.webhooks.CheckURL(wh.URL)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range wh.Topics {
+		if !api.Kafka.HasTopic(t) {
+			http.Error(w, "unknown topic "+t, http.StatusBadRequest)
+			return
+		}
+	}
+	if id == 0 && wh.Secret == "" {
+		var err error
+		if wh.Secret, err = NewWebhookSecret(); err != nil {
+			api.reqLogError(r, "%s", err.Error())
+			http.Error(w, "error creating secret", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := api.saveWebhook(&wh); err != nil {
+		api.writeWebhookError(w, r, err)
+		return
+	}
+	if id == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh)
+		return
+	}
+	wh.Secret = ""
+	api.writeJSON(w, r, wh)
+}
+
+// DeleteWebhook removes a webhook & its delivery log
+func (api *API) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok || !api.webhooksAvailable(w) {
+		return
+	}
+	if err := api.deleteWebhook(id); err != nil {
+		api.writeWebhookError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries returns the newest delivery attempts of a webhook,
+// `limit` defaults to 100
+func (api *API) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok || !api.webhooksAvailable(w) {
+		return
+	}
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 1000 {
+			http.Error(w, "limit must be an integer between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if _, err := api.getWebhook(id); err != nil {
+		api.writeWebhookError(w, r, err)
+		return
+	}
+	res, err := api.listWebhookDeliveries(id, limit)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		http.Error(w, "error querying deliveries", http.StatusInternalServerError)
+		return
 	}
-	return b, nil
+	api.writeJSON(w, r, res)
 }
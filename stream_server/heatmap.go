@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// HeatmapParams are the query parameters of a heatmap
+type HeatmapParams struct {
+	Field string
+	// optional date range, To is exclusive
+	From time.Time
+	To   time.Time
+}
+
+// ParseHeatmapParams reads `field`, `from` & `to` from the request, field
+// defaults to the first field of the topic
+func ParseHeatmapParams(r *http.Request, spec *TopicSpec) (*HeatmapParams, error) {
+	p := HeatmapParams{Field: r.URL.Query().Get("field")}
+	if p.Field == "" {
+		p.Field = spec.Fields[0].Name
+	}
+	if spec.Field(p.Field) == nil {
+		return nil, fmt.Errorf("topic %s has no field %s", spec.Name, p.Field)
+	}
+	var err error
+	if p.From, p.To, err = parseDateRange(r); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Heatmap is a field of a topic summed by weekday & hour, weekdays are
+// numbered from Sunday as 0 the same as date_dimension.weekday_number
+type Heatmap struct {
+	Topic    string         `json:"topic"`
+	Field    string         `json:"field"`
+	Weekdays [7]string      `json:"weekdays"`
+	Values   [7][24]float64 `json:"values"`
+	params   *HeatmapParams
+}
+
+// HeatmapCell is a changed cell sent on the live stream
+type HeatmapCell struct {
+	Weekday int     `json:"weekday"`
+	Hour    int     `json:"hour"`
+	Value   float64 `json:"value"`
+}
+
+func NewHeatmap(topic string, p *HeatmapParams) *Heatmap {
+	hm := &Heatmap{Topic: topic, Field: p.Field, params: p}
+	for i := range hm.Weekdays {
+		hm.Weekdays[i] = time.Weekday(i).String()
+	}
+	return hm
+}
+
+// Add sums an event into its cell if it is inside the date range, ok is false
+// when the event is outside of it
+func (hm *Heatmap) Add(e *Event) (cell HeatmapCell, ok bool) {
+	key := BucketKey(e.TimeStamp)
+	day := time.Date(key.Year(), key.Month(), key.Day(), 0, 0, 0, 0, time.UTC)
+	if (!hm.params.From.IsZero() && day.Before(hm.params.From)) || (!hm.params.To.IsZero() && !day.Before(hm.params.To)) {
+		return cell, false
+	}
+	wd, h := int(key.Weekday()), key.Hour()
+	hm.Values[wd][h] += e.Values[hm.Field]
+	return HeatmapCell{Weekday: wd, Hour: h, Value: hm.Values[wd][h]}, true
+}
+
+// HandleMessage sums the events of a message & returns the changed cells
+// with their new totals, nil when nothing changed
+func (hm *Heatmap) HandleMessage(msg *sarama.ConsumerMessage) []HeatmapCell {
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("heatmap could not parse message: " + err.Error())
+		return nil
+	}
+	var cells []HeatmapCell
+	index := make(map[[2]int]int)
+	for i := range events {
+		c, ok := hm.Add(&events[i])
+		if !ok {
+			continue
+		}
+		// a cell hit twice is sent once with its latest total
+		k := [2]int{c.Weekday, c.Hour}
+		if j, seen := index[k]; seen {
+			cells[j] = c
+			continue
+		}
+		index[k] = len(cells)
+		cells = append(cells, c)
+	}
+	return cells
+}
+
+// heatmapSQL sums a field by weekday & hour using the date & time dimensions,
+// the field SQL comes from the topic spec
+func heatmapSQL(spec *TopicSpec, p *HeatmapParams) string {
+	q := fmt.Sprintf(`
+select dd.weekday_number, td.hour_24, %s
+from %s t0
+join mart.date_dimension dd
+	on t0.date_key = dd.date_key
+join mart.time_dimension td
+	on t0.time_key = td.time_key`, spec.Field(p.Field).SQL, spec.Table)
+	if where, _ := dateRangeWhere(p.From, p.To); where != "" {
+		q += "\nwhere " + where
+	}
+	return q + "\ngroup by dd.weekday_number, td.hour_24"
+}
+
+// queryHeatmap reads the heatmap of a topic from the fact table
+func (api *API) queryHeatmap(spec *TopicSpec, p *HeatmapParams) (*Heatmap, error) {
+	_, args := dateRangeWhere(p.From, p.To)
+	rows, err := api.dm.Raw(heatmapSQL(spec, p), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hm := NewHeatmap(spec.Name, p)
+	for rows.Next() {
+		var wd, h int
+		var v float64
+		if err = rows.Scan(&wd, &h, &v); err != nil {
+			return nil, err
+		}
+		if wd < 0 || wd > 6 || h < 0 || h > 23 {
+			return nil, fmt.Errorf("heatmap cell out of range weekday %d hour %d", wd, h)
+		}
+		hm.Values[wd][h] = v
+	}
+	return hm, rows.Err()
+}
+
+// heatmapView streams the heatmap of a topic followed by the changed cells
+type heatmapView struct {
+	spec   *TopicSpec
+	params *HeatmapParams
+	hm     *Heatmap
+}
+
+func (v *heatmapView) History(api *API, r *http.Request) (interface{}, error) {
+	hm, err := api.queryHeatmap(v.spec, v.params)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		// live cells are still summed from zero
+		v.hm = NewHeatmap(v.spec.Name, v.params)
+		return nil, err
+	}
+	v.hm = hm
+	return hm, nil
+}
+
+func (v *heatmapView) HandleMessage(msg *sarama.ConsumerMessage) interface{} {
+	if cells := v.hm.HandleMessage(msg); len(cells) > 0 {
+		return cells
+	}
+	return nil
+}
+
+func (v *heatmapView) Tick(now time.Time) interface{} {
+	return nil
+}
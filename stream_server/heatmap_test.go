@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseHeatmapParams(t *testing.T) {
+	spec := topicSpecs["order_count"]
+	p, err := ParseHeatmapParams(httptest.NewRequest("GET", "/", nil), spec)
+	if err != nil || p.Field != "n" {
+		t.Errorf("expected default field n, got %+v %v", p, err)
+	}
+	p, err = ParseHeatmapParams(httptest.NewRequest("GET", "/?field=revenue&from=2020-06-01", nil), spec)
+	if err != nil || p.Field != "revenue" || p.From.Day() != 1 {
+		t.Errorf("incorrect params %+v %v", p, err)
+	}
+	if _, err = ParseHeatmapParams(httptest.NewRequest("GET", "/?field=units", nil), spec); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestHeatmapSQL(t *testing.T) {
+	q := heatmapSQL(topicSpecs["order_count"], &HeatmapParams{Field: "order_count", To: time.Now()})
+	for _, s := range []string{"count(*)", "join mart.time_dimension td", "where dd.the_date < ?", "group by dd.weekday_number, td.hour_24"} {
+		if !strings.Contains(q, s) {
+			t.Errorf("expected query to contain %s:\n%s", s, q)
+		}
+	}
+}
+
+func TestHeatmapLive(t *testing.T) {
+	// a Monday
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	p := &HeatmapParams{Field: "revenue", From: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2020, 6, 3, 0, 0, 0, 0, time.UTC)}
+	hm := NewHeatmap("order_count", p)
+	hm.Values[1][10] = 5
+	if hm.Weekdays[1] != "Monday" {
+		t.Errorf("incorrect weekday labels %v", hm.Weekdays)
+	}
+
+	b, _ := json.Marshal([]map[string]interface{}{
+		{"time_stamp": base.Format(time.RFC3339Nano), "revenue": 10},
+		{"time_stamp": base.Add(time.Minute).Format(time.RFC3339Nano), "revenue": 1},
+		{"time_stamp": base.Add(25 * time.Hour).Format(time.RFC3339Nano), "revenue": 3},
+		// after the range
+		{"time_stamp": base.Add(48 * time.Hour).Format(time.RFC3339Nano), "revenue": 100},
+	})
+	cells := hm.HandleMessage(&sarama.ConsumerMessage{Topic: "order_count", Value: b})
+	if len(cells) != 2 {
+		t.Fatalf("expected 2 changed cells, got %v", cells)
+	}
+	if cells[0] != (HeatmapCell{Weekday: 1, Hour: 10, Value: 16}) || cells[1] != (HeatmapCell{Weekday: 2, Hour: 11, Value: 3}) {
+		t.Errorf("incorrect cells %v", cells)
+	}
+
+	if cells = hm.HandleMessage(orderMessage(base.Add(-24*time.Hour), 1)); cells != nil {
+		t.Errorf("expected no changes before the range, got %v", cells)
+	}
+}
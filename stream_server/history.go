@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistoryParams are the query parameters shared by the history requests
+type HistoryParams struct {
+	GroupMinute int
+	// optional start of the history, zero value means all history
+	From time.Time
+}
+
+// ParseHistoryParams reads `groupMinute` & `from` from the request
+func ParseHistoryParams(r *http.Request) (*HistoryParams, error) {
+	var p HistoryParams
+	q := r.URL.Query()
+
+	p.GroupMinute = 1
+	if gMin := q.Get("groupMinute"); gMin != "" {
+		groupMinute, err := strconv.Atoi(gMin)
+		if err != nil {
+			return nil, fmt.Errorf("error converting groupMinute %s to integer: %w", gMin, err)
+		}
+		if groupMinute < 1 || groupMinute > 60 {
+			return nil, fmt.Errorf("groupMinute must be between 1 and 60, got %d", groupMinute)
+		}
+		p.GroupMinute = groupMinute
+	}
+
+	if from := q.Get("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing from %s as RFC3339: %w", from, err)
+		}
+		p.From = t
+	}
+	return &p, nil
+}
+
+// bucketSQL builds the history query for a topic, groupMinute is validated as
+// an integer so it is safe to format into the query
+func bucketSQL(spec *TopicSpec, groupMinute int, withFrom bool) string {
+	cols := make([]string, len(spec.Fields))
+	for i, f := range spec.Fields {
+		cols[i] = fmt.Sprintf("%s %s", f.SQL, f.Name)
+	}
+	where := ""
+	if withFrom {
+		where = "\n\twhere date_key + time_key >= ?"
+	}
+	// aggregates run over the inner columns so count(*) & sum() keep working
+	return fmt.Sprintf(`
+select ts time_stamp, %s
+from (
+	select
+		date_key + make_time(
+			extract(hour from date_key + time_key)::int,
+			cast(floor(extract(minute from date_key + time_key) / %d) * %d as int),
+			0
+		) ts
+		,t0.*
+	from %s t0%s
+) t
+group by ts
+order by time_stamp`, strings.Join(cols, ", "), groupMinute, groupMinute, spec.Table, where)
+}
+
+// queryBuckets runs the history query for a topic
+func (api *API) queryBuckets(spec *TopicSpec, groupMinute int, from time.Time) ([]Bucket, error) {
+	var args []interface{}
+	if !from.IsZero() {
+		args = append(args, from)
+	}
+	rows, err := api.dm.Raw(bucketSQL(spec, groupMinute, !from.IsZero()), args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []Bucket{}
+	vals := make([]float64, len(spec.Fields))
+	dest := make([]interface{}, len(spec.Fields)+1)
+	for i := range vals {
+		dest[i+1] = &vals[i]
+	}
+	for rows.Next() {
+		var ts time.Time
+		dest[0] = &ts
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		b := NewBucket(ts)
+		for i, f := range spec.Fields {
+			b.Values[f.Name] = vals[i]
+		}
+		res = append(res, *b)
+	}
+	return res, rows.Err()
+}
+
+// getHistory returns the initial bucketed data for a topic stream
+func (api *API) getHistory(r *http.Request, spec *TopicSpec) ([]Bucket, error) {
+	p, err := ParseHistoryParams(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		return nil, err
+	}
+	return api.bucketHistory(r, spec, p)
+}
+
+// bucketHistory reads the history of a topic, recent history is served from
+// the aggregate cache when it covers the request
+func (api *API) bucketHistory(r *http.Request, spec *TopicSpec, p *HistoryParams) ([]Bucket, error) {
+	if api.cache != nil {
+		if res, ok := api.cache.Get(spec.Name, p.GroupMinute, p.From); ok {
+			api.reqLogTrace(r, "serving %s history from cache", spec.Name)
+			return res, nil
+		}
+	}
+
+	res, err := api.queryBuckets(spec, p.GroupMinute, p.From)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLog estimates the number of distinct values added to it, the
+// standard error is about 1.04/sqrt(2^precision)
+type HyperLogLog struct {
+	p   uint8
+	reg []uint8
+}
+
+// NewHyperLogLog uses 2^precision one byte registers, precision is clamped to
+// 4 to 16
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < 4 {
+		precision = 4
+	} else if precision > 16 {
+		precision = 16
+	}
+	return &HyperLogLog{p: precision, reg: make([]uint8, 1<<precision)}
+}
+
+// hash64 is FNV-1a with the splitmix64 finalizer so short similar strings i.e.
+// sequential ids spread over all the bits
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *HyperLogLog) Add(s string) {
+	x := hash64(s)
+	idx := x >> (64 - h.p)
+	// the guard bit caps the run of zeros for the remaining bits
+	w := x<<h.p | 1<<(h.p-1)
+	rho := uint8(bits.LeadingZeros64(w)) + 1
+	if rho > h.reg[idx] {
+		h.reg[idx] = rho
+	}
+}
+
+// Count estimates the distinct values, small counts use linear counting
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(len(h.reg))
+	var sum float64
+	zeros := 0
+	for _, r := range h.reg {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.reg) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	est := alpha * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+// Merge makes h the union of h & o, both need the same precision
+func (h *HyperLogLog) Merge(o *HyperLogLog) error {
+	if h.p != o.p {
+		return fmt.Errorf("can not merge HyperLogLog of precision %d into %d", o.p, h.p)
+	}
+	for i, r := range o.reg {
+		if r > h.reg[i] {
+			h.reg[i] = r
+		}
+	}
+	return nil
+}
+
+func (h *HyperLogLog) Copy() *HyperLogLog {
+	c := &HyperLogLog{p: h.p, reg: make([]uint8, len(h.reg))}
+	copy(c.reg, h.reg)
+	return c
+}
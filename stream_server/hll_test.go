@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 50000} {
+		h := NewHyperLogLog(12)
+		for i := 0; i < n; i++ {
+			h.Add(strconv.Itoa(i))
+			// duplicates do not count
+			h.Add(strconv.Itoa(i))
+		}
+		if err := math.Abs(float64(h.Count())-float64(n)) / float64(n); err > 0.05 {
+			t.Errorf("%d distinct estimated as %d", n, h.Count())
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b, all := NewHyperLogLog(12), NewHyperLogLog(12), NewHyperLogLog(12)
+	for i := 0; i < 3000; i++ {
+		all.Add(strconv.Itoa(i))
+		if i < 2000 {
+			a.Add(strconv.Itoa(i))
+		}
+		if i >= 1000 {
+			b.Add(strconv.Itoa(i))
+		}
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatal(err)
+	}
+	// a merge is the same as adding everything to one sketch
+	if a.Count() != all.Count() {
+		t.Errorf("merged count %d, expected %d", a.Count(), all.Count())
+	}
+	if err := a.Merge(NewHyperLogLog(10)); err == nil {
+		t.Error("expected error merging different precisions")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// z value of a 95% confidence band
+const confidenceZ = 1.96
+
+// HoltWinters is an additive Holt-Winters model, Period 0 fits Holt's linear
+// trend without seasonality
+type HoltWinters struct {
+	Alpha  float64 `json:"alpha"`
+	Beta   float64 `json:"beta"`
+	Gamma  float64 `json:"gamma"`
+	Period int     `json:"period"`
+	level  float64
+	trend  float64
+	season []float64
+	// standard deviation of the one step ahead errors
+	sigma float64
+	// number of points the model was fit on
+	n int
+}
+
+// ForecastPoint is a forecast value with its confidence band
+type ForecastPoint struct {
+	Value float64 `json:"value"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// candidate smoothing parameters tried when fitting
+var smoothingGrid = []float64{0.05, 0.1, 0.2, 0.4, 0.6, 0.8}
+
+// FitHoltWinters picks the smoothing parameters with the lowest one step ahead
+// squared error, seasonality needs at least two full periods of data so
+// shorter series fall back to a trend only model
+func FitHoltWinters(y []float64, period int) (*HoltWinters, error) {
+	if len(y) < 3 {
+		return nil, errors.New("at least 3 points are needed to fit a forecast")
+	}
+	if period > 0 && len(y) < 2*period {
+		period = 0
+	}
+
+	gammas := smoothingGrid
+	if period == 0 {
+		gammas = []float64{0}
+	}
+
+	var best *HoltWinters
+	bestSSE := math.Inf(1)
+	for _, a := range smoothingGrid {
+		for _, b := range smoothingGrid {
+			for _, g := range gammas {
+				hw := &HoltWinters{Alpha: a, Beta: b, Gamma: g, Period: period}
+				sse := hw.fit(y)
+				if sse < bestSSE {
+					best, bestSSE = hw, sse
+				}
+			}
+		}
+	}
+	return best, nil
+}
+
+// fit runs the smoothing over y & returns the sum of squared one step errors
+func (hw *HoltWinters) fit(y []float64) float64 {
+	m := hw.Period
+	start := 1
+	if m > 0 {
+		// level & trend from the first two periods, seasonal offsets from the
+		// first period
+		var first, second float64
+		for i := 0; i < m; i++ {
+			first += y[i]
+			second += y[m+i]
+		}
+		first /= float64(m)
+		second /= float64(m)
+		hw.level = first
+		hw.trend = (second - first) / float64(m)
+		hw.season = make([]float64, m)
+		for i := 0; i < m; i++ {
+			hw.season[i] = y[i] - first
+		}
+		start = m
+	} else {
+		hw.level = y[0]
+		hw.trend = y[1] - y[0]
+	}
+
+	var sse float64
+	for t := start; t < len(y); t++ {
+		s := 0.0
+		if m > 0 {
+			s = hw.season[t%m]
+		}
+		pred := hw.level + hw.trend + s
+		err := y[t] - pred
+		sse += err * err
+
+		prevLevel := hw.level
+		hw.level = hw.Alpha*(y[t]-s) + (1-hw.Alpha)*(hw.level+hw.trend)
+		hw.trend = hw.Beta*(hw.level-prevLevel) + (1-hw.Beta)*hw.trend
+		if m > 0 {
+			hw.season[t%m] = hw.Gamma*(y[t]-hw.level) + (1-hw.Gamma)*s
+		}
+	}
+	hw.n = len(y)
+	if steps := len(y) - start; steps > 0 {
+		hw.sigma = math.Sqrt(sse / float64(steps))
+	}
+	return sse
+}
+
+// Forecast predicts the next h points after the fitted series, the band
+// widens with the horizon using the additive Holt-Winters error variance
+func (hw *HoltWinters) Forecast(h int) []ForecastPoint {
+	out := make([]ForecastPoint, h)
+	// running sum of the squared error multipliers
+	var c2 float64
+	for i := 1; i <= h; i++ {
+		v := hw.level + float64(i)*hw.trend
+		if hw.Period > 0 {
+			v += hw.season[(hw.n+i-1)%hw.Period]
+		}
+		width := confidenceZ * hw.sigma * math.Sqrt(1+c2)
+		out[i-1] = ForecastPoint{Value: v, Lower: v - width, Upper: v + width}
+
+		c := hw.Alpha * (1 + float64(i)*hw.Beta)
+		if hw.Period > 0 && i%hw.Period == 0 {
+			c += hw.Gamma
+		}
+		c2 += c * c
+	}
+	return out
+}
+
+// BacktestMetrics are the errors of forecasting a held out tail of the series
+type BacktestMetrics struct {
+	Points int     `json:"points"`
+	MAE    float64 `json:"mae"`
+	RMSE   float64 `json:"rmse"`
+	// zero actuals are skipped
+	MAPE float64 `json:"mape"`
+}
+
+// Backtest fits on all but the last holdout points & scores the forecast of
+// the held out points
+func Backtest(y []float64, period, holdout int) (*BacktestMetrics, error) {
+	if holdout <= 0 || holdout >= len(y) {
+		return nil, errors.New("holdout must be inside the series")
+	}
+	hw, err := FitHoltWinters(y[:len(y)-holdout], period)
+	if err != nil {
+		return nil, err
+	}
+	fc := hw.Forecast(holdout)
+	actual := y[len(y)-holdout:]
+
+	m := &BacktestMetrics{Points: holdout}
+	var sq, pct float64
+	var pctN int
+	for i := range actual {
+		e := actual[i] - fc[i].Value
+		m.MAE += math.Abs(e)
+		sq += e * e
+		if actual[i] != 0 {
+			pct += math.Abs(e / actual[i])
+			pctN++
+		}
+	}
+	m.MAE /= float64(holdout)
+	m.RMSE = math.Sqrt(sq / float64(holdout))
+	if pctN > 0 {
+		m.MAPE = 100 * pct / float64(pctN)
+	}
+	return m, nil
+}
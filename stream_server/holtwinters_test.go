@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// seasonal series with a trend & period 8
+func seasonalSeries(n int) []float64 {
+	pattern := []float64{0, 2, 5, 9, 9, 5, 2, 0}
+	y := make([]float64, n)
+	for i := range y {
+		y[i] = 10 + 0.1*float64(i) + pattern[i%len(pattern)]
+	}
+	return y
+}
+
+func TestFitHoltWintersSeasonal(t *testing.T) {
+	y := seasonalSeries(80)
+	hw, err := FitHoltWinters(y, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hw.Period != 8 {
+		t.Errorf("expected seasonal model, got period %d", hw.Period)
+	}
+
+	e := seasonalSeries(88)[80:]
+	for i, p := range hw.Forecast(8) {
+		if math.Abs(p.Value-e[i]) > 0.5 {
+			t.Errorf("step %d: expected %.2f got %.2f", i+1, e[i], p.Value)
+		}
+		if p.Lower > p.Value || p.Upper < p.Value {
+			t.Errorf("step %d: value outside of band %+v", i+1, p)
+		}
+	}
+}
+
+func TestFitHoltWintersShortSeries(t *testing.T) {
+	// less than two periods falls back to a trend only model
+	y := []float64{1, 2, 3, 4, 5, 6}
+	hw, err := FitHoltWinters(y, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hw.Period != 0 {
+		t.Errorf("expected trend only model, got period %d", hw.Period)
+	}
+	fc := hw.Forecast(2)
+	if math.Abs(fc[0].Value-7) > 0.01 || math.Abs(fc[1].Value-8) > 0.01 {
+		t.Errorf("incorrect trend forecast %+v", fc)
+	}
+
+	if _, err = FitHoltWinters([]float64{1, 2}, 0); err == nil {
+		t.Error("expected error for too short series")
+	}
+}
+
+func TestForecastBandWidens(t *testing.T) {
+	y := seasonalSeries(40)
+	// add noise so the errors are not zero
+	for i := range y {
+		if i%3 == 0 {
+			y[i] += 1
+		}
+	}
+	hw, err := FitHoltWinters(y, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := hw.Forecast(10)
+	for i := 1; i < len(fc); i++ {
+		if fc[i].Upper-fc[i].Value < fc[i-1].Upper-fc[i-1].Value {
+			t.Errorf("band narrowed at step %d", i+1)
+		}
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	m, err := Backtest(seasonalSeries(80), 8, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Points != 8 {
+		t.Errorf("expected 8 points got %d", m.Points)
+	}
+	if m.MAE > 0.5 || m.RMSE > 0.5 || m.MAPE > 5 {
+		t.Errorf("backtest errors too large %+v", m)
+	}
+	if m.RMSE < m.MAE {
+		t.Error("RMSE should not be less than MAE")
+	}
+
+	if _, err = Backtest(seasonalSeries(10), 8, 10); err == nil {
+		t.Error("expected error when holdout covers the series")
+	}
+}
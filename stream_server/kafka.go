@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 )
@@ -22,12 +24,37 @@ type Kafka struct {
 	topics *[]string
 	// map of channels for each topic to receive messages on
 	subs map[string]*MessageSub
+	// handlers get every consumed message before it is sent to clients
+	handlers []MessageHandler
+	// taps get every message sent to clients, consumed or published
+	taps []MessageTap
 	// context controls closing the Kafka connection
 	ctx    context.Context
 	cancel func()
 	client sarama.ConsumerGroup
 }
 
+// MessageHandler processes consumed messages inside the server, i.e. to keep
+// aggregates up to date
+type MessageHandler func(*sarama.ConsumerMessage)
+
+// skipBefore wraps the handler of state loaded from the database, messages
+// produced before the load are part of it already so the ones the consumer
+// group replays from its committed offset are skipped instead of counted
+// twice, messages without a timestamp are always handled
+func skipBefore(loaded time.Time, h MessageHandler) MessageHandler {
+	return func(msg *sarama.ConsumerMessage) {
+		if !msg.Timestamp.IsZero() && msg.Timestamp.Before(loaded) {
+			return
+		}
+		h(msg)
+	}
+}
+
+// MessageTap stores or forwards messages, a consumed message a tap fails on
+// is not marked so it is consumed again
+type MessageTap func(*sarama.ConsumerMessage) error
+
 type MessageSub struct {
 	counter *uint32
 	// messages *chan *sarama.ConsumerMessage
@@ -233,6 +260,88 @@ func (k *Kafka) Unsubscribe(clientID *string, topic *string) (err error) {
 	return nil
 }
 
+// RegisterTopic adds a topic which clients can subscribe to but is not
+// consumed from Kafka, messages are sent to it with Publish
+func (k *Kafka) RegisterTopic(topic string) {
+	k.stLock.Lock()
+	defer k.stLock.Unlock()
+	if _, ok := k.subs[topic]; ok {
+		return
+	}
+	logger.Print("initializing topic subscription information for topic " + topic)
+	k.subs[topic] = &MessageSub{
+		counter: Uint32(1),
+		clients: make(map[string]*chan *sarama.ConsumerMessage),
+	}
+}
+
+// HasTopic checks if clients can subscribe to the topic
+func (k *Kafka) HasTopic(topic string) bool {
+	k.stLock.RLock()
+	defer k.stLock.RUnlock()
+	return k.TopicSubscribed(&topic)
+}
+
+// Topics lists the topics clients can subscribe to
+func (k *Kafka) Topics() []string {
+	k.stLock.RLock()
+	defer k.stLock.RUnlock()
+	topics := make([]string, 0, len(k.subs))
+	for topic := range k.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Publish sends a message produced inside the server to the clients of a
+// topic, this is called from message handlers so a client with a full
+// channel has the message dropped instead of blocking the consumer
+func (k *Kafka) Publish(topic string, value []byte) {
+	msg := &sarama.ConsumerMessage{
+		Topic:     topic,
+		Value:     value,
+		Timestamp: time.Now(),
+	}
+	for _, h := range k.taps {
+		if err := h(msg); err != nil {
+			logger.Print("error tapping published message: " + err.Error())
+		}
+	}
+
+	k.stLock.RLock()
+	sub, ok := k.subs[topic]
+	if !ok {
+		k.stLock.RUnlock()
+		return
+	}
+	clients := make([]*chan *sarama.ConsumerMessage, 0, len(sub.clients))
+	for _, ch := range sub.clients {
+		clients = append(clients, ch)
+	}
+	k.stLock.RUnlock()
+
+	for _, ch := range clients {
+		select {
+		case *ch <- msg:
+		default:
+			logger.Print("client channel full, dropping message for topic " + topic)
+		}
+	}
+}
+
+// AddHandler registers a handler for consumed messages, must be called before
+// Connect as the handlers are not locked
+func (k *Kafka) AddHandler(h MessageHandler) {
+	k.handlers = append(k.handlers, h)
+}
+
+// AddTap registers a handler for the messages of every topic, including the
+// ones published inside the server, must be called before Connect as well
+func (k *Kafka) AddTap(h MessageTap) {
+	k.taps = append(k.taps, h)
+}
+
 func (k *Kafka) GetMessage(clientID *string, topic *string) *chan *sarama.ConsumerMessage {
 	return k.subs[*topic].clients[*clientID]
 }
@@ -270,7 +379,20 @@ func (k *Kafka) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.C
 	)
 	for message := range claim.Messages() {
 		logger.Printf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+
+		// taps run first, a failed one restarts the session from the last
+		// marked offset before any handler has counted the message
+		for _, h := range k.taps {
+			if err := h(message); err != nil {
+				return err
+			}
+		}
 		session.MarkMessage(message, "")
+
+		for _, h := range k.handlers {
+			h(message)
+		}
+
 		// TODO: evaluate necessity of locks here
 		// there will only be single thread per topic so it should not need to lock
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestKafkaPublish(t *testing.T) {
+	k := KafkaInit()
+	k.RegisterTopic("alerts")
+	if !k.HasTopic("alerts") || !k.HasTopic("order_count") {
+		t.Fatal("expected topics to be registered")
+	}
+	if k.HasTopic("banana") {
+		t.Error("unexpected topic")
+	}
+
+	client := "client"
+	topic := "alerts"
+	k.Subscribe(&client, &topic)
+	ch := k.GetMessage(&client, &topic)
+
+	k.Publish("alerts", []byte("[]"))
+	msg := <-*ch
+	if string(msg.Value) != "[]" || msg.Topic != "alerts" {
+		t.Errorf("incorrect message %v", msg)
+	}
+
+	// a full channel drops messages instead of blocking
+	for i := 0; i < cap(*ch)+1; i++ {
+		k.Publish("alerts", []byte("[]"))
+	}
+	if len(*ch) != cap(*ch) {
+		t.Error("expected channel to be full")
+	}
+
+	if err := k.Unsubscribe(&client, &topic); err != nil {
+		t.Error(err)
+	}
+}
+
+// testSession records the marked offsets of a claim
+type testSession struct {
+	sarama.ConsumerGroupSession
+	marked []int64
+}
+
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.marked = append(s.marked, msg.Offset)
+}
+
+type testClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+func TestConsumeClaimTapFailure(t *testing.T) {
+	k := KafkaInit()
+	c := NewAggregateCache(time.Hour, []int{1}, topicSpecs)
+	now := time.Now()
+	c.Warm("order_count", nil, BucketKey(now.Add(-time.Minute)), false)
+	k.AddHandler(c.HandleMessage)
+	fail := true
+	k.AddTap(func(msg *sarama.ConsumerMessage) error {
+		if fail {
+			fail = false
+			return errors.New("database is down")
+		}
+		return nil
+	})
+
+	value := []byte(`[{"time_stamp": "` + now.Format(time.RFC3339Nano) + `", "revenue": 10}]`)
+	consume := func() (*testSession, error) {
+		claim := &testClaim{messages: make(chan *sarama.ConsumerMessage, 1)}
+		claim.messages <- &sarama.ConsumerMessage{Topic: "order_count", Offset: 7, Value: value}
+		close(claim.messages)
+		s := &testSession{}
+		return s, k.ConsumeClaim(s, claim)
+	}
+
+	// the failed tap leaves the message unmarked & uncounted
+	s, err := consume()
+	if err == nil || len(s.marked) != 0 {
+		t.Errorf("expected an error & no mark, got %v %v", err, s.marked)
+	}
+	// the replayed message is counted once
+	if s, err = consume(); err != nil || len(s.marked) != 1 {
+		t.Errorf("expected the replay to be marked, got %v %v", err, s.marked)
+	}
+	res, _ := c.Get("order_count", 1, time.Time{})
+	var revenue float64
+	for _, b := range res {
+		revenue += b.Values["revenue"]
+	}
+	if revenue != 10 {
+		t.Errorf("expected the revenue counted once, got %v", revenue)
+	}
+}
+
+func TestSkipBefore(t *testing.T) {
+	loaded := time.Now()
+	var handled int
+	h := skipBefore(loaded, func(msg *sarama.ConsumerMessage) { handled++ })
+	h(&sarama.ConsumerMessage{Timestamp: loaded.Add(-time.Second)})
+	h(&sarama.ConsumerMessage{Timestamp: loaded.Add(time.Second)})
+	h(&sarama.ConsumerMessage{})
+	if handled != 2 {
+		t.Errorf("expected the message from before the load to be skipped, handled %d", handled)
+	}
+}
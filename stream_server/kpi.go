@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// topic the KPI buckets are published on
+const kpisTopic = "kpis"
+
+// KPIConfig controls the business KPI topic
+type KPIConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+	// size of the KPI buckets
+	GroupMinute int `yaml:"groupMinute"`
+	// how far back buckets are kept & sent to new subscribers
+	Window time.Duration `yaml:"window"`
+}
+
+type kpiBucket struct {
+	ts      time.Time
+	orders  float64
+	revenue float64
+	// customers that ordered in the bucket & the ones whose first order was
+	customers    map[string]bool
+	newCustomers map[string]bool
+	// orders from customers that had ordered before
+	repeatOrders float64
+	signups      float64
+}
+
+// Bucket turns the counts into KPIs, ratios are left out when they have no
+// denominator
+func (kb *kpiBucket) Bucket() Bucket {
+	b := NewBucket(kb.ts)
+	active := float64(len(kb.customers))
+	b.Values["orders"] = kb.orders
+	b.Values["revenue"] = kb.revenue
+	b.Values["active_customers"] = active
+	b.Values["new_customers"] = float64(len(kb.newCustomers))
+	b.Values["returning_customers"] = active - float64(len(kb.newCustomers))
+	b.Values["repeat_orders"] = kb.repeatOrders
+	b.Values["signups"] = kb.signups
+	if kb.orders > 0 {
+		b.Values["aov"] = kb.revenue / kb.orders
+		b.Values["repeat_share"] = kb.repeatOrders / kb.orders
+	}
+	if active > 0 {
+		b.Values["revenue_per_customer"] = kb.revenue / active
+	}
+	return *b
+}
+
+// KPITracker computes average order value, revenue per active customer, the
+// share of orders from repeat customers & new against returning customers for
+// each bucket, a customer is new in the bucket of their first order
+type KPITracker struct {
+	mu   sync.Mutex
+	conf KPIConfig
+	// time of the first order of every customer
+	firstOrder map[string]time.Time
+	buckets    map[time.Time]*kpiBucket
+	publish    func(topic string, value []byte)
+}
+
+func NewKPITracker(conf *KPIConfig, publish func(string, []byte)) *KPITracker {
+	return &KPITracker{
+		conf:       *conf,
+		firstOrder: make(map[string]time.Time),
+		buckets:    make(map[time.Time]*kpiBucket),
+		publish:    publish,
+	}
+}
+
+// bucket returns the bucket of an event time, must be locked
+func (kt *KPITracker) bucket(t time.Time) *kpiBucket {
+	ts := BucketTime(BucketKey(t), kt.conf.GroupMinute)
+	kb, ok := kt.buckets[ts]
+	if !ok {
+		kb = &kpiBucket{ts: ts, customers: make(map[string]bool), newCustomers: make(map[string]bool)}
+		kt.buckets[ts] = kb
+	}
+	return kb
+}
+
+// SeedCustomer records a customer that first ordered before the window
+func (kt *KPITracker) SeedCustomer(customerID string, first time.Time) {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	kt.firstOrder[customerID] = first
+}
+
+// AddOrder adds an order, orders must be added in time order for the first
+// order of a customer to be right
+func (kt *KPITracker) AddOrder(t time.Time, customerID string, value float64) time.Time {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	return kt.addOrder(t, customerID, value)
+}
+
+func (kt *KPITracker) addOrder(t time.Time, customerID string, value float64) time.Time {
+	kb := kt.bucket(t)
+	kb.orders++
+	kb.revenue += value
+	if customerID == "" {
+		return kb.ts
+	}
+	kb.customers[customerID] = true
+	if first, ok := kt.firstOrder[customerID]; !ok {
+		kt.firstOrder[customerID] = t
+		kb.newCustomers[customerID] = true
+	} else if !first.After(t) {
+		kb.repeatOrders++
+	}
+	return kb.ts
+}
+
+// AddSignups adds new customers
+func (kt *KPITracker) AddSignups(t time.Time, n float64) time.Time {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	return kt.addSignups(t, n)
+}
+
+func (kt *KPITracker) addSignups(t time.Time, n float64) time.Time {
+	kb := kt.bucket(t)
+	kb.signups += n
+	return kb.ts
+}
+
+// HandleMessage adds order & customer events & publishes the updated buckets
+func (kt *KPITracker) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" && msg.Topic != "customer_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("KPIs could not parse message: " + err.Error())
+		return
+	}
+
+	kt.mu.Lock()
+	changed := make(map[time.Time]bool)
+	for i := range events {
+		e := &events[i]
+		if msg.Topic == "customer_count" {
+			changed[kt.addSignups(e.TimeStamp, e.Values["n"])] = true
+			continue
+		}
+		customerID, value := orderSketchValues(e)
+		changed[kt.addOrder(e.TimeStamp, customerID, value)] = true
+	}
+	var res []Bucket
+	for ts := range changed {
+		res = append(res, kt.buckets[ts].Bucket())
+	}
+	kt.evict(time.Now())
+	kt.mu.Unlock()
+
+	if len(res) == 0 || kt.publish == nil {
+		return
+	}
+	SortBuckets(res)
+	out, err := json.Marshal(res)
+	if err != nil {
+		logger.Print("error encoding KPIs: " + err.Error())
+		return
+	}
+	kt.publish(kpisTopic, out)
+}
+
+// evict drops buckets that have left the window, must be locked
+func (kt *KPITracker) evict(now time.Time) {
+	cutoff := BucketTime(BucketKey(now.Add(-kt.conf.Window)), kt.conf.GroupMinute)
+	for ts := range kt.buckets {
+		if ts.Before(cutoff) {
+			delete(kt.buckets, ts)
+		}
+	}
+}
+
+// Buckets returns the KPIs of the window sorted by time
+func (kt *KPITracker) Buckets() []Bucket {
+	kt.mu.Lock()
+	defer kt.mu.Unlock()
+	res := make([]Bucket, 0, len(kt.buckets))
+	for _, kb := range kt.buckets {
+		res = append(res, kb.Bucket())
+	}
+	SortBuckets(res)
+	return res
+}
+
+// seedKPIs loads the customers that ordered before the window, then replays
+// the orders & signups of the window from the store tables
+func (api *API) seedKPIs(kt *KPITracker) {
+	start := time.Now().Add(-kt.conf.Window)
+
+	rows, err := api.dm.Raw(`select customer_id, min(created_at) from "order" where deleted_at is null and created_at < ? group by customer_id`, start).Rows()
+	if err != nil {
+		logger.Print("error loading customers for KPIs: " + err.Error())
+		return
+	}
+	for rows.Next() {
+		var id int64
+		var first time.Time
+		if err = rows.Scan(&id, &first); err != nil {
+			logger.Print("error reading customers for KPIs: " + err.Error())
+			break
+		}
+		kt.SeedCustomer(strconv.FormatInt(id, 10), first)
+	}
+	rows.Close()
+
+	// sales_price of an order is never stored, the fact row is priced the same way
+	rows, err = api.dm.Raw(`select customer_id, created_at, quantity * unit_price::numeric from "order" where deleted_at is null and created_at >= ? order by created_at`, start).Rows()
+	if err != nil {
+		logger.Print("error loading orders for KPIs: " + err.Error())
+		return
+	}
+	for rows.Next() {
+		var id int64
+		var t time.Time
+		var value sql.NullFloat64
+		if err = rows.Scan(&id, &t, &value); err != nil {
+			logger.Print("error reading orders for KPIs: " + err.Error())
+			break
+		}
+		kt.AddOrder(t, strconv.FormatInt(id, 10), value.Float64)
+	}
+	rows.Close()
+
+	rows, err = api.dm.Raw(`select created_at from customer where deleted_at is null and created_at >= ?`, start).Rows()
+	if err != nil {
+		logger.Print("error loading signups for KPIs: " + err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t time.Time
+		if err = rows.Scan(&t); err != nil {
+			logger.Print("error reading signups for KPIs: " + err.Error())
+			return
+		}
+		kt.AddSignups(t, 1)
+	}
+}
+
+// kpiSnapshot is the first event of the KPI stream
+func (api *API) kpiSnapshot(r *http.Request) (interface{}, error) {
+	return api.kpis.Buckets(), nil
+}
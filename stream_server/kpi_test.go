@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func customerOrderMessage(ts time.Time, customerID int, price float64) *sarama.ConsumerMessage {
+	b, _ := json.Marshal([]map[string]interface{}{{
+		"time_stamp":  ts.Format(time.RFC3339Nano),
+		"order_count": 1,
+		"customer_id": customerID,
+		"n":           1,
+		"revenue":     price,
+	}})
+	return &sarama.ConsumerMessage{Topic: "order_count", Value: b}
+}
+
+func TestKPITracker(t *testing.T) {
+	var published [][]Bucket
+	publish := func(topic string, value []byte) {
+		var res []map[string]interface{}
+		if err := json.Unmarshal(value, &res); err != nil {
+			t.Fatal(err)
+		}
+		var buckets []Bucket
+		for _, m := range res {
+			b := NewBucket(time.Time{})
+			for k, v := range m {
+				if f, ok := v.(float64); ok {
+					b.Values[k] = f
+				}
+			}
+			buckets = append(buckets, *b)
+		}
+		published = append(published, buckets)
+	}
+	conf := DefaultConfig().KPI
+	kt := NewKPITracker(&conf, publish)
+
+	now := time.Now().Truncate(time.Hour)
+	// customer 1 ordered last month
+	kt.SeedCustomer("1", now.AddDate(0, -1, 0))
+	kt.AddOrder(now, "1", 30)
+	kt.AddOrder(now.Add(time.Minute), "2", 10)
+
+	kt.HandleMessage(customerOrderMessage(now.Add(2*time.Minute), 2, 20))
+	kt.HandleMessage(customerMessage(now.Add(3*time.Minute), 2))
+	if len(published) != 2 || len(published[0]) != 1 {
+		t.Fatalf("expected a bucket for each message, got %v", published)
+	}
+
+	b := published[1][0].Values
+	want := map[string]float64{
+		"orders":               3,
+		"revenue":              60,
+		"aov":                  20,
+		"active_customers":     2,
+		"revenue_per_customer": 30,
+		"new_customers":        1,
+		"returning_customers":  1,
+		// customer 1 & the second order of customer 2
+		"repeat_orders": 2,
+		"signups":       2,
+	}
+	for k, v := range want {
+		if b[k] != v {
+			t.Errorf("%s: expected %v got %v", k, v, b[k])
+		}
+	}
+	if share := b["repeat_share"]; share < 0.66 || share > 0.67 {
+		t.Errorf("expected repeat share of 2/3, got %v", share)
+	}
+
+	// a bucket with only signups has no order ratios
+	kt.AddSignups(now.Add(time.Hour), 1)
+	res := kt.Buckets()
+	if len(res) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(res))
+	}
+	if _, ok := res[1].Values["aov"]; ok {
+		t.Error("aov should be left out without orders")
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// LeaderboardConfig is a topic ranking products over a trailing window
+type LeaderboardConfig struct {
+	// topic the ranking is published on
+	Name string `yaml:"name"`
+	// units or revenue, defaults to revenue
+	By string `yaml:"by"`
+	// number of products ranked, defaults to 10
+	Size int `yaml:"size"`
+	// trailing window the products are summed over, defaults to 1h
+	Window time.Duration `yaml:"window"`
+}
+
+// Validate checks the leaderboard can be ranked
+func (lc *LeaderboardConfig) Validate() error {
+	if lc.Name == "" {
+		return fmt.Errorf("leaderboard missing name")
+	}
+	if lc.By != "units" && lc.By != "revenue" {
+		return fmt.Errorf("leaderboard %s must rank by units or revenue, got %q", lc.Name, lc.By)
+	}
+	if lc.Size < 1 || lc.Window <= 0 {
+		return fmt.Errorf("leaderboard %s requires a positive size & window", lc.Name)
+	}
+	return nil
+}
+
+// ProductRank is a product on the leaderboard
+type ProductRank struct {
+	Rank    int     `json:"rank"`
+	Product string  `json:"product"`
+	Units   float64 `json:"units"`
+	Revenue float64 `json:"revenue"`
+}
+
+// Ranking is published every time the leaderboard changes
+type Ranking struct {
+	Name      string        `json:"name"`
+	By        string        `json:"by"`
+	Window    string        `json:"window"`
+	TimeStamp time.Time     `json:"time_stamp"`
+	Products  []ProductRank `json:"products"`
+}
+
+type productTotals struct {
+	units   float64
+	revenue float64
+	// adds summed in, the product is dropped when this gets back to zero as
+	// float sums may not
+	adds int
+}
+
+// Leaderboard sums units & revenue per product into one minute slots so the
+// totals can slide with the window
+type Leaderboard struct {
+	mu   sync.Mutex
+	conf LeaderboardConfig
+	// slots keyed by minute, see BucketKey
+	slots   map[time.Time]map[string]*productTotals
+	totals  map[string]*productTotals
+	current []ProductRank
+	publish func(topic string, value []byte)
+}
+
+func NewLeaderboard(conf *LeaderboardConfig, publish func(string, []byte)) (*Leaderboard, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &Leaderboard{
+		conf:    *conf,
+		slots:   make(map[time.Time]map[string]*productTotals),
+		totals:  make(map[string]*productTotals),
+		current: []ProductRank{},
+		publish: publish,
+	}, nil
+}
+
+// add sums an order into its slot & the totals, must be locked
+func (lb *Leaderboard) add(key time.Time, product string, units, revenue float64) {
+	key = key.Truncate(time.Minute)
+	slot, ok := lb.slots[key]
+	if !ok {
+		slot = make(map[string]*productTotals)
+		lb.slots[key] = slot
+	}
+	for _, m := range []map[string]*productTotals{slot, lb.totals} {
+		pt, ok := m[product]
+		if !ok {
+			pt = &productTotals{}
+			m[product] = pt
+		}
+		pt.units += units
+		pt.revenue += revenue
+		pt.adds++
+	}
+}
+
+// expire drops the slots which have left the window ending at now, must be
+// locked
+func (lb *Leaderboard) expire(now time.Time) {
+	cutoff := BucketKey(now).Add(-lb.conf.Window)
+	for key, slot := range lb.slots {
+		if !key.Before(cutoff.Truncate(time.Minute)) {
+			continue
+		}
+		for product, pt := range slot {
+			t := lb.totals[product]
+			t.units -= pt.units
+			t.revenue -= pt.revenue
+			if t.adds -= pt.adds; t.adds == 0 {
+				delete(lb.totals, product)
+			}
+		}
+		delete(lb.slots, key)
+	}
+}
+
+// rank sorts the totals, ties are broken by product name, must be locked
+func (lb *Leaderboard) rank() []ProductRank {
+	res := make([]ProductRank, 0, len(lb.totals))
+	for product, pt := range lb.totals {
+		res = append(res, ProductRank{Product: product, Units: pt.units, Revenue: pt.revenue})
+	}
+	value := func(pr ProductRank) float64 {
+		if lb.conf.By == "units" {
+			return pr.Units
+		}
+		return pr.Revenue
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if vi, vj := value(res[i]), value(res[j]); vi != vj {
+			return vi > vj
+		}
+		return res[i].Product < res[j].Product
+	})
+	if len(res) > lb.conf.Size {
+		res = res[:lb.conf.Size]
+	}
+	for i := range res {
+		res[i].Rank = i + 1
+	}
+	return res
+}
+
+// update ranks the products & publishes the ranking if it changed
+func (lb *Leaderboard) update(now time.Time) {
+	lb.mu.Lock()
+	lb.expire(now)
+	ranked := lb.rank()
+	changed := len(ranked) != len(lb.current)
+	for i := 0; !changed && i < len(ranked); i++ {
+		changed = ranked[i] != lb.current[i]
+	}
+	if changed {
+		lb.current = ranked
+	}
+	r := lb.ranking(now)
+	lb.mu.Unlock()
+
+	if !changed || lb.publish == nil {
+		return
+	}
+	out, err := json.Marshal(r)
+	if err != nil {
+		logger.Print("error encoding leaderboard " + lb.conf.Name + ": " + err.Error())
+		return
+	}
+	lb.publish(lb.conf.Name, out)
+}
+
+// ranking wraps the current products, must be locked
+func (lb *Leaderboard) ranking(now time.Time) Ranking {
+	products := make([]ProductRank, len(lb.current))
+	copy(products, lb.current)
+	return Ranking{
+		Name:      lb.conf.Name,
+		By:        lb.conf.By,
+		Window:    lb.conf.Window.String(),
+		TimeStamp: now,
+		Products:  products,
+	}
+}
+
+// Seed adds the orders of a minute read from the fact table, key is the
+// minute on the database wall clock
+func (lb *Leaderboard) Seed(key time.Time, product string, units, revenue float64) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.add(key, product, units, revenue)
+}
+
+// HandleMessage adds the orders of a message & publishes the new ranking when
+// it changed, orders without a product are skipped
+func (lb *Leaderboard) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("leaderboard could not parse message: " + err.Error())
+		return
+	}
+	lb.mu.Lock()
+	for i := range events {
+		if product := events[i].Attrs["product"]; product != "" {
+			lb.add(BucketKey(events[i].TimeStamp), product, events[i].Values["n"], events[i].Values["revenue"])
+		}
+	}
+	lb.mu.Unlock()
+	lb.update(time.Now())
+}
+
+// Current returns the latest ranking, sent to new subscribers
+func (lb *Leaderboard) Current() Ranking {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.ranking(time.Now())
+}
+
+// Run expires orders leaving the window until ctx is cancelled
+func (lb *Leaderboard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			lb.update(now)
+		}
+	}
+}
+
+// seedLeaderboard loads the window of orders per product & minute from the
+// fact table
+func (api *API) seedLeaderboard(lb *Leaderboard) {
+	rows, err := api.dm.Raw(`
+select date_trunc('minute', date_key + time_key) ts, product, sum(n) units, sum(revenue) revenue
+from mart.order_fact
+where date_key + time_key >= ? and product is not null
+group by 1, 2`, time.Now().Add(-lb.conf.Window)).Rows()
+	if err != nil {
+		logger.Print("error seeding leaderboard " + lb.conf.Name + ": " + err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts time.Time
+		var product string
+		var units, revenue float64
+		if err = rows.Scan(&ts, &product, &units, &revenue); err != nil {
+			logger.Print("error reading leaderboard " + lb.conf.Name + ": " + err.Error())
+			return
+		}
+		lb.Seed(ts, product, units, revenue)
+	}
+	lb.update(time.Now())
+}
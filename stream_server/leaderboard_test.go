@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func productMessage(ts time.Time, product string, units, revenue float64) *sarama.ConsumerMessage {
+	b, _ := json.Marshal([]map[string]interface{}{{
+		"time_stamp":  ts.Format(time.RFC3339Nano),
+		"order_count": 1,
+		"product":     product,
+		"n":           units,
+		"revenue":     revenue,
+	}})
+	return &sarama.ConsumerMessage{Topic: "order_count", Value: b}
+}
+
+func TestLeaderboardValidate(t *testing.T) {
+	for _, c := range []LeaderboardConfig{
+		{Name: "", By: "revenue", Size: 3, Window: time.Hour},
+		{Name: "x", By: "profit", Size: 3, Window: time.Hour},
+		{Name: "x", By: "units", Size: 0, Window: time.Hour},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
+
+func TestLeaderboard(t *testing.T) {
+	var published []Ranking
+	publish := func(topic string, value []byte) {
+		var r Ranking
+		if err := json.Unmarshal(value, &r); err != nil {
+			t.Fatal(err)
+		}
+		published = append(published, r)
+	}
+	lb, err := NewLeaderboard(&LeaderboardConfig{Name: "top_products", By: "units", Size: 2, Window: 10 * time.Minute}, publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	lb.Seed(BucketKey(now.Add(-5*time.Minute)), "apple", 5, 10)
+	lb.Seed(BucketKey(now.Add(-30*time.Minute)), "banana", 100, 100)
+	lb.HandleMessage(productMessage(now, "cherry", 3, 30))
+	if len(published) != 1 {
+		t.Fatalf("expected 1 ranking, got %d", len(published))
+	}
+	// banana was outside of the window
+	r := published[0]
+	if len(r.Products) != 2 || r.Products[0].Product != "apple" || r.Products[1].Product != "cherry" || r.Products[1].Rank != 2 {
+		t.Errorf("incorrect ranking %+v", r.Products)
+	}
+
+	// a product outside of the top 2 does not change the ranking
+	lb.HandleMessage(productMessage(now, "date", 1, 100))
+	if len(published) != 1 {
+		t.Error("ranking published without changing")
+	}
+	lb.HandleMessage(productMessage(now, "cherry", 3, 30))
+	if len(published) != 2 || published[1].Products[0].Product != "cherry" || published[1].Products[0].Units != 6 {
+		t.Errorf("expected cherry to lead, got %+v", published[len(published)-1].Products)
+	}
+	// messages from other topics & orders without products are ignored
+	lb.HandleMessage(customerMessage(now, 1))
+	lb.HandleMessage(orderMessage(now, 50))
+	if len(published) != 2 {
+		t.Error("ranking changed by an order without a product")
+	}
+
+	// apple leaves the window
+	lb.update(now.Add(6 * time.Minute))
+	cur := lb.Current()
+	if len(cur.Products) != 2 || cur.Products[1].Product != "date" {
+		t.Errorf("expected apple to expire, got %+v", cur.Products)
+	}
+	if _, ok := lb.totals["apple"]; ok {
+		t.Error("expired product should be removed from the totals")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// BucketListener gets each bucket of a topic once it has closed
+type BucketListener func(topic string, b Bucket)
+
+// BucketStream sums live events into fixed size buckets for each topic & hands
+// every bucket to the listeners once its interval has passed, buckets without
+// events are sent as zeros so a topic going quiet is visible to listeners
+type BucketStream struct {
+	mu          sync.Mutex
+	groupMinute int
+	// events are allowed to arrive this late before their bucket is closed
+	grace     time.Duration
+	specs     map[string]*TopicSpec
+	open      map[string]*Bucket
+	listeners []BucketListener
+}
+
+func NewBucketStream(groupMinute int, grace time.Duration, specs map[string]*TopicSpec, now time.Time) *BucketStream {
+	bs := &BucketStream{
+		groupMinute: groupMinute,
+		grace:       grace,
+		specs:       specs,
+		open:        make(map[string]*Bucket),
+	}
+	start := BucketTime(BucketKey(now), groupMinute)
+	for name := range specs {
+		bs.open[name] = NewBucket(start)
+	}
+	return bs
+}
+
+// AddListener registers a listener for closed buckets, must be called before
+// messages are handled
+func (bs *BucketStream) AddListener(l BucketListener) {
+	bs.listeners = append(bs.listeners, l)
+}
+
+// OpenTime is the start of the open bucket of a topic
+func (bs *BucketStream) OpenTime(topic string) time.Time {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.open[topic].TimeStamp
+}
+
+// Seed sums a partly filled bucket read from the database into the open bucket
+// of its topic, buckets for other intervals are ignored
+func (bs *BucketStream) Seed(topic string, b Bucket) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if open, ok := bs.open[topic]; ok && open.TimeStamp.Equal(b.TimeStamp) {
+		open.Merge(&b)
+	}
+}
+
+// HandleMessage sums the events of a message into the open bucket of its topic
+func (bs *BucketStream) HandleMessage(msg *sarama.ConsumerMessage) {
+	spec, ok := bs.specs[msg.Topic]
+	if !ok {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("live buckets could not parse message: " + err.Error())
+		return
+	}
+
+	var closed []Bucket
+	bs.mu.Lock()
+	for i := range events {
+		ts := BucketTime(BucketKey(events[i].TimeStamp), bs.groupMinute)
+		open := bs.open[msg.Topic]
+		if ts.Before(open.TimeStamp) {
+			logger.Printf("dropping late event for topic %s at %v", msg.Topic, events[i].TimeStamp)
+			continue
+		}
+		// an event from a later bucket closes everything before it
+		closed = append(closed, bs.advance(msg.Topic, ts)...)
+		bs.open[msg.Topic].Add(&events[i], spec.FieldNames())
+	}
+	bs.mu.Unlock()
+
+	bs.emit(msg.Topic, closed)
+}
+
+// advance closes the open bucket of a topic & any empty ones until the open
+// bucket starts at ts, must be called while locked
+func (bs *BucketStream) advance(topic string, ts time.Time) []Bucket {
+	var closed []Bucket
+	open := bs.open[topic]
+	for open.TimeStamp.Before(ts) {
+		closed = append(closed, *open)
+		open = NewBucket(NextBucketTime(open.TimeStamp, bs.groupMinute))
+	}
+	bs.open[topic] = open
+	return closed
+}
+
+// Tick closes every bucket which ended more than the grace period before now
+func (bs *BucketStream) Tick(now time.Time) {
+	key := BucketTime(BucketKey(now.Add(-bs.grace)), bs.groupMinute)
+	closed := make(map[string][]Bucket)
+	bs.mu.Lock()
+	for topic := range bs.open {
+		if c := bs.advance(topic, key); len(c) > 0 {
+			closed[topic] = c
+		}
+	}
+	bs.mu.Unlock()
+
+	for topic, c := range closed {
+		bs.emit(topic, c)
+	}
+}
+
+func (bs *BucketStream) emit(topic string, closed []Bucket) {
+	for _, b := range closed {
+		for _, l := range bs.listeners {
+			l(topic, b)
+		}
+	}
+}
+
+// Run closes buckets on a timer until ctx is cancelled
+func (bs *BucketStream) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			bs.Tick(now)
+		}
+	}
+}
+
+// liveBuckets returns the bucket stream of a bucket size, creating it on first
+// use, only called while processors are initialized
+func (api *API) liveBuckets(groupMinute int) *BucketStream {
+	if api.bucketStreams == nil {
+		api.bucketStreams = make(map[int]*BucketStream)
+	}
+	if bs, ok := api.bucketStreams[groupMinute]; ok {
+		return bs
+	}
+	bs := NewBucketStream(groupMinute, 5*time.Second, topicSpecs, time.Now())
+	api.bucketStreams[groupMinute] = bs
+	api.Kafka.AddHandler(bs.HandleMessage)
+	go bs.Run(api.Kafka.ctx, 5*time.Second)
+	return bs
+}
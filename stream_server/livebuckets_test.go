@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func customerMessage(ts time.Time, n int) *sarama.ConsumerMessage {
+	return &sarama.ConsumerMessage{
+		Topic: "customer_count",
+		Value: []byte(`[{"time_stamp": "` + ts.Format(time.RFC3339Nano) + `", "n": ` + string(rune('0'+n)) + `}]`),
+	}
+}
+
+func TestBucketStream(t *testing.T) {
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	bs := NewBucketStream(5, 5*time.Second, topicSpecs, base)
+
+	var closed []Bucket
+	bs.AddListener(func(topic string, b Bucket) {
+		if topic == "customer_count" {
+			closed = append(closed, b)
+		}
+	})
+
+	bs.HandleMessage(customerMessage(base.Add(time.Minute), 1))
+	bs.HandleMessage(customerMessage(base.Add(2*time.Minute), 2))
+	if len(closed) != 0 {
+		t.Fatal("bucket closed early")
+	}
+
+	// an event in a later bucket closes the first & the empty one between
+	bs.HandleMessage(customerMessage(base.Add(11*time.Minute), 1))
+	if len(closed) != 2 {
+		t.Fatalf("expected 2 closed buckets, got %d", len(closed))
+	}
+	if closed[0].Values["n"] != 3 || !closed[0].TimeStamp.Equal(BucketKey(base)) {
+		t.Errorf("incorrect first bucket %v", closed[0])
+	}
+	if closed[1].Values["n"] != 0 {
+		t.Errorf("expected empty bucket, got %v", closed[1])
+	}
+
+	// late events are dropped
+	bs.HandleMessage(customerMessage(base.Add(time.Minute), 1))
+
+	// within the grace period nothing closes
+	bs.Tick(base.Add(15*time.Minute + 2*time.Second))
+	if len(closed) != 2 {
+		t.Fatalf("bucket closed inside grace period")
+	}
+	bs.Tick(base.Add(21 * time.Minute))
+	if len(closed) != 4 {
+		t.Fatalf("expected 4 closed buckets, got %d", len(closed))
+	}
+	if closed[2].Values["n"] != 1 || closed[3].Values["n"] != 0 {
+		t.Errorf("incorrect ticked buckets %v", closed[2:])
+	}
+}
+
+// bucket sizes that do not divide an hour restart on the hour like the SQL
+func TestBucketStreamUneven(t *testing.T) {
+	base := time.Date(2020, 6, 1, 10, 50, 0, 0, time.Local)
+	bs := NewBucketStream(7, 0, topicSpecs, base)
+	var closed []Bucket
+	bs.AddListener(func(topic string, b Bucket) {
+		if topic == "customer_count" {
+			closed = append(closed, b)
+		}
+	})
+	bs.Tick(base.Add(20 * time.Minute))
+
+	e := []int{49, 56, 0}
+	if len(closed) != len(e) {
+		t.Fatalf("expected %d buckets, got %d", len(e), len(closed))
+	}
+	for i, m := range e {
+		if closed[i].TimeStamp.Minute() != m {
+			t.Errorf("bucket %d: expected minute %d got %d", i, m, closed[i].TimeStamp.Minute())
+		}
+	}
+}
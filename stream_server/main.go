@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
@@ -26,7 +26,7 @@ func main() {
 	logger = zerolog.New(logFile).With().Timestamp().Str("service", "stream_server").Logger()
 	pidFile := prog + ".pid"
 	pid := os.Getpid()
-	logger.Print("Running pid: %d", pid)
+	logger.Printf("Running pid: %d", pid)
 
 	err = ioutil.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0600)
 	if err != nil {
@@ -34,26 +34,36 @@ func main() {
 		os.Exit(1)
 	}
 
+	// config file path can be given as the first argument
+	confFile := "config.yaml"
+	if len(os.Args) > 1 && os.Args[1] != "" {
+		confFile = os.Args[1]
+	}
+	conf, err := LoadConfig(confFile)
+	if err != nil {
+		logger.Print("error reading config file, using defaults: " + err.Error())
+		conf = DefaultConfig()
+	}
+
 	var api API
-	if err = api.Init(); err != nil {
+	if err = api.Init(conf); err != nil {
 		logger.Print("error initializing API server: " + err.Error())
 		os.Exit(1)
 	}
 
 	// run Kafka consumer manager on a thread
 	api.Kafka = KafkaInit()
+	api.InitProcessors()
 	go func(k *Kafka) {
 		k.Connect()
 	}(&api.Kafka)
 
-	// run REST service on a thread
-	go func(server *http.Server) {
-		logger.Printf("starting api server at %s", server.Addr)
-		err := server.ListenAndServe()
-		if err != nil && err != http.ErrServerClosed {
-			logger.Print("error starting API server: " + err.Error())
-		}
-	}(api.Server)
+	// run REST service on a thread per listener
+	ctx, cancel := context.WithCancel(context.Background())
+	if err = api.Serve(ctx); err != nil {
+		logger.Print("error starting API server: " + err.Error())
+		os.Exit(1)
+	}
 
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
@@ -70,6 +80,7 @@ func main() {
 		os.Exit(1)
 	}
 	logger.Print("closing server")
+	cancel()
 	api.Server.Close()
 
 	err = os.Remove(pidFile)
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// default & largest number of top products in a customer profile
+const (
+	defaultProfileProducts = 5
+	maxProfileProducts     = 50
+)
+
+// ProfileConfig controls the customer profiles kept in memory
+type ProfileConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+}
+
+// CustomerProfile is the lifetime summary of a customer
+type CustomerProfile struct {
+	CustomerID string     `json:"customer_id"`
+	Name       string     `json:"name,omitempty"`
+	City       string     `json:"city,omitempty"`
+	State      string     `json:"state,omitempty"`
+	SignedUp   *time.Time `json:"signed_up,omitempty"`
+	Orders     int        `json:"orders"`
+	Units      float64    `json:"units"`
+	Revenue    float64    `json:"revenue"`
+	FirstOrder *time.Time `json:"first_order,omitempty"`
+	LastOrder  *time.Time `json:"last_order,omitempty"`
+	// products ranked by revenue
+	TopProducts []ProductRank `json:"top_products"`
+}
+
+type customerState struct {
+	profile  CustomerProfile
+	products map[string]*ProductRank
+}
+
+// snapshot copies the profile with the top n products
+func (cs *customerState) snapshot(n int) CustomerProfile {
+	p := cs.profile
+	p.TopProducts = make([]ProductRank, 0, len(cs.products))
+	for _, pr := range cs.products {
+		p.TopProducts = append(p.TopProducts, *pr)
+	}
+	sort.Slice(p.TopProducts, func(i, j int) bool {
+		a, b := p.TopProducts[i], p.TopProducts[j]
+		if a.Revenue != b.Revenue {
+			return a.Revenue > b.Revenue
+		}
+		return a.Product < b.Product
+	})
+	if len(p.TopProducts) > n {
+		p.TopProducts = p.TopProducts[:n]
+	}
+	for i := range p.TopProducts {
+		p.TopProducts[i].Rank = i + 1
+	}
+	return p
+}
+
+// ProfileStore keeps a profile of every customer, built from Postgres at
+// startup & updated from the customer & order events
+type ProfileStore struct {
+	mu        sync.Mutex
+	customers map[string]*customerState
+	// subscribers of each customer get a signal when the profile changes
+	watchers map[string]map[chan struct{}]bool
+}
+
+func NewProfileStore() *ProfileStore {
+	return &ProfileStore{
+		customers: make(map[string]*customerState),
+		watchers:  make(map[string]map[chan struct{}]bool),
+	}
+}
+
+// customer returns the state of a customer, creating it, must be locked
+func (ps *ProfileStore) customer(id string) *customerState {
+	cs, ok := ps.customers[id]
+	if !ok {
+		cs = &customerState{
+			profile:  CustomerProfile{CustomerID: id},
+			products: make(map[string]*ProductRank),
+		}
+		ps.customers[id] = cs
+	}
+	return cs
+}
+
+// SetCustomer sets the details of a customer, empty values are left as they
+// were
+func (ps *ProfileStore) SetCustomer(id, name, city, state string, signedUp time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	cs := ps.customer(id)
+	if name != "" {
+		cs.profile.Name = name
+	}
+	if city != "" {
+		cs.profile.City = city
+	}
+	if state != "" {
+		cs.profile.State = state
+	}
+	if !signedUp.IsZero() && cs.profile.SignedUp == nil {
+		cs.profile.SignedUp = &signedUp
+	}
+	ps.notify(id)
+}
+
+// AddOrders sums orders of one product into a customer's profile
+func (ps *ProfileStore) AddOrders(id, product string, orders int, units, revenue float64, first, last time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	cs := ps.customer(id)
+	p := &cs.profile
+	p.Orders += orders
+	p.Units += units
+	p.Revenue += revenue
+	if p.FirstOrder == nil || first.Before(*p.FirstOrder) {
+		p.FirstOrder = &first
+	}
+	if p.LastOrder == nil || last.After(*p.LastOrder) {
+		p.LastOrder = &last
+	}
+	if product != "" {
+		pr, ok := cs.products[product]
+		if !ok {
+			pr = &ProductRank{Product: product}
+			cs.products[product] = pr
+		}
+		pr.Units += units
+		pr.Revenue += revenue
+	}
+	ps.notify(id)
+}
+
+// Profile returns the profile of a customer with the top n products
+func (ps *ProfileStore) Profile(id string, n int) (CustomerProfile, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	cs, ok := ps.customers[id]
+	if !ok {
+		return CustomerProfile{}, false
+	}
+	return cs.snapshot(n), true
+}
+
+// Watch returns a channel signalled after each change to a customer's profile
+// & a func to stop watching, signals are dropped while one is pending
+func (ps *ProfileStore) Watch(id string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	ps.mu.Lock()
+	if ps.watchers[id] == nil {
+		ps.watchers[id] = make(map[chan struct{}]bool)
+	}
+	ps.watchers[id][ch] = true
+	ps.mu.Unlock()
+	return ch, func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		delete(ps.watchers[id], ch)
+		if len(ps.watchers[id]) == 0 {
+			delete(ps.watchers, id)
+		}
+	}
+}
+
+// notify signals the watchers of a customer, must be locked
+func (ps *ProfileStore) notify(id string) {
+	for ch := range ps.watchers[id] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// HandleMessage adds the orders & signups of the customer & order events,
+// events without a customer_id are skipped
+func (ps *ProfileStore) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" && msg.Topic != "customer_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("profiles could not parse message: " + err.Error())
+		return
+	}
+	for i := range events {
+		e := &events[i]
+		id, _ := orderSketchValues(e)
+		if id == "" {
+			continue
+		}
+		if msg.Topic == "customer_count" {
+			ps.SetCustomer(id, "", e.Attrs["city"], e.Attrs["state"], e.TimeStamp)
+		} else {
+			ps.AddOrders(id, e.Attrs["product"], 1, e.Values["n"], e.Values["revenue"], e.TimeStamp, e.TimeStamp)
+		}
+	}
+}
+
+// ParseProfileProducts reads the number of top products from `top`
+func ParseProfileProducts(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("top")
+	if s == "" {
+		return defaultProfileProducts, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > maxProfileProducts {
+		return 0, fmt.Errorf("top must be an integer between 0 and %d", maxProfileProducts)
+	}
+	return n, nil
+}
+
+// loadProfiles builds the profiles of every customer from public.customer &
+// their orders by product from public."order"
+func (api *API) loadProfiles(ps *ProfileStore) error {
+	rows, err := api.dm.Raw(`
+select customer_id, trim(concat_ws(' ', name_first, name_last)), coalesce(city, ''), coalesce(state, ''), created_at
+from public.customer
+where deleted_at is null`).Rows()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		var name, city, state string
+		var created time.Time
+		if err = rows.Scan(&id, &name, &city, &state, &created); err != nil {
+			rows.Close()
+			return err
+		}
+		ps.SetCustomer(strconv.FormatInt(id, 10), name, city, state, created)
+	}
+	rows.Close()
+
+	// sales_price of an order is never stored, the fact row is priced the same way
+	rows, err = api.dm.Raw(`
+select customer_id, coalesce(product, ''), count(*), coalesce(sum(quantity), 0), coalesce(sum(quantity * unit_price::numeric), 0), min(created_at), max(created_at)
+from public."order"
+where deleted_at is null
+group by 1, 2`).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var product string
+		var orders int
+		var units, revenue float64
+		var first, last time.Time
+		if err = rows.Scan(&id, &product, &orders, &units, &revenue, &first, &last); err != nil {
+			return err
+		}
+		ps.AddOrders(strconv.FormatInt(id, 10), product, orders, units, revenue, first, last)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestProfileStore(t *testing.T) {
+	ps := NewProfileStore()
+	signedUp := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	ps.SetCustomer("1", "Ada Lovelace", "London", "LDN", signedUp)
+	ps.AddOrders("1", "widget", 2, 3, 30, signedUp.Add(time.Hour), signedUp.Add(2*time.Hour))
+	ps.AddOrders("1", "gadget", 1, 1, 50, signedUp.Add(3*time.Hour), signedUp.Add(3*time.Hour))
+	ps.AddOrders("1", "gizmo", 1, 1, 5, signedUp.Add(30*time.Minute), signedUp.Add(30*time.Minute))
+
+	p, ok := ps.Profile("1", 2)
+	if !ok {
+		t.Fatal("expected profile")
+	}
+	if p.Name != "Ada Lovelace" || p.Orders != 4 || p.Units != 5 || p.Revenue != 85 {
+		t.Errorf("unexpected profile %+v", p)
+	}
+	if !p.FirstOrder.Equal(signedUp.Add(30*time.Minute)) || !p.LastOrder.Equal(signedUp.Add(3*time.Hour)) {
+		t.Errorf("unexpected order times %v %v", p.FirstOrder, p.LastOrder)
+	}
+	if len(p.TopProducts) != 2 || p.TopProducts[0].Product != "gadget" || p.TopProducts[0].Rank != 1 || p.TopProducts[1].Product != "widget" {
+		t.Errorf("unexpected top products %+v", p.TopProducts)
+	}
+
+	// a later signup time does not replace the first
+	ps.SetCustomer("1", "", "Paris", "", signedUp.Add(time.Hour))
+	if p, _ = ps.Profile("1", 2); p.City != "Paris" || p.Name != "Ada Lovelace" || !p.SignedUp.Equal(signedUp) {
+		t.Errorf("unexpected customer details %+v", p)
+	}
+
+	if _, ok = ps.Profile("2", 2); ok {
+		t.Error("expected unknown customer")
+	}
+}
+
+func TestProfileStoreHandleMessage(t *testing.T) {
+	ps := NewProfileStore()
+	changed, stop := ps.Watch("7")
+	defer stop()
+
+	ts := time.Date(2020, 1, 1, 9, 0, 0, 0, time.UTC)
+	b, _ := json.Marshal([]map[string]interface{}{{
+		"time_stamp":  ts.Format(time.RFC3339Nano),
+		"customer_id": 7,
+		"state":       "NY",
+		"city":        "Albany",
+		"n":           1,
+	}})
+	ps.HandleMessage(&sarama.ConsumerMessage{Topic: "customer_count", Value: b})
+	ps.HandleMessage(productMessage(ts.Add(time.Minute), "widget", 2, 20))
+	ps.HandleMessage(customerOrderMessage(ts.Add(time.Hour), 7, 10))
+
+	select {
+	case <-changed:
+	default:
+		t.Error("expected a change signal")
+	}
+	p, ok := ps.Profile("7", 5)
+	if !ok {
+		t.Fatal("expected profile")
+	}
+	// the product message has no customer
+	if p.State != "NY" || p.Orders != 1 || p.Revenue != 10 || !p.SignedUp.Equal(ts) || !p.LastOrder.Equal(ts.Add(time.Hour)) {
+		t.Errorf("unexpected profile %+v", p)
+	}
+
+	stop()
+	if len(ps.watchers) != 0 {
+		t.Error("expected watcher to be removed")
+	}
+}
+
+func TestParseProfileProducts(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v0/customers/1/profile", nil)
+	if n, err := ParseProfileProducts(r); err != nil || n != defaultProfileProducts {
+		t.Errorf("unexpected default %d %v", n, err)
+	}
+	r = httptest.NewRequest("GET", "/v0/customers/1/profile?top=100", nil)
+	if _, err := ParseProfileProducts(r); err == nil {
+		t.Error("expected error for top above the limit")
+	}
+}
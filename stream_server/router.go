@@ -1,10 +1,62 @@
 package main
 
+import "expvar"
+
 // AddRoutes attaches the routes to the server
 // use to move the routes into their own file for easier maintenance
 func (api *API) AddRoutes() {
 	api.SubRouter.HandleFunc("/health", api.GetHealth).Methods("Get")
+	// exported server metrics i.e. aggregate cache hit rate
+	api.SubRouter.Handle("/debug/vars", expvar.Handler()).Methods("Get")
 
 	// listen to data stream
 	api.SubRouter.HandleFunc("/stream/subscribe/{topic}", api.StreamMessages).Methods("Get")
+
+	// history rolled up by week, month, quarter etc
+	api.SubRouter.HandleFunc("/history/{topic}/calendar", api.GetCalendar).Methods("Get")
+	// customers, orders & revenue by state or city
+	api.SubRouter.HandleFunc("/history/geo", api.GetGeo).Methods("Get")
+	// retention of signup cohorts by week or month
+	api.SubRouter.HandleFunc("/history/cohorts", api.GetCohorts).Methods("Get")
+	// weekday by hour totals
+	api.SubRouter.HandleFunc("/history/{topic}/heatmap", api.GetHeatmap).Methods("Get")
+
+	// lifetime orders & top products of a customer, streamed with an
+	// Accept of text/event-stream
+	api.SubRouter.HandleFunc("/customers/{id}/profile", api.GetCustomerProfile).Methods("Get")
+
+	// measures by dimensions of the mart schema built from the semantic model
+	api.SubRouter.HandleFunc("/query", api.PostQuery).Methods("Post")
+
+	// GraphQL queries over POST & subscriptions over WebSocket
+	api.SubRouter.HandleFunc("/graphql", api.PostGraphQL).Methods("Post")
+	api.SubRouter.HandleFunc("/graphql", api.GraphQLSocket).Methods("Get")
+	api.SubRouter.HandleFunc("/graphql/schema", api.GetGraphQLSchema).Methods("Get")
+
+	// revenue targets by day or month, progress is streamed on the goals topic
+	api.SubRouter.HandleFunc("/goals", api.ListGoals).Methods("Get")
+	api.SubRouter.HandleFunc("/goals", api.CreateGoal).Methods("Post")
+	api.SubRouter.HandleFunc("/goals/{id}", api.GetGoal).Methods("Get")
+	api.SubRouter.HandleFunc("/goals/{id}", api.UpdateGoal).Methods("Put")
+	api.SubRouter.HandleFunc("/goals/{id}", api.DeleteGoal).Methods("Delete")
+
+	// named subscriptions with a committed position per topic, events are
+	// fetched until acked
+	api.SubRouter.HandleFunc("/durable", api.ListDurable).Methods("Get")
+	api.SubRouter.HandleFunc("/durable", api.CreateDurable).Methods("Post")
+	api.SubRouter.HandleFunc("/durable/{name}", api.GetDurable).Methods("Get")
+	api.SubRouter.HandleFunc("/durable/{name}", api.DeleteDurable).Methods("Delete")
+	api.SubRouter.HandleFunc("/durable/{name}/events", api.GetDurableEvents).Methods("Get")
+	api.SubRouter.HandleFunc("/durable/{name}/ack", api.AckDurable).Methods("Post")
+
+	// events pushed to registered URLs, signed & retried
+	api.SubRouter.HandleFunc("/webhooks", api.ListWebhooks).Methods("Get")
+	api.SubRouter.HandleFunc("/webhooks", api.CreateWebhook).Methods("Post")
+	api.SubRouter.HandleFunc("/webhooks/{id}", api.GetWebhook).Methods("Get")
+	api.SubRouter.HandleFunc("/webhooks/{id}", api.UpdateWebhook).Methods("Put")
+	api.SubRouter.HandleFunc("/webhooks/{id}", api.DeleteWebhook).Methods("Delete")
+	api.SubRouter.HandleFunc("/webhooks/{id}/deliveries", api.GetWebhookDeliveries).Methods("Get")
+
+	// forecast of a topic with confidence bands & backtest errors
+	api.SubRouter.HandleFunc("/forecast/{topic}", api.GetForecast).Methods("Get")
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryConfig limits the cost of semantic layer queries
+type QueryConfig struct {
+	// largest number of rows returned, requests can ask for fewer
+	MaxRows int `yaml:"maxRows"`
+	// largest planner cost from EXPLAIN a query may have
+	MaxCost float64 `yaml:"maxCost"`
+	// statement timeout of each query
+	Timeout time.Duration `yaml:"timeout"`
+	// most dimensions & measures in one query
+	MaxFields int `yaml:"maxFields"`
+	// most values of an in or not_in filter
+	MaxValues int `yaml:"maxValues"`
+}
+
+// queryMaxBytes caps the body of a query request
+const queryMaxBytes = 64 << 10
+
+// FactModel is a fact table with its measures & the dimensions it joins
+type FactModel struct {
+	Table string
+	// aggregate SQL of each measure over the fact rows f
+	Measures map[string]string
+	// columns of the fact table itself i.e. product
+	Attributes map[string]string
+	// dimensions that may be joined
+	Joins []string
+}
+
+// DimensionModel is a dimension table joined to the facts
+type DimensionModel struct {
+	Table string
+	Alias string
+	On    string
+	// SQL of each attribute
+	Attributes map[string]string
+}
+
+// SemanticModel describes what can be queried through /query, fields are
+// referenced as `{dimension or fact}.{attribute}` and only SQL from the model
+// ends up in the query, values are always parameters
+type SemanticModel struct {
+	Facts      map[string]*FactModel
+	Dimensions map[string]*DimensionModel
+}
+
+// semanticModel is the model of the mart schema
+var semanticModel = &SemanticModel{
+	Facts: map[string]*FactModel{
+		"orders": {
+			Table: "mart.order_fact",
+			Measures: map[string]string{
+				"orders":          "count(*)",
+				"units":           "sum(f.n)",
+				"revenue":         "sum(f.revenue)",
+				"avg_order_value": "avg(f.revenue)",
+				"customers":       "count(distinct f.customer_id)",
+			},
+			Attributes: map[string]string{
+				"product":     "f.product",
+				"customer_id": "f.customer_id",
+			},
+			Joins: []string{"date", "time"},
+		},
+		"customers": {
+			Table: "mart.customer_fact",
+			Measures: map[string]string{
+				"signups": "sum(f.n)",
+			},
+			Attributes: map[string]string{
+				"customer_id": "f.customer_id",
+			},
+			Joins: []string{"date", "time"},
+		},
+	},
+	Dimensions: map[string]*DimensionModel{
+		"date": {
+			Table: "mart.date_dimension",
+			Alias: "dd",
+			On:    "dd.date_key = f.date_key",
+			Attributes: map[string]string{
+				"date":         "dd.the_date",
+				"year":         "dd.the_year",
+				"quarter":      "dd.quarter_number",
+				"quarter_name": "dd.quarter_name",
+				"month":        "dd.month_number",
+				"month_name":   "trim(dd.month_name)",
+				"week":         "dd.week_of_year",
+				"weekday":      "dd.weekday_number",
+				"weekday_name": "trim(dd.weekday_name)",
+				"day_of_month": "dd.day_of_month",
+				"day_of_year":  "dd.day_of_year",
+				"weekend":      "dd.weekend",
+			},
+		},
+		"time": {
+			Table: "mart.time_dimension",
+			Alias: "td",
+			On:    "td.time_key = f.time_key",
+			Attributes: map[string]string{
+				"hour":   "td.hour_24",
+				"minute": "td.the_minute",
+			},
+		},
+	},
+}
+
+// QueryFilter compares a dimension or measure with a value, `in` & `not_in`
+// take a list
+type QueryFilter struct {
+	Field string      `json:"field"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// filterOps are the SQL operators of the filter ops
+var filterOps = map[string]string{
+	"eq":     "=",
+	"neq":    "<>",
+	"gt":     ">",
+	"gte":    ">=",
+	"lt":     "<",
+	"lte":    "<=",
+	"in":     "in",
+	"not_in": "not in",
+}
+
+// QueryOrder sorts by a requested dimension or measure
+type QueryOrder struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc"`
+}
+
+// SemanticQuery is the body of a /query request, measures are named without
+// the fact
+type SemanticQuery struct {
+	Fact       string        `json:"fact"`
+	Measures   []string      `json:"measures"`
+	Dimensions []string      `json:"dimensions"`
+	Filters    []QueryFilter `json:"filters"`
+	// fact time range, to is exclusive
+	From  time.Time    `json:"from"`
+	To    time.Time    `json:"to"`
+	Order []QueryOrder `json:"order"`
+	Limit int          `json:"limit"`
+}
+
+// BuiltQuery is the SQL of a semantic query with its parameters
+type BuiltQuery struct {
+	SQL     string
+	Args    []interface{}
+	Columns []string
+	// number of leading dimension columns
+	Dimensions int
+	Limit      int
+}
+
+// Build validates the query against the model & builds the SQL
+func (m *SemanticModel) Build(q *SemanticQuery, conf *QueryConfig) (*BuiltQuery, error) {
+	fact, ok := m.Facts[q.Fact]
+	if !ok {
+		return nil, fmt.Errorf("unknown fact %s", q.Fact)
+	}
+	if len(q.Measures) == 0 && len(q.Dimensions) == 0 {
+		return nil, errors.New("at least one measure or dimension is needed")
+	}
+	if n := len(q.Measures) + len(q.Dimensions); n > conf.MaxFields {
+		return nil, fmt.Errorf("at most %d measures & dimensions can be queried, got %d", conf.MaxFields, n)
+	}
+
+	bq := &BuiltQuery{Limit: conf.MaxRows}
+	if q.Limit < 0 {
+		return nil, errors.New("limit must be positive")
+	}
+	if q.Limit > 0 && q.Limit < conf.MaxRows {
+		bq.Limit = q.Limit
+	}
+
+	joins := make(map[string]bool)
+	// resolve finds the SQL of a dimension attribute
+	resolve := func(field string) (string, error) {
+		parts := strings.SplitN(field, ".", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("dimension %s must be named as {dimension}.{attribute}", field)
+		}
+		if parts[0] == q.Fact {
+			if s, ok := fact.Attributes[parts[1]]; ok {
+				return s, nil
+			}
+			return "", fmt.Errorf("unknown attribute %s of fact %s", parts[1], q.Fact)
+		}
+		dim, ok := m.Dimensions[parts[0]]
+		if !ok || !SliceContainsString(fact.Joins, parts[0]) {
+			return "", fmt.Errorf("dimension %s can not be joined to fact %s", parts[0], q.Fact)
+		}
+		s, ok := dim.Attributes[parts[1]]
+		if !ok {
+			return "", fmt.Errorf("unknown attribute %s of dimension %s", parts[1], parts[0])
+		}
+		joins[parts[0]] = true
+		return s, nil
+	}
+
+	var cols, groups []string
+	aliases := make(map[string]string)
+	for _, d := range q.Dimensions {
+		if _, dup := aliases[d]; dup {
+			return nil, fmt.Errorf("%s is requested twice", d)
+		}
+		s, err := resolve(d)
+		if err != nil {
+			return nil, err
+		}
+		alias := "c" + strconv.Itoa(len(cols))
+		cols = append(cols, s+" "+alias)
+		groups = append(groups, strconv.Itoa(len(cols)))
+		aliases[d] = alias
+		bq.Columns = append(bq.Columns, d)
+	}
+	bq.Dimensions = len(cols)
+	for _, ms := range q.Measures {
+		if _, dup := aliases[ms]; dup {
+			return nil, fmt.Errorf("%s is requested twice", ms)
+		}
+		s, ok := fact.Measures[ms]
+		if !ok {
+			return nil, fmt.Errorf("unknown measure %s of fact %s", ms, q.Fact)
+		}
+		alias := "c" + strconv.Itoa(len(cols))
+		cols = append(cols, s+" "+alias)
+		aliases[ms] = alias
+		bq.Columns = append(bq.Columns, ms)
+	}
+
+	var where, having []string
+	if !q.From.IsZero() {
+		where = append(where, "f.date_key + f.time_key >= ?")
+		bq.Args = append(bq.Args, q.From)
+	}
+	if !q.To.IsZero() {
+		if !q.From.IsZero() && !q.To.After(q.From) {
+			return nil, errors.New("to must be after from")
+		}
+		where = append(where, "f.date_key + f.time_key < ?")
+		bq.Args = append(bq.Args, q.To)
+	}
+	// having comes after where so its parameters are kept apart
+	var havingArgs []interface{}
+	for _, f := range q.Filters {
+		op, ok := filterOps[f.Op]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter op %s", f.Op)
+		}
+		placeholder, args, err := filterValues(f, conf.MaxValues)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := fact.Measures[f.Field]; ok {
+			having = append(having, fmt.Sprintf("%s %s %s", s, op, placeholder))
+			havingArgs = append(havingArgs, args...)
+			continue
+		}
+		s, err := resolve(f.Field)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, fmt.Sprintf("%s %s %s", s, op, placeholder))
+		bq.Args = append(bq.Args, args...)
+	}
+	bq.Args = append(bq.Args, havingArgs...)
+
+	var order []string
+	for _, o := range q.Order {
+		alias, ok := aliases[o.Field]
+		if !ok {
+			return nil, fmt.Errorf("can only order by a requested field, got %s", o.Field)
+		}
+		if o.Desc {
+			alias += " desc"
+		}
+		order = append(order, alias)
+	}
+	// stable pages when nothing is asked for
+	if len(order) == 0 {
+		order = groups
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "select %s\nfrom %s f", strings.Join(cols, ", "), fact.Table)
+	names := make([]string, 0, len(joins))
+	for name := range joins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dim := m.Dimensions[name]
+		fmt.Fprintf(&b, "\njoin %s %s on %s", dim.Table, dim.Alias, dim.On)
+	}
+	if len(where) > 0 {
+		fmt.Fprintf(&b, "\nwhere %s", strings.Join(where, " and "))
+	}
+	if len(groups) > 0 {
+		fmt.Fprintf(&b, "\ngroup by %s", strings.Join(groups, ", "))
+	}
+	if len(having) > 0 {
+		fmt.Fprintf(&b, "\nhaving %s", strings.Join(having, " and "))
+	}
+	if len(order) > 0 {
+		fmt.Fprintf(&b, "\norder by %s", strings.Join(order, ", "))
+	}
+	// one extra row tells if the result was cut off
+	fmt.Fprintf(&b, "\nlimit %d", bq.Limit+1)
+	bq.SQL = b.String()
+	return bq, nil
+}
+
+// filterValues returns the placeholders & parameters of a filter value
+func filterValues(f QueryFilter, maxValues int) (string, []interface{}, error) {
+	list, isList := f.Value.([]interface{})
+	if f.Op != "in" && f.Op != "not_in" {
+		if isList || f.Value == nil {
+			return "", nil, fmt.Errorf("filter on %s needs a single value", f.Field)
+		}
+		return "?", []interface{}{f.Value}, nil
+	}
+	if !isList || len(list) == 0 {
+		return "", nil, fmt.Errorf("filter on %s needs a list of values", f.Field)
+	}
+	if len(list) > maxValues {
+		return "", nil, fmt.Errorf("filter on %s can have at most %d values, got %d", f.Field, maxValues, len(list))
+	}
+	for _, v := range list {
+		if _, nested := v.([]interface{}); nested || v == nil {
+			return "", nil, fmt.Errorf("filter on %s needs a list of values", f.Field)
+		}
+	}
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", len(list)), ", ") + ")", list, nil
+}
+
+// QueryResult is the response of /query
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// more rows matched than the limit
+	Truncated bool `json:"truncated"`
+	// planner cost the query was checked with
+	Cost float64 `json:"cost"`
+}
+
+// errQueryCost is returned when the planner cost is above the limit
+var errQueryCost = errors.New("query is too expensive")
+
+// planCost reads the total cost from EXPLAIN (format json) output
+func planCost(plan []byte) (float64, error) {
+	var res []struct {
+		Plan struct {
+			TotalCost float64 `json:"Total Cost"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal(plan, &res); err != nil {
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, errors.New("empty query plan")
+	}
+	return res[0].Plan.TotalCost, nil
+}
+
+// runQuery checks the planner cost & runs the query in a read only
+// transaction with the statement timeout
+func (api *API) runQuery(bq *BuiltQuery) (*QueryResult, error) {
+	conf := &api.Config.Query
+	tx := api.dm.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	// nothing is written so the transaction is always rolled back
+	defer tx.Rollback()
+	if err := tx.Exec("set transaction read only").Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Exec(fmt.Sprintf("set local statement_timeout = %d", conf.Timeout.Milliseconds())).Error; err != nil {
+		return nil, err
+	}
+
+	var plan []byte
+	if err := tx.Raw("explain (format json) "+bq.SQL, bq.Args...).Row().Scan(&plan); err != nil {
+		return nil, err
+	}
+	cost, err := planCost(plan)
+	if err != nil {
+		return nil, err
+	}
+	if cost > conf.MaxCost {
+		return nil, fmt.Errorf("%w: planner cost %.0f is above the limit of %.0f", errQueryCost, cost, conf.MaxCost)
+	}
+
+	rows, err := tx.Raw(bq.SQL, bq.Args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := &QueryResult{Columns: bq.Columns, Rows: [][]interface{}{}, Cost: cost}
+	for rows.Next() {
+		vals := make([]interface{}, len(bq.Columns))
+		dest := make([]interface{}, len(vals))
+		for i := range vals {
+			dest[i] = &vals[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if len(res.Rows) == bq.Limit {
+			res.Truncated = true
+			break
+		}
+		for i, v := range vals {
+			vals[i] = queryValue(v, i >= bq.Dimensions)
+		}
+		res.Rows = append(res.Rows, vals)
+	}
+	return res, rows.Err()
+}
+
+// queryValue converts the driver's text values, numeric columns come back as
+// bytes & measures are sent as numbers
+func queryValue(v interface{}, measure bool) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	if measure {
+		if f, err := strconv.ParseFloat(string(b), 64); err == nil {
+			return f
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testQueryConfig() *QueryConfig {
+	return &DefaultConfig().Query
+}
+
+func TestSemanticBuild(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := &SemanticQuery{
+		Fact:       "orders",
+		Measures:   []string{"revenue", "orders"},
+		Dimensions: []string{"date.month_name", "orders.product"},
+		Filters: []QueryFilter{
+			{Field: "date.weekend", Op: "eq", Value: false},
+			{Field: "revenue", Op: "gt", Value: 100.0},
+			{Field: "orders.product", Op: "in", Value: []interface{}{"widget", "gadget"}},
+		},
+		From:  from,
+		Order: []QueryOrder{{Field: "revenue", Desc: true}},
+		Limit: 50,
+	}
+	bq, err := semanticModel.Build(q, testQueryConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `select trim(dd.month_name) c0, f.product c1, sum(f.revenue) c2, count(*) c3
+from mart.order_fact f
+join mart.date_dimension dd on dd.date_key = f.date_key
+where f.date_key + f.time_key >= ? and dd.weekend = ? and f.product in (?, ?)
+group by 1, 2
+having sum(f.revenue) > ?
+order by c2 desc
+limit 51`
+	if bq.SQL != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, bq.SQL)
+	}
+	args, _ := json.Marshal(bq.Args)
+	if string(args) != `["2020-01-01T00:00:00Z",false,"widget","gadget",100]` {
+		t.Errorf("unexpected args %s", args)
+	}
+	if strings.Join(bq.Columns, ",") != "date.month_name,orders.product,revenue,orders" || bq.Dimensions != 2 || bq.Limit != 50 {
+		t.Errorf("unexpected columns %v", bq)
+	}
+}
+
+func TestSemanticBuildErrors(t *testing.T) {
+	conf := testQueryConfig()
+	many := make([]interface{}, conf.MaxValues+1)
+	for i := range many {
+		many[i] = i
+	}
+	for _, q := range []SemanticQuery{
+		{Fact: "returns", Measures: []string{"orders"}},
+		{Fact: "orders"},
+		{Fact: "orders", Measures: []string{"profit"}},
+		{Fact: "orders", Dimensions: []string{"month_name"}},
+		{Fact: "orders", Dimensions: []string{"customer.state"}},
+		{Fact: "orders", Dimensions: []string{"date.fiscal_year"}},
+		{Fact: "customers", Dimensions: []string{"customers.product"}},
+		{Fact: "orders", Measures: []string{"orders", "orders"}},
+		{Fact: "orders", Measures: []string{"orders"}, Filters: []QueryFilter{{Field: "date.year", Op: "like", Value: 1}}},
+		{Fact: "orders", Measures: []string{"orders"}, Filters: []QueryFilter{{Field: "date.year", Op: "eq", Value: []interface{}{1}}}},
+		{Fact: "orders", Measures: []string{"orders"}, Filters: []QueryFilter{{Field: "date.year", Op: "in", Value: 2020}}},
+		{Fact: "orders", Measures: []string{"orders"}, Filters: []QueryFilter{{Field: "date.year", Op: "not_in", Value: many}}},
+		{Fact: "orders", Measures: []string{"orders"}, Filters: []QueryFilter{{Field: "date.year; drop table x", Op: "eq", Value: 1}}},
+		{Fact: "orders", Measures: []string{"orders"}, Order: []QueryOrder{{Field: "revenue"}}},
+		{Fact: "orders", Measures: []string{"orders"}, Limit: -1},
+		{Fact: "orders", Measures: []string{"orders"}, From: time.Now(), To: time.Now().Add(-time.Hour)},
+		{Fact: "orders", Measures: []string{"orders", "units", "revenue", "customers", "avg_order_value"},
+			Dimensions: []string{"date.year", "date.month", "date.week", "date.weekday", "time.hour", "time.minute"}},
+	} {
+		if _, err := semanticModel.Build(&q, conf); err == nil {
+			t.Errorf("expected error for %+v", q)
+		}
+	}
+}
+
+func TestSemanticBuildLimit(t *testing.T) {
+	conf := testQueryConfig()
+	bq, err := semanticModel.Build(&SemanticQuery{Fact: "customers", Measures: []string{"signups"}, Limit: conf.MaxRows * 2}, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bq.Limit != conf.MaxRows || strings.Contains(bq.SQL, "group by") {
+		t.Errorf("unexpected query %+v", bq)
+	}
+}
+
+func TestPlanCost(t *testing.T) {
+	cost, err := planCost([]byte(`[{"Plan": {"Node Type": "Aggregate", "Startup Cost": 1.5, "Total Cost": 2405.25}}]`))
+	if err != nil || cost != 2405.25 {
+		t.Errorf("unexpected cost %v %v", cost, err)
+	}
+	if _, err = planCost([]byte(`[]`)); err == nil {
+		t.Error("expected error for empty plan")
+	}
+}
+
+func TestQueryValue(t *testing.T) {
+	if v := queryValue([]byte("12.50000"), true); v != 12.5 {
+		t.Errorf("expected measure as number, got %v", v)
+	}
+	if v := queryValue([]byte("widget"), false); v != "widget" {
+		t.Errorf("expected dimension as string, got %v", v)
+	}
+	if v := queryValue(int64(3), false); v != int64(3) {
+		t.Errorf("expected value unchanged, got %v", v)
+	}
+}
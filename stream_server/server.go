@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// NewServer creates the http.Server shared by all listeners, the returned
+// CertReloader is nil unless a TLS listener is configured
+func NewServer(conf *ServerConfig, h http.Handler) (*http.Server, *CertReloader, error) {
+	server := &http.Server{
+		Handler: h,
+		// data streams are long lived so the timeouts need to allow for that
+		WriteTimeout: conf.WriteTimeout,
+		ReadTimeout:  conf.ReadTimeout,
+	}
+	if len(conf.Listeners) > 0 {
+		server.Addr = conf.Listeners[0].Addr
+	}
+
+	if !conf.UsesTLS() {
+		return server, nil, nil
+	}
+
+	certs, err := NewCertReloader(conf.TLS.CertFile, conf.TLS.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if *conf.HTTP2 {
+		// listing h2 up front makes net/http configure HTTP/2 no matter if a
+		// plain or TLS listener is served first
+		server.TLSConfig.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		// a non-nil empty map stops net/http from enabling HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		server.TLSConfig.NextProtos = []string{"http/1.1"}
+	}
+	return server, certs, nil
+}
+
+// ServeListeners binds every listener before serving any of them so that a bad
+// address is reported to the caller, each listener is then served on its own
+// thread until the server is closed
+func ServeListeners(server *http.Server, listeners []ListenerConfig) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, l := range listeners {
+		ln, err := net.Listen("tcp", l.Addr)
+		if err != nil {
+			for _, opened := range lns {
+				opened.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+
+	for i, l := range listeners {
+		go func(ln net.Listener, useTLS bool) {
+			var err error
+			if useTLS {
+				logger.Printf("starting api server at https://%s", ln.Addr())
+				// cert & key come from TLSConfig.GetCertificate, ServeTLS also sets
+				// up HTTP/2 negotiation unless it was disabled
+				err = server.ServeTLS(ln, "", "")
+			} else {
+				logger.Printf("starting api server at http://%s", ln.Addr())
+				err = server.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Print("error starting API server: " + err.Error())
+			}
+		}(lns[i], l.TLS)
+	}
+	return lns, nil
+}
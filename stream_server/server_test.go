@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert generates a certificate for 127.0.0.1 & writes the PEM
+// encoded cert & key into dir
+func writeSelfSignedCert(t *testing.T, dir string, cn string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func tlsTestClient(cert *x509.Certificate, http2 bool) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: http2,
+	}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+func startTestServer(t *testing.T, conf *Config) (*http.Server, *CertReloader, []net.Listener) {
+	t.Helper()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.WriteHeader(http.StatusOK)
+	})
+	server, certs, err := NewServer(&conf.Server, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns, err := ServeListeners(server, conf.Server.Listeners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, certs, lns
+}
+
+func TestServeTLSHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir, "first")
+
+	conf, err := ParseConfig([]byte(`
+server:
+  listeners:
+    - addr: "127.0.0.1:0"
+    - addr: "127.0.0.1:0"
+      tls: true
+  tls:
+    certFile: ` + certFile + `
+    keyFile: ` + keyFile + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, lns := startTestServer(t, conf)
+
+	// plain listener still serves HTTP/1.1
+	resp, err := http.Get("http://" + lns[0].Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("expected HTTP/1.x on plain listener, got %s", resp.Proto)
+	}
+
+	resp, err = tlsTestClient(cert, true).Get("https://" + lns[1].Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2 on TLS listener, got %s", resp.Proto)
+	}
+}
+
+func TestServeTLSHTTP2Disabled(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir, "first")
+
+	conf, err := ParseConfig([]byte(`
+server:
+  listeners:
+    - addr: "127.0.0.1:0"
+      tls: true
+  tls:
+    certFile: ` + certFile + `
+    keyFile: ` + keyFile + `
+  http2: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, lns := startTestServer(t, conf)
+
+	resp, err := tlsTestClient(cert, true).Get("https://" + lns[0].Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("expected HTTP/1.x with http2 disabled, got %s", resp.Proto)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writeSelfSignedCert(t, dir, "first")
+
+	conf := DefaultConfig()
+	conf.Server.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0", TLS: true}}
+	conf.Server.TLS.CertFile = certFile
+	conf.Server.TLS.KeyFile = keyFile
+	_, certs, lns := startTestServer(t, conf)
+	addr := "https://" + lns[0].Addr().String() + "/"
+
+	resp, err := tlsTestClient(first, false).Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "first" {
+		t.Errorf("expected first certificate, got %s", cn)
+	}
+
+	// nothing changed so nothing to reload
+	if reloaded, err := certs.Reload(); err != nil || reloaded {
+		t.Errorf("unexpected reload: %v %v", reloaded, err)
+	}
+
+	_, _, second := writeSelfSignedCert(t, dir, "second")
+	// make sure the modification time moves even on coarse filesystems
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if reloaded, err := certs.Reload(); err != nil || !reloaded {
+		t.Fatalf("expected reload: %v %v", reloaded, err)
+	}
+
+	resp, err = tlsTestClient(second, false).Get(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "second" {
+		t.Errorf("expected second certificate, got %s", cn)
+	}
+}
+
+func TestNewServerMissingCert(t *testing.T) {
+	conf := DefaultConfig()
+	conf.Server.Listeners = []ListenerConfig{{Addr: "127.0.0.1:0", TLS: true}}
+	if _, _, err := NewServer(&conf.Server, http.NotFoundHandler()); err == nil {
+		t.Error("expected error without cert & key files")
+	}
+}
+
+func TestParseConfigDefaults(t *testing.T) {
+	conf, err := ParseConfig([]byte(`version: "1"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Version != "1" {
+		t.Error("incorrect Version")
+	}
+	if len(conf.Server.Listeners) != 1 || conf.Server.Listeners[0].Addr != "127.0.0.1:3000" {
+		t.Error("incorrect default listener")
+	}
+	if !*conf.Server.HTTP2 {
+		t.Error("HTTP/2 should default to enabled")
+	}
+	if conf.Server.WriteTimeout != 30*time.Minute {
+		t.Error("incorrect default WriteTimeout")
+	}
+
+	conf, err = ParseConfig([]byte(`
+server:
+  tls:
+    reloadInterval: 5s
+  readTimeout: 1m
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Server.TLS.ReloadInterval != 5*time.Second {
+		t.Error("incorrect ReloadInterval")
+	}
+	if conf.Server.ReadTimeout != time.Minute {
+		t.Error("incorrect ReadTimeout")
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// SketchConfig controls the distinct customer & order value sketches kept for
+// the order_count topic
+type SketchConfig struct {
+	// defaults to enabled
+	Enabled *bool `yaml:"enabled"`
+	// how far back one minute sketches are kept in memory, older history is
+	// built from the fact table
+	Window time.Duration `yaml:"window"`
+	// how far back sketch history goes, a request without from or an older
+	// one starts here
+	MaxHistory time.Duration `yaml:"maxHistory"`
+	// HyperLogLog precision, 12 uses 4KB per minute for about 1.6% error
+	Precision uint8 `yaml:"precision"`
+	// t-digest compression
+	Compression float64 `yaml:"compression"`
+}
+
+// quantiles sent when the request does not ask for any
+var defaultQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// ParseQuantiles reads the comma separated `quantiles` from the request
+func ParseQuantiles(r *http.Request) ([]float64, error) {
+	s := r.URL.Query().Get("quantiles")
+	if s == "" {
+		return defaultQuantiles, nil
+	}
+	var qs []float64
+	for _, part := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("quantiles must be between 0 & 1, got %s", part)
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+// SketchBucket holds the sketches of the orders in one interval, buckets of
+// the same interval can be merged so coarser buckets are built from finer ones
+type SketchBucket struct {
+	TimeStamp  time.Time
+	Customers  *HyperLogLog
+	OrderValue *TDigest
+}
+
+func NewSketchBucket(ts time.Time, conf *SketchConfig) *SketchBucket {
+	return &SketchBucket{
+		TimeStamp:  ts,
+		Customers:  NewHyperLogLog(conf.Precision),
+		OrderValue: NewTDigest(conf.Compression),
+	}
+}
+
+// Add adds an order, orders without a customer only count towards the value
+func (sb *SketchBucket) Add(customerID string, value float64) {
+	if customerID != "" {
+		sb.Customers.Add(customerID)
+	}
+	sb.OrderValue.Add(value)
+}
+
+func (sb *SketchBucket) Merge(o *SketchBucket) error {
+	if err := sb.Customers.Merge(o.Customers); err != nil {
+		return err
+	}
+	sb.OrderValue.Merge(o.OrderValue)
+	return nil
+}
+
+func (sb *SketchBucket) Copy() *SketchBucket {
+	return &SketchBucket{TimeStamp: sb.TimeStamp, Customers: sb.Customers.Copy(), OrderValue: sb.OrderValue.Copy()}
+}
+
+// Summary turns the sketches into a bucket with `distinct_customers`,
+// `orders` & `order_value_p{quantile}` i.e. order_value_p95
+func (sb *SketchBucket) Summary(quantiles []float64) Bucket {
+	b := NewBucket(sb.TimeStamp)
+	b.Values["distinct_customers"] = float64(sb.Customers.Count())
+	b.Values["orders"] = sb.OrderValue.Count()
+	if sb.OrderValue.Count() == 0 {
+		return *b
+	}
+	for _, q := range quantiles {
+		b.Values[QuantileField(q)] = sb.OrderValue.Quantile(q)
+	}
+	return *b
+}
+
+// QuantileField names the field of a quantile, 0.95 is order_value_p95
+func QuantileField(q float64) string {
+	return "order_value_p" + strconv.FormatFloat(math.Round(q*1e6)/1e4, 'f', -1, 64)
+}
+
+// orderSketchValues reads the customer & order value of an order event, the
+// revenue of an order is its sales price
+func orderSketchValues(e *Event) (string, float64) {
+	customerID := e.Attrs["customer_id"]
+	if id, ok := e.Values["customer_id"]; ok {
+		customerID = strconv.FormatFloat(id, 'f', -1, 64)
+	}
+	return customerID, e.Values["revenue"]
+}
+
+// SketchStore keeps one minute sketch buckets of recent orders
+type SketchStore struct {
+	mu      sync.Mutex
+	conf    SketchConfig
+	minutes map[time.Time]*SketchBucket
+	// minutes are complete from this key onwards
+	since time.Time
+}
+
+func NewSketchStore(conf *SketchConfig, since time.Time) *SketchStore {
+	return &SketchStore{
+		conf:    *conf,
+		minutes: make(map[time.Time]*SketchBucket),
+		since:   since,
+	}
+}
+
+// Add adds an order at a bucket key
+func (ss *SketchStore) Add(key time.Time, customerID string, value float64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.add(key, customerID, value)
+}
+
+func (ss *SketchStore) add(key time.Time, customerID string, value float64) {
+	ts := BucketTime(key, 1)
+	sb, ok := ss.minutes[ts]
+	if !ok {
+		sb = NewSketchBucket(ts, &ss.conf)
+		ss.minutes[ts] = sb
+	}
+	sb.Add(customerID, value)
+}
+
+// HandleMessage adds the orders of a consumed message
+func (ss *SketchStore) HandleMessage(msg *sarama.ConsumerMessage) {
+	if msg.Topic != "order_count" {
+		return
+	}
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		logger.Print("sketches could not parse message: " + err.Error())
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for i := range events {
+		customerID, value := orderSketchValues(&events[i])
+		ss.add(BucketKey(events[i].TimeStamp), customerID, value)
+	}
+	ss.evict(BucketKey(time.Now()))
+}
+
+// evict drops minutes that have left the window, must be locked
+func (ss *SketchStore) evict(now time.Time) {
+	cutoff := BucketTime(now.Add(-ss.conf.Window), 1)
+	for ts := range ss.minutes {
+		if ts.Before(cutoff) {
+			delete(ss.minutes, ts)
+		}
+	}
+	if ss.since.Before(cutoff) {
+		ss.since = cutoff
+	}
+}
+
+// Since is the key the store is complete from
+func (ss *SketchStore) Since() time.Time {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.since
+}
+
+// Buckets merges the minutes from `from` to `to` into groupMinute buckets, a
+// zero to has no end
+func (ss *SketchStore) Buckets(groupMinute int, from, to time.Time) []*SketchBucket {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	grouped := make(map[time.Time]*SketchBucket)
+	for ts, sb := range ss.minutes {
+		if ts.Before(from) || (!to.IsZero() && ts.After(to)) {
+			continue
+		}
+		g := BucketTime(ts, groupMinute)
+		if b, ok := grouped[g]; ok {
+			b.Merge(sb)
+			continue
+		}
+		b := sb.Copy()
+		b.TimeStamp = g
+		grouped[g] = b
+	}
+	return sortedSketches(grouped)
+}
+
+func sortedSketches(m map[time.Time]*SketchBucket) []*SketchBucket {
+	res := make([]*SketchBucket, 0, len(m))
+	for _, sb := range m {
+		res = append(res, sb)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].TimeStamp.Before(res[j].TimeStamp) })
+	return res
+}
+
+// MergeSketches merges bucket lists of the same bucket size, buckets of the
+// same interval are combined
+func MergeSketches(lists ...[]*SketchBucket) []*SketchBucket {
+	grouped := make(map[time.Time]*SketchBucket)
+	for _, list := range lists {
+		for _, sb := range list {
+			if b, ok := grouped[sb.TimeStamp]; ok {
+				b.Merge(sb)
+			} else {
+				grouped[sb.TimeStamp] = sb.Copy()
+			}
+		}
+	}
+	return sortedSketches(grouped)
+}
+
+// querySketches builds sketch buckets from the order facts between from & to,
+// either can be zero
+func (api *API) querySketches(conf *SketchConfig, groupMinute int, from, to time.Time) ([]*SketchBucket, error) {
+	var where []string
+	var args []interface{}
+	if !from.IsZero() {
+		where = append(where, "date_key + time_key >= ?")
+		args = append(args, from)
+	}
+	if !to.IsZero() {
+		where = append(where, "date_key + time_key < ?")
+		args = append(args, to)
+	}
+	q := "select date_key + time_key ts, customer_id, revenue from mart.order_fact"
+	if len(where) > 0 {
+		q += " where " + strings.Join(where, " and ")
+	}
+	rows, err := api.dm.Raw(q, args...).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grouped := make(map[time.Time]*SketchBucket)
+	for rows.Next() {
+		var ts time.Time
+		var customerID sql.NullInt64
+		var value float64
+		if err = rows.Scan(&ts, &customerID, &value); err != nil {
+			return nil, err
+		}
+		g := BucketTime(ts, groupMinute)
+		sb, ok := grouped[g]
+		if !ok {
+			sb = NewSketchBucket(g, conf)
+			grouped[g] = sb
+		}
+		id := ""
+		if customerID.Valid {
+			id = strconv.FormatInt(customerID.Int64, 10)
+		}
+		sb.Add(id, value)
+	}
+	return sortedSketches(grouped), rows.Err()
+}
+
+// warmSketches loads the window of orders into the store
+func (api *API) warmSketches(ss *SketchStore) {
+	start := time.Now().Add(-ss.conf.Window).Truncate(time.Minute).Add(time.Minute)
+	buckets, err := api.querySketches(&ss.conf, 1, start, time.Time{})
+	if err != nil {
+		logger.Print("error warming sketches: " + err.Error())
+		return
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, sb := range buckets {
+		ss.minutes[sb.TimeStamp] = sb
+	}
+	ss.since = BucketKey(start)
+	logger.Printf("warmed sketches with %d minutes", len(buckets))
+}
+
+// sketchFrom is the first bucket of a sketch history, sketches are rebuilt from
+// every order so the history is bounded by maxHistory
+func sketchFrom(conf *SketchConfig, p *HistoryParams, now time.Time) time.Time {
+	from := BucketTime(BucketKey(now.Add(-conf.MaxHistory)), p.GroupMinute)
+	if !p.From.IsZero() {
+		if f := BucketTime(BucketKey(p.From), p.GroupMinute); f.After(from) {
+			return f
+		}
+	}
+	return from
+}
+
+// sketchHistory builds the sketch buckets of the request, the minutes kept in
+// memory are merged with sketches built from the fact table before them
+func (api *API) sketchHistory(r *http.Request, p *HistoryParams) ([]*SketchBucket, error) {
+	from := sketchFrom(&api.Config.Sketches, p, time.Now())
+	since := api.sketches.Since()
+	mem := api.sketches.Buckets(p.GroupMinute, from, time.Time{})
+	if !from.Before(since) {
+		return mem, nil
+	}
+	// since is a key on the database wall clock so can be compared directly
+	older, err := api.querySketches(&api.Config.Sketches, p.GroupMinute, from, since)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		return nil, err
+	}
+	return MergeSketches(older, mem), nil
+}
+
+// sketchView streams the sketch summaries of order_count, live orders send
+// the updated summary of their bucket
+type sketchView struct {
+	api       *API
+	params    HistoryParams
+	quantiles []float64
+}
+
+func (v *sketchView) History(api *API, r *http.Request) (interface{}, error) {
+	buckets, err := api.sketchHistory(r, &v.params)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Bucket, len(buckets))
+	for i, sb := range buckets {
+		res[i] = sb.Summary(v.quantiles)
+	}
+	return res, nil
+}
+
+// HandleMessage runs after the store handler so the store already holds the
+// orders of the message
+func (v *sketchView) HandleMessage(msg *sarama.ConsumerMessage) interface{} {
+	events, err := ParseEvents(msg.Value)
+	if err != nil {
+		return nil
+	}
+	g := v.params.GroupMinute
+	touched := make(map[time.Time]bool)
+	for i := range events {
+		touched[BucketTime(BucketKey(events[i].TimeStamp), g)] = true
+	}
+	var res []Bucket
+	for ts := range touched {
+		end := NextBucketTime(ts, g).Add(-time.Minute)
+		for _, sb := range v.api.sketches.Buckets(g, ts, end) {
+			res = append(res, sb.Summary(v.quantiles))
+		}
+	}
+	SortBuckets(res)
+	return bucketsOrNil(res)
+}
+
+func (v *sketchView) Tick(now time.Time) interface{} {
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestParseQuantiles(t *testing.T) {
+	qs, err := ParseQuantiles(httptest.NewRequest("GET", "/?quantiles=0.5,0.999", nil))
+	if err != nil || len(qs) != 2 || qs[1] != 0.999 {
+		t.Errorf("incorrect quantiles %v %v", qs, err)
+	}
+	if _, err = ParseQuantiles(httptest.NewRequest("GET", "/?quantiles=0.5,95", nil)); err == nil {
+		t.Error("expected error for quantile above 1")
+	}
+	if QuantileField(0.95) != "order_value_p95" || QuantileField(0.999) != "order_value_p99.9" {
+		t.Errorf("incorrect quantile fields %s %s", QuantileField(0.95), QuantileField(0.999))
+	}
+}
+
+func TestSketchStore(t *testing.T) {
+	conf := DefaultConfig().Sketches
+	ss := NewSketchStore(&conf, time.Time{})
+	now := time.Now().Truncate(time.Hour)
+
+	// customers 1 to 4 order over two minutes, customer 1 twice
+	var events []map[string]interface{}
+	for i, c := range []int{1, 2, 1, 3, 4} {
+		events = append(events, map[string]interface{}{
+			"time_stamp":  now.Add(time.Duration(i*20) * time.Second).Format(time.RFC3339Nano),
+			"customer_id": c,
+			"revenue":     float64(10 * (i + 1)),
+		})
+	}
+	b, _ := json.Marshal(events)
+	ss.HandleMessage(&sarama.ConsumerMessage{Topic: "order_count", Value: b})
+
+	key := BucketKey(now)
+	minutes := ss.Buckets(1, key, time.Time{})
+	if len(minutes) != 2 {
+		t.Fatalf("expected 2 minutes, got %d", len(minutes))
+	}
+	if c := minutes[0].Customers.Count(); c != 2 {
+		t.Errorf("expected 2 distinct customers in the first minute, got %d", c)
+	}
+
+	// the 5 minute bucket is merged from the minutes
+	buckets := ss.Buckets(5, key, time.Time{})
+	if len(buckets) != 1 {
+		t.Fatalf("expected 1 bucket, got %d", len(buckets))
+	}
+	s := buckets[0].Summary([]float64{0.5})
+	if s.Values["distinct_customers"] != 4 || s.Values["orders"] != 5 || s.Values["order_value_p50"] != 30 {
+		t.Errorf("incorrect summary %v", s.Values)
+	}
+	// merging copies so the store is unchanged
+	if minutes[0].OrderValue.Count() != 3 {
+		t.Error("store minute changed by building a coarser bucket")
+	}
+
+	// sketches built elsewhere merge into the same interval
+	older := NewSketchBucket(BucketTime(key, 5), &conf)
+	older.Add("5", 1000)
+	merged := MergeSketches([]*SketchBucket{older}, buckets)
+	if s = merged[0].Summary(nil); s.Values["distinct_customers"] != 5 || s.Values["orders"] != 6 {
+		t.Errorf("incorrect merged summary %v", s.Values)
+	}
+}
+
+func TestSketchFrom(t *testing.T) {
+	conf := DefaultConfig().Sketches
+	now := time.Date(2021, 3, 10, 12, 7, 0, 0, time.UTC)
+	limit := BucketTime(BucketKey(now.Add(-conf.MaxHistory)), 5)
+	for _, c := range []struct {
+		from, want time.Time
+	}{
+		{time.Time{}, limit},
+		{now.Add(-30 * 24 * time.Hour), limit},
+		{now.Add(-time.Hour), BucketTime(BucketKey(now.Add(-time.Hour)), 5)},
+	} {
+		if f := sketchFrom(&conf, &HistoryParams{GroupMinute: 5, From: c.from}, now); !f.Equal(c.want) {
+			t.Errorf("expected %v for from %v, got %v", c.want, c.from, f)
+		}
+	}
+}
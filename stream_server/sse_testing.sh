@@ -1,2 +1,14 @@
 # get streaming data
 curl -N -H "Content-Type: text/event-stream" -H "Connection: keep-alive" http://localhost:3000/v0/stream/subscribe/customer_count
+
+# get compressed streaming data
+curl -N --compressed -H "Content-Type: text/event-stream" -H "Connection: keep-alive" "http://localhost:3000/v0/stream/subscribe/customer_count?compress=true"
+
+# get 15 minute moving statistics of order revenue
+curl -N -H "Content-Type: text/event-stream" -H "Connection: keep-alive" "http://localhost:3000/v0/stream/subscribe/order_count?window=sliding&size=15m&step=1m"
+
+# get a live weekday by hour revenue heatmap
+curl -N -H "Content-Type: text/event-stream" -H "Connection: keep-alive" "http://localhost:3000/v0/stream/subscribe/order_count?view=heatmap&field=revenue"
+
+# compare 5 minute order buckets with the same time last week
+curl -N -H "Content-Type: text/event-stream" -H "Connection: keep-alive" "http://localhost:3000/v0/stream/subscribe/order_count?groupMinute=5&compare=7d"
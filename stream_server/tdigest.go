@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// Centroid is a cluster of values in a t-digest
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// TDigest is a merging t-digest which estimates quantiles with the best
+// accuracy at the tails, higher compression keeps more centroids
+type TDigest struct {
+	compression float64
+	centroids   []Centroid
+	// values not merged into the centroids yet
+	buffer []Centroid
+	count  float64
+	min    float64
+	max    float64
+}
+
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (td *TDigest) Add(x float64) {
+	td.add(Centroid{Mean: x, Weight: 1})
+}
+
+func (td *TDigest) add(c Centroid) {
+	td.buffer = append(td.buffer, c)
+	td.count += c.Weight
+	td.min = math.Min(td.min, c.Mean)
+	td.max = math.Max(td.max, c.Mean)
+	if len(td.buffer) >= int(5*td.compression) {
+		td.compress()
+	}
+}
+
+// scale is the k1 scale function, centroids may span at most one unit of it
+// so they stay small near the tails
+func (td *TDigest) scale(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// compress merges the buffer into the centroids
+func (td *TDigest) compress() {
+	if len(td.buffer) == 0 {
+		return
+	}
+	all := append(td.centroids, td.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+
+	out := make([]Centroid, 0, len(td.centroids)+1)
+	cur := all[0]
+	var before float64
+	for _, c := range all[1:] {
+		if td.scale((before+cur.Weight+c.Weight)/td.count)-td.scale(before/td.count) <= 1 {
+			w := cur.Weight + c.Weight
+			cur.Mean += (c.Mean - cur.Mean) * c.Weight / w
+			cur.Weight = w
+			continue
+		}
+		out = append(out, cur)
+		before += cur.Weight
+		cur = c
+	}
+	td.centroids = append(out, cur)
+	td.buffer = td.buffer[:0]
+}
+
+// Merge adds the centroids of o, o is not changed
+func (td *TDigest) Merge(o *TDigest) {
+	for _, cs := range [][]Centroid{o.centroids, o.buffer} {
+		for _, c := range cs {
+			td.add(c)
+		}
+	}
+}
+
+// Count is the total weight added
+func (td *TDigest) Count() float64 {
+	return td.count
+}
+
+// Quantile estimates the value at q by interpolating between the centroid
+// means, the min & max bound the tails, an empty digest returns NaN
+func (td *TDigest) Quantile(q float64) float64 {
+	td.compress()
+	c := td.centroids
+	n := len(c)
+	if n == 0 {
+		return math.NaN()
+	}
+	if n == 1 || q <= 0 {
+		if q <= 0 {
+			return td.min
+		}
+		return c[0].Mean
+	}
+	if q >= 1 {
+		return td.max
+	}
+
+	target := q * td.count
+	var cum float64
+	for i := range c {
+		center := cum + c[i].Weight/2
+		if target < center {
+			if i == 0 {
+				return td.min + (c[0].Mean-td.min)*target/center
+			}
+			prev := cum - c[i-1].Weight/2
+			return c[i-1].Mean + (c[i].Mean-c[i-1].Mean)*(target-prev)/(center-prev)
+		}
+		cum += c[i].Weight
+	}
+	last := td.count - c[n-1].Weight/2
+	return c[n-1].Mean + (td.max-c[n-1].Mean)*(target-last)/(td.count-last)
+}
+
+func (td *TDigest) Copy() *TDigest {
+	c := &TDigest{compression: td.compression, count: td.count, min: td.min, max: td.max}
+	c.centroids = append([]Centroid(nil), td.centroids...)
+	c.buffer = append([]Centroid(nil), td.buffer...)
+	return c
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestTDigestQuantiles(t *testing.T) {
+	td := NewTDigest(100)
+	r := rand.New(rand.NewSource(1))
+	for _, i := range r.Perm(10001) {
+		td.Add(float64(i))
+	}
+	if td.Count() != 10001 {
+		t.Errorf("expected 10001 values, got %v", td.Count())
+	}
+	for _, q := range []float64{0.01, 0.5, 0.9, 0.99, 0.999} {
+		if v := td.Quantile(q); math.Abs(v-q*10000) > 50 {
+			t.Errorf("p%v estimated as %v", q*100, v)
+		}
+	}
+	if td.Quantile(0) != 0 || td.Quantile(1) != 10000 {
+		t.Error("expected the min & max at the ends")
+	}
+	if len(td.centroids) > 200 {
+		t.Errorf("expected the digest to be compressed, got %d centroids", len(td.centroids))
+	}
+	if !math.IsNaN(NewTDigest(100).Quantile(0.5)) {
+		t.Error("expected NaN from an empty digest")
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	// skewed values like order prices
+	r := rand.New(rand.NewSource(2))
+	all := NewTDigest(100)
+	parts := []*TDigest{NewTDigest(100), NewTDigest(100), NewTDigest(100)}
+	for i := 0; i < 30000; i++ {
+		v := math.Exp(r.NormFloat64())
+		all.Add(v)
+		parts[i%3].Add(v)
+	}
+	merged := NewTDigest(100)
+	for _, p := range parts {
+		merged.Merge(p)
+	}
+	if merged.Count() != all.Count() {
+		t.Errorf("merged count %v, expected %v", merged.Count(), all.Count())
+	}
+	for _, q := range []float64{0.5, 0.95, 0.99} {
+		a, m := all.Quantile(q), merged.Quantile(q)
+		if math.Abs(a-m)/a > 0.02 {
+			t.Errorf("p%v merged %v, expected %v", q*100, m, a)
+		}
+	}
+}
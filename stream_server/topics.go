@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// TopicSpec describes how a topic is aggregated into time buckets
+type TopicSpec struct {
+	Name string
+	// fact table the topic history is read from
+	Table string
+	// summed fields of each bucket
+	Fields []FieldSpec
+}
+
+// FieldSpec is a bucket field, live events are summed by Name & history uses
+// the SQL aggregate
+type FieldSpec struct {
+	Name string
+	SQL  string
+}
+
+// topicSpecs are the topics which are backed by a fact table
+var topicSpecs = map[string]*TopicSpec{
+	"customer_count": {
+		Name:  "customer_count",
+		Table: "mart.customer_fact",
+		Fields: []FieldSpec{
+			{Name: "n", SQL: "sum(n)"},
+		},
+	},
+	"order_count": {
+		Name:  "order_count",
+		Table: "mart.order_fact",
+		Fields: []FieldSpec{
+			{Name: "n", SQL: "sum(n)"},
+			{Name: "order_count", SQL: "count(*)"},
+			{Name: "revenue", SQL: "sum(revenue)"},
+		},
+	},
+}
+
+// FieldNames lists the bucket fields of the topic
+func (ts *TopicSpec) FieldNames() []string {
+	names := make([]string, len(ts.Fields))
+	for i, f := range ts.Fields {
+		names[i] = f.Name
+	}
+	return names
+}
+
+// Field returns the field called name, nil if there is none
+func (ts *TopicSpec) Field(name string) *FieldSpec {
+	for i := range ts.Fields {
+		if ts.Fields[i].Name == name {
+			return &ts.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Event is a single record of a topic message, the Postgres notify triggers
+// send a JSON array of these
+type Event struct {
+	TimeStamp time.Time
+	// numeric fields i.e. n, revenue
+	Values map[string]float64
+	// text fields
+	Attrs map[string]string
+}
+
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	e.Values = make(map[string]float64)
+	e.Attrs = make(map[string]string)
+	for k, v := range raw {
+		switch val := v.(type) {
+		case float64:
+			e.Values[k] = val
+		case string:
+			if k == "time_stamp" {
+				t, err := time.Parse(time.RFC3339Nano, val)
+				if err != nil {
+					return err
+				}
+				e.TimeStamp = t
+				continue
+			}
+			e.Attrs[k] = val
+		}
+	}
+	if e.TimeStamp.IsZero() {
+		return errors.New("event missing time_stamp")
+	}
+	return nil
+}
+
+// ParseEvents parses the value of a topic message
+func ParseEvents(b []byte) ([]Event, error) {
+	var events []Event
+	if err := json.Unmarshal(b, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Bucket holds the summed fields of a topic for one interval
+type Bucket struct {
+	TimeStamp time.Time
+	Values    map[string]float64
+}
+
+func NewBucket(ts time.Time) *Bucket {
+	return &Bucket{TimeStamp: ts, Values: make(map[string]float64)}
+}
+
+// MarshalJSON flattens the values next to the time stamp which is the same
+// shape the UI gets from the history queries
+func (b Bucket) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.flat())
+}
+
+func (b Bucket) flat() map[string]interface{} {
+	m := make(map[string]interface{}, len(b.Values)+1)
+	for k, v := range b.Values {
+		m[k] = v
+	}
+	m["time_stamp"] = b.TimeStamp
+	return m
+}
+
+// Add sums the event fields into the bucket
+func (b *Bucket) Add(e *Event, fields []string) {
+	for _, f := range fields {
+		b.Values[f] += e.Values[f]
+	}
+}
+
+// Merge sums another bucket into this one
+func (b *Bucket) Merge(o *Bucket) {
+	for k, v := range o.Values {
+		b.Values[k] += v
+	}
+}
+
+// Copy returns a bucket that does not share its values
+func (b *Bucket) Copy() Bucket {
+	c := Bucket{TimeStamp: b.TimeStamp, Values: make(map[string]float64, len(b.Values))}
+	for k, v := range b.Values {
+		c.Values[k] = v
+	}
+	return c
+}
+
+// BucketKey converts an event time into the time space of the history
+// queries, those group on the database wall clock & come back without a time
+// zone so live events use the local wall clock as UTC to line up with them
+func BucketKey(t time.Time) time.Time {
+	t = t.Local()
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// BucketTime floors a key to the start of its bucket, minutes are floored to a
+// multiple of groupMinute within the hour the same as the history SQL
+func BucketTime(key time.Time, groupMinute int) time.Time {
+	m := (key.Minute() / groupMinute) * groupMinute
+	return time.Date(key.Year(), key.Month(), key.Day(), key.Hour(), m, 0, 0, key.Location())
+}
+
+// Rollup groups buckets into coarser ones, buckets must be sorted by time
+func Rollup(buckets []Bucket, groupMinute int) []Bucket {
+	var out []Bucket
+	for i := range buckets {
+		ts := BucketTime(buckets[i].TimeStamp, groupMinute)
+		if len(out) == 0 || !out[len(out)-1].TimeStamp.Equal(ts) {
+			out = append(out, Bucket{TimeStamp: ts, Values: make(map[string]float64)})
+		}
+		out[len(out)-1].Merge(&buckets[i])
+	}
+	return out
+}
+
+// SortBuckets orders buckets by time
+func SortBuckets(buckets []Bucket) {
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].TimeStamp.Before(buckets[j].TimeStamp)
+	})
+}
+
+// NextBucketTime is the start of the bucket after ts, flooring restarts the
+// buckets at the hour the same as the SQL
+func NextBucketTime(ts time.Time, groupMinute int) time.Time {
+	return BucketTime(ts.Add(time.Duration(groupMinute)*time.Minute), groupMinute)
+}
+
+// FillGaps adds empty buckets where the history queries skipped intervals
+// without facts, buckets must be sorted by time
+func FillGaps(buckets []Bucket, groupMinute int) []Bucket {
+	if len(buckets) == 0 {
+		return buckets
+	}
+	out := make([]Bucket, 0, len(buckets))
+	for i := range buckets {
+		if len(out) > 0 {
+			for ts := NextBucketTime(out[len(out)-1].TimeStamp, groupMinute); ts.Before(buckets[i].TimeStamp); ts = NextBucketTime(ts, groupMinute) {
+				out = append(out, *NewBucket(ts))
+			}
+		}
+		out = append(out, buckets[i])
+	}
+	return out
+}
+
+// BucketsPerDay is the number of buckets in a day, when groupMinute does not
+// divide an hour the last bucket of each hour is short
+func BucketsPerDay(groupMinute int) int {
+	perHour := (60 + groupMinute - 1) / groupMinute
+	return 24 * perHour
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEvents(t *testing.T) {
+	msg := `[{"time_stamp": "2020-06-01T10:15:30.123456+00:00", "order_count": 1, "n": 3, "revenue": 29.97, "product": "widget"}]`
+
+	events, err := ParseEvents([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(events))
+	}
+	e := events[0]
+	if !e.TimeStamp.Equal(time.Date(2020, 6, 1, 10, 15, 30, 123456000, time.UTC)) {
+		t.Error("incorrect TimeStamp")
+	}
+	if e.Values["n"] != 3 || e.Values["order_count"] != 1 || e.Values["revenue"] != 29.97 {
+		t.Errorf("incorrect Values %v", e.Values)
+	}
+	if e.Attrs["product"] != "widget" {
+		t.Error("incorrect product")
+	}
+
+	if _, err = ParseEvents([]byte(`[{"n": 1}]`)); err == nil {
+		t.Error("expected error for event without time_stamp")
+	}
+}
+
+func TestBucketTime(t *testing.T) {
+	key := time.Date(2020, 6, 1, 10, 17, 45, 0, time.UTC)
+	cases := map[int]time.Time{
+		1:  time.Date(2020, 6, 1, 10, 17, 0, 0, time.UTC),
+		5:  time.Date(2020, 6, 1, 10, 15, 0, 0, time.UTC),
+		7:  time.Date(2020, 6, 1, 10, 14, 0, 0, time.UTC),
+		30: time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC),
+	}
+	for g, e := range cases {
+		if o := BucketTime(key, g); !o.Equal(e) {
+			t.Errorf("groupMinute %d: expected %v got %v", g, e, o)
+		}
+	}
+}
+
+func TestRollup(t *testing.T) {
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	var buckets []Bucket
+	for i := 0; i < 10; i++ {
+		b := NewBucket(base.Add(time.Duration(i) * time.Minute))
+		b.Values["n"] = float64(i)
+		buckets = append(buckets, *b)
+	}
+
+	o := Rollup(buckets, 5)
+	if len(o) != 2 {
+		t.Fatalf("expected 2 buckets, got %d", len(o))
+	}
+	if o[0].Values["n"] != 0+1+2+3+4 || o[1].Values["n"] != 5+6+7+8+9 {
+		t.Errorf("incorrect rollup %v", o)
+	}
+	if !o[1].TimeStamp.Equal(base.Add(5 * time.Minute)) {
+		t.Error("incorrect rollup time stamp")
+	}
+}
+
+func TestBucketMarshalJSON(t *testing.T) {
+	b := NewBucket(time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC))
+	b.Values["n"] = 2
+	o, err := json.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(o) != `{"n":2,"time_stamp":"2020-06-01T10:00:00Z"}` {
+		t.Errorf("incorrect JSON %s", o)
+	}
+}
+
+func TestBucketSQL(t *testing.T) {
+	q := bucketSQL(topicSpecs["order_count"], 5, true)
+	for _, e := range []string{"sum(n) n", "count(*) order_count", "sum(revenue) revenue", "/ 5) * 5", "from mart.order_fact t0", "where date_key + time_key >= ?"} {
+		if !strings.Contains(q, e) {
+			t.Errorf("query missing %q:\n%s", e, q)
+		}
+	}
+	if strings.Contains(bucketSQL(topicSpecs["customer_count"], 1, false), "where") {
+		t.Error("unexpected where clause")
+	}
+}
@@ -11,6 +11,15 @@ func SliceRemoveString(s []string, x string) ([]string, error) {
 	return s, errors.New("input slice does not contain value to remove")
 }
 
+func SliceContainsString(s []string, x string) bool {
+	for _, v := range s {
+		if v == x {
+			return true
+		}
+	}
+	return false
+}
+
 func Uint32(x uint32) *uint32 {
 	return &x
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// StreamView replaces the raw events of a fact table topic stream with values
+// computed from them, picked with `window`, `compare`, `view` or `groupBy` on
+// the subscribe URL
+type StreamView interface {
+	// History is sent as the first event
+	History(api *API, r *http.Request) (interface{}, error)
+	// HandleMessage & Tick return the next event, nil when there is nothing to
+	// send
+	HandleMessage(msg *sarama.ConsumerMessage) interface{}
+	Tick(now time.Time) interface{}
+}
+
+// streamView picks the view of a stream from the request, nil streams the
+// raw events
+func (api *API) streamView(r *http.Request, topic string) (StreamView, error) {
+	q := r.URL.Query()
+	window, compare, view, groupBy := q.Get("window"), q.Get("compare"), q.Get("view"), q.Get("groupBy")
+	picked := 0
+	for _, s := range []string{window, compare, view, groupBy} {
+		if s != "" {
+			picked++
+		}
+	}
+	if picked == 0 {
+		return nil, nil
+	}
+	spec, ok := topicSpecs[topic]
+	if !ok {
+		return nil, fmt.Errorf("topic %s only streams raw events", topic)
+	}
+	if picked > 1 {
+		return nil, fmt.Errorf("only one of window, compare, view & groupBy can be used")
+	}
+
+	if window != "" {
+		wp, err := ParseWindowParams(r)
+		if err != nil {
+			return nil, err
+		}
+		return &windowView{spec: spec, params: wp, lw: NewLiveWindow(spec, wp, time.Now())}, nil
+	}
+
+	if compare != "" {
+		days, err := ComparePeriod(r)
+		if err != nil {
+			return nil, err
+		}
+		p, err := ParseHistoryParams(r)
+		if err != nil {
+			return nil, err
+		}
+		return &compareView{spec: spec, days: days, params: *p, series: NewCompareSeries(spec, p.GroupMinute, days)}, nil
+	}
+
+	if groupBy != "" {
+		p, err := ParseGroupByParams(r, spec)
+		if err != nil {
+			return nil, err
+		}
+		return &groupByView{spec: spec, params: p, series: NewGroupedSeries(spec, p)}, nil
+	}
+
+	switch view {
+	case "sketches":
+		if topic != "order_count" || api.sketches == nil {
+			return nil, fmt.Errorf("sketches are only kept for order_count when enabled")
+		}
+		p, err := ParseHistoryParams(r)
+		if err != nil {
+			return nil, err
+		}
+		qs, err := ParseQuantiles(r)
+		if err != nil {
+			return nil, err
+		}
+		return &sketchView{api: api, params: *p, quantiles: qs}, nil
+	case "heatmap":
+		p, err := ParseHeatmapParams(r, spec)
+		if err != nil {
+			return nil, err
+		}
+		return &heatmapView{spec: spec, params: p}, nil
+	}
+	return nil, fmt.Errorf("unknown view %s", view)
+}
+
+// windowView streams sliding window statistics
+type windowView struct {
+	spec   *TopicSpec
+	params *WindowParams
+	lw     *LiveWindow
+}
+
+func (v *windowView) History(api *API, r *http.Request) (interface{}, error) {
+	return api.windowHistory(r, v.spec, v.params, v.lw)
+}
+
+func (v *windowView) HandleMessage(msg *sarama.ConsumerMessage) interface{} {
+	return bucketsOrNil(v.lw.HandleMessage(msg))
+}
+
+func (v *windowView) Tick(now time.Time) interface{} {
+	return bucketsOrNil(v.lw.Tick(now))
+}
+
+// bucketsOrNil keeps an empty slice from being sent as an event
+func bucketsOrNil(buckets []Bucket) interface{} {
+	if len(buckets) == 0 {
+		return nil
+	}
+	return buckets
+}
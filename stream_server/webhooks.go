@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/xid"
+)
+
+// WebhookRegistryConfig controls the delivery of the registered webhooks,
+// the alert webhooks in AlertsConfig are separate
+type WebhookRegistryConfig struct {
+	// timeout of each attempt
+	Timeout time.Duration `yaml:"timeout"`
+	// attempts of each event before it counts as failed
+	MaxAttempts int `yaml:"maxAttempts"`
+	// delay before the first retry, doubled for each retry up to MaxBackoff
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+	// failed events in a row that disable an endpoint
+	DisableAfter int `yaml:"disableAfter"`
+	// events waiting per endpoint, more are dropped while it is retrying
+	QueueSize int `yaml:"queueSize"`
+	// how long the delivery log is kept
+	LogRetention time.Duration `yaml:"logRetention"`
+	// CIDRs of loopback, link-local or private addresses endpoints may still
+	// point to, i.e. 10.0.0.0/8 for receivers inside the network
+	AllowNetworks []string `yaml:"allowNetworks"`
+}
+
+// WebhookEndpoint is a registered webhook, stored in public.webhook
+type WebhookEndpoint struct {
+	ID     int64    `json:"id"`
+	URL    string   `json:"url"`
+	Topics []string `json:"topics"`
+	// events of fact table topics are only sent when these attributes match,
+	// i.e. {"state": "CA"}
+	Filter map[string]string `json:"filter,omitempty"`
+	// only returned when the endpoint is created
+	Secret     string     `json:"secret,omitempty"`
+	Enabled    bool       `json:"enabled"`
+	Failures   int        `json:"failures"`
+	DisabledAt *time.Time `json:"disabled_at,omitempty"`
+}
+
+// Validate checks the URL, the topics are checked against the server's
+// topics by the handler
+func (wh *WebhookEndpoint) Validate() error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if len(wh.Topics) == 0 {
+		return errors.New("topics must not be empty")
+	}
+	if len(wh.Filter) > 0 {
+		for _, t := range wh.Topics {
+			if _, ok := topicSpecs[t]; !ok {
+				return fmt.Errorf("filter only applies to fact table topics, not %s", t)
+			}
+		}
+	}
+	return nil
+}
+
+// filterString formats an attribute for comparing to a filter value, numbers
+// are written out in full i.e. 1000000 & not 1e+06
+func filterString(v interface{}) string {
+	if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// Match returns the payload of a message for the endpoint, with a filter
+// only the matching events of the message are kept
+func (wh *WebhookEndpoint) Match(msg *sarama.ConsumerMessage) (json.RawMessage, bool) {
+	if !SliceContainsString(wh.Topics, msg.Topic) {
+		return nil, false
+	}
+	if len(wh.Filter) == 0 {
+		return msg.Value, true
+	}
+	var events []json.RawMessage
+	if err := json.Unmarshal(msg.Value, &events); err != nil {
+		return nil, false
+	}
+	kept := events[:0]
+	for _, e := range events {
+		var attrs map[string]interface{}
+		if json.Unmarshal(e, &attrs) != nil {
+			continue
+		}
+		match := true
+		for k, v := range wh.Filter {
+			if a, ok := attrs[k]; !ok || filterString(a) != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, false
+	}
+	b, err := json.Marshal(kept)
+	return b, err == nil
+}
+
+// NewWebhookSecret is used when an endpoint is created without a secret
+func NewWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignWebhook is the hex HMAC-SHA256 of `{timestamp}.{body}`, sent as
+// `X-Webhook-Signature: sha256={signature}` so receivers can also reject old
+// timestamps
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookEvent is the body POSTed to an endpoint
+type webhookEvent struct {
+	ID    string          `json:"id"`
+	Topic string          `json:"topic"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// WebhookDelivery is one attempt at sending an event, the delivery log
+type WebhookDelivery struct {
+	WebhookID int64 `json:"webhook_id"`
+	// the event id, the same for every attempt
+	EventID    string    `json:"event_id"`
+	Topic      string    `json:"topic"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	DurationMs float64   `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+type webhookWorker struct {
+	hook   WebhookEndpoint
+	queue  chan webhookEvent
+	cancel func()
+}
+
+// WebhookDispatcher runs a worker per enabled endpoint fed from the Kafka
+// fan-out, each worker sends its events in order & retries an event before
+// moving on
+type WebhookDispatcher struct {
+	conf   *WebhookRegistryConfig
+	client *http.Client
+	ctx    context.Context
+
+	// networks from AllowNetworks
+	allow []*net.IPNet
+
+	mu      sync.Mutex
+	workers map[int64]*webhookWorker
+
+	// record is called after every attempt
+	record func(WebhookDelivery)
+	// state is called when the failures of an endpoint change, enabled is false
+	// once it is disabled
+	state func(id int64, failures int, enabled bool)
+}
+
+// NewWebhookDispatcher checks every address it connects to so endpoints, or
+// their redirects & DNS, can not reach the server's own network, deliveries
+// do not go through a proxy for the same reason
+func NewWebhookDispatcher(ctx context.Context, conf *WebhookRegistryConfig, record func(WebhookDelivery), state func(int64, int, bool)) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		conf:    conf,
+		ctx:     ctx,
+		workers: make(map[int64]*webhookWorker),
+		record:  record,
+		state:   state,
+	}
+	for _, cidr := range conf.AllowNetworks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logger.Warn().Msgf("ignoring webhook allowNetworks entry %s: %v", cidr, err)
+			continue
+		}
+		d.allow = append(d.allow, n)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: conf.Timeout, Control: d.checkDial}).DialContext
+	d.client = &http.Client{Timeout: conf.Timeout, Transport: transport}
+	return d
+}
+
+// allowed checks an address is public or in AllowNetworks
+func (d *WebhookDispatcher) allowed(ip net.IP) bool {
+	for _, n := range d.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkDial refuses connections to addresses that are not allowed, it runs
+// after DNS resolution
+func (d *WebhookDispatcher) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !d.allowed(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// CheckURL refuses endpoint URLs with a loopback, link-local or private
+// address, host names are checked again when they are dialed
+func (d *WebhookDispatcher) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && !d.allowed(ip) {
+		return errors.New("url must not point to a loopback, link-local or private address")
+	}
+	return nil
+}
+
+// Set starts or replaces the worker of an endpoint, disabled endpoints have
+// no worker
+func (d *WebhookDispatcher) Set(hook WebhookEndpoint) {
+	d.Remove(hook.ID)
+	if !hook.Enabled {
+		return
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	w := &webhookWorker{hook: hook, queue: make(chan webhookEvent, d.conf.QueueSize), cancel: cancel}
+	d.mu.Lock()
+	d.workers[hook.ID] = w
+	d.mu.Unlock()
+	go d.run(ctx, w)
+}
+
+// Remove stops the worker of an endpoint, queued events are dropped
+func (d *WebhookDispatcher) Remove(id int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if w, ok := d.workers[id]; ok {
+		w.cancel()
+		delete(d.workers, id)
+	}
+}
+
+// retire removes a worker that is still the one of its endpoint
+func (d *WebhookDispatcher) retire(w *webhookWorker) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.workers[w.hook.ID] != w {
+		return false
+	}
+	w.cancel()
+	delete(d.workers, w.hook.ID)
+	return true
+}
+
+// Active lists the endpoints with a worker
+func (d *WebhookDispatcher) Active() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]int64, 0, len(d.workers))
+	for id := range d.workers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// HandleMessage queues the message for every matching endpoint, it is a tap
+// so published topics are sent as well
+func (d *WebhookDispatcher) HandleMessage(msg *sarama.ConsumerMessage) error {
+	var dropped []WebhookDelivery
+	d.mu.Lock()
+	for _, w := range d.workers {
+		data, ok := w.hook.Match(msg)
+		if !ok {
+			continue
+		}
+		ev := webhookEvent{ID: xid.New().String(), Topic: msg.Topic, Time: msg.Timestamp, Data: data}
+		select {
+		case w.queue <- ev:
+		default:
+			dropped = append(dropped, WebhookDelivery{WebhookID: w.hook.ID, EventID: ev.ID, Topic: ev.Topic, Error: "queue full, event dropped", Time: time.Now()})
+		}
+	}
+	d.mu.Unlock()
+	for _, res := range dropped {
+		d.record(res)
+	}
+	return nil
+}
+
+func (d *WebhookDispatcher) run(ctx context.Context, w *webhookWorker) {
+	failures := w.hook.Failures
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-w.queue:
+			ok := d.deliver(ctx, &w.hook, ev)
+			if ctx.Err() != nil {
+				return
+			}
+			if ok {
+				if failures > 0 {
+					failures = 0
+					d.state(w.hook.ID, failures, true)
+				}
+				continue
+			}
+			failures++
+			if failures >= d.conf.DisableAfter {
+				// a worker replaced in the meantime leaves the endpoint alone
+				if d.retire(w) {
+					logger.Warn().Msgf("disabling webhook %d after %d failed events", w.hook.ID, failures)
+					d.state(w.hook.ID, failures, false)
+				}
+				return
+			}
+			d.state(w.hook.ID, failures, true)
+		}
+	}
+}
+
+// deliver sends an event until it succeeds, fails permanently or runs out of
+// attempts, waiting Backoff doubled for each retry
+func (d *WebhookDispatcher) deliver(ctx context.Context, hook *WebhookEndpoint, ev webhookEvent) bool {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Print("error encoding webhook event: " + err.Error())
+		return false
+	}
+	wait := d.conf.Backoff
+	for attempt := 1; ; attempt++ {
+		res := d.post(ctx, hook, ev, body)
+		res.Attempt = attempt
+		d.record(res)
+		if res.Success {
+			return true
+		}
+		// other client errors will not succeed on a retry
+		if res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests {
+			return false
+		}
+		if attempt >= d.conf.MaxAttempts {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > d.conf.MaxBackoff {
+			wait = d.conf.MaxBackoff
+		}
+	}
+}
+
+// post makes one signed attempt
+func (d *WebhookDispatcher) post(ctx context.Context, hook *WebhookEndpoint, ev webhookEvent, body []byte) WebhookDelivery {
+	res := WebhookDelivery{WebhookID: hook.ID, EventID: ev.ID, Topic: ev.Topic, Time: time.Now()}
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	ts := res.Time.Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", strconv.FormatInt(hook.ID, 10))
+	req.Header.Set("X-Webhook-Event", ev.ID)
+	req.Header.Set("X-Webhook-Topic", ev.Topic)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhook(hook.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	res.DurationMs = float64(time.Since(res.Time).Microseconds()) / 1000
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	resp.Body.Close()
+	res.StatusCode = resp.StatusCode
+	res.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !res.Success {
+		res.Error = fmt.Sprintf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return res
+}
+
+// errWebhookNotFound is returned when no webhook has the id
+var errWebhookNotFound = errors.New("webhook not found")
+
+const webhookColumns = `webhook_id, url, topics::text, coalesce(filter::text, '{}'), secret, enabled, failures, disabled_at`
+
+func scanWebhook(scan func(...interface{}) error) (*WebhookEndpoint, error) {
+	var wh WebhookEndpoint
+	var topics, filter string
+	var disabled sql.NullTime
+	if err := scan(&wh.ID, &wh.URL, &topics, &filter, &wh.Secret, &wh.Enabled, &wh.Failures, &disabled); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(topics), &wh.Topics); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(filter), &wh.Filter); err != nil {
+		return nil, err
+	}
+	if disabled.Valid {
+		wh.DisabledAt = &disabled.Time
+	}
+	return &wh, nil
+}
+
+// listWebhooks reads every webhook with its secret
+func (api *API) listWebhooks() ([]WebhookEndpoint, error) {
+	rows, err := api.dm.Raw(`select ` + webhookColumns + ` from public.webhook order by webhook_id`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hooks := []WebhookEndpoint{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *wh)
+	}
+	return hooks, rows.Err()
+}
+
+// getWebhook reads the webhook with the id
+func (api *API) getWebhook(id int64) (*WebhookEndpoint, error) {
+	wh, err := scanWebhook(api.dm.Raw(`select `+webhookColumns+` from public.webhook where webhook_id = ?`, id).Row().Scan)
+	if err == sql.ErrNoRows {
+		return nil, errWebhookNotFound
+	}
+	return wh, err
+}
+
+// saveWebhook inserts a webhook without an id or updates the webhook with its
+// id & restarts its worker, an empty secret keeps the stored one & enabling
+// resets the failures
+func (api *API) saveWebhook(wh *WebhookEndpoint) error {
+	topics, err := json.Marshal(wh.Topics)
+	if err != nil {
+		return err
+	}
+	var filter interface{}
+	if len(wh.Filter) > 0 {
+		b, err := json.Marshal(wh.Filter)
+		if err != nil {
+			return err
+		}
+		filter = string(b)
+	}
+	var row *sql.Row
+	if wh.ID == 0 {
+		row = api.dm.Raw(`insert into public.webhook (url, topics, filter, secret, enabled) values (?, ?::jsonb, ?::jsonb, ?, ?) returning `+webhookColumns,
+			wh.URL, string(topics), filter, wh.Secret, wh.Enabled).Row()
+	} else {
+		row = api.dm.Raw(`
+update public.webhook set url = ?, topics = ?::jsonb, filter = ?::jsonb, secret = coalesce(nullif(?, ''), secret), enabled = ?,
+	failures = case when ? then 0 else failures end,
+	disabled_at = case when ? then null else coalesce(disabled_at, now()) end,
+	updated_at = now()
+where webhook_id = ?
+returning `+webhookColumns, wh.URL, string(topics), filter, wh.Secret, wh.Enabled, wh.Enabled, wh.Enabled, wh.ID).Row()
+	}
+	saved, err := scanWebhook(row.Scan)
+	if err == sql.ErrNoRows {
+		return errWebhookNotFound
+	}
+	if err != nil {
+		return err
+	}
+	api.webhooks.Set(*saved)
+	*wh = *saved
+	return nil
+}
+
+// deleteWebhook removes the webhook with the id & its delivery log
+func (api *API) deleteWebhook(id int64) error {
+	res := api.dm.Exec(`delete from public.webhook where webhook_id = ?`, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errWebhookNotFound
+	}
+	api.webhooks.Remove(id)
+	return nil
+}
+
+// recordWebhookDelivery writes an attempt to the delivery log
+func (api *API) recordWebhookDelivery(d WebhookDelivery) {
+	var status interface{}
+	if d.StatusCode != 0 {
+		status = d.StatusCode
+	}
+	if err := api.dm.Exec(`
+insert into public.webhook_delivery (webhook_id, event_id, topic, attempt, status_code, error, success, duration_ms, created_at)
+values (?, ?, ?, ?, ?, nullif(?, ''), ?, ?, ?)`,
+		d.WebhookID, d.EventID, d.Topic, d.Attempt, status, d.Error, d.Success, d.DurationMs, d.Time).Error; err != nil {
+		logger.Print("error recording webhook delivery: " + err.Error())
+	}
+}
+
+// setWebhookState stores the failures in a row & disables the webhook
+func (api *API) setWebhookState(id int64, failures int, enabled bool) {
+	if err := api.dm.Exec(`
+update public.webhook set failures = ?, enabled = ?, disabled_at = case when ? then null else now() end, updated_at = now()
+where webhook_id = ?`, failures, enabled, enabled, id).Error; err != nil {
+		logger.Print("error updating webhook state: " + err.Error())
+	}
+}
+
+// listWebhookDeliveries reads the newest attempts of a webhook
+func (api *API) listWebhookDeliveries(id int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := api.dm.Raw(`
+select webhook_id, event_id, topic, attempt, coalesce(status_code, 0), coalesce(error, ''), success, duration_ms, created_at
+from public.webhook_delivery
+where webhook_id = ?
+order by webhook_delivery_id desc
+limit ?`, id, limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []WebhookDelivery{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err = rows.Scan(&d.WebhookID, &d.EventID, &d.Topic, &d.Attempt, &d.StatusCode, &d.Error, &d.Success, &d.DurationMs, &d.Time); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// loadWebhooks starts a worker for every enabled webhook
+func (api *API) loadWebhooks() error {
+	hooks, err := api.listWebhooks()
+	if err != nil {
+		return err
+	}
+	for _, wh := range hooks {
+		api.webhooks.Set(wh)
+	}
+	return nil
+}
+
+// pruneWebhookDeliveries drops the delivery log past the retention until ctx
+// is cancelled
+func (api *API) pruneWebhookDeliveries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := api.dm.Exec(`delete from public.webhook_delivery where created_at < ?`,
+				now.Add(-api.Config.Webhooks.LogRetention)).Error; err != nil {
+				logger.Print("error pruning webhook deliveries: " + err.Error())
+			}
+		}
+	}
+}
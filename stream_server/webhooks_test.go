@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func testWebhookConfig() *WebhookRegistryConfig {
+	return &WebhookRegistryConfig{Timeout: time.Second, MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond, DisableAfter: 2, QueueSize: 10,
+		// the test servers listen on loopback
+		AllowNetworks: []string{"127.0.0.0/8"}}
+}
+
+func TestWebhookValidate(t *testing.T) {
+	valid := WebhookEndpoint{URL: "https://partner.example.com/hooks", Topics: []string{"order_count"}, Filter: map[string]string{"state": "CA"}}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	invalid := []WebhookEndpoint{
+		{URL: "partner.example.com", Topics: []string{"order_count"}},
+		{URL: "ftp://partner.example.com", Topics: []string{"order_count"}},
+		{URL: "https://partner.example.com"},
+		{URL: "https://partner.example.com", Topics: []string{"alerts"}, Filter: map[string]string{"state": "CA"}},
+	}
+	for _, wh := range invalid {
+		if err := wh.Validate(); err == nil {
+			t.Errorf("expected error for %+v", wh)
+		}
+	}
+}
+
+func TestWebhookCheckURL(t *testing.T) {
+	conf := testWebhookConfig()
+	conf.AllowNetworks = nil
+	d := NewWebhookDispatcher(context.Background(), conf, nil, nil)
+	for _, u := range []string{"http://127.0.0.1:8080/hooks", "http://169.254.169.254/latest/meta-data", "http://[::1]/hooks", "http://localhost/hooks", "https://10.1.2.3/hooks"} {
+		if err := d.CheckURL(u); err == nil {
+			t.Errorf("expected %s to be refused", u)
+		}
+	}
+	if err := d.CheckURL("https://partner.example.com/hooks"); err != nil {
+		t.Error(err)
+	}
+
+	conf.AllowNetworks = []string{"10.0.0.0/8"}
+	d = NewWebhookDispatcher(context.Background(), conf, nil, nil)
+	if err := d.CheckURL("https://10.1.2.3/hooks"); err != nil {
+		t.Error(err)
+	}
+	if err := d.CheckURL("http://127.0.0.1/hooks"); err == nil {
+		t.Error("expected loopback to be refused")
+	}
+}
+
+func TestWebhookDispatcherRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected no request")
+	}))
+	defer srv.Close()
+
+	conf := testWebhookConfig()
+	conf.AllowNetworks, conf.MaxAttempts = nil, 1
+	wr := &webhookRecorder{states: make(chan [2]int, 10)}
+	d := NewWebhookDispatcher(context.Background(), conf, wr.record, wr.state)
+	d.Set(WebhookEndpoint{ID: 1, URL: srv.URL, Topics: []string{"alerts"}, Enabled: true})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{}`)})
+
+	if ds := wr.waitDeliveries(t, 1); ds[0].Success || !strings.Contains(ds[0].Error, "not allowed") {
+		t.Errorf("expected the delivery to be refused, got %+v", ds)
+	}
+	d.Remove(1)
+}
+
+func TestWebhookMatch(t *testing.T) {
+	msg := &sarama.ConsumerMessage{Topic: "order_count", Value: []byte(`[{"state": "CA", "n": 1}, {"state": "NY", "n": 2}, {"state": "CA", "n": 3}]`)}
+
+	wh := WebhookEndpoint{Topics: []string{"customer_count"}}
+	if _, ok := wh.Match(msg); ok {
+		t.Error("expected no match for another topic")
+	}
+	wh.Topics = []string{"order_count"}
+	if b, ok := wh.Match(msg); !ok || string(b) != string(msg.Value) {
+		t.Errorf("expected the whole message without a filter, got %s", b)
+	}
+	wh.Filter = map[string]string{"state": "CA"}
+	if b, ok := wh.Match(msg); !ok || string(b) != `[{"state":"CA","n":1},{"state":"CA","n":3}]` {
+		t.Errorf("expected only the CA events, got %s", b)
+	}
+	wh.Filter = map[string]string{"state": "CA", "n": "3"}
+	if b, ok := wh.Match(msg); !ok || string(b) != `[{"state":"CA","n":3}]` {
+		t.Errorf("expected the CA event with n 3, got %s", b)
+	}
+	wh.Filter = map[string]string{"state": "TX"}
+	if _, ok := wh.Match(msg); ok {
+		t.Error("expected no match when no event matches")
+	}
+
+	// large & fractional numbers are compared written out
+	msg.Value = []byte(`[{"id": 1000000, "price": 2.5}, {"id": 2000000, "price": 2.5}]`)
+	wh.Filter = map[string]string{"id": "1000000", "price": "2.5"}
+	if b, ok := wh.Match(msg); !ok || string(b) != `[{"id":1000000,"price":2.5}]` {
+		t.Errorf("expected the event with id 1000000, got %s", b)
+	}
+}
+
+// webhookRecorder collects the callbacks of a dispatcher
+type webhookRecorder struct {
+	mu         sync.Mutex
+	deliveries []WebhookDelivery
+	states     chan [2]int
+}
+
+func (wr *webhookRecorder) record(d WebhookDelivery) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.deliveries = append(wr.deliveries, d)
+}
+
+func (wr *webhookRecorder) state(id int64, failures int, enabled bool) {
+	e := 0
+	if enabled {
+		e = 1
+	}
+	wr.states <- [2]int{failures, e}
+}
+
+func (wr *webhookRecorder) waitDeliveries(t *testing.T, n int) []WebhookDelivery {
+	for i := 0; i < 200; i++ {
+		wr.mu.Lock()
+		if len(wr.deliveries) >= n {
+			out := append([]WebhookDelivery(nil), wr.deliveries...)
+			wr.mu.Unlock()
+			return out
+		}
+		wr.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d deliveries", n)
+	return nil
+}
+
+func TestWebhookDispatcherSigned(t *testing.T) {
+	received := make(chan webhookEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if r.Header.Get("X-Webhook-Signature") != "sha256="+SignWebhook("secret", ts, body) {
+			t.Error("signature does not match")
+		}
+		if r.Header.Get("X-Webhook-Id") != "7" || r.Header.Get("X-Webhook-Topic") != "alerts" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		var ev webhookEvent
+		json.Unmarshal(body, &ev)
+		received <- ev
+	}))
+	defer srv.Close()
+
+	wr := &webhookRecorder{states: make(chan [2]int, 10)}
+	d := NewWebhookDispatcher(context.Background(), testWebhookConfig(), wr.record, wr.state)
+	d.Set(WebhookEndpoint{ID: 7, URL: srv.URL, Topics: []string{"alerts"}, Secret: "secret", Enabled: true})
+	d.Set(WebhookEndpoint{ID: 8, URL: srv.URL, Topics: []string{"alerts"}, Secret: "secret"})
+	if ids := d.Active(); len(ids) != 1 || ids[0] != 7 {
+		t.Errorf("expected only the enabled webhook to be active, got %v", ids)
+	}
+
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "kpis", Value: []byte(`{}`)})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{"rule":"revenue"}`), Timestamp: time.Now()})
+	select {
+	case ev := <-received:
+		if ev.Topic != "alerts" || string(ev.Data) != `{"rule":"revenue"}` || ev.ID == "" {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+	ds := wr.waitDeliveries(t, 1)
+	if !ds[0].Success || ds[0].StatusCode != 200 || ds[0].Attempt != 1 || ds[0].WebhookID != 7 {
+		t.Errorf("unexpected delivery %+v", ds[0])
+	}
+	d.Remove(7)
+}
+
+func TestWebhookDispatcherRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	wr := &webhookRecorder{states: make(chan [2]int, 10)}
+	d := NewWebhookDispatcher(context.Background(), testWebhookConfig(), wr.record, wr.state)
+	d.Set(WebhookEndpoint{ID: 1, URL: srv.URL, Topics: []string{"alerts"}, Enabled: true})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{}`)})
+
+	ds := wr.waitDeliveries(t, 3)
+	if ds[0].Success || ds[0].StatusCode != 503 || ds[1].Attempt != 2 || !ds[2].Success || ds[2].Attempt != 3 {
+		t.Errorf("unexpected deliveries %+v", ds)
+	}
+	if ds[0].EventID != ds[2].EventID {
+		t.Error("expected retries to keep the event id")
+	}
+	d.Remove(1)
+}
+
+func TestWebhookDispatcherDisable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	wr := &webhookRecorder{states: make(chan [2]int, 10)}
+	d := NewWebhookDispatcher(context.Background(), testWebhookConfig(), wr.record, wr.state)
+	d.Set(WebhookEndpoint{ID: 1, URL: srv.URL, Topics: []string{"alerts"}, Enabled: true})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{}`)})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{}`)})
+
+	for _, e := range [][2]int{{1, 1}, {2, 0}} {
+		select {
+		case s := <-wr.states:
+			if s != e {
+				t.Errorf("expected state %v, got %v", e, s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("state was not updated")
+		}
+	}
+	if len(d.Active()) != 0 {
+		t.Error("expected the webhook to be disabled")
+	}
+	if ds := wr.waitDeliveries(t, 6); len(ds) != 6 {
+		t.Errorf("expected 3 attempts of 2 events, got %d", len(ds))
+	}
+
+	// client errors are not retried
+	gone := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer gone.Close()
+	wr = &webhookRecorder{states: make(chan [2]int, 10)}
+	d = NewWebhookDispatcher(context.Background(), testWebhookConfig(), wr.record, wr.state)
+	d.Set(WebhookEndpoint{ID: 2, URL: gone.URL, Topics: []string{"alerts"}, Enabled: true})
+	d.HandleMessage(&sarama.ConsumerMessage{Topic: "alerts", Value: []byte(`{}`)})
+	<-wr.states
+	if ds := wr.waitDeliveries(t, 1); len(ds) != 1 || ds[0].StatusCode != 410 {
+		t.Errorf("expected a single attempt, got %+v", ds)
+	}
+	d.Remove(2)
+
+	// a replaced worker does not disable the endpoint
+	d.Set(WebhookEndpoint{ID: 3, URL: gone.URL, Topics: []string{"alerts"}, Enabled: true})
+	d.mu.Lock()
+	old := d.workers[3]
+	d.mu.Unlock()
+	d.Set(WebhookEndpoint{ID: 3, URL: gone.URL, Topics: []string{"alerts"}, Enabled: true})
+	if d.retire(old) || len(d.Active()) != 1 {
+		t.Error("expected the replaced worker not to remove the endpoint")
+	}
+	d.Remove(3)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// largest number of step buckets in a sliding window, a day of one minute steps
+const maxWindowBuckets = 24 * 60
+
+// WindowParams are the sliding window options of a stream request
+type WindowParams struct {
+	Size time.Duration
+	Step time.Duration
+}
+
+// ParseWindowParams reads `window=sliding`, `size` & `step` from the request,
+// nil is returned when no window is asked for
+func ParseWindowParams(r *http.Request) (*WindowParams, error) {
+	q := r.URL.Query()
+	switch q.Get("window") {
+	case "":
+		return nil, nil
+	case "sliding":
+	default:
+		return nil, fmt.Errorf("unknown window %s, only sliding is supported", q.Get("window"))
+	}
+
+	wp := WindowParams{Step: time.Minute}
+	var err error
+	if s := q.Get("size"); s == "" {
+		return nil, fmt.Errorf("a sliding window needs a size")
+	} else if wp.Size, err = time.ParseDuration(s); err != nil {
+		return nil, fmt.Errorf("error parsing size %s: %w", s, err)
+	}
+	if s := q.Get("step"); s != "" {
+		if wp.Step, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("error parsing step %s: %w", s, err)
+		}
+	}
+
+	// steps are the buckets of the history queries so they have to be whole
+	// minutes which split an hour evenly
+	if wp.Step < time.Minute || wp.Step%time.Minute != 0 || 60%wp.GroupMinute() != 0 {
+		return nil, fmt.Errorf("step must be a whole number of minutes dividing an hour, got %v", wp.Step)
+	}
+	if wp.Size < wp.Step || wp.Size%wp.Step != 0 {
+		return nil, fmt.Errorf("size must be a multiple of step %v, got %v", wp.Step, wp.Size)
+	}
+	if wp.Buckets() > maxWindowBuckets {
+		return nil, fmt.Errorf("a window can hold at most %d steps, got %d", maxWindowBuckets, wp.Buckets())
+	}
+	return &wp, nil
+}
+
+// GroupMinute is the bucket size the window slides over
+func (wp *WindowParams) GroupMinute() int {
+	return int(wp.Step / time.Minute)
+}
+
+// Buckets is the number of step buckets in a window
+func (wp *WindowParams) Buckets() int {
+	return int(wp.Size / wp.Step)
+}
+
+// SlidingWindow keeps the last step buckets of a topic & computes the moving
+// statistics of each field, a window bucket has `{field}_sum`, `_avg`, `_min`,
+// `_max` & `_stddev` & takes the time stamp of its newest step
+type SlidingWindow struct {
+	groupMinute int
+	size        int
+	fields      []string
+	steps       []Bucket
+}
+
+func NewSlidingWindow(wp *WindowParams, fields []string) *SlidingWindow {
+	return &SlidingWindow{
+		groupMinute: wp.GroupMinute(),
+		size:        wp.Buckets(),
+		fields:      fields,
+	}
+}
+
+// Push adds the next step bucket & returns the windows it completes, skipped
+// steps count as empty & buckets older than the last step are ignored
+func (sw *SlidingWindow) Push(b Bucket) []Bucket {
+	var res []Bucket
+	if n := len(sw.steps); n > 0 {
+		last := sw.steps[n-1].TimeStamp
+		if !b.TimeStamp.After(last) {
+			return nil
+		}
+		for ts := NextBucketTime(last, sw.groupMinute); ts.Before(b.TimeStamp); ts = NextBucketTime(ts, sw.groupMinute) {
+			res = append(res, sw.push(*NewBucket(ts))...)
+		}
+	}
+	return append(res, sw.push(b)...)
+}
+
+func (sw *SlidingWindow) push(b Bucket) []Bucket {
+	sw.steps = append(sw.steps, b)
+	if len(sw.steps) > sw.size {
+		sw.steps = append(sw.steps[:0], sw.steps[len(sw.steps)-sw.size:]...)
+	}
+	// only full windows are sent so the line does not jump at the start
+	if len(sw.steps) < sw.size {
+		return nil
+	}
+	return []Bucket{sw.stats()}
+}
+
+func (sw *SlidingWindow) stats() Bucket {
+	w := NewBucket(sw.steps[len(sw.steps)-1].TimeStamp)
+	n := float64(len(sw.steps))
+	for _, f := range sw.fields {
+		sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+		for i := range sw.steps {
+			v := sw.steps[i].Values[f]
+			sum += v
+			min = math.Min(min, v)
+			max = math.Max(max, v)
+		}
+		avg := sum / n
+		var sq float64
+		for i := range sw.steps {
+			d := sw.steps[i].Values[f] - avg
+			sq += d * d
+		}
+		w.Values[f+"_sum"] = sum
+		w.Values[f+"_avg"] = avg
+		w.Values[f+"_min"] = min
+		w.Values[f+"_max"] = max
+		w.Values[f+"_stddev"] = math.Sqrt(sq / n)
+	}
+	return *w
+}
+
+// LiveWindow turns the raw messages of a stream into sliding window buckets
+// using the same step buckets as the history so both give the same results
+type LiveWindow struct {
+	topic   string
+	steps   *BucketStream
+	window  *SlidingWindow
+	pending []Bucket
+}
+
+func NewLiveWindow(spec *TopicSpec, wp *WindowParams, now time.Time) *LiveWindow {
+	lw := &LiveWindow{
+		topic:  spec.Name,
+		steps:  NewBucketStream(wp.GroupMinute(), 5*time.Second, map[string]*TopicSpec{spec.Name: spec}, now),
+		window: NewSlidingWindow(wp, spec.FieldNames()),
+	}
+	lw.steps.AddListener(func(topic string, b Bucket) {
+		lw.pending = append(lw.pending, lw.window.Push(b)...)
+	})
+	return lw
+}
+
+// Load pushes the history of the topic through the window & returns the
+// windows at or after from, a step that is still open is carried over into
+// the live steps
+func (lw *LiveWindow) Load(history []Bucket, from time.Time) []Bucket {
+	open := lw.steps.OpenTime(lw.topic)
+	res := []Bucket{}
+	for i := range history {
+		if !history[i].TimeStamp.Before(open) {
+			lw.steps.Seed(lw.topic, history[i])
+			continue
+		}
+		for _, w := range lw.window.Push(history[i]) {
+			if !w.TimeStamp.Before(from) {
+				res = append(res, w)
+			}
+		}
+	}
+	return res
+}
+
+// HandleMessage adds a message to the live steps & returns any windows the
+// closed steps complete
+func (lw *LiveWindow) HandleMessage(msg *sarama.ConsumerMessage) []Bucket {
+	lw.steps.HandleMessage(msg)
+	return lw.flush()
+}
+
+// Tick closes steps which have ended, see BucketStream.Tick
+func (lw *LiveWindow) Tick(now time.Time) []Bucket {
+	lw.steps.Tick(now)
+	return lw.flush()
+}
+
+func (lw *LiveWindow) flush() []Bucket {
+	res := lw.pending
+	lw.pending = nil
+	return res
+}
+
+// windowHistory reads the step buckets needed to fill the first window at
+// `from` & loads them into the live window
+func (api *API) windowHistory(r *http.Request, spec *TopicSpec, wp *WindowParams, lw *LiveWindow) ([]Bucket, error) {
+	p, err := ParseHistoryParams(r)
+	if err != nil {
+		api.reqLogError(r, "%s", err.Error())
+		return nil, err
+	}
+	var from time.Time
+	if !p.From.IsZero() {
+		from = BucketTime(BucketKey(p.From), wp.GroupMinute())
+		p.From = p.From.Add(-(wp.Size - wp.Step))
+	}
+	p.GroupMinute = wp.GroupMinute()
+	history, err := api.bucketHistory(r, spec, p)
+	if err != nil {
+		return nil, err
+	}
+	return lw.Load(history, from), nil
+}
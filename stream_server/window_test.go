@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseWindowParams(t *testing.T) {
+	wp, err := ParseWindowParams(httptest.NewRequest("GET", "/?window=sliding&size=15m&step=5m", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wp.GroupMinute() != 5 || wp.Buckets() != 3 {
+		t.Errorf("incorrect window %+v", wp)
+	}
+
+	wp, err = ParseWindowParams(httptest.NewRequest("GET", "/?window=sliding&size=1h", nil))
+	if err != nil || wp.GroupMinute() != 1 || wp.Buckets() != 60 {
+		t.Errorf("expected default step of 1 minute, got %+v %v", wp, err)
+	}
+
+	if wp, err = ParseWindowParams(httptest.NewRequest("GET", "/?groupMinute=5", nil)); wp != nil || err != nil {
+		t.Error("expected no window")
+	}
+
+	for _, q := range []string{
+		"window=tumbling&size=15m",
+		"window=sliding",
+		"window=sliding&size=15m&step=30s",
+		"window=sliding&size=14m&step=7m",
+		"window=sliding&size=10m&step=4m",
+		"window=sliding&size=5m&step=10m",
+		"window=sliding&size=48h",
+	} {
+		if _, err = ParseWindowParams(httptest.NewRequest("GET", "/?"+q, nil)); err == nil {
+			t.Errorf("%s: expected error", q)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	sw := NewSlidingWindow(&WindowParams{Size: 3 * time.Minute, Step: time.Minute}, []string{"n"})
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	step := func(m int, n float64) Bucket {
+		b := NewBucket(base.Add(time.Duration(m) * time.Minute))
+		b.Values["n"] = n
+		return *b
+	}
+
+	if len(sw.Push(step(0, 1))) != 0 || len(sw.Push(step(1, 2))) != 0 {
+		t.Fatal("window sent before it was full")
+	}
+	res := sw.Push(step(2, 6))
+	if len(res) != 1 {
+		t.Fatalf("expected 1 window, got %d", len(res))
+	}
+	w := res[0]
+	if !w.TimeStamp.Equal(base.Add(2*time.Minute)) || w.Values["n_sum"] != 9 || w.Values["n_avg"] != 3 ||
+		w.Values["n_min"] != 1 || w.Values["n_max"] != 6 || math.Abs(w.Values["n_stddev"]-math.Sqrt(14.0/3)) > 1e-9 {
+		t.Errorf("incorrect window %v", w)
+	}
+
+	// the skipped minute counts as empty
+	res = sw.Push(step(4, 3))
+	if len(res) != 2 || res[0].Values["n_sum"] != 8 || res[1].Values["n_sum"] != 9 || res[1].Values["n_min"] != 0 {
+		t.Errorf("incorrect windows over a gap %v", res)
+	}
+	if len(sw.Push(step(3, 1))) != 0 {
+		t.Error("an older step should be ignored")
+	}
+}
+
+// the windows computed from history & from live messages should match
+func TestLiveWindowMatchesHistory(t *testing.T) {
+	wp := &WindowParams{Size: 5 * time.Minute, Step: time.Minute}
+	spec := topicSpecs["customer_count"]
+	base := time.Date(2020, 6, 1, 10, 0, 0, 0, time.Local)
+	key := BucketKey(base)
+
+	// an event every 40 seconds for 20 minutes
+	var events []time.Time
+	for ts := base; ts.Before(base.Add(20 * time.Minute)); ts = ts.Add(40 * time.Second) {
+		events = append(events, ts)
+	}
+	stepsUntil := func(end time.Time) []Bucket {
+		var steps []Bucket
+		for _, ts := range events {
+			if !ts.Before(end) {
+				break
+			}
+			b := NewBucket(BucketTime(BucketKey(ts), 1))
+			b.Values["n"] = 1
+			steps = append(steps, *b)
+		}
+		return Rollup(steps, 1)
+	}
+
+	// all of it from history
+	expected := NewSlidingWindow(wp, spec.FieldNames())
+	var want []Bucket
+	for _, b := range stepsUntil(base.Add(20 * time.Minute)) {
+		want = append(want, expected.Push(b)...)
+	}
+
+	// history stops part way through the ninth minute
+	split := base.Add(8*time.Minute + 30*time.Second)
+	lw := NewLiveWindow(spec, wp, split)
+	got := lw.Load(stepsUntil(split), key.Add(6*time.Minute))
+	if len(got) != 2 || !got[0].TimeStamp.Equal(key.Add(6*time.Minute)) {
+		t.Fatalf("expected history windows from minute 6, got %v", got)
+	}
+	for _, ts := range events {
+		if ts.Before(split) {
+			continue
+		}
+		got = append(got, lw.HandleMessage(customerMessage(ts, 1))...)
+	}
+	got = append(got, lw.Tick(base.Add(21*time.Minute))...)
+
+	want = want[2:]
+	if len(got) != len(want) {
+		t.Fatalf("expected %d windows, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !got[i].TimeStamp.Equal(want[i].TimeStamp) {
+			t.Fatalf("window %d at %v, expected %v", i, got[i].TimeStamp, want[i].TimeStamp)
+		}
+		for k, v := range want[i].Values {
+			if math.Abs(got[i].Values[k]-v) > 1e-9 {
+				t.Errorf("window %d %s: expected %v got %v", i, k, v, got[i].Values[k])
+			}
+		}
+	}
+}